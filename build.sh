@@ -3,8 +3,10 @@ WORDIR=${PWD}
 mkdir ${WORDIR}/bin
 
 # run unit tests
-cd ${WORDIR}/model/ && go test -v .
+cd ${WORDIR}/model/ && go test -v -race ./...
 cd ${WORDIR}/serving/ && go test -v .
+cd ${WORDIR}/sqlstore/ && go test -v .
+cd ${WORDIR}/cmd/ && go test -v .
 
 # build binary
 cd ${WORDIR}/cmd && go build -o ${WORDIR}/bin/server
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	mdl "hsbc-hw/model"
+	"hsbc-hw/sqlstore"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config of the server is read from the file of --config first, then
+// overridden by flags, then by environment variables.
+type config struct {
+	Port      int    `json:"port" yaml:"port"`
+	DataDir   string `json:"data_dir" yaml:"data_dir"`
+	Fsync     string `json:"fsync" yaml:"fsync"`
+	SQLDriver string `json:"sql_driver" yaml:"sql_driver"`
+	SQLDSN    string `json:"sql_dsn" yaml:"sql_dsn"`
+
+	// Engine options, see model.Options
+	UserShards    int      `json:"user_shards" yaml:"user_shards"`
+	TokenShards   int      `json:"token_shards" yaml:"token_shards"`
+	TokenTTL      duration `json:"token_ttl" yaml:"token_ttl"`
+	SweepInterval duration `json:"sweep_interval" yaml:"sweep_interval"`
+	MaxSessions   int      `json:"max_sessions" yaml:"max_sessions"`
+	Hasher        string   `json:"hasher" yaml:"hasher"`
+
+	// ABAC policy file or directory of *.policy files, see model/policy.go
+	Policy       string   `json:"policy" yaml:"policy"`
+	PolicyReload duration `json:"policy_reload" yaml:"policy_reload"`
+
+	// Password policy of new passwords, see model.PasswordPolicy, and the
+	// number of the last passwords they must differ from
+	PasswordMinLength      int    `json:"password_min_length" yaml:"password_min_length"`
+	PasswordMaxLength      int    `json:"password_max_length" yaml:"password_max_length"`
+	PasswordClasses        string `json:"password_classes" yaml:"password_classes"`
+	PasswordBanned         string `json:"password_banned" yaml:"password_banned"`
+	PasswordRejectUserName bool   `json:"password_reject_user_name" yaml:"password_reject_user_name"`
+	PasswordHistory        int    `json:"password_history" yaml:"password_history"`
+
+	// Admin created with system:admin on the first start, see serving.Bootstrap
+	AdminUser     string `json:"admin_user" yaml:"admin_user"`
+	AdminPassword string `json:"admin_password" yaml:"admin_password"`
+
+	// Namespaces of relation tuples, only read from the file
+	Namespaces []mdl.Namespace `json:"namespaces" yaml:"namespaces"`
+}
+
+func defaultConfig() config {
+	return config{
+		Port:          8080,
+		Fsync:         "always",
+		UserShards:    1024,
+		TokenShards:   1024,
+		TokenTTL:      duration(2 * time.Hour),
+		SweepInterval: duration(200 * time.Millisecond),
+		Hasher:        "argon2id",
+		PolicyReload:  duration(5 * time.Second),
+	}
+}
+
+// envs maps environment variables to the flags they override.
+var envs = []struct {
+	name, flag string
+}{
+	{"PORT", "port"},
+	{"AUTH_DATA_DIR", "data-dir"},
+	{"AUTH_FSYNC", "fsync"},
+	{"AUTH_SQL_DRIVER", "sql-driver"},
+	{"AUTH_SQL_DSN", "sql-dsn"},
+	{"AUTH_USER_SHARDS", "user-shards"},
+	{"AUTH_TOKEN_SHARDS", "token-shards"},
+	{"AUTH_TOKEN_TTL", "token-ttl"},
+	{"AUTH_SWEEP_INTERVAL", "sweep-interval"},
+	{"AUTH_MAX_SESSIONS", "max-sessions"},
+	{"AUTH_HASHER", "hasher"},
+	{"AUTH_POLICY", "policy"},
+	{"AUTH_POLICY_RELOAD", "policy-reload"},
+	{"AUTH_PASSWORD_MIN_LENGTH", "password-min-length"},
+	{"AUTH_PASSWORD_MAX_LENGTH", "password-max-length"},
+	{"AUTH_PASSWORD_CLASSES", "password-classes"},
+	{"AUTH_PASSWORD_BANNED", "password-banned"},
+	{"AUTH_PASSWORD_REJECT_USER_NAME", "password-reject-user-name"},
+	{"AUTH_PASSWORD_HISTORY", "password-history"},
+	{"AUTH_ADMIN_USER", "admin-user"},
+	{"AUTH_ADMIN_PASSWORD", "admin-password"},
+}
+
+var sqlDialects = map[string]sqlstore.Dialect{
+	"sqlite": sqlstore.SQLite,
+}
+
+var fsyncPolicies = map[string]mdl.FsyncPolicy{
+	"always":   mdl.FsyncAlways,
+	"interval": mdl.FsyncInterval,
+	"never":    mdl.FsyncNever,
+}
+
+var hashers = map[string]func() mdl.PasswordHasher{
+	"argon2id": mdl.DefaultPasswordHasher,
+	"bcrypt":   func() mdl.PasswordHasher { return mdl.NewBcryptHasher(12) },
+	"scrypt":   func() mdl.PasswordHasher { return mdl.NewScryptHasher(15, 8, 1) },
+	"pbkdf2":   func() mdl.PasswordHasher { return mdl.NewPBKDF2Hasher(600000) },
+}
+
+func newFlagSet(c *config) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("authenticate_server", flag.ContinueOnError)
+	path := fs.String("config", "", "The YAML or JSON file to read the configuration from")
+	fs.IntVar(&c.Port, "port", c.Port, "The port to listen on")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "The directory to persist data in, data is kept in memory only if empty")
+	fs.StringVar(&c.Fsync, "fsync", c.Fsync, "When to fsync the write-ahead log under --data-dir: always, interval or never")
+	fs.StringVar(&c.SQLDriver, "sql-driver", c.SQLDriver, "The database/sql driver to store data with, one of sqlite, or empty to not use SQL")
+	fs.StringVar(&c.SQLDSN, "sql-dsn", c.SQLDSN, "The data source name of --sql-driver")
+	fs.IntVar(&c.UserShards, "user-shards", c.UserShards, "The number of partitions of users in memory")
+	fs.IntVar(&c.TokenShards, "token-shards", c.TokenShards, "The number of partitions of tokens in memory")
+	fs.Var(&c.TokenTTL, "token-ttl", "The lifetime of tokens")
+	fs.Var(&c.SweepInterval, "sweep-interval", "The period of deleting expired tokens")
+	fs.IntVar(&c.MaxSessions, "max-sessions", c.MaxSessions, "The sessions of each user, the oldest is revoked beyond it, 0 for unlimited")
+	fs.StringVar(&c.Hasher, "hasher", c.Hasher, "The password hasher: argon2id, bcrypt, scrypt or pbkdf2")
+	fs.StringVar(&c.Policy, "policy", c.Policy, "The ABAC policy file, or directory of *.policy files, everything is denied if empty")
+	fs.Var(&c.PolicyReload, "policy-reload", "The period of reloading --policy if changed, 0 to never reload")
+	fs.IntVar(&c.PasswordMinLength, "password-min-length", c.PasswordMinLength, "The characters of new passwords at least")
+	fs.IntVar(&c.PasswordMaxLength, "password-max-length", c.PasswordMaxLength, "The characters of new passwords at most, 0 for unlimited")
+	fs.StringVar(&c.PasswordClasses, "password-classes", c.PasswordClasses, "The character classes new passwords must have, a comma separated list of lower, upper, digit or symbol")
+	fs.StringVar(&c.PasswordBanned, "password-banned", c.PasswordBanned, "The file of passwords refused regardless of case, one per line")
+	fs.BoolVar(&c.PasswordRejectUserName, "password-reject-user-name", c.PasswordRejectUserName, "Refuse new passwords containing the user name")
+	fs.IntVar(&c.PasswordHistory, "password-history", c.PasswordHistory, "The last passwords of each user, the current one included, new passwords must differ from, 0 for no check")
+	fs.StringVar(&c.AdminUser, "admin-user", c.AdminUser, "The admin created on the first start, management APIs are refused to everyone if none exists")
+	fs.StringVar(&c.AdminPassword, "admin-password", c.AdminPassword, "The password of --admin-user")
+	return fs, path
+}
+
+// loadConfig builds and validates the configuration from the command line
+// arguments (without the program name) and the environment.
+func loadConfig(args []string, getenv func(string) string) (config, error) {
+	// The file is applied before flags, so find its path first
+	c := defaultConfig()
+	fs, path := newFlagSet(&c)
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	c = defaultConfig()
+	if *path != "" {
+		if err := c.readFile(*path); err != nil {
+			return c, err
+		}
+	}
+	fs, _ = newFlagSet(&c)
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	for _, env := range envs {
+		if v := getenv(env.name); v != "" {
+			if err := fs.Set(env.flag, v); err != nil {
+				return c, fmt.Errorf("invalid %s: %v", env.name, err)
+			}
+		}
+	}
+	return c, c.validate()
+}
+
+func (c *config) readFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch filepath.Ext(path) {
+	case ".json":
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.DisallowUnknownFields()
+		err = d.Decode(c)
+	case ".yaml", ".yml":
+		d := yaml.NewDecoder(bytes.NewReader(b))
+		d.KnownFields(true)
+		err = d.Decode(c)
+	default:
+		return fmt.Errorf("config %s: unknown format, must be .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c config) validate() error {
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port, must be in [0, 65535], found %d", c.Port)
+	}
+	if c.DataDir != "" && c.SQLDriver != "" {
+		return fmt.Errorf("data-dir and sql-driver can't be used together")
+	}
+	if _, ok := fsyncPolicies[c.Fsync]; !ok {
+		return fmt.Errorf("invalid fsync, must be one of always, interval or never, found %q", c.Fsync)
+	}
+	if _, ok := sqlDialects[c.SQLDriver]; c.SQLDriver != "" && !ok {
+		return fmt.Errorf("invalid sql-driver, must be sqlite, found %q", c.SQLDriver)
+	}
+	if _, ok := hashers[c.Hasher]; !ok {
+		return fmt.Errorf("invalid hasher, must be one of argon2id, bcrypt, scrypt or pbkdf2, found %q", c.Hasher)
+	}
+	if c.PolicyReload < 0 {
+		return fmt.Errorf("invalid policy-reload, must not be negative, found %v", time.Duration(c.PolicyReload))
+	}
+	if (c.AdminUser == "") != (c.AdminPassword == "") {
+		return fmt.Errorf("admin-user and admin-password must be given together")
+	}
+	for _, n := range c.Namespaces {
+		if err := n.Validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := c.passwordPolicy(); err != nil {
+		return err
+	}
+	_, err := mdl.NewOptions(c.engineOptions()...)
+	return err
+}
+
+// passwordPolicy returns the password policy without the banned passwords,
+// which are loaded from PasswordBanned by the server.
+func (c config) passwordPolicy() (*mdl.PasswordPolicy, error) {
+	p := &mdl.PasswordPolicy{
+		MinLength:      c.PasswordMinLength,
+		MaxLength:      c.PasswordMaxLength,
+		RejectUserName: c.PasswordRejectUserName,
+	}
+	for _, class := range strings.Split(c.PasswordClasses, ",") {
+		switch strings.TrimSpace(class) {
+		case "":
+		case "lower":
+			p.Lowercase = true
+		case "upper":
+			p.Uppercase = true
+		case "digit":
+			p.Digit = true
+		case "symbol":
+			p.Symbol = true
+		default:
+			return nil, fmt.Errorf("invalid password-classes, must be a comma separated list of lower, upper, digit or symbol, found %q", c.PasswordClasses)
+		}
+	}
+	return p, p.Validate()
+}
+
+func (c config) engineOptions() []mdl.Option {
+	opts := []mdl.Option{
+		mdl.WithUserShards(c.UserShards),
+		mdl.WithTokenShards(c.TokenShards),
+		mdl.WithTokenTTL(time.Duration(c.TokenTTL)),
+		mdl.WithSweepInterval(time.Duration(c.SweepInterval)),
+		mdl.WithMaxSessions(c.MaxSessions),
+		mdl.WithPasswordHistory(c.PasswordHistory),
+	}
+	if h, ok := hashers[c.Hasher]; ok {
+		opts = append(opts, mdl.WithPasswordHasher(h()))
+	}
+	return opts
+}
+
+// duration is a time.Duration written like "2h30m" in flags and files.
+type duration time.Duration
+
+func (d *duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+func (d *duration) UnmarshalYAML(n *yaml.Node) error {
+	var s string
+	if err := n.Decode(&s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mdl "hsbc-hw/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func env(m map[string]string) func(string) string {
+	return func(k string) string { return m[k] }
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfigDefault(t *testing.T) {
+	c, err := loadConfig(nil, env(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, defaultConfig(), c)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	yml := writeFile(t, "server.yaml", `
+port: 9000
+token_ttl: 30m
+sweep_interval: 1s
+max_sessions: 5
+hasher: bcrypt
+`)
+	c, err := loadConfig([]string{"--config", yml}, env(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, 9000, c.Port)
+	assert.Equal(t, duration(30*time.Minute), c.TokenTTL)
+	assert.Equal(t, duration(time.Second), c.SweepInterval)
+	assert.Equal(t, 5, c.MaxSessions)
+	assert.Equal(t, "bcrypt", c.Hasher)
+	assert.Equal(t, 1024, c.UserShards, "defaults are kept")
+
+	// Flags override the file, and environment variables override flags
+	c, err = loadConfig([]string{"--port", "9001", "--max-sessions", "6", "--config", yml},
+		env(map[string]string{"PORT": "9002", "AUTH_TOKEN_TTL": "1h"}))
+	assert.Nil(t, err)
+	assert.Equal(t, 9002, c.Port)
+	assert.Equal(t, 6, c.MaxSessions)
+	assert.Equal(t, duration(time.Hour), c.TokenTTL)
+
+	c, err = loadConfig([]string{"--policy", "policies"}, env(map[string]string{"AUTH_POLICY_RELOAD": "0s"}))
+	assert.Nil(t, err)
+	assert.Equal(t, "policies", c.Policy)
+	assert.Equal(t, duration(0), c.PolicyReload)
+
+	c, err = loadConfig([]string{"--admin-user", "admin"}, env(map[string]string{"AUTH_ADMIN_PASSWORD": "secret"}))
+	assert.Nil(t, err)
+	assert.Equal(t, "admin", c.AdminUser)
+	assert.Equal(t, "secret", c.AdminPassword)
+
+	c, err = loadConfig([]string{"--password-min-length", "12", "--password-classes", "lower, digit,symbol", "--password-history", "3"},
+		env(map[string]string{"AUTH_PASSWORD_REJECT_USER_NAME": "true", "AUTH_PASSWORD_BANNED": "banned.txt"}))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, c.PasswordHistory)
+	assert.Equal(t, "banned.txt", c.PasswordBanned)
+	p, err := c.passwordPolicy()
+	assert.Nil(t, err)
+	assert.Equal(t, &mdl.PasswordPolicy{MinLength: 12, Lowercase: true, Digit: true, Symbol: true, RejectUserName: true}, p)
+
+	js := writeFile(t, "server.json", `{"token_shards": 16, "token_ttl": "10m"}`)
+	c, err = loadConfig([]string{"--config", js}, env(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, 16, c.TokenShards)
+	assert.Equal(t, duration(10*time.Minute), c.TokenTTL)
+
+	yml = writeFile(t, "namespaces.yaml", `
+namespaces:
+  - name: doc
+    relations:
+      - name: owner
+      - name: viewer
+        union:
+          - this: true
+          - computed_userset: owner
+`)
+	c, err = loadConfig([]string{"--config", yml}, env(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, []mdl.Namespace{{Name: "doc", Relations: []mdl.Relation{
+		{Name: "owner"},
+		{Name: "viewer", Union: []mdl.Userset{{This: true}, {ComputedUserset: "owner"}}},
+	}}}, c.Namespaces)
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		env  map[string]string
+	}{
+		{args: []string{"--port", "70000"}},
+		{args: []string{"--fsync", "sometimes"}},
+		{args: []string{"--sql-driver", "oracle"}},
+		{args: []string{"--sql-driver", "sqlite", "--data-dir", "data"}},
+		{args: []string{"--hasher", "md5"}},
+		{args: []string{"--token-ttl", "-1h"}},
+		{args: []string{"--token-ttl", "forever"}},
+		{args: []string{"--user-shards", "0"}},
+		{args: []string{"--max-sessions", "-1"}},
+		{args: []string{"--config", "not_existing.yaml"}},
+		{args: []string{"--config", writeFile(t, "bad.yaml", "unknown: 1\n")}},
+		{args: []string{"--config", writeFile(t, "bad.json", `{"token_ttl": 10}`)}},
+		{args: []string{"--config", writeFile(t, "server.toml", "")}},
+		{args: []string{"--config", writeFile(t, "ns.json", `{"namespaces": [{"name": "doc", "relations": [{"name": "viewer", "union": [{"computed_userset": "owner"}]}]}]}`)}},
+		{env: map[string]string{"AUTH_SWEEP_INTERVAL": "0s"}},
+		{env: map[string]string{"AUTH_MAX_SESSIONS": "many"}},
+		{env: map[string]string{"AUTH_POLICY_RELOAD": "-1s"}},
+		{args: []string{"--password-min-length", "-1"}},
+		{args: []string{"--password-min-length", "12", "--password-max-length", "8"}},
+		{args: []string{"--password-classes", "lower,emoji"}},
+		{args: []string{"--password-history", "-1"}},
+		{env: map[string]string{"AUTH_PASSWORD_REJECT_USER_NAME": "maybe"}},
+		{env: map[string]string{"AUTH_ADMIN_USER": "admin"}},
+	} {
+		_, err := loadConfig(tt.args, env(tt.env))
+		assert.NotNil(t, err, "%v %v", tt.args, tt.env)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"flag"
 	"fmt"
 	"log"
@@ -8,35 +9,95 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
-	"strconv"
+	"time"
 
+	mdl "hsbc-hw/model"
 	"hsbc-hw/serving"
-)
+	"hsbc-hw/sqlstore"
 
-var (
-	port = flag.Int("port", 8080, "The port to listen on")
+	_ "modernc.org/sqlite"
 )
 
 func main() {
-	flag.Parse()
+	c, err := loadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		log.Fatalf("authenticate_server: %v", err)
+	}
+	opts := c.engineOptions()
 
-	tmp := os.Getenv("PORT")
-	if tmp != "" {
-		*port, _ = strconv.Atoi(tmp)
+	if c.SQLDriver != "" {
+		db, err := sql.Open(c.SQLDriver, c.SQLDSN)
+		if err != nil {
+			log.Fatalf("authenticate_server: failed to open database: %v", err)
+		}
+		e, err := sqlstore.NewSQLEngine(db, sqlDialects[c.SQLDriver], opts...)
+		if err != nil {
+			log.Fatalf("authenticate_server: failed to init database: %v", err)
+		}
+		serving.SetEngine(e)
+		log.Printf("authenticate_server: data stored by %v", c.SQLDriver)
+	} else if c.DataDir != "" {
+		e, err := mdl.NewDurableEngine(c.DataDir, mdl.DurableOptions{Fsync: fsyncPolicies[c.Fsync]}, opts...)
+		if err != nil {
+			log.Fatalf("authenticate_server: failed to open data in %v: %v", c.DataDir, err)
+		}
+		serving.SetEngine(e)
+		log.Printf("authenticate_server: data persisted in %v", c.DataDir)
+	} else {
+		serving.SetEngine(mdl.NewInmemEngine(opts...))
+	}
+	pp, _ := c.passwordPolicy()
+	if c.PasswordBanned != "" {
+		if pp.Banned, err = mdl.LoadBannedPasswords(c.PasswordBanned); err != nil {
+			log.Fatalf("authenticate_server: failed to load banned passwords: %v", err)
+		}
+		log.Printf("authenticate_server: %d banned passwords loaded from %v", len(pp.Banned), c.PasswordBanned)
 	}
-	if *port < 0 || *port > 65535 {
-		log.Fatalf("authenticate_server: invalid --port, must be in [0, 65535], found %d", *port)
+	serving.SetPasswordPolicy(pp)
+	if err := serving.Bootstrap(mdl.User{Name: c.AdminUser, Password: c.AdminPassword}); err != nil {
+		log.Fatalf("authenticate_server: failed to bootstrap: %v", err)
+	}
+	if c.SQLDriver != "" || c.DataDir != "" {
+		// Tuples have no journal nor table yet, unlike users and roles
+		log.Printf("authenticate_server: warning: relation tuples are kept in memory only, and lost on restart")
+	}
+	serving.SetRelationEngines(func(mdl.Tenant) mdl.RelationEngine {
+		relations := mdl.NewInmemRelationEngine()
+		for _, n := range c.Namespaces {
+			relations.SetNamespace(n)
+		}
+		return relations
+	})
+	if c.Policy != "" {
+		p, err := mdl.NewPolicyStore(c.Policy)
+		if err != nil {
+			log.Fatalf("authenticate_server: failed to load policy: %v", err)
+		}
+		if c.PolicyReload > 0 {
+			p.Watch(time.Duration(c.PolicyReload), func(err error) {
+				if err != nil {
+					log.Printf("authenticate_server: failed to reload policy, keep the current one: %v", err)
+				} else {
+					log.Printf("authenticate_server: policy reloaded, %d rules", p.Policy().Rules())
+				}
+			})
+		}
+		defer p.Close()
+		serving.SetPolicy(p)
+		log.Printf("authenticate_server: policy loaded from %v, %d rules", c.Policy, p.Policy().Rules())
 	}
 
 	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte("Hello"))
 	})
 	go func() {
-		log.Printf("authenticate_server: start listen on :%d", *port)
-		http.ListenAndServe(fmt.Sprintf(":%d", *port), nil)
+		log.Printf("authenticate_server: start listen on :%d", c.Port)
+		http.ListenAndServe(fmt.Sprintf(":%d", c.Port), nil)
 	}()
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	<-quit
 	log.Printf("authenticate_server: gracefully shutdown")
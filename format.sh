@@ -1,3 +1,4 @@
 gofmt -w cmd/
 gofmt -w model/
 gofmt -w serving/
+gofmt -w sqlstore/
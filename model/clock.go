@@ -0,0 +1,54 @@
+package model
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells engines the time, which decides token creation and expiry.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// RealClock returns the clock of the system.
+func RealClock() Clock {
+	return realClock{}
+}
+
+// FakeClock is a Clock which only moves when told to, so that tests can
+// expire tokens without sleeping. It's safe for concurrent use.
+type FakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock returns a FakeClock stopped at t.
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{now: t}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by du.
+func (c *FakeClock) Advance(du time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(du)
+}
+
+// Set moves the clock to t.
+func (c *FakeClock) Set(t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = t
+}
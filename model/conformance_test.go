@@ -0,0 +1,37 @@
+package model_test
+
+import (
+	"testing"
+
+	mdl "hsbc-hw/model"
+	"hsbc-hw/model/enginetest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func options(c enginetest.Config) []mdl.Option {
+	return []mdl.Option{
+		mdl.WithTokenTTL(c.TokenTTL),
+		mdl.WithPasswordHasher(c.Hasher),
+		mdl.WithClock(c.Clock),
+		mdl.WithMaxSessions(c.MaxSessions),
+		mdl.WithPasswordHistory(c.PasswordHistory),
+		// Few shards to have partitions shared
+		mdl.WithUserShards(4),
+		mdl.WithTokenShards(4),
+	}
+}
+
+func TestInmemConformance(t *testing.T) {
+	enginetest.Run(t, func(t *testing.T, c enginetest.Config) mdl.AuthenticateAuthorizationEngine {
+		return mdl.NewInmemEngine(options(c)...)
+	})
+}
+
+func TestDurableConformance(t *testing.T) {
+	enginetest.Run(t, func(t *testing.T, c enginetest.Config) mdl.AuthenticateAuthorizationEngine {
+		e, err := mdl.NewDurableEngine(t.TempDir(), mdl.DurableOptions{Fsync: mdl.FsyncNever}, options(c)...)
+		assert.Nil(t, err)
+		return e
+	})
+}
@@ -0,0 +1,759 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// This file implements a durable engine on top of inmemEngine. Every
+// mutation is appended to a write-ahead log before it's applied in memory,
+// and the log is compacted into a snapshot periodically. Both files are
+// replayed on startup.
+
+const (
+	walFileName      = "wal"
+	snapshotFileName = "snapshot"
+)
+
+// Journal record operations
+const (
+	opSnapshot          = "snapshot" // header of snapshot files
+	opCreateTenant      = "tenant.create"
+	opDeleteTenant      = "tenant.delete"
+	opCreateUser        = "user.create"
+	opDeleteUser        = "user.delete"
+	opSetPassword       = "user.password.set"
+	opCreateRole        = "role.create"
+	opDeleteRole        = "role.delete"
+	opAddUserRole       = "user.role.add"
+	opRemoveUserRole    = "user.role.remove"
+	opAddRoleParent     = "role.parent.add"
+	opRemoveRoleParent  = "role.parent.remove"
+	opGrantPermission   = "role.permission.grant"
+	opRevokePermission  = "role.permission.revoke"
+	opCreateGroup       = "group.create"
+	opDeleteGroup       = "group.delete"
+	opAddGroupMember    = "group.member.add"
+	opRemoveGroupMember = "group.member.remove"
+	opAddGroupParent    = "group.parent.add"
+	opRemoveGroupParent = "group.parent.remove"
+	opAddGroupRole      = "group.role.add"
+	opRemoveGroupRole   = "group.role.remove"
+	opCreateSession     = "session.create"
+	opRevokeSession     = "session.revoke"
+	opRevokeAllSessions = "session.revoke_all"
+)
+
+type journalRecord struct {
+	Seq        uint64         `json:"seq"`
+	Op         string         `json:"op"`
+	Tenant     string         `json:"tenant,omitempty"`
+	User       string         `json:"user,omitempty"`
+	Pwd        string         `json:"pwd,omitempty"`
+	Temporary  bool           `json:"temporary,omitempty"` // of Pwd, which must be changed
+	History    []string       `json:"history,omitempty"`   // previous hashes of Pwd
+	Role       string         `json:"role,omitempty"`
+	Group      string         `json:"group,omitempty"`
+	Parents    []string       `json:"parents,omitempty"`
+	Parent     string         `json:"parent,omitempty"`
+	Permission string         `json:"permission,omitempty"`
+	Resource   string         `json:"resource,omitempty"`
+	SessionID  string         `json:"session_id,omitempty"`
+	Session    *sessionRecord `json:"session,omitempty"`
+}
+
+// sessionRecord keeps the key of the token of a session rather than its
+// ID, so that the files don't give the session away, see tokenKey.
+type sessionRecord struct {
+	Key             string `json:"key"`
+	ID              string `json:"id,omitempty"` // instead of Key in older files
+	SessionID       string `json:"session_id"`
+	CreatedAtInUsec int64  `json:"created_at_in_usec"`
+	ExpiredAtInUsec int64  `json:"expired_at_in_usec"`
+	UserAgent       string `json:"user_agent,omitempty"`
+	IP              string `json:"ip,omitempty"`
+	Label           string `json:"label,omitempty"`
+}
+
+func newSessionRecord(t *Token) *sessionRecord {
+	return &sessionRecord{
+		Key:             t.ID,
+		SessionID:       t.SessionID,
+		CreatedAtInUsec: t.CreatedAtInUsec,
+		ExpiredAtInUsec: t.ExpiredAtInUsec,
+		UserAgent:       t.Info.UserAgent,
+		IP:              t.Info.IP,
+		Label:           t.Info.Label,
+	}
+}
+
+// DurableOptions configures NewDurableEngine.
+//
+// Once a write or sync of the log fails, mutations are refused with Internal
+// and a snapshot is taken in the background, which starts a new log when it
+// succeeds, so that the engine recovers once the disk does. Failures are
+// logged by the standard logger.
+type DurableOptions struct {
+	// Fsync decides when the log is synced, FsyncAlways by default.
+	Fsync FsyncPolicy
+	// FsyncInterval is the sync period of FsyncInterval, 1s by default.
+	FsyncInterval time.Duration
+	// SnapshotThreshold is the number of log records which triggers a
+	// compaction into a new snapshot, 10000 by default.
+	SnapshotThreshold int
+}
+
+type durableEngine struct {
+	*inmemEngine
+
+	// Mutations hold the read lock, while snapshots stop the world with
+	// the write lock so that a snapshot always matches a log position.
+	barrier sync.RWMutex
+
+	dir  string
+	opts DurableOptions
+	log  *wal
+
+	compactChan chan struct{}
+	exitChan    chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewDurableEngine opens or creates an engine persisted to the directory,
+// restoring the state from the snapshot and write-ahead log in it. The in
+// memory engine underneath is configured by engineOpts.
+func NewDurableEngine(dir string, opts DurableOptions, engineOpts ...Option) (AuthenticateAuthorizationEngine, error) {
+	d, err := openDurableEngine(dir, opts, engineOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func openDurableEngine(dir string, opts DurableOptions, engineOpts ...Option) (*durableEngine, error) {
+	o, err := NewOptions(engineOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if opts.FsyncInterval <= 0 {
+		opts.FsyncInterval = time.Second
+	}
+	if opts.SnapshotThreshold <= 0 {
+		opts.SnapshotThreshold = 10000
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	d := &durableEngine{
+		inmemEngine: newInmemEngine(o),
+		dir:         dir,
+		opts:        opts,
+		compactChan: make(chan struct{}, 1),
+		exitChan:    make(chan struct{}),
+	}
+	seq, err := d.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	size, seq, err := d.replayWAL(seq)
+	if err != nil {
+		return nil, err
+	}
+	if d.log, err = openWAL(d.path(walFileName), size, seq, opts.Fsync); err != nil {
+		return nil, err
+	}
+	d.inmemEngine.journal = func(r journalRecord) error {
+		records, err := d.log.append(&r)
+		if err != nil || records >= d.opts.SnapshotThreshold {
+			d.compact()
+		}
+		return err
+	}
+
+	go d.inmemEngine.deleteExpiredTokens()
+	d.wg.Add(1)
+	go d.background()
+	return d, nil
+}
+
+func (d *durableEngine) CreateTenant(t Tenant) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.CreateTenant(t)
+}
+
+func (d *durableEngine) DeleteTenant(t Tenant) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.DeleteTenant(t)
+}
+
+func (d *durableEngine) CreateUser(u User) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.CreateUser(u)
+}
+
+func (d *durableEngine) DeleteUser(u User) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.DeleteUser(u)
+}
+
+func (d *durableEngine) ChangePassword(u User, password string) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.ChangePassword(u, password)
+}
+
+func (d *durableEngine) ResetPassword(u User) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.ResetPassword(u)
+}
+
+func (d *durableEngine) CreateRole(r Role) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.CreateRole(r)
+}
+
+func (d *durableEngine) DeleteRole(r Role) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.DeleteRole(r)
+}
+
+func (d *durableEngine) AddUserRole(u User, r Role) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.AddUserRole(u, r)
+}
+
+func (d *durableEngine) RemoveUserRole(u User, r Role) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.RemoveUserRole(u, r)
+}
+
+func (d *durableEngine) AddUserRoleOn(u User, r Role, res Resource) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.AddUserRoleOn(u, r, res)
+}
+
+func (d *durableEngine) RemoveUserRoleOn(u User, r Role, res Resource) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.RemoveUserRoleOn(u, r, res)
+}
+
+func (d *durableEngine) GrantPermission(r Role, p Permission) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.GrantPermission(r, p)
+}
+
+func (d *durableEngine) RevokePermission(r Role, p Permission) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.RevokePermission(r, p)
+}
+
+func (d *durableEngine) AddRoleParent(r, parent Role) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.AddRoleParent(r, parent)
+}
+
+func (d *durableEngine) RemoveRoleParent(r, parent Role) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.RemoveRoleParent(r, parent)
+}
+
+func (d *durableEngine) CreateGroup(g Group) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.CreateGroup(g)
+}
+
+func (d *durableEngine) DeleteGroup(g Group) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.DeleteGroup(g)
+}
+
+func (d *durableEngine) AddGroupMember(g Group, u User) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.AddGroupMember(g, u)
+}
+
+func (d *durableEngine) RemoveGroupMember(g Group, u User) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.RemoveGroupMember(g, u)
+}
+
+func (d *durableEngine) AddGroupParent(g, parent Group) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.AddGroupParent(g, parent)
+}
+
+func (d *durableEngine) RemoveGroupParent(g, parent Group) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.RemoveGroupParent(g, parent)
+}
+
+func (d *durableEngine) AddGroupRole(g Group, r Role) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.AddGroupRole(g, r)
+}
+
+func (d *durableEngine) RemoveGroupRole(g Group, r Role) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.RemoveGroupRole(g, r)
+}
+
+func (d *durableEngine) Authenticate(u User, info SessionInfo) (Token, StatusCode) {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.Authenticate(u, info)
+}
+
+func (d *durableEngine) Invalidate(t string) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.Invalidate(t)
+}
+
+func (d *durableEngine) RevokeSession(t, sessionID string) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.RevokeSession(t, sessionID)
+}
+
+func (d *durableEngine) RevokeAllSessions(t string) StatusCode {
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+	return d.inmemEngine.RevokeAllSessions(t)
+}
+
+func (d *durableEngine) Shutdown() {
+	close(d.exitChan)
+	d.wg.Wait()
+	d.log.close()
+	d.inmemEngine.Shutdown()
+}
+
+// Snapshot writes the whole state to a new snapshot and empties the log.
+func (d *durableEngine) Snapshot() error {
+	d.barrier.Lock()
+	defer d.barrier.Unlock()
+
+	tmp := d.path(snapshotFileName + ".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeFrame(f, &journalRecord{Op: opSnapshot, Seq: d.log.seq})
+	for _, r := range d.inmemEngine.dump() {
+		if err != nil {
+			break
+		}
+		err = writeFrame(f, &r)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, d.path(snapshotFileName)); err != nil {
+		return err
+	}
+	if err := syncDir(d.dir); err != nil {
+		return err
+	}
+	// A crash before the log is reset is fine, as records covered by the
+	// snapshot are skipped by their sequence on replay.
+	return d.log.reset()
+}
+
+// compact schedules a snapshot, which also recovers the log from a failure.
+func (d *durableEngine) compact() {
+	select {
+	case d.compactChan <- struct{}{}:
+	default:
+	}
+}
+
+// lower level funcs
+func (d *durableEngine) background() {
+	defer d.wg.Done()
+
+	var syncC <-chan time.Time
+	if d.opts.Fsync == FsyncInterval {
+		t := time.NewTicker(d.opts.FsyncInterval)
+		defer t.Stop()
+		syncC = t.C
+	}
+	for {
+		select {
+		case <-syncC:
+			if err := d.log.sync(); err != nil {
+				d.compact()
+			}
+		case <-d.compactChan:
+			failure := d.log.failure()
+			if failure != nil {
+				log.Printf("model: the log failed by %v, recovering by a snapshot", failure)
+			}
+			if err := d.Snapshot(); err != nil {
+				log.Printf("model: failed to snapshot: %v", err)
+			} else if failure != nil {
+				log.Printf("model: the log recovered")
+			}
+		case <-d.exitChan:
+			return
+		}
+	}
+}
+
+// loadSnapshot applies the snapshot and returns the log sequence it covers.
+func (d *durableEngine) loadSnapshot() (uint64, error) {
+	f, err := os.Open(d.path(snapshotFileName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var seq uint64
+	first := true
+	_, err = readFrames(f, func(r journalRecord) error {
+		if first {
+			first = false
+			if r.Op != opSnapshot {
+				return errors.New("missing snapshot header")
+			}
+			seq = r.Seq
+			return nil
+		}
+		return d.inmemEngine.apply(r)
+	})
+	if err != nil {
+		// Snapshots are renamed into place once complete, a bad one is
+		// not a torn write and must not be silently dropped
+		return 0, fmt.Errorf("durable engine: load snapshot: %v", err)
+	}
+	return seq, nil
+}
+
+// replayWAL applies log records after the snapshot sequence, and returns
+// the size of the valid log and the last sequence.
+func (d *durableEngine) replayWAL(seq uint64) (int64, uint64, error) {
+	f, err := os.Open(d.path(walFileName))
+	if os.IsNotExist(err) {
+		return 0, seq, nil
+	} else if err != nil {
+		return 0, seq, err
+	}
+	defer f.Close()
+
+	size, err := readFrames(f, func(r journalRecord) error {
+		if r.Seq <= seq {
+			return nil
+		}
+		seq = r.Seq
+		return d.inmemEngine.apply(r)
+	})
+	if err != nil && err != errCorruptFrame {
+		return 0, seq, fmt.Errorf("durable engine: replay log: %v", err)
+	}
+	return size, seq, nil
+}
+
+func (d *durableEngine) path(name string) string {
+	return filepath.Join(d.dir, name)
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// apply redoes a journal record, it's only used before the engine serves.
+func (e *inmemEngine) apply(r journalRecord) error {
+	switch r.Op {
+	case opCreateTenant:
+		e.tenants[r.Tenant] = struct{}{}
+	case opDeleteTenant:
+		if _, ok := e.tenants[r.Tenant]; ok {
+			delete(e.tenants, r.Tenant)
+			e.deleteTenantData(Tenant{Name: r.Tenant})
+		}
+	case opCreateUser:
+		e.getUserPartition(r.User).users[r.User] = &User{Name: r.User, PwdEncrypted: r.Pwd, mustChange: r.Temporary,
+			history: r.History}
+	case opDeleteUser:
+		p := e.getUserPartition(r.User)
+		if u, ok := p.users[r.User]; ok {
+			for _, t := range u.sessions {
+				t.invalid = true
+				t.user = nil
+			}
+			delete(p.users, r.User)
+			removeMember(u)
+		}
+	case opSetPassword:
+		u, ok := e.getUserPartition(r.User).users[r.User]
+		if !ok {
+			return nil
+		}
+		u.history = pushHistory(u.history, u.PwdEncrypted, e.passwordHistory-1)
+		u.PwdEncrypted = r.Pwd
+		u.mustChange = r.Temporary
+		for _, t := range u.sessions {
+			t.invalid = true
+			t.user = nil
+		}
+		u.sessions = nil
+	case opCreateRole:
+		if parents, status := e.getParents(r.Parents); status == OK {
+			e.createRole(&Role{Name: r.Role}, parents)
+		}
+	case opDeleteRole:
+		if cur, ok := e.roles[r.Role]; ok {
+			for u := range e.deleteRole(cur) {
+				removeRole(u, cur)
+			}
+		}
+	case opAddRoleParent:
+		cur, ok := e.roles[r.Role]
+		pr, ok2 := e.roles[r.Parent]
+		if ok && ok2 && !hasParent(cur, pr) && !pr.inherits(cur.Name) {
+			addParent(cur, pr)
+			refreshClosures(cur)
+		}
+	case opRemoveRoleParent:
+		cur, ok := e.roles[r.Role]
+		pr, ok2 := e.roles[r.Parent]
+		if ok && ok2 && hasParent(cur, pr) {
+			removeParent(cur, pr)
+			refreshClosures(cur)
+		}
+	case opAddUserRole:
+		u, ok := e.getUserPartition(r.User).users[r.User]
+		rr, ok2 := e.roles[r.Role]
+		if ok && ok2 && !hasBinding(u, rr, r.Resource) {
+			addMember(u, rr, r.Resource)
+		}
+	case opRemoveUserRole:
+		u, ok := e.getUserPartition(r.User).users[r.User]
+		rr, ok2 := e.roles[r.Role]
+		if ok && ok2 {
+			unbind(u, rr, r.Resource)
+		}
+	case opGrantPermission:
+		if cur, ok := e.roles[r.Role]; ok {
+			grantPermission(cur, r.Permission)
+		}
+	case opRevokePermission:
+		if cur, ok := e.roles[r.Role]; ok {
+			delete(cur.permissions, r.Permission)
+			refreshClosures(cur)
+		}
+	case opCreateGroup:
+		if _, ok := e.groups[r.Group]; !ok {
+			e.createGroup(&Group{Name: r.Group})
+		}
+	case opDeleteGroup:
+		if cur, ok := e.groups[r.Group]; ok {
+			for u := range e.deleteGroup(cur) {
+				u.groups = withoutGroup(u.groups, cur)
+			}
+		}
+	case opAddGroupMember:
+		u, ok := e.getUserPartition(r.User).users[r.User]
+		g, ok2 := e.groups[r.Group]
+		if ok && ok2 {
+			if _, ok := g.members[u]; !ok {
+				addGroupMember(g, u)
+			}
+		}
+	case opRemoveGroupMember:
+		u, ok := e.getUserPartition(r.User).users[r.User]
+		g, ok2 := e.groups[r.Group]
+		if ok && ok2 {
+			removeGroupMember(g, u)
+		}
+	case opAddGroupParent:
+		cur, ok := e.groups[r.Group]
+		pg, ok2 := e.groups[r.Parent]
+		if ok && ok2 && !hasGroupParent(cur, pg) && !pg.nestedIn(cur.Name) {
+			addGroupParent(cur, pg)
+			refreshGroupClosures(cur)
+		}
+	case opRemoveGroupParent:
+		cur, ok := e.groups[r.Group]
+		pg, ok2 := e.groups[r.Parent]
+		if ok && ok2 && hasGroupParent(cur, pg) {
+			removeGroupParent(cur, pg)
+			refreshGroupClosures(cur)
+		}
+	case opAddGroupRole:
+		g, ok := e.groups[r.Group]
+		rr, ok2 := e.roles[r.Role]
+		if ok && ok2 {
+			if _, ok := rr.groups[g]; !ok {
+				addGroupRole(g, rr)
+			}
+		}
+	case opRemoveGroupRole:
+		g, ok := e.groups[r.Group]
+		rr, ok2 := e.roles[r.Role]
+		if ok && ok2 {
+			removeGroupRole(g, rr)
+		}
+	case opCreateSession:
+		u, ok := e.getUserPartition(r.User).users[r.User]
+		if !ok || r.Session == nil {
+			return nil
+		}
+		if r.Pwd != "" {
+			u.PwdEncrypted = r.Pwd
+		}
+		s := r.Session
+		if s.Key == "" {
+			s.Key = tokenKey(s.ID)
+		}
+		t := &Token{
+			ID:              s.Key,
+			SessionID:       s.SessionID,
+			CreatedAtInUsec: s.CreatedAtInUsec,
+			ExpiredAtInUsec: s.ExpiredAtInUsec,
+			Info:            SessionInfo{UserAgent: s.UserAgent, IP: s.IP, Label: s.Label},
+			Tenant:          TenantOf(u.Name).Name,
+			user:            u,
+		}
+		if u.sessions == nil {
+			u.sessions = make(map[string]*Token)
+		}
+		u.sessions[t.SessionID] = t
+		e.getTokePartition(t.ID).add(t)
+	case opRevokeSession:
+		u, ok := e.getUserPartition(r.User).users[r.User]
+		if !ok {
+			return nil
+		}
+		if t, ok := u.sessions[r.SessionID]; ok {
+			t.invalid = true
+			t.user = nil
+			delete(u.sessions, r.SessionID)
+		}
+	case opRevokeAllSessions:
+		u, ok := e.getUserPartition(r.User).users[r.User]
+		if !ok {
+			return nil
+		}
+		for _, t := range u.sessions {
+			t.invalid = true
+			t.user = nil
+		}
+		u.sessions = nil
+	default:
+		return fmt.Errorf("unknown journal op %q", r.Op)
+	}
+	return nil
+}
+
+// dump returns journal records to rebuild the current state, skipping
+// expired and invalid sessions.
+func (e *inmemEngine) dump() []journalRecord {
+	var res []journalRecord
+	// Tenants first, as their users and roles can only be created in them
+	e.tenantlock.RLock()
+	for name := range e.tenants {
+		res = append(res, journalRecord{Op: opCreateTenant, Tenant: name})
+	}
+	e.tenantlock.RUnlock()
+	e.rolelock.RLock()
+	for name := range e.roles {
+		res = append(res, journalRecord{Op: opCreateRole, Role: name})
+	}
+	// Parents are linked once all roles exist
+	for name, r := range e.roles {
+		for _, p := range r.parents {
+			res = append(res, journalRecord{Op: opAddRoleParent, Role: name, Parent: p.Name})
+		}
+		for p := range r.permissions {
+			res = append(res, journalRecord{Op: opGrantPermission, Role: name, Permission: p})
+		}
+	}
+	// Groups follow roles, and are nested once all groups exist
+	for name := range e.groups {
+		res = append(res, journalRecord{Op: opCreateGroup, Group: name})
+	}
+	for name, g := range e.groups {
+		for _, p := range g.parents {
+			res = append(res, journalRecord{Op: opAddGroupParent, Group: name, Parent: p.Name})
+		}
+		for _, r := range g.roles {
+			res = append(res, journalRecord{Op: opAddGroupRole, Group: name, Role: r.Name})
+		}
+	}
+	e.rolelock.RUnlock()
+
+	now := e.clock.Now()
+	for _, p := range e.users {
+		p.RLock()
+		for _, u := range p.users {
+			res = append(res, journalRecord{Op: opCreateUser, User: u.Name, Pwd: u.PwdEncrypted, Temporary: u.mustChange, History: u.history})
+			for _, r := range u.roles {
+				if !r.isDeleted() {
+					res = append(res, journalRecord{Op: opAddUserRole, User: u.Name, Role: r.Name})
+				}
+			}
+			for scope, roles := range u.scoped {
+				for _, r := range roles {
+					if !r.isDeleted() {
+						res = append(res, journalRecord{Op: opAddUserRole, User: u.Name, Role: r.Name, Resource: scope})
+					}
+				}
+			}
+			for _, g := range u.groups {
+				if !g.isDeleted() {
+					res = append(res, journalRecord{Op: opAddGroupMember, Group: g.Name, User: u.Name})
+				}
+			}
+			for _, t := range u.sessions {
+				if !expiredByTime(t.ExpiredAtInUsec, now) {
+					res = append(res, journalRecord{Op: opCreateSession, User: u.Name, Session: newSessionRecord(t)})
+				}
+			}
+		}
+		p.RUnlock()
+	}
+	return res
+}
@@ -0,0 +1,468 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testHasher = NewPBKDF2Hasher(10)
+
+func openDurableForTesting(t *testing.T, dir string, opts DurableOptions) *durableEngine {
+	d, err := openDurableEngine(dir, opts, WithPasswordHasher(testHasher))
+	assert.Nil(t, err)
+	return d
+}
+
+func TestDurableRestart(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurableForTesting(t, dir, DurableOptions{})
+	statusCodeEqual(t, UserCreated, d.CreateUser(u1))
+	statusCodeEqual(t, UserCreated, d.CreateUser(u2))
+	statusCodeEqual(t, RoleCreated, d.CreateRole(r1))
+	statusCodeEqual(t, RoleCreated, d.CreateRole(r2))
+	statusCodeEqual(t, RoleCreated, d.CreateRole(r3))
+	statusCodeEqual(t, UserRoleAdded, d.AddUserRole(u1, r1))
+	statusCodeEqual(t, UserRoleAdded, d.AddUserRole(u1, r2))
+	statusCodeEqual(t, UserRoleAdded, d.AddUserRole(u1, r3))
+	statusCodeEqual(t, UserRoleRemoved, d.RemoveUserRole(u1, r3))
+	statusCodeEqual(t, UserRoleAdded, d.AddUserRoleOn(u1, r3, Resource{Path: "org/1"}))
+	statusCodeEqual(t, RoleDeleted, d.DeleteRole(r2))
+	statusCodeEqual(t, UserDeleted, d.DeleteUser(u2))
+	kept, code := d.Authenticate(u1, SessionInfo{Label: "kept"})
+	statusCodeEqual(t, TokenCreated, code)
+	invalidated, code := d.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	statusCodeEqual(t, TokenInvalidated, d.Invalidate(invalidated.ID))
+	d.Shutdown()
+
+	d = openDurableForTesting(t, dir, DurableOptions{})
+	statusCodeEqual(t, UserAlreadyExisting, d.CreateUser(u1))
+	statusCodeEqual(t, UserCreated, d.CreateUser(u2))
+	statusCodeEqual(t, RoleAlreadyExisting, d.CreateRole(r1))
+	statusCodeEqual(t, RoleCreated, d.CreateRole(r2))
+	statusCodeEqual(t, TokenRoleOK, d.CheckRole(kept.ID, r1.Name))
+	statusCodeEqual(t, TokenRoleNotFound, d.CheckRole(kept.ID, r2.Name))
+	statusCodeEqual(t, TokenRoleNotFound, d.CheckRole(kept.ID, r3.Name))
+	statusCodeEqual(t, TokenRoleOK, d.CheckRoleOn(kept.ID, r3.Name, Resource{Path: "org/1/project/2"}))
+	statusCodeEqual(t, TokenIsInvalid, d.CheckRole(invalidated.ID, r1.Name))
+	ss, code := d.ListSessions(kept.ID)
+	statusCodeEqual(t, OK, code)
+	assert.Equal(t, 1, len(ss))
+	assert.Equal(t, "kept", ss[0].Info.Label)
+	_, code = d.Authenticate(u12, SessionInfo{})
+	statusCodeEqual(t, UserPasswordNotMatch, code)
+
+	// Tokens are kept by their keys only, in the log and snapshots alike
+	assertFilesLack(t, dir, kept.ID)
+	assert.Nil(t, d.Snapshot())
+	d.Shutdown()
+	assertFilesLack(t, dir, kept.ID)
+	d = openDurableForTesting(t, dir, DurableOptions{})
+	statusCodeEqual(t, TokenRoleOK, d.CheckRole(kept.ID, r1.Name))
+	d.Shutdown()
+}
+
+func TestDurableRawTokenID(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, walFileName))
+	assert.Nil(t, err)
+	pwd, _ := testHasher.Hash(u1.Password)
+	assert.Nil(t, writeFrame(f, &journalRecord{Seq: 1, Op: opCreateUser, User: u1.Name, Pwd: pwd}))
+	// Older logs kept the ID itself
+	assert.Nil(t, writeFrame(f, &journalRecord{Seq: 2, Op: opCreateSession, User: u1.Name, Session: &sessionRecord{
+		ID:              "hsbc_at_raw",
+		SessionID:       "sid",
+		ExpiredAtInUsec: time.Now().Add(time.Hour).UnixNano() / 1000,
+	}}))
+	assert.Nil(t, f.Close())
+
+	d := openDurableForTesting(t, dir, DurableOptions{})
+	defer d.Shutdown()
+	u, code := d.TokenUser("hsbc_at_raw")
+	statusCodeEqual(t, OK, code)
+	assert.Equal(t, u1.Name, u.Name)
+}
+
+// assertFilesLack asserts that no file of dir contains secret.
+func assertFilesLack(t *testing.T, dir, secret string) {
+	for _, name := range []string{walFileName, snapshotFileName} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if !os.IsNotExist(err) {
+			assert.Nil(t, err)
+		}
+		assert.NotContains(t, string(b), secret, name)
+	}
+}
+
+func TestDurableSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurableForTesting(t, dir, DurableOptions{SnapshotThreshold: 1 << 30})
+	statusCodeEqual(t, UserCreated, d.CreateUser(u1))
+	statusCodeEqual(t, RoleCreated, d.CreateRole(r1))
+	statusCodeEqual(t, UserRoleAdded, d.AddUserRole(u1, r1))
+	token, code := d.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	walBeforeSnapshot, err := ioutil.ReadFile(filepath.Join(dir, walFileName))
+	assert.Nil(t, err)
+
+	assert.Nil(t, d.Snapshot())
+	fi, err := os.Stat(filepath.Join(dir, walFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), fi.Size())
+	statusCodeEqual(t, RoleCreated, d.CreateRole(r2))
+	statusCodeEqual(t, UserRoleAdded, d.AddUserRole(u1, r2))
+	d.Shutdown()
+
+	check := func() {
+		d = openDurableForTesting(t, dir, DurableOptions{})
+		rs, code := d.AllRoles(token.ID)
+		statusCodeEqual(t, OK, code)
+		assert.Equal(t, 2, len(rs))
+		d.Shutdown()
+	}
+	check()
+
+	// Crash after the snapshot is written but before the log is reset,
+	// records covered by the snapshot must be skipped.
+	wal, err := ioutil.ReadFile(filepath.Join(dir, walFileName))
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, walFileName), append(walBeforeSnapshot, wal...), 0600))
+	check()
+}
+
+func TestDurableRoleHierarchy(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurableForTesting(t, dir, DurableOptions{SnapshotThreshold: 1 << 30})
+	statusCodeEqual(t, RoleCreated, d.CreateRole(r1))
+	statusCodeEqual(t, RoleCreated, d.CreateRole(Role{Name: r2.Name, Parents: []string{r1.Name}}))
+	statusCodeEqual(t, RoleCreated, d.CreateRole(r3))
+	statusCodeEqual(t, RoleParentAdded, d.AddRoleParent(r1, r3))
+	statusCodeEqual(t, PermissionGranted, d.GrantPermission(r1, Permission{Name: "orders:*"}))
+	statusCodeEqual(t, PermissionGranted, d.GrantPermission(r3, Permission{Name: "users:read"}))
+	statusCodeEqual(t, UserCreated, d.CreateUser(u1))
+	statusCodeEqual(t, UserRoleAdded, d.AddUserRole(u1, r2))
+	statusCodeEqual(t, UserRoleAdded, d.AddUserRoleOn(u1, r3, Resource{Path: "org/1"}))
+	token, code := d.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	// Parents and permissions are restored from the snapshot and the log
+	// after it
+	assert.Nil(t, d.Snapshot())
+	statusCodeEqual(t, RoleParentRemoved, d.RemoveRoleParent(r1, r3))
+	d.Shutdown()
+
+	d = openDurableForTesting(t, dir, DurableOptions{})
+	defer d.Shutdown()
+	rs, code := d.AllRoles(token.ID)
+	statusCodeEqual(t, OK, code)
+	assert.Equal(t, []Role{{Name: r2.Name}, {Name: r1.Name}}, rs)
+	statusCodeEqual(t, TokenRoleNotFound, d.CheckRole(token.ID, r3.Name))
+	statusCodeEqual(t, RoleCycle, d.AddRoleParent(r1, r2))
+	statusCodeEqual(t, TokenPermissionOK, d.CheckPermission(token.ID, "orders:refund"))
+	statusCodeEqual(t, TokenPermissionNotFound, d.CheckPermission(token.ID, "users:read"))
+	statusCodeEqual(t, TokenRoleOK, d.CheckRoleOn(token.ID, r3.Name, Resource{Path: "org/1"}))
+}
+
+func TestDurableTenants(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurableForTesting(t, dir, DurableOptions{SnapshotThreshold: 1 << 30})
+	acme, globex := Tenant{Name: "acme"}, Tenant{Name: "globex"}
+	statusCodeEqual(t, TenantCreated, d.CreateTenant(acme))
+	statusCodeEqual(t, TenantCreated, d.CreateTenant(globex))
+	va, vg := ForTenant(d, acme), ForTenant(d, globex)
+	for _, v := range []AuthenticateAuthorizationEngine{va, vg} {
+		statusCodeEqual(t, UserCreated, v.CreateUser(u1))
+		statusCodeEqual(t, RoleCreated, v.CreateRole(r1))
+		statusCodeEqual(t, UserRoleAdded, v.AddUserRole(u1, r1))
+	}
+	ta, code := va.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	tg, code := vg.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	// Tenants are restored from the snapshot, and deleted again by the log
+	// after it
+	assert.Nil(t, d.Snapshot())
+	statusCodeEqual(t, TenantDeleted, d.DeleteTenant(acme))
+	d.Shutdown()
+
+	d = openDurableForTesting(t, dir, DurableOptions{})
+	defer d.Shutdown()
+	va, vg = ForTenant(d, acme), ForTenant(d, globex)
+	tenants, code := d.ListTenants()
+	statusCodeEqual(t, OK, code)
+	assert.Equal(t, []Tenant{globex}, tenants)
+	statusCodeEqual(t, TokenRoleOK, vg.CheckRole(tg.ID, r1.Name))
+	sessions, code := vg.ListSessions(tg.ID)
+	statusCodeEqual(t, OK, code)
+	assert.Equal(t, globex.Name, sessions[0].Tenant)
+	statusCodeEqual(t, TokenIsInvalid, va.CheckRole(ta.ID, r1.Name))
+	statusCodeEqual(t, TenantNotFound, va.CreateUser(u1))
+	statusCodeEqual(t, TenantCreated, d.CreateTenant(acme))
+	statusCodeEqual(t, RoleNotFound, va.DeleteRole(r1))
+}
+
+func TestDurableGroups(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurableForTesting(t, dir, DurableOptions{SnapshotThreshold: 1 << 30})
+	eng, all, ops := Group{Name: "eng"}, Group{Name: "all"}, Group{Name: "ops"}
+	statusCodeEqual(t, UserCreated, d.CreateUser(u1))
+	statusCodeEqual(t, RoleCreated, d.CreateRole(r1))
+	statusCodeEqual(t, RoleCreated, d.CreateRole(r2))
+	for _, g := range []Group{eng, all, ops} {
+		statusCodeEqual(t, GroupCreated, d.CreateGroup(g))
+	}
+	statusCodeEqual(t, GroupParentAdded, d.AddGroupParent(eng, all))
+	statusCodeEqual(t, GroupRoleAdded, d.AddGroupRole(all, r1))
+	statusCodeEqual(t, GroupMemberAdded, d.AddGroupMember(eng, u1))
+	statusCodeEqual(t, GroupMemberAdded, d.AddGroupMember(ops, u1))
+	token, code := d.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	// Groups are restored from the snapshot, and changed again by the log
+	// after it
+	assert.Nil(t, d.Snapshot())
+	statusCodeEqual(t, GroupRoleAdded, d.AddGroupRole(ops, r2))
+	statusCodeEqual(t, GroupDeleted, d.DeleteGroup(ops))
+	d.Shutdown()
+
+	d = openDurableForTesting(t, dir, DurableOptions{})
+	defer d.Shutdown()
+	statusCodeEqual(t, TokenRoleOK, d.CheckRole(token.ID, r1.Name))
+	statusCodeEqual(t, TokenRoleNotFound, d.CheckRole(token.ID, r2.Name))
+	statusCodeEqual(t, GroupMemberAlreadyExisting, d.AddGroupMember(eng, u1))
+	statusCodeEqual(t, GroupCycle, d.AddGroupParent(all, eng))
+	statusCodeEqual(t, GroupNotFound, d.DeleteGroup(ops))
+}
+
+func TestDurablePasswords(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurableForTesting(t, dir, DurableOptions{SnapshotThreshold: 1 << 30})
+	statusCodeEqual(t, UserCreated, d.CreateUser(u1))
+	statusCodeEqual(t, UserCreated, d.CreateUser(u2))
+	token, code := d.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	// The reset is restored from the snapshot, the change from the log
+	statusCodeEqual(t, PasswordReset, d.ResetPassword(User{Name: u1.Name, Password: "temp"}))
+	statusCodeEqual(t, PasswordReset, d.ResetPassword(User{Name: u2.Name, Password: "temp"}))
+	assert.Nil(t, d.Snapshot())
+	statusCodeEqual(t, PasswordChanged, d.ChangePassword(User{Name: u2.Name, Password: "temp"}, u12.Password))
+	d.Shutdown()
+
+	d = openDurableForTesting(t, dir, DurableOptions{})
+	defer d.Shutdown()
+	statusCodeEqual(t, TokenNotFound, d.CheckRole(token.ID, r1.Name))
+	_, code = d.Authenticate(User{Name: u1.Name, Password: "temp"}, SessionInfo{})
+	statusCodeEqual(t, PasswordChangeRequired, code)
+	_, code = d.Authenticate(User{Name: u2.Name, Password: u12.Password}, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+}
+
+func TestDurablePasswordHistory(t *testing.T) {
+	dir := t.TempDir()
+	open := func(opts DurableOptions) *durableEngine {
+		d, err := openDurableEngine(dir, opts, WithPasswordHasher(testHasher), WithPasswordHistory(3))
+		assert.Nil(t, err)
+		return d
+	}
+	// u1 history is restored from the snapshot, u2 history from the log
+	d := open(DurableOptions{SnapshotThreshold: 1 << 30})
+	statusCodeEqual(t, UserCreated, d.CreateUser(u1))
+	statusCodeEqual(t, UserCreated, d.CreateUser(u2))
+	statusCodeEqual(t, PasswordChanged, d.ChangePassword(u1, "p2"))
+	assert.Nil(t, d.Snapshot())
+	statusCodeEqual(t, PasswordChanged, d.ChangePassword(u2, "p2"))
+	d.Shutdown()
+
+	d = open(DurableOptions{})
+	defer d.Shutdown()
+	for _, u := range []User{u1, u2} {
+		statusCodeEqual(t, PasswordReused, d.ChangePassword(User{Name: u.Name, Password: "p2"}, u.Password))
+	}
+}
+
+func TestDurableCompaction(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurableForTesting(t, dir, DurableOptions{SnapshotThreshold: 10})
+	for i := 0; i < 100; i++ {
+		statusCodeEqual(t, RoleCreated, d.CreateRole(Role{Name: fmt.Sprintf("r%d", i)}))
+	}
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, snapshotFileName))
+		return err == nil
+	}, time.Second, time.Millisecond)
+	d.Shutdown()
+
+	d = openDurableForTesting(t, dir, DurableOptions{})
+	defer d.Shutdown()
+	for i := 0; i < 100; i++ {
+		statusCodeEqual(t, RoleAlreadyExisting, d.CreateRole(Role{Name: fmt.Sprintf("r%d", i)}))
+	}
+}
+
+// TestDurableCrashRecovery truncates the log at random offsets, as a crash
+// in the middle of a write would, and checks that the engine recovers to a
+// consistent prefix of the history and can keep writing.
+func TestDurableCrashRecovery(t *testing.T) {
+	const n = 30
+	dir := t.TempDir()
+	d := openDurableForTesting(t, dir, DurableOptions{Fsync: FsyncNever})
+	user := func(i int) User { return User{Name: fmt.Sprintf("u%d", i), Password: "pwd"} }
+	role := func(i int) Role { return Role{Name: fmt.Sprintf("r%d", i)} }
+
+	// Every mutation appends one record, which is handed to the OS right
+	// away, so the size of the log after each one gives its frame end.
+	var ends []int64
+	mutated := func() {
+		info, err := os.Stat(filepath.Join(dir, walFileName))
+		assert.Nil(t, err)
+		ends = append(ends, info.Size())
+	}
+	var token Token
+	session := -1
+	for i := 0; i < n; i++ {
+		statusCodeEqual(t, UserCreated, d.CreateUser(user(i)))
+		mutated()
+		statusCodeEqual(t, RoleCreated, d.CreateRole(role(i)))
+		mutated()
+		statusCodeEqual(t, UserRoleAdded, d.AddUserRole(user(i), role(i)))
+		mutated()
+		if i == n/2 {
+			var status StatusCode
+			token, status = d.Authenticate(user(i), SessionInfo{})
+			statusCodeEqual(t, TokenCreated, status)
+			mutated()
+			session = len(ends) - 1
+		}
+	}
+	d.Shutdown()
+	wal, err := ioutil.ReadFile(filepath.Join(dir, walFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, ends[len(ends)-1], int64(len(wal)))
+
+	rnd := rand.New(rand.NewSource(1))
+	for k := 0; k < 20; k++ {
+		offset := rnd.Intn(len(wal) + 1)
+		crashed := t.TempDir()
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(crashed, walFileName), wal[:offset], 0600))
+
+		// Records are applied in order, so exactly the mutations whose
+		// frames are complete must be recovered.
+		recovered := 0
+		for recovered < len(ends) && ends[recovered] <= int64(offset) {
+			recovered++
+		}
+		applied := func(op int) bool {
+			if op > session {
+				op++
+			}
+			return op < recovered
+		}
+		d := openDurableForTesting(t, crashed, DurableOptions{})
+		for i := 0; i < n; i++ {
+			u, status := d.GetUser(user(i))
+			if applied(3 * i) {
+				statusCodeEqual(t, OK, status)
+			} else {
+				statusCodeEqual(t, UserNotFound, status)
+			}
+			_, status = d.GetRole(role(i))
+			if applied(3*i + 1) {
+				statusCodeEqual(t, OK, status)
+			} else {
+				statusCodeEqual(t, RoleNotFound, status)
+			}
+			if applied(3*i + 2) {
+				assert.Equal(t, []string{role(i).Name}, u.Roles, "offset %d user %d", offset, i)
+			} else {
+				assert.Empty(t, u.Roles, "offset %d user %d", offset, i)
+			}
+		}
+		if session < recovered {
+			statusCodeEqual(t, TokenRoleOK, d.CheckRole(token.ID, role(n/2).Name))
+		} else {
+			statusCodeEqual(t, TokenNotFound, d.CheckRole(token.ID, role(n/2).Name))
+		}
+
+		// Keep writing after the torn tail and recover again
+		extra := User{Name: "extra", Password: "pwd"}
+		statusCodeEqual(t, UserCreated, d.CreateUser(extra))
+		d.Shutdown()
+		d = openDurableForTesting(t, crashed, DurableOptions{})
+		statusCodeEqual(t, UserAlreadyExisting, d.CreateUser(extra))
+		if recovered > 0 {
+			statusCodeEqual(t, UserAlreadyExisting, d.CreateUser(user(0)))
+		}
+		d.Shutdown()
+	}
+}
+
+// TestDurableSyncFailure fails the sync of a record, and checks that the
+// mutation refused isn't replayed by the next start.
+func TestDurableSyncFailure(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurableForTesting(t, dir, DurableOptions{})
+	statusCodeEqual(t, UserCreated, d.CreateUser(u1))
+	setFsync(d, func(*os.File) error { return errors.New("injected sync failure") })
+	statusCodeEqual(t, Internal, d.CreateUser(u2))
+	statusCodeEqual(t, Internal, d.CreateRole(r1))
+	statusCodeEqual(t, UserNotFound, d.DeleteUser(u2))
+	d.Shutdown()
+
+	d = openDurableForTesting(t, dir, DurableOptions{})
+	statusCodeEqual(t, UserAlreadyExisting, d.CreateUser(u1))
+	statusCodeEqual(t, UserCreated, d.CreateUser(u2))
+	statusCodeEqual(t, RoleCreated, d.CreateRole(r1))
+	d.Shutdown()
+}
+
+func TestDurableSyncRecovery(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurableForTesting(t, dir, DurableOptions{})
+	statusCodeEqual(t, UserCreated, d.CreateUser(u1))
+	setFsync(d, func(*os.File) error { return errors.New("injected sync failure") })
+	statusCodeEqual(t, Internal, d.CreateUser(u2))
+	assert.Error(t, d.log.failure())
+
+	// the disk is back, the next failed mutation schedules a snapshot
+	setFsync(d, (*os.File).Sync)
+	assert.Eventually(t, func() bool {
+		return d.CreateRole(r1) == RoleCreated
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, d.log.failure())
+	statusCodeEqual(t, UserCreated, d.CreateUser(u2))
+	d.Shutdown()
+
+	d = openDurableForTesting(t, dir, DurableOptions{})
+	defer d.Shutdown()
+	statusCodeEqual(t, UserAlreadyExisting, d.CreateUser(u1))
+	statusCodeEqual(t, UserAlreadyExisting, d.CreateUser(u2))
+	statusCodeEqual(t, RoleAlreadyExisting, d.CreateRole(r1))
+}
+
+func setFsync(d *durableEngine, fsync func(*os.File) error) {
+	d.log.Lock()
+	defer d.log.Unlock()
+	d.log.fsync = fsync
+}
+
+func TestDurableCorruptSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	d := openDurableForTesting(t, dir, DurableOptions{})
+	statusCodeEqual(t, RoleCreated, d.CreateRole(r1))
+	assert.Nil(t, d.Snapshot())
+	d.Shutdown()
+
+	path := filepath.Join(dir, snapshotFileName)
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	b[len(b)-2] ^= 0xff
+	assert.Nil(t, ioutil.WriteFile(path, b, 0600))
+	_, err = NewDurableEngine(dir, DurableOptions{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,1094 @@
+// Package enginetest is the behavioral contract of
+// model.AuthenticateAuthorizationEngine. Every implementation should pass
+// it by calling Run from its tests, e.g.
+//
+//	func TestConformance(t *testing.T) {
+//		enginetest.Run(t, func(t *testing.T, c enginetest.Config) mdl.AuthenticateAuthorizationEngine {
+//			return NewMyEngine(
+//				mdl.WithTokenTTL(c.TokenTTL),
+//				mdl.WithPasswordHasher(c.Hasher),
+//				mdl.WithClock(c.Clock),
+//				mdl.WithMaxSessions(c.MaxSessions),
+//				mdl.WithPasswordHistory(c.PasswordHistory),
+//			)
+//		})
+//	}
+package enginetest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mdl "hsbc-hw/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Config is what a Factory must apply to the engine it creates.
+type Config struct {
+	// TokenTTL is the lifetime of new tokens.
+	TokenTTL time.Duration
+	// Hasher hashes new passwords, which is cheap to keep tests fast.
+	Hasher mdl.PasswordHasher
+	// Clock must tell the time of the engine, tests advance it instead of
+	// sleeping.
+	Clock *mdl.FakeClock
+	// MaxSessions limits the sessions of each user, 0 for unlimited.
+	MaxSessions int
+	// PasswordHistory is the number of the last passwords of each user a
+	// new one must differ from, 0 for no check.
+	PasswordHistory int
+}
+
+// Factory creates a new and empty engine for each test. Engines are shut
+// down by the tests.
+type Factory func(t *testing.T, c Config) mdl.AuthenticateAuthorizationEngine
+
+var (
+	u1               = mdl.User{Name: "u1", Password: "xxxx"}
+	u12              = mdl.User{Name: "u1", Password: "yyyy"}
+	u2               = mdl.User{Name: "u2", Password: "zzzz"}
+	r1               = mdl.Role{Name: "r1"}
+	r2               = mdl.Role{Name: "r2"}
+	r3               = mdl.Role{Name: "r3"}
+	tokenNotExisting = mdl.Token{ID: "__not_existing__"}
+)
+
+// Run runs the whole contract against engines created by f.
+func Run(t *testing.T, f Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, f Factory)
+	}{
+		{"UserBasic", testUserBasic},
+		{"RoleBasic", testRoleBasic},
+		{"UserRole", testUserRole},
+		{"RemoveUserRole", testRemoveUserRole},
+		{"Authenticate", testAuthenticate},
+		{"MissingUserVerified", testMissingUserVerified},
+		{"Sessions", testSessions},
+		{"MaxSessions", testMaxSessions},
+		{"Invalidate", testInvalidate},
+		{"TokenExpired", testTokenExpired},
+		{"DeleteUserWithToken", testDeleteUserWithToken},
+		{"CheckRole", testCheckRole},
+		{"AllRoles", testAllRoles},
+		{"RoleDeletionCascade", testRoleDeletionCascade},
+		{"RoleHierarchy", testRoleHierarchy},
+		{"Permissions", testPermissions},
+		{"ScopedRoles", testScopedRoles},
+		{"Groups", testGroups},
+		{"Get", testGet},
+		{"List", testList},
+		{"Passwords", testPasswords},
+		{"PasswordHistory", testPasswordHistory},
+		{"Tenants", testTenants},
+		{"Concurrency", testConcurrency},
+	}
+	for _, tt := range tests {
+		fn := tt.fn
+		t.Run(tt.name, func(t *testing.T) {
+			fn(t, f)
+		})
+	}
+}
+
+func newEngine(t *testing.T, f Factory, c Config) mdl.AuthenticateAuthorizationEngine {
+	if c.TokenTTL == 0 {
+		c.TokenTTL = time.Hour
+	}
+	if c.Hasher == nil {
+		c.Hasher = mdl.NewPBKDF2Hasher(10)
+	}
+	if c.Clock == nil {
+		c.Clock = mdl.NewFakeClock(time.Unix(1600000000, 0))
+	}
+	e := f(t, c)
+	t.Cleanup(e.Shutdown)
+	return e
+}
+
+func statusCodeEqual(t *testing.T, expected, actual mdl.StatusCode, msgAndArgs ...interface{}) {
+	t.Helper()
+	assert.Equal(t, expected, actual, msgAndArgs...)
+	assert.Equal(t, expected.String(), actual.String(), msgAndArgs...)
+}
+
+func authenticate(t *testing.T, e mdl.AuthenticateAuthorizationEngine, u mdl.User) mdl.Token {
+	t.Helper()
+	token, code := e.Authenticate(u, mdl.SessionInfo{})
+	statusCodeEqual(t, mdl.TokenCreated, code)
+	return token
+}
+
+func roleNames(rs []mdl.Role) []string {
+	res := make([]string, 0, len(rs))
+	for _, r := range rs {
+		res = append(res, r.Name)
+	}
+	return res
+}
+
+func userNames(us []mdl.User) []string {
+	res := make([]string, 0, len(us))
+	for _, u := range us {
+		res = append(res, u.Name)
+	}
+	return res
+}
+
+func testUserBasic(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, mdl.UserAlreadyExisting, e.CreateUser(u1))
+	statusCodeEqual(t, mdl.UserPasswordNotMatch, e.DeleteUser(u12))
+	statusCodeEqual(t, mdl.UserDeleted, e.DeleteUser(u1))
+	statusCodeEqual(t, mdl.UserNotFound, e.DeleteUser(u1))
+}
+
+func testRoleBasic(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.RoleAlreadyExisting, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.RoleDeleted, e.DeleteRole(r1))
+	statusCodeEqual(t, mdl.RoleNotFound, e.DeleteRole(r1))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+}
+
+func testUserRole(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	statusCodeEqual(t, mdl.UserNotFound, e.AddUserRole(u1, r1))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, mdl.RoleNotFound, e.AddUserRole(u1, r1))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, r1))
+	statusCodeEqual(t, mdl.UserRoleAlreadyExisting, e.AddUserRole(u1, r1))
+	// No password is required
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r2))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(mdl.User{Name: u1.Name}, r2))
+}
+
+func testRemoveUserRole(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	statusCodeEqual(t, mdl.UserNotFound, e.RemoveUserRole(u1, r1))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u2))
+	statusCodeEqual(t, mdl.RoleNotFound, e.RemoveUserRole(u1, r1))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r2))
+	statusCodeEqual(t, mdl.UserRoleNotFound, e.RemoveUserRole(u1, r1))
+	for _, u := range []mdl.User{u1, u2} {
+		statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u, r1))
+		statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u, r2))
+	}
+	t1 := authenticate(t, e, u1)
+	t2 := authenticate(t, e, u2)
+
+	// Active tokens lose the role at once, other users keep it
+	statusCodeEqual(t, mdl.UserRoleRemoved, e.RemoveUserRole(mdl.User{Name: u1.Name}, r1))
+	statusCodeEqual(t, mdl.UserRoleNotFound, e.RemoveUserRole(u1, r1))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(t1.ID, r1.Name))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(t1.ID, r2.Name))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(t2.ID, r1.Name))
+	rs, code := e.AllRoles(t1.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{r2.Name}, roleNames(rs))
+
+	// Removed roles can be added back, and deleting the role still cascades
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, r1))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(t1.ID, r1.Name))
+	rs, code = e.AllRoles(t1.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{r2.Name, r1.Name}, roleNames(rs))
+	statusCodeEqual(t, mdl.RoleDeleted, e.DeleteRole(r1))
+	statusCodeEqual(t, mdl.RoleNotFound, e.RemoveUserRole(u2, r1))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(t2.ID, r1.Name))
+}
+
+func testAuthenticate(t *testing.T, f Factory) {
+	clock := mdl.NewFakeClock(time.Unix(1600000000, 0))
+	e := newEngine(t, f, Config{Clock: clock})
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	_, code := e.Authenticate(u12, mdl.SessionInfo{})
+	statusCodeEqual(t, mdl.UserPasswordNotMatch, code)
+	_, code = e.Authenticate(u2, mdl.SessionInfo{})
+	statusCodeEqual(t, mdl.UserNotFound, code)
+
+	t1 := authenticate(t, e, u1)
+	t2 := authenticate(t, e, u1)
+	assert.NotEqual(t, "", t1.ID)
+	assert.NotEqual(t, "", t1.SessionID)
+	assert.NotEqual(t, t1.ID, t2.ID)
+	assert.NotEqual(t, t1.SessionID, t2.SessionID)
+	assert.Equal(t, clock.Now().UnixNano()/1000, t1.CreatedAtInUsec)
+	assert.Equal(t, clock.Now().Add(time.Hour).UnixNano()/1000, t1.ExpiredAtInUsec)
+
+	u, code := e.TokenUser(t1.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, mdl.User{Name: u1.Name}, u)
+	statusCodeEqual(t, mdl.TokenInvalidated, e.Invalidate(t1.ID))
+	_, code = e.TokenUser(t1.ID)
+	statusCodeEqual(t, mdl.TokenIsInvalid, code)
+	_, code = e.TokenUser("not_existing")
+	statusCodeEqual(t, mdl.TokenNotFound, code)
+}
+
+// verifyingHasher records the hashes verified by it.
+type verifyingHasher struct {
+	mdl.PasswordHasher
+	verified []string
+}
+
+func (h *verifyingHasher) Verify(pwd, encoded string) (bool, error) {
+	h.verified = append(h.verified, encoded)
+	return h.PasswordHasher.Verify(pwd, encoded)
+}
+
+func testMissingUserVerified(t *testing.T, f Factory) {
+	h := &verifyingHasher{PasswordHasher: mdl.NewPBKDF2Hasher(10)}
+	e := newEngine(t, f, Config{Hasher: h})
+	_, code := e.Authenticate(u2, mdl.SessionInfo{})
+	statusCodeEqual(t, mdl.UserNotFound, code)
+	statusCodeEqual(t, mdl.UserNotFound, e.DeleteUser(u2))
+
+	// Missing users are refused as slowly as wrong passwords, by verifying
+	// against a hash by the hasher
+	assert.Len(t, h.verified, 2)
+	for _, v := range h.verified {
+		assert.Contains(t, v, "$pbkdf2-sha256$i=10$")
+	}
+}
+
+func testSessions(t *testing.T, f Factory) {
+	clock := mdl.NewFakeClock(time.Unix(1600000000, 0))
+	e := newEngine(t, f, Config{Clock: clock})
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u2))
+	info := mdl.SessionInfo{UserAgent: "firefox", IP: "10.0.0.1", Label: "laptop"}
+	laptop, code := e.Authenticate(u1, info)
+	statusCodeEqual(t, mdl.TokenCreated, code)
+	clock.Advance(time.Second) // to order sessions by creation
+	phone := authenticate(t, e, u1)
+	clock.Advance(time.Second)
+	tablet := authenticate(t, e, u1)
+	other := authenticate(t, e, u2)
+
+	ss, code := e.ListSessions(phone.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	if assert.Equal(t, 3, len(ss)) {
+		assert.Equal(t, laptop.SessionID, ss[0].SessionID)
+		assert.Equal(t, "", ss[0].ID, "secret token must not be listed")
+		assert.Equal(t, info, ss[0].Info)
+		assert.Equal(t, laptop.ExpiredAtInUsec, ss[0].ExpiredAtInUsec)
+		assert.Equal(t, phone.SessionID, ss[1].SessionID)
+		assert.Equal(t, tablet.SessionID, ss[2].SessionID)
+	}
+	_, code = e.ListSessions(tokenNotExisting.ID)
+	statusCodeEqual(t, mdl.TokenNotFound, code)
+
+	statusCodeEqual(t, mdl.SessionNotFound, e.RevokeSession(phone.ID, "__not_existing__"))
+	statusCodeEqual(t, mdl.SessionNotFound, e.RevokeSession(phone.ID, other.SessionID), "sessions of others")
+	statusCodeEqual(t, mdl.SessionRevoked, e.RevokeSession(phone.ID, laptop.SessionID))
+	statusCodeEqual(t, mdl.SessionNotFound, e.RevokeSession(phone.ID, laptop.SessionID))
+	statusCodeEqual(t, mdl.TokenIsInvalid, e.CheckRole(laptop.ID, r1.Name))
+	statusCodeEqual(t, mdl.TokenInvalidated, e.Invalidate(tablet.ID))
+	ss, code = e.ListSessions(phone.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	if assert.Equal(t, 1, len(ss)) {
+		assert.Equal(t, phone.SessionID, ss[0].SessionID)
+	}
+
+	authenticate(t, e, u1)
+	statusCodeEqual(t, mdl.SessionRevoked, e.RevokeAllSessions(phone.ID))
+	statusCodeEqual(t, mdl.TokenIsInvalid, e.CheckRole(phone.ID, r1.Name))
+	statusCodeEqual(t, mdl.TokenIsInvalid, e.RevokeAllSessions(phone.ID))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(other.ID, r1.Name))
+}
+
+func testMaxSessions(t *testing.T, f Factory) {
+	clock := mdl.NewFakeClock(time.Unix(1600000000, 0))
+	e := newEngine(t, f, Config{TokenTTL: time.Minute, Clock: clock, MaxSessions: 2})
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	first := authenticate(t, e, u1)
+	clock.Advance(time.Second)
+	second := authenticate(t, e, u1)
+	clock.Advance(time.Second)
+
+	// The oldest session makes room for the new one
+	third := authenticate(t, e, u1)
+	statusCodeEqual(t, mdl.TokenIsInvalid, e.CheckRole(first.ID, r1.Name))
+	ss, code := e.ListSessions(third.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	if assert.Equal(t, 2, len(ss)) {
+		assert.Equal(t, second.SessionID, ss[0].SessionID)
+		assert.Equal(t, third.SessionID, ss[1].SessionID)
+	}
+
+	// Expired sessions don't count, the second one expires here
+	clock.Advance(time.Minute - time.Second + time.Microsecond)
+	fourth := authenticate(t, e, u1)
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(third.ID, r1.Name))
+	ss, code = e.ListSessions(fourth.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, 2, len(ss))
+}
+
+func testInvalidate(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	token := authenticate(t, e, u1)
+	statusCodeEqual(t, mdl.TokenNotFound, e.Invalidate(tokenNotExisting.ID))
+	statusCodeEqual(t, mdl.TokenInvalidated, e.Invalidate(token.ID))
+	statusCodeEqual(t, mdl.TokenIsInvalid, e.Invalidate(token.ID))
+	statusCodeEqual(t, mdl.TokenIsInvalid, e.CheckRole(token.ID, r1.Name))
+	_, code := e.AllRoles(token.ID)
+	statusCodeEqual(t, mdl.TokenIsInvalid, code)
+	_, code = e.ListSessions(token.ID)
+	statusCodeEqual(t, mdl.TokenIsInvalid, code)
+}
+
+func testTokenExpired(t *testing.T, f Factory) {
+	clock := mdl.NewFakeClock(time.Unix(1600000000, 0))
+	e := newEngine(t, f, Config{TokenTTL: time.Minute, Clock: clock})
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, r1))
+	token := authenticate(t, e, u1)
+	clock.Advance(time.Minute)
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(token.ID, r1.Name), "valid until the end of TTL")
+	clock.Advance(time.Second)
+
+	// Expired tokens are either reported so or already deleted
+	expiredOrNotFound := func(code mdl.StatusCode) {
+		t.Helper()
+		assert.Contains(t, []mdl.StatusCode{mdl.TokenExpired, mdl.TokenNotFound}, code)
+	}
+	expiredOrNotFound(e.CheckRole(token.ID, r1.Name))
+	expiredOrNotFound(e.Invalidate(token.ID))
+	_, code := e.AllRoles(token.ID)
+	expiredOrNotFound(code)
+	_, code = e.ListSessions(token.ID)
+	expiredOrNotFound(code)
+
+	// And not listed as sessions
+	fresh := authenticate(t, e, u1)
+	ss, code := e.ListSessions(fresh.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	if assert.Equal(t, 1, len(ss)) {
+		assert.Equal(t, fresh.SessionID, ss[0].SessionID)
+	}
+	clock.Advance(time.Hour)
+	_, code = e.ListSessions(fresh.ID)
+	expiredOrNotFound(code)
+}
+
+func testDeleteUserWithToken(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, r1))
+	token := authenticate(t, e, u1)
+	statusCodeEqual(t, mdl.UserDeleted, e.DeleteUser(u1))
+	statusCodeEqual(t, mdl.TokenIsInvalid, e.CheckRole(token.ID, r1.Name))
+
+	// A new user of the same name inherits neither sessions nor roles
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, mdl.TokenIsInvalid, e.CheckRole(token.ID, r1.Name))
+	token = authenticate(t, e, u1)
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(token.ID, r1.Name))
+}
+
+func testCheckRole(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	statusCodeEqual(t, mdl.TokenNotFound, e.CheckRole(tokenNotExisting.ID, r1.Name))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	token := authenticate(t, e, u1)
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(token.ID, u1.Name))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(token.ID, r1.Name))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, r1))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(token.ID, r1.Name))
+	// Roles added after login apply to existing sessions
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r2))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, r2))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(token.ID, r2.Name))
+}
+
+func testAllRoles(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	_, code := e.AllRoles(tokenNotExisting.ID)
+	statusCodeEqual(t, mdl.TokenNotFound, code)
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	token := authenticate(t, e, u1)
+	rs, code := e.AllRoles(token.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, 0, len(rs))
+
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r3))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r2))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, r1))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, r2))
+	rs, code = e.AllRoles(token.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{r1.Name, r2.Name}, roleNames(rs), "in the order added")
+}
+
+func testRoleDeletionCascade(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u2))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r2))
+	for _, u := range []mdl.User{u1, u2} {
+		statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u, r1))
+		statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u, r2))
+	}
+	t1 := authenticate(t, e, u1)
+	t2 := authenticate(t, e, u2)
+
+	statusCodeEqual(t, mdl.RoleDeleted, e.DeleteRole(r1))
+	for _, token := range []mdl.Token{t1, t2} {
+		statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(token.ID, r1.Name))
+		statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(token.ID, r2.Name))
+		rs, code := e.AllRoles(token.ID)
+		statusCodeEqual(t, mdl.OK, code)
+		assert.Equal(t, []string{r2.Name}, roleNames(rs))
+	}
+	statusCodeEqual(t, mdl.RoleNotFound, e.AddUserRole(u1, r1))
+
+	// Re-creating the role doesn't grant it again
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(t1.ID, r1.Name))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, r1))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(t1.ID, r1.Name))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(t2.ID, r1.Name))
+	rs, code := e.AllRoles(t1.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{r2.Name, r1.Name}, roleNames(rs))
+}
+
+func testRoleHierarchy(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	reader := mdl.Role{Name: "reader"}
+	writer := mdl.Role{Name: "writer", Parents: []string{"reader"}}
+	admin := mdl.Role{Name: "admin", Parents: []string{"writer", "writer"}}
+	statusCodeEqual(t, mdl.RoleNotFound, e.CreateRole(writer))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(reader))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(writer))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(admin))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, admin))
+	token := authenticate(t, e, u1)
+
+	assertRoles := func(direct, effective []string) {
+		t.Helper()
+		rs, code := e.DirectRoles(token.ID)
+		statusCodeEqual(t, mdl.OK, code)
+		assert.Equal(t, direct, roleNames(rs))
+		rs, code = e.AllRoles(token.ID)
+		statusCodeEqual(t, mdl.OK, code)
+		assert.Equal(t, effective, roleNames(rs))
+		for _, r := range []string{"reader", "writer", "admin", r1.Name} {
+			exp := mdl.TokenRoleNotFound
+			for _, v := range effective {
+				if v == r {
+					exp = mdl.TokenRoleOK
+				}
+			}
+			statusCodeEqual(t, exp, e.CheckRole(token.ID, r), r)
+		}
+	}
+	assertRoles([]string{"admin"}, []string{"admin", "reader", "writer"})
+
+	// Cycles are rejected at write time
+	statusCodeEqual(t, mdl.RoleCycle, e.AddRoleParent(reader, admin))
+	statusCodeEqual(t, mdl.RoleCycle, e.AddRoleParent(reader, reader))
+	statusCodeEqual(t, mdl.RoleParentAlreadyExisting, e.AddRoleParent(admin, writer))
+	statusCodeEqual(t, mdl.RoleNotFound, e.AddRoleParent(admin, r2))
+	statusCodeEqual(t, mdl.RoleNotFound, e.AddRoleParent(r2, admin))
+
+	// Parents added later apply to existing sessions
+	statusCodeEqual(t, mdl.RoleParentAdded, e.AddRoleParent(reader, r1))
+	assertRoles([]string{"admin"}, []string{"admin", "r1", "reader", "writer"})
+	statusCodeEqual(t, mdl.RoleParentRemoved, e.RemoveRoleParent(admin, writer))
+	statusCodeEqual(t, mdl.RoleParentNotFound, e.RemoveRoleParent(admin, writer))
+	assertRoles([]string{"admin"}, []string{"admin"})
+
+	// Deleting a role in the middle cuts the chain
+	statusCodeEqual(t, mdl.RoleParentAdded, e.AddRoleParent(admin, writer))
+	statusCodeEqual(t, mdl.RoleDeleted, e.DeleteRole(writer))
+	assertRoles([]string{"admin"}, []string{"admin"})
+	statusCodeEqual(t, mdl.RoleParentAdded, e.AddRoleParent(admin, reader))
+	assertRoles([]string{"admin"}, []string{"admin", "r1", "reader"})
+
+	// A directly granted ancestor is listed once, as a direct role
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, reader))
+	assertRoles([]string{"admin", "reader"}, []string{"admin", "reader", "r1"})
+}
+
+func testPermissions(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	refund := mdl.Permission{Name: "orders:refund"}
+	orders := mdl.Permission{Name: "orders:*"}
+	statusCodeEqual(t, mdl.TokenNotFound, e.CheckPermission(tokenNotExisting.ID, refund.Name))
+	statusCodeEqual(t, mdl.RoleNotFound, e.GrantPermission(r1, refund))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(mdl.Role{Name: r2.Name, Parents: []string{r1.Name}}))
+	statusCodeEqual(t, mdl.PermissionInvalid, e.GrantPermission(r1, mdl.Permission{Name: "orders:"}))
+	statusCodeEqual(t, mdl.PermissionInvalid, e.GrantPermission(r1, mdl.Permission{Name: "orders:re*"}))
+	statusCodeEqual(t, mdl.PermissionGranted, e.GrantPermission(r1, refund))
+	statusCodeEqual(t, mdl.PermissionAlreadyGranted, e.GrantPermission(r1, refund))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	token := authenticate(t, e, u1)
+	statusCodeEqual(t, mdl.TokenPermissionNotFound, e.CheckPermission(token.ID, refund.Name))
+
+	// Permissions of parents are inherited
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, r2))
+	statusCodeEqual(t, mdl.TokenPermissionOK, e.CheckPermission(token.ID, refund.Name))
+	statusCodeEqual(t, mdl.TokenPermissionNotFound, e.CheckPermission(token.ID, "orders:create"))
+	statusCodeEqual(t, mdl.TokenPermissionNotFound, e.CheckPermission(token.ID, "orders"))
+
+	// Wildcards match any segment
+	statusCodeEqual(t, mdl.PermissionGranted, e.GrantPermission(r2, orders))
+	statusCodeEqual(t, mdl.TokenPermissionOK, e.CheckPermission(token.ID, "orders:create"))
+	statusCodeEqual(t, mdl.TokenPermissionOK, e.CheckPermission(token.ID, "orders:refund:partial"))
+	statusCodeEqual(t, mdl.TokenPermissionNotFound, e.CheckPermission(token.ID, "users:create"))
+
+	statusCodeEqual(t, mdl.PermissionRevoked, e.RevokePermission(r2, orders))
+	statusCodeEqual(t, mdl.PermissionNotGranted, e.RevokePermission(r2, orders))
+	statusCodeEqual(t, mdl.TokenPermissionNotFound, e.CheckPermission(token.ID, "orders:create"))
+	statusCodeEqual(t, mdl.TokenPermissionOK, e.CheckPermission(token.ID, refund.Name))
+
+	// Permissions go with their role
+	statusCodeEqual(t, mdl.RoleDeleted, e.DeleteRole(r1))
+	statusCodeEqual(t, mdl.TokenPermissionNotFound, e.CheckPermission(token.ID, refund.Name))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.PermissionGranted, e.GrantPermission(r1, refund))
+	statusCodeEqual(t, mdl.TokenPermissionNotFound, e.CheckPermission(token.ID, refund.Name))
+}
+
+func testScopedRoles(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	org := mdl.Resource{Path: "org/1"}
+	project := mdl.Resource{Path: "org/1/project/42"}
+	other := mdl.Resource{Path: "org/2/project/42"}
+	editor := mdl.Role{Name: "editor"}
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(mdl.Role{Name: "viewer"}))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(mdl.Role{Name: editor.Name, Parents: []string{"viewer"}}))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	token := authenticate(t, e, u1)
+	statusCodeEqual(t, mdl.ResourceInvalid, e.AddUserRoleOn(u1, editor, mdl.Resource{Path: "org"}))
+	statusCodeEqual(t, mdl.ResourceInvalid, e.CheckRoleOn(token.ID, editor.Name, mdl.Resource{Path: "org/"}))
+	statusCodeEqual(t, mdl.RoleNotFound, e.AddUserRoleOn(u1, r1, project))
+	statusCodeEqual(t, mdl.UserNotFound, e.AddUserRoleOn(u2, editor, project))
+
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRoleOn(u1, editor, project))
+	statusCodeEqual(t, mdl.UserRoleAlreadyExisting, e.AddUserRoleOn(u1, editor, project))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRoleOn(token.ID, editor.Name, project))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRoleOn(token.ID, "viewer", project))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRoleOn(token.ID, editor.Name, mdl.Resource{Path: project.Path + "/doc/7"}))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRoleOn(token.ID, editor.Name, org))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRoleOn(token.ID, editor.Name, other))
+	// Scoped bindings aren't global
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(token.ID, editor.Name))
+	rs, code := e.AllRoles(token.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Empty(t, rs)
+
+	// Bindings on parent resources and global ones apply below them
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRoleOn(u1, mdl.Role{Name: "viewer"}, org))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRoleOn(token.ID, "viewer", mdl.Resource{Path: "org/1/project/7"}))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRoleOn(token.ID, "viewer", other))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, editor))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRoleOn(token.ID, editor.Name, other))
+
+	// Each binding is removed on its own
+	statusCodeEqual(t, mdl.UserRoleRemoved, e.RemoveUserRole(u1, editor))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRoleOn(token.ID, editor.Name, other))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRoleOn(token.ID, editor.Name, project))
+	statusCodeEqual(t, mdl.UserRoleNotFound, e.RemoveUserRoleOn(u1, editor, org))
+	statusCodeEqual(t, mdl.UserRoleRemoved, e.RemoveUserRoleOn(u1, editor, project))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRoleOn(token.ID, editor.Name, project))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRoleOn(token.ID, "viewer", project))
+
+	// Deleting a role removes its scoped bindings
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRoleOn(u1, editor, project))
+	statusCodeEqual(t, mdl.RoleDeleted, e.DeleteRole(editor))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(editor))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRoleOn(token.ID, editor.Name, project))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRoleOn(u1, editor, project))
+}
+
+// testGroups grants roles through nested groups.
+func testGroups(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	eng, platform, all := mdl.Group{Name: "eng"}, mdl.Group{Name: "platform"}, mdl.Group{Name: "all"}
+	statusCodeEqual(t, mdl.GroupNotFound, e.DeleteGroup(eng))
+	statusCodeEqual(t, mdl.GroupCreated, e.CreateGroup(eng))
+	statusCodeEqual(t, mdl.GroupAlreadyExisting, e.CreateGroup(eng))
+	statusCodeEqual(t, mdl.GroupCreated, e.CreateGroup(platform))
+	statusCodeEqual(t, mdl.GroupCreated, e.CreateGroup(all))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(mdl.Role{Name: r2.Name, Parents: []string{r1.Name}}))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r3))
+	statusCodeEqual(t, mdl.PermissionGranted, e.GrantPermission(r1, mdl.Permission{Name: "orders:read"}))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u2))
+	t1, t2 := authenticate(t, e, u1), authenticate(t, e, u2)
+
+	statusCodeEqual(t, mdl.UserNotFound, e.AddGroupMember(eng, mdl.User{Name: "u3"}))
+	statusCodeEqual(t, mdl.GroupNotFound, e.AddGroupMember(mdl.Group{Name: "ops"}, u1))
+	statusCodeEqual(t, mdl.GroupMemberAdded, e.AddGroupMember(platform, u1))
+	statusCodeEqual(t, mdl.GroupMemberAlreadyExisting, e.AddGroupMember(platform, u1))
+	statusCodeEqual(t, mdl.GroupMemberAdded, e.AddGroupMember(eng, u2))
+	statusCodeEqual(t, mdl.RoleNotFound, e.AddGroupRole(eng, mdl.Role{Name: "r4"}))
+	statusCodeEqual(t, mdl.GroupNotFound, e.AddGroupRole(mdl.Group{Name: "ops"}, r2))
+	statusCodeEqual(t, mdl.GroupRoleAdded, e.AddGroupRole(eng, r2))
+	statusCodeEqual(t, mdl.GroupRoleAlreadyExisting, e.AddGroupRole(eng, r2))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(t2.ID, r1.Name))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(t1.ID, r2.Name))
+
+	// Members of nested groups are members of the outer ones
+	statusCodeEqual(t, mdl.GroupParentAdded, e.AddGroupParent(platform, eng))
+	statusCodeEqual(t, mdl.GroupParentAlreadyExisting, e.AddGroupParent(platform, eng))
+	statusCodeEqual(t, mdl.GroupParentAdded, e.AddGroupParent(eng, all))
+	statusCodeEqual(t, mdl.GroupCycle, e.AddGroupParent(all, platform))
+	statusCodeEqual(t, mdl.GroupCycle, e.AddGroupParent(eng, eng))
+	statusCodeEqual(t, mdl.GroupNotFound, e.AddGroupParent(eng, mdl.Group{Name: "ops"}))
+	statusCodeEqual(t, mdl.GroupRoleAdded, e.AddGroupRole(all, r3))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(t1.ID, r2.Name))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(t1.ID, r3.Name))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRoleOn(t1.ID, r1.Name, mdl.Resource{Path: "org/1"}))
+	statusCodeEqual(t, mdl.TokenPermissionOK, e.CheckPermission(t1.ID, "orders:read"))
+	rs, code := e.AllRoles(t1.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{r1.Name, r2.Name, r3.Name}, roleNames(rs))
+	rs, code = e.DirectRoles(t1.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Empty(t, rs)
+	// Direct roles come first and are listed once
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, r3))
+	rs, code = e.AllRoles(t1.ID)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{r3.Name, r1.Name, r2.Name}, roleNames(rs))
+	statusCodeEqual(t, mdl.UserRoleRemoved, e.RemoveUserRole(u1, r3))
+
+	statusCodeEqual(t, mdl.GroupParentRemoved, e.RemoveGroupParent(platform, eng))
+	statusCodeEqual(t, mdl.GroupParentNotFound, e.RemoveGroupParent(platform, eng))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(t1.ID, r2.Name))
+	statusCodeEqual(t, mdl.GroupParentAdded, e.AddGroupParent(platform, eng))
+	statusCodeEqual(t, mdl.GroupRoleRemoved, e.RemoveGroupRole(eng, r2))
+	statusCodeEqual(t, mdl.GroupRoleNotFound, e.RemoveGroupRole(eng, r2))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(t1.ID, r2.Name))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(t1.ID, r3.Name))
+	statusCodeEqual(t, mdl.GroupMemberRemoved, e.RemoveGroupMember(platform, u1))
+	statusCodeEqual(t, mdl.GroupMemberNotFound, e.RemoveGroupMember(platform, u1))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(t1.ID, r3.Name))
+
+	// Deleting a role or a group in the middle cuts the chain
+	statusCodeEqual(t, mdl.GroupMemberAdded, e.AddGroupMember(platform, u1))
+	statusCodeEqual(t, mdl.RoleDeleted, e.DeleteRole(r3))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r3))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(t1.ID, r3.Name))
+	statusCodeEqual(t, mdl.GroupRoleAdded, e.AddGroupRole(all, r3))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(t1.ID, r3.Name))
+	statusCodeEqual(t, mdl.GroupDeleted, e.DeleteGroup(eng))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(t1.ID, r3.Name))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(t2.ID, r3.Name))
+	statusCodeEqual(t, mdl.GroupCreated, e.CreateGroup(eng))
+	statusCodeEqual(t, mdl.GroupParentNotFound, e.RemoveGroupParent(platform, eng))
+	statusCodeEqual(t, mdl.GroupMemberNotFound, e.RemoveGroupMember(eng, u2))
+
+	// Deleting a user removes it from its groups
+	statusCodeEqual(t, mdl.UserDeleted, e.DeleteUser(u1))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, mdl.GroupMemberNotFound, e.RemoveGroupMember(platform, u1))
+	statusCodeEqual(t, mdl.GroupDeleted, e.DeleteGroup(platform))
+
+	// Groups live in tenants like roles
+	statusCodeEqual(t, mdl.TenantNotFound, e.CreateGroup(mdl.Group{Name: "acme/eng"}))
+	statusCodeEqual(t, mdl.TenantCreated, e.CreateTenant(mdl.Tenant{Name: "acme"}))
+	acme := mdl.ForTenant(e, mdl.Tenant{Name: "acme"})
+	statusCodeEqual(t, mdl.GroupCreated, acme.CreateGroup(eng))
+	statusCodeEqual(t, mdl.InvalidArgument, acme.AddGroupParent(eng, mdl.Group{Name: "/all"}))
+	statusCodeEqual(t, mdl.GroupNotFound, acme.AddGroupParent(eng, all))
+	statusCodeEqual(t, mdl.TenantDeleted, e.DeleteTenant(mdl.Tenant{Name: "acme"}))
+	statusCodeEqual(t, mdl.GroupNotFound, e.DeleteGroup(mdl.Group{Name: "acme/eng"}))
+}
+
+// testTenants uses the same names in tenants through their views, and
+// checks nothing is seen across them.
+func testGet(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	_, code := e.GetUser(u1)
+	statusCodeEqual(t, mdl.UserNotFound, code)
+	_, code = e.GetRole(r1)
+	statusCodeEqual(t, mdl.RoleNotFound, code)
+
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r3))
+	u, code := e.GetUser(mdl.User{Name: u1.Name})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, mdl.User{Name: u1.Name}, u, "no password or hash is returned")
+	r, code := e.GetRole(r1)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, mdl.Role{Name: r1.Name}, r)
+
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(mdl.Role{Name: r2.Name, Parents: []string{r3.Name, r1.Name}}))
+	statusCodeEqual(t, mdl.PermissionGranted, e.GrantPermission(r2, mdl.Permission{Name: "orders:read"}))
+	statusCodeEqual(t, mdl.PermissionGranted, e.GrantPermission(r2, mdl.Permission{Name: "invoices:*"}))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, r3))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, r1))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRoleOn(u1, r2, mdl.Resource{Path: "org/1"}))
+	for _, g := range []mdl.Group{{Name: "eng"}, {Name: "all"}} {
+		statusCodeEqual(t, mdl.GroupCreated, e.CreateGroup(g))
+		statusCodeEqual(t, mdl.GroupMemberAdded, e.AddGroupMember(g, u1))
+	}
+	r, code = e.GetRole(r2)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, mdl.Role{Name: r2.Name, Parents: []string{r1.Name, r3.Name}, Permissions: []string{"invoices:*", "orders:read"}}, r)
+	// Roles bound on resources aren't global ones
+	u, code = e.GetUser(u1)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, mdl.User{Name: u1.Name, Roles: []string{r3.Name, r1.Name}, Groups: []string{"all", "eng"}}, u)
+
+	statusCodeEqual(t, mdl.RoleDeleted, e.DeleteRole(r3))
+	statusCodeEqual(t, mdl.GroupDeleted, e.DeleteGroup(mdl.Group{Name: "eng"}))
+	u, code = e.GetUser(u1)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, mdl.User{Name: u1.Name, Roles: []string{r1.Name}, Groups: []string{"all"}}, u)
+	r, code = e.GetRole(r2)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{r1.Name}, r.Parents)
+}
+
+func testList(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	us, next, code := e.ListUsers(mdl.Page{})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Empty(t, us)
+	assert.Empty(t, next)
+	_, _, code = e.ListRoleMembers(r1, mdl.Page{})
+	statusCodeEqual(t, mdl.RoleNotFound, code)
+
+	// Enough users to spread over the partitions
+	var all []string
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("user%02d", i)
+		all = append(all, name)
+		statusCodeEqual(t, mdl.UserCreated, e.CreateUser(mdl.User{Name: name, Password: "xxxx"}))
+	}
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	var listed []string
+	p := mdl.Page{Prefix: "user", Limit: 10}
+	for {
+		us, next, code := e.ListUsers(p)
+		statusCodeEqual(t, mdl.OK, code)
+		assert.True(t, len(us) <= 10)
+		listed = append(listed, userNames(us)...)
+		if next == "" {
+			break
+		}
+		p.Cursor = next
+	}
+	assert.Equal(t, all, listed)
+	us, next, code = e.ListUsers(mdl.Page{Prefix: "user1", Cursor: "user12", Limit: 3})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{"user13", "user14", "user15"}, userNames(us))
+	assert.Equal(t, "user15", next)
+	us, next, code = e.ListUsers(mdl.Page{Prefix: "user2", Limit: 5})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{"user20", "user21", "user22", "user23", "user24"}, userNames(us))
+	assert.Empty(t, next, "no cursor after the last page")
+	us, _, code = e.ListUsers(mdl.Page{Limit: -1})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Len(t, us, 26)
+
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(mdl.Role{Name: r2.Name, Parents: []string{r1.Name}}))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r3))
+	rs, next, code := e.ListRoles(mdl.Page{Cursor: r1.Name, Limit: 1})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{r2.Name}, roleNames(rs))
+	assert.Equal(t, r2.Name, next)
+
+	// Members have the role by itself, a role inheriting it or a group
+	eng := mdl.Group{Name: "eng"}
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(mdl.User{Name: "user03"}, r1))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(mdl.User{Name: "user01"}, r2))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(mdl.User{Name: "user02"}, r3))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRoleOn(mdl.User{Name: "user04"}, r1, mdl.Resource{Path: "org/1"}))
+	statusCodeEqual(t, mdl.GroupCreated, e.CreateGroup(eng))
+	statusCodeEqual(t, mdl.GroupMemberAdded, e.AddGroupMember(eng, u1))
+	statusCodeEqual(t, mdl.GroupMemberAdded, e.AddGroupMember(eng, mdl.User{Name: "user01"}))
+	statusCodeEqual(t, mdl.GroupRoleAdded, e.AddGroupRole(eng, r2))
+	us, next, code = e.ListRoleMembers(r1, mdl.Page{})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{u1.Name, "user01", "user03"}, userNames(us))
+	assert.Empty(t, next)
+	us, next, code = e.ListRoleMembers(r1, mdl.Page{Prefix: "user", Limit: 1})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{"user01"}, userNames(us))
+	assert.Equal(t, "user01", next)
+	us, _, code = e.ListRoleMembers(r3, mdl.Page{})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{"user02"}, userNames(us))
+
+	statusCodeEqual(t, mdl.RoleParentRemoved, e.RemoveRoleParent(r2, r1))
+	us, _, code = e.ListRoleMembers(r1, mdl.Page{})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{"user03"}, userNames(us))
+}
+
+func testPasswords(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	statusCodeEqual(t, mdl.UserNotFound, e.ChangePassword(u1, u12.Password))
+	statusCodeEqual(t, mdl.UserNotFound, e.ResetPassword(u1))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r1))
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, r1))
+	tok1 := authenticate(t, e, u1)
+	tok2 := authenticate(t, e, u1)
+
+	// Changing keeps the roles and revokes the sessions
+	statusCodeEqual(t, mdl.UserPasswordNotMatch, e.ChangePassword(u12, "wwww"))
+	statusCodeEqual(t, mdl.PasswordChanged, e.ChangePassword(u1, u12.Password))
+	for _, tok := range []mdl.Token{tok1, tok2} {
+		statusCodeEqual(t, mdl.TokenIsInvalid, e.CheckRole(tok.ID, r1.Name))
+	}
+	_, code := e.Authenticate(u1, mdl.SessionInfo{})
+	statusCodeEqual(t, mdl.UserPasswordNotMatch, code)
+	tok := authenticate(t, e, u12)
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(tok.ID, r1.Name))
+
+	// A reset password must be changed before authenticating
+	temp := mdl.User{Name: u1.Name, Password: "temp"}
+	statusCodeEqual(t, mdl.PasswordReset, e.ResetPassword(temp))
+	statusCodeEqual(t, mdl.TokenIsInvalid, e.CheckRole(tok.ID, r1.Name))
+	u, code := e.GetUser(u1)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.True(t, u.MustChangePassword)
+	_, code = e.Authenticate(u12, mdl.SessionInfo{})
+	statusCodeEqual(t, mdl.UserPasswordNotMatch, code)
+	_, code = e.Authenticate(temp, mdl.SessionInfo{})
+	statusCodeEqual(t, mdl.PasswordChangeRequired, code)
+	statusCodeEqual(t, mdl.PasswordChanged, e.ChangePassword(temp, u1.Password))
+	u, code = e.GetUser(u1)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.False(t, u.MustChangePassword)
+	authenticate(t, e, u1)
+}
+
+func testPasswordHistory(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{PasswordHistory: 3})
+	statusCodeEqual(t, mdl.UserNotFound, e.ResetPassword(u1))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+
+	// The current password and the two before can't be reused
+	statusCodeEqual(t, mdl.PasswordReused, e.ChangePassword(u1, u1.Password))
+	statusCodeEqual(t, mdl.PasswordChanged, e.ChangePassword(u1, "p2"))
+	p2 := mdl.User{Name: u1.Name, Password: "p2"}
+	statusCodeEqual(t, mdl.PasswordReused, e.ChangePassword(p2, u1.Password))
+	statusCodeEqual(t, mdl.PasswordReused, e.ResetPassword(u1))
+	statusCodeEqual(t, mdl.PasswordReset, e.ResetPassword(mdl.User{Name: u1.Name, Password: "p3"}))
+	p3 := mdl.User{Name: u1.Name, Password: "p3"}
+	for _, pwd := range []string{u1.Password, "p2", "p3"} {
+		statusCodeEqual(t, mdl.PasswordReused, e.ChangePassword(p3, pwd), pwd)
+	}
+	_, code := e.Authenticate(p3, mdl.SessionInfo{})
+	statusCodeEqual(t, mdl.PasswordChangeRequired, code)
+
+	// The oldest falls out of the history
+	statusCodeEqual(t, mdl.PasswordChanged, e.ChangePassword(p3, "p4"))
+	statusCodeEqual(t, mdl.PasswordChanged, e.ChangePassword(mdl.User{Name: u1.Name, Password: "p4"}, u1.Password))
+	authenticate(t, e, u1)
+
+	// A new user doesn't inherit the history of a deleted one
+	statusCodeEqual(t, mdl.UserDeleted, e.DeleteUser(u1))
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u12))
+	statusCodeEqual(t, mdl.PasswordChanged, e.ChangePassword(u12, "p4"))
+}
+
+func testTenants(t *testing.T, f Factory) {
+	e := newEngine(t, f, Config{})
+	acme, globex := mdl.Tenant{Name: "acme"}, mdl.Tenant{Name: "globex"}
+	statusCodeEqual(t, mdl.TenantInvalid, e.CreateTenant(mdl.Tenant{}))
+	statusCodeEqual(t, mdl.TenantInvalid, e.CreateTenant(mdl.Tenant{Name: "a/b"}))
+	statusCodeEqual(t, mdl.TenantCreated, e.CreateTenant(acme))
+	statusCodeEqual(t, mdl.TenantAlreadyExisting, e.CreateTenant(acme))
+	statusCodeEqual(t, mdl.TenantNotFound, e.DeleteTenant(globex))
+	statusCodeEqual(t, mdl.TenantCreated, e.CreateTenant(globex))
+	tenants, code := e.ListTenants()
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []mdl.Tenant{acme, globex}, tenants)
+
+	// Nothing is created in a tenant which doesn't exist
+	initech := mdl.ForTenant(e, mdl.Tenant{Name: "initech"})
+	statusCodeEqual(t, mdl.TenantNotFound, initech.CreateUser(u1))
+	statusCodeEqual(t, mdl.TenantNotFound, initech.CreateRole(r1))
+
+	views := map[mdl.Tenant]mdl.AuthenticateAuthorizationEngine{
+		{}:     mdl.ForTenant(e, mdl.Tenant{}),
+		acme:   mdl.ForTenant(e, acme),
+		globex: mdl.ForTenant(e, globex),
+	}
+	tokens := make(map[mdl.Tenant]mdl.Token)
+	for tenant, v := range views {
+		statusCodeEqual(t, mdl.InvalidArgument, v.CreateUser(mdl.User{Name: "acme/" + u1.Name, Password: u1.Password}))
+		statusCodeEqual(t, mdl.InvalidArgument, v.CreateRole(mdl.Role{Name: r2.Name, Parents: []string{"acme/" + r1.Name}}))
+		statusCodeEqual(t, mdl.UserCreated, v.CreateUser(u1))
+		statusCodeEqual(t, mdl.RoleCreated, v.CreateRole(r1))
+		statusCodeEqual(t, mdl.RoleCreated, v.CreateRole(mdl.Role{Name: r2.Name, Parents: []string{r1.Name}}))
+		statusCodeEqual(t, mdl.PermissionGranted, v.GrantPermission(r1, mdl.Permission{Name: "orders:read"}))
+		tokens[tenant] = authenticate(t, v, u1)
+		assert.Equal(t, tenant.Name, tokens[tenant].Tenant)
+	}
+	statusCodeEqual(t, mdl.UserRoleAdded, views[acme].AddUserRole(u1, r2))
+	u, code := views[acme].GetUser(u1)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, mdl.User{Name: u1.Name, Roles: []string{r2.Name}}, u)
+	r, code := views[acme].GetRole(r2)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, mdl.Role{Name: r2.Name, Parents: []string{r1.Name}}, r)
+	_, code = views[globex].GetUser(mdl.User{Name: "acme/" + u1.Name})
+	statusCodeEqual(t, mdl.InvalidArgument, code)
+	statusCodeEqual(t, mdl.UserCreated, views[acme].CreateUser(u2))
+	us, next, code := views[acme].ListUsers(mdl.Page{Limit: 1})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []mdl.User{{Name: u1.Name}}, us)
+	assert.Equal(t, u1.Name, next)
+	us, next, code = views[acme].ListUsers(mdl.Page{Cursor: next})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []mdl.User{{Name: u2.Name}}, us)
+	assert.Empty(t, next)
+	us, _, code = views[acme].ListRoleMembers(r1, mdl.Page{})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []mdl.User{{Name: u1.Name}}, us)
+	// Names of the tenants aren't listed in the default one
+	us, _, code = e.ListUsers(mdl.Page{})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{u1.Name}, userNames(us))
+	rs, _, code := views[globex].ListRoles(mdl.Page{Prefix: "r"})
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{r1.Name, r2.Name}, roleNames(rs))
+	_, _, code = views[globex].ListUsers(mdl.Page{Prefix: "acme/"})
+	statusCodeEqual(t, mdl.InvalidArgument, code)
+	statusCodeEqual(t, mdl.UserDeleted, views[acme].DeleteUser(u2))
+	statusCodeEqual(t, mdl.InvalidArgument, views[acme].CreateTenant(mdl.Tenant{Name: "sub"}))
+
+	for tenant, v := range views {
+		for other, tok := range tokens {
+			if other == tenant {
+				continue
+			}
+			statusCodeEqual(t, mdl.TokenNotFound, v.CheckRole(tok.ID, r1.Name))
+			statusCodeEqual(t, mdl.TokenNotFound, v.CheckPermission(tok.ID, "orders:read"))
+			statusCodeEqual(t, mdl.TokenNotFound, v.Invalidate(tok.ID))
+			statusCodeEqual(t, mdl.TokenNotFound, v.RevokeAllSessions(tok.ID))
+			_, code := v.AllRoles(tok.ID)
+			statusCodeEqual(t, mdl.TokenNotFound, code)
+			_, code = v.TokenUser(tok.ID)
+			statusCodeEqual(t, mdl.TokenNotFound, code)
+		}
+		u, code := v.TokenUser(tokens[tenant].ID)
+		statusCodeEqual(t, mdl.OK, code)
+		assert.Equal(t, mdl.User{Name: u1.Name}, u)
+	}
+	tok := tokens[acme].ID
+	statusCodeEqual(t, mdl.TokenRoleOK, views[acme].CheckRole(tok, r1.Name))
+	statusCodeEqual(t, mdl.TokenPermissionOK, views[acme].CheckPermission(tok, "orders:read"))
+	rs, code = views[acme].AllRoles(tok)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []string{r2.Name, r1.Name}, roleNames(rs))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, views[globex].CheckRole(tokens[globex].ID, r1.Name))
+	rs, code = views[globex].AllRoles(tokens[globex].ID)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Empty(t, rs)
+	// The engine itself sees qualified names
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(tok, "acme/"+r1.Name))
+	u, code = e.TokenUser(tok)
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, "acme/"+u1.Name, u.Name)
+
+	// Deleting a tenant deletes its users, roles and tokens only
+	statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u1, mdl.Role{Name: "acme/" + r1.Name}))
+	statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(tokens[mdl.Tenant{}].ID, "acme/"+r1.Name))
+	statusCodeEqual(t, mdl.TenantDeleted, e.DeleteTenant(acme))
+	statusCodeEqual(t, mdl.TenantNotFound, e.DeleteTenant(acme))
+	statusCodeEqual(t, mdl.TokenIsInvalid, views[acme].CheckRole(tok, r1.Name))
+	statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(tokens[mdl.Tenant{}].ID, "acme/"+r1.Name))
+	for _, tenant := range []mdl.Tenant{{}, globex} {
+		statusCodeEqual(t, mdl.UserRoleAdded, views[tenant].AddUserRole(u1, r2))
+		statusCodeEqual(t, mdl.TokenRoleOK, views[tenant].CheckRole(tokens[tenant].ID, r1.Name))
+	}
+	tenants, code = e.ListTenants()
+	statusCodeEqual(t, mdl.OK, code)
+	assert.Equal(t, []mdl.Tenant{globex}, tenants)
+
+	// Re-creating the tenant starts from scratch
+	statusCodeEqual(t, mdl.TenantCreated, e.CreateTenant(acme))
+	_, code = views[acme].Authenticate(u1, mdl.SessionInfo{})
+	statusCodeEqual(t, mdl.UserNotFound, code)
+	statusCodeEqual(t, mdl.RoleNotFound, views[acme].DeleteRole(r1))
+}
+
+// testConcurrency races every operation on a few shared names, then checks
+// that exactly one of the conflicting operations won.
+func testConcurrency(t *testing.T, f Factory) {
+	const workers = 8
+	const rounds = 10
+	e := newEngine(t, f, Config{})
+	shared := mdl.Role{Name: "shared"}
+
+	var mu sync.Mutex
+	counts := make(map[mdl.StatusCode]int)
+	count := func(code mdl.StatusCode) {
+		mu.Lock()
+		counts[code]++
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			count(e.CreateRole(shared))
+			count(e.CreateUser(mdl.User{Name: "shared", Password: "pwd"}))
+			for i := 0; i < rounds; i++ {
+				u := mdl.User{Name: fmt.Sprintf("u-%d-%d", w, i), Password: "pwd"}
+				r := mdl.Role{Name: fmt.Sprintf("r-%d-%d", w, i)}
+				statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u))
+				statusCodeEqual(t, mdl.RoleCreated, e.CreateRole(r))
+				statusCodeEqual(t, mdl.UserRoleAdded, e.AddUserRole(u, r))
+				token := authenticate(t, e, u)
+				statusCodeEqual(t, mdl.TokenRoleOK, e.CheckRole(token.ID, r.Name))
+				if code := e.AddUserRole(u, shared); code != mdl.UserRoleAdded {
+					statusCodeEqual(t, mdl.RoleNotFound, code)
+				}
+				rs, code := e.AllRoles(token.ID)
+				statusCodeEqual(t, mdl.OK, code)
+				assert.Contains(t, roleNames(rs), r.Name)
+				if i%2 == 0 {
+					statusCodeEqual(t, mdl.RoleDeleted, e.DeleteRole(r))
+					statusCodeEqual(t, mdl.TokenRoleNotFound, e.CheckRole(token.ID, r.Name))
+					statusCodeEqual(t, mdl.TokenInvalidated, e.Invalidate(token.ID))
+				} else {
+					statusCodeEqual(t, mdl.UserDeleted, e.DeleteUser(u))
+					statusCodeEqual(t, mdl.TokenIsInvalid, e.CheckRole(token.ID, r.Name))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, counts[mdl.RoleCreated])
+	assert.Equal(t, workers-1, counts[mdl.RoleAlreadyExisting])
+	assert.Equal(t, 1, counts[mdl.UserCreated])
+	assert.Equal(t, workers-1, counts[mdl.UserAlreadyExisting])
+}
@@ -0,0 +1,106 @@
+package model
+
+import "container/heap"
+
+// This file implements token expiration. Every token partition keeps its
+// tokens in a min-heap by expiration as well, so a sweep only visits the
+// tokens which have expired, and every partition is swept each period.
+
+const (
+	// sweepBatchSize bounds the tokens deleted under one hold of a
+	// partition lock, so that a burst of expirations doesn't block requests.
+	sweepBatchSize = 1024
+	// Tables are shrunk once a quarter of their peak is left, only when
+	// copying them is cheap enough to do under the lock.
+	shrinkMinPeak = 64
+	shrinkMaxLen  = 4 * sweepBatchSize
+)
+
+// tokenHeap is a min-heap of tokens by ExpiredAtInUsec.
+type tokenHeap []*Token
+
+func (h tokenHeap) Len() int           { return len(h) }
+func (h tokenHeap) Less(i, j int) bool { return h[i].ExpiredAtInUsec < h[j].ExpiredAtInUsec }
+func (h tokenHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *tokenHeap) Push(x interface{}) {
+	*h = append(*h, x.(*Token))
+}
+
+func (h *tokenHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return t
+}
+
+// add must hold the lock of pp.
+func (pp *tokenPartition) add(t *Token) {
+	pp.tokens[t.ID] = t
+	heap.Push(&pp.expiry, t)
+	if len(pp.tokens) > pp.peak {
+		pp.peak = len(pp.tokens)
+	}
+}
+
+// deleteExpired deletes at most max tokens expired before nowInUsec, and
+// collects the users of the valid ones into expired. Must hold the lock.
+func (pp *tokenPartition) deleteExpired(nowInUsec int64, max int, expired map[*Token]*User) int {
+	n := 0
+	for n < max && len(pp.expiry) > 0 && pp.expiry[0].ExpiredAtInUsec < nowInUsec {
+		t := heap.Pop(&pp.expiry).(*Token)
+		delete(pp.tokens, t.ID)
+		if t.user != nil {
+			expired[t] = t.user
+		}
+		n++
+	}
+	if n > 0 {
+		pp.shrink()
+	}
+	return n
+}
+
+// shrink reallocates the tables once most of their entries are deleted, as
+// Go maps never give memory back.
+func (pp *tokenPartition) shrink() {
+	if pp.peak < shrinkMinPeak || len(pp.tokens)*4 > pp.peak || len(pp.tokens) > shrinkMaxLen {
+		return
+	}
+	tokens := make(map[string]*Token, len(pp.tokens))
+	for id, t := range pp.tokens {
+		tokens[id] = t
+	}
+	pp.tokens = tokens
+	pp.expiry = append(make(tokenHeap, 0, len(pp.expiry)), pp.expiry...)
+	pp.peak = len(pp.tokens)
+}
+
+// deleteExpiredTokensOf deletes expired tokens of the i-th token partition,
+// returns the number of them.
+func (e *inmemEngine) deleteExpiredTokensOf(i int) int {
+	pp := e.tokens[i]
+	nowInUsec := e.clock.Now().UnixNano() / 1000
+	total := 0
+	for {
+		expired := make(map[*Token]*User)
+		pp.Lock()
+		n := pp.deleteExpired(nowInUsec, sweepBatchSize, expired)
+		pp.Unlock()
+		e.deleteSessions(expired)
+		total += n
+		if n < sweepBatchSize {
+			return total
+		}
+	}
+}
+
+// sweep deletes expired tokens of all partitions.
+func (e *inmemEngine) sweep() int {
+	n := 0
+	for i := range e.tokens {
+		n += e.deleteExpiredTokensOf(i)
+	}
+	return n
+}
@@ -0,0 +1,178 @@
+package model
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEngineForExpiry(t testing.TB, clock *FakeClock, tokenShards int) *inmemEngine {
+	o, err := NewOptions(WithClock(clock), WithTokenShards(tokenShards), WithUserShards(64), WithPasswordHasher(testHasher))
+	assert.Nil(t, err)
+	return newInmemEngine(o)
+}
+
+// addTokens adds n tokens of users expiring randomly within du, without
+// hashing or generating anything.
+func addTokens(e *inmemEngine, users, n int, du time.Duration) {
+	now := e.clock.Now()
+	us := make([]*User, users)
+	for i := range us {
+		us[i] = &User{Name: "u" + strconv.Itoa(i), sessions: make(map[string]*Token)}
+		e.getUserPartition(us[i].Name).users[us[i].Name] = us[i]
+	}
+	for i := 0; i < n; i++ {
+		u := us[i%users]
+		t := &Token{
+			ID:              "t" + strconv.Itoa(i),
+			SessionID:       "s" + strconv.Itoa(i),
+			CreatedAtInUsec: now.UnixNano() / 1000,
+			ExpiredAtInUsec: tokenExpirationInUsecFromTime(now, time.Duration(rand.Int63n(int64(du)))),
+			user:            u,
+		}
+		u.sessions[t.SessionID] = t
+		e.getTokePartition(t.ID).add(t)
+	}
+}
+
+func countTokens(t *testing.T, e *inmemEngine) int {
+	n := 0
+	for _, pp := range e.tokens {
+		assert.Equal(t, len(pp.tokens), len(pp.expiry))
+		n += len(pp.tokens)
+	}
+	return n
+}
+
+func TestSweep(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1600000000, 0))
+	e := newEngineForExpiry(t, clock, 4)
+	addTokens(e, 10, 5000, time.Hour)
+
+	for i := 0; i < 6; i++ {
+		clock.Advance(10 * time.Minute)
+		e.sweep()
+		// Exactly the expired ones are gone, in one sweep
+		nowInUsec := clock.Now().UnixNano() / 1000
+		for _, pp := range e.tokens {
+			for _, v := range pp.tokens {
+				assert.True(t, v.ExpiredAtInUsec >= nowInUsec)
+			}
+			for j := range pp.expiry {
+				assert.True(t, j == 0 || pp.expiry[(j-1)/2].ExpiredAtInUsec <= pp.expiry[j].ExpiredAtInUsec)
+			}
+		}
+		sessions := 0
+		for _, p := range e.users {
+			for _, u := range p.users {
+				sessions += len(u.sessions)
+			}
+		}
+		assert.Equal(t, countTokens(t, e), sessions)
+	}
+	clock.Advance(time.Microsecond)
+	e.sweep()
+	assert.Equal(t, 0, countTokens(t, e))
+	for _, pp := range e.tokens {
+		assert.True(t, pp.peak < shrinkMinPeak, "tables are shrunk")
+	}
+}
+
+func TestSweepBounded(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1600000000, 0))
+	o, err := NewOptions(WithClock(clock), WithTokenTTL(time.Minute), WithSweepInterval(10*time.Millisecond), WithPasswordHasher(testHasher))
+	assert.Nil(t, err)
+	e := newInmemEngine(o)
+	go e.deleteExpiredTokens()
+	defer e.Shutdown()
+
+	statusCodeEqual(t, UserCreated, e.CreateUser(u1))
+	token, code := e.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	clock.Advance(time.Minute + time.Microsecond)
+	// Any of 1024 partitions is swept within the interval
+	assert.Eventually(t, func() bool {
+		return e.Invalidate(token.ID) == TokenNotFound
+	}, time.Second, 10*time.Millisecond)
+}
+
+// BenchmarkSweepNothingExpired is the cost of a sweep of all partitions
+// when no token expires, which used to scan every token.
+func BenchmarkSweepNothingExpired(b *testing.B) {
+	for _, n := range []int{100000, 1000000} {
+		b.Run(fmt.Sprintf("tokens=%d", n), func(b *testing.B) {
+			clock := NewFakeClock(time.Unix(1600000000, 0))
+			e := newEngineForExpiry(b, clock, 1024)
+			addTokens(e, 1000, n, time.Hour)
+			clock.Advance(-time.Second)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				e.sweep()
+			}
+		})
+	}
+}
+
+// BenchmarkSweepLockHold measures the longest hold of a partition lock
+// while a single partition of a million tokens all expire.
+func BenchmarkSweepLockHold(b *testing.B) {
+	const n = 1000000
+	var longest time.Duration
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		clock := NewFakeClock(time.Unix(1600000000, 0))
+		e := newEngineForExpiry(b, clock, 1)
+		addTokens(e, 1000, n, time.Hour)
+		clock.Advance(time.Hour)
+		pp := e.tokens[0]
+		nowInUsec := clock.Now().UnixNano() / 1000
+		b.StartTimer()
+		for {
+			expired := make(map[*Token]*User)
+			start := time.Now()
+			pp.Lock()
+			deleted := pp.deleteExpired(nowInUsec, sweepBatchSize, expired)
+			pp.Unlock()
+			if held := time.Since(start); held > longest {
+				longest = held
+			}
+			e.deleteSessions(expired)
+			if deleted < sweepBatchSize {
+				break
+			}
+		}
+	}
+	b.ReportMetric(float64(longest.Nanoseconds()), "max-lock-ns")
+}
+
+// BenchmarkSweepReclaim reports the heap kept by the token tables after a
+// million tokens expire and are swept.
+func BenchmarkSweepReclaim(b *testing.B) {
+	const n = 1000000
+	var ms runtime.MemStats
+	var before, peak, after uint64
+	for i := 0; i < b.N; i++ {
+		clock := NewFakeClock(time.Unix(1600000000, 0))
+		e := newEngineForExpiry(b, clock, 1024)
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		before = ms.HeapAlloc
+		addTokens(e, 1000, n, time.Hour)
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		peak = ms.HeapAlloc
+		clock.Advance(time.Hour)
+		e.sweep()
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		after = ms.HeapAlloc
+		runtime.KeepAlive(e)
+	}
+	b.ReportMetric(float64(peak-before)/n, "peak-B/token")
+	b.ReportMetric(float64(int64(after)-int64(before))/n, "kept-B/token")
+}
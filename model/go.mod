@@ -2,4 +2,7 @@ module hsbc-hw/model
 
 go 1.15
 
-require github.com/stretchr/testify v1.8.0
+require (
+	github.com/stretchr/testify v1.8.0
+	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa
+)
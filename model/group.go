@@ -0,0 +1,378 @@
+package model
+
+import "sync/atomic"
+
+// This file implements groups. A group has users as members and may be
+// nested in other groups, so that the members of a group are members of
+// all groups it's nested in. Roles granted to a group are granted globally
+// to its members. Like roles, every group keeps its closure, the names of
+// itself and the groups it's nested in and the roles granted to them,
+// which is recomputed on writes so that checks only need the lock of the
+// user. Groups are guarded by the role lock.
+
+type groupClosure struct {
+	groups map[string]struct{}
+	roles  []*Role
+}
+
+func (e *inmemEngine) CreateGroup(g Group) StatusCode {
+	e.rolelock.Lock()
+	defer e.rolelock.Unlock()
+
+	if _, ok := e.groups[g.Name]; ok {
+		return GroupAlreadyExisting
+	}
+	if status := e.checkTenant(g.Name); status != OK {
+		return status
+	}
+	if err := e.record(journalRecord{Op: opCreateGroup, Group: g.Name}); err != nil {
+		return Internal
+	}
+	e.createGroup(&Group{Name: g.Name})
+	return GroupCreated
+}
+
+func (e *inmemEngine) DeleteGroup(g Group) StatusCode {
+	e.rolelock.Lock()
+	cur, ok := e.groups[g.Name]
+	if !ok {
+		e.rolelock.Unlock()
+		return GroupNotFound
+	}
+	if err := e.record(journalRecord{Op: opDeleteGroup, Group: g.Name}); err != nil {
+		e.rolelock.Unlock()
+		return Internal
+	}
+	members := e.deleteGroup(cur)
+	e.rolelock.Unlock()
+
+	// Lock users after the role lock is released to keep the user -> role
+	// order
+	for u := range members {
+		p := e.getUserPartition(u.Name)
+		p.Lock()
+		u.groups = withoutGroup(u.groups, cur)
+		p.Unlock()
+	}
+	return GroupDeleted
+}
+
+func (e *inmemEngine) AddGroupMember(g Group, u User) StatusCode {
+	p := e.getUserPartition(u.Name)
+	p.Lock()
+	defer p.Unlock()
+
+	cur, ok := p.users[u.Name]
+	if !ok {
+		return UserNotFound
+	}
+	e.rolelock.Lock()
+	defer e.rolelock.Unlock()
+	gg, ok := e.groups[g.Name]
+	if !ok {
+		return GroupNotFound
+	}
+	if _, ok := gg.members[cur]; ok {
+		return GroupMemberAlreadyExisting
+	}
+	if err := e.record(journalRecord{Op: opAddGroupMember, Group: g.Name, User: u.Name}); err != nil {
+		return Internal
+	}
+	addGroupMember(gg, cur)
+	return GroupMemberAdded
+}
+
+func (e *inmemEngine) RemoveGroupMember(g Group, u User) StatusCode {
+	p := e.getUserPartition(u.Name)
+	p.Lock()
+	defer p.Unlock()
+
+	cur, ok := p.users[u.Name]
+	if !ok {
+		return UserNotFound
+	}
+	e.rolelock.Lock()
+	defer e.rolelock.Unlock()
+	gg, ok := e.groups[g.Name]
+	if !ok {
+		return GroupNotFound
+	}
+	if _, ok := gg.members[cur]; !ok {
+		return GroupMemberNotFound
+	}
+	if err := e.record(journalRecord{Op: opRemoveGroupMember, Group: g.Name, User: u.Name}); err != nil {
+		return Internal
+	}
+	removeGroupMember(gg, cur)
+	return GroupMemberRemoved
+}
+
+// AddGroupParent nests g in parent.
+func (e *inmemEngine) AddGroupParent(g, parent Group) StatusCode {
+	e.rolelock.Lock()
+	defer e.rolelock.Unlock()
+
+	cur, ok := e.groups[g.Name]
+	pg, ok2 := e.groups[parent.Name]
+	if !ok || !ok2 {
+		return GroupNotFound
+	}
+	if hasGroupParent(cur, pg) {
+		return GroupParentAlreadyExisting
+	}
+	// The parent must not be the group or nested in it
+	if pg.nestedIn(cur.Name) {
+		return GroupCycle
+	}
+	if err := e.record(journalRecord{Op: opAddGroupParent, Group: g.Name, Parent: parent.Name}); err != nil {
+		return Internal
+	}
+	addGroupParent(cur, pg)
+	refreshGroupClosures(cur)
+	return GroupParentAdded
+}
+
+func (e *inmemEngine) RemoveGroupParent(g, parent Group) StatusCode {
+	e.rolelock.Lock()
+	defer e.rolelock.Unlock()
+
+	cur, ok := e.groups[g.Name]
+	pg, ok2 := e.groups[parent.Name]
+	if !ok || !ok2 {
+		return GroupNotFound
+	}
+	if !hasGroupParent(cur, pg) {
+		return GroupParentNotFound
+	}
+	if err := e.record(journalRecord{Op: opRemoveGroupParent, Group: g.Name, Parent: parent.Name}); err != nil {
+		return Internal
+	}
+	removeGroupParent(cur, pg)
+	refreshGroupClosures(cur)
+	return GroupParentRemoved
+}
+
+func (e *inmemEngine) AddGroupRole(g Group, r Role) StatusCode {
+	e.rolelock.Lock()
+	defer e.rolelock.Unlock()
+
+	cur, ok := e.groups[g.Name]
+	if !ok {
+		return GroupNotFound
+	}
+	rr, ok := e.roles[r.Name]
+	if !ok {
+		return RoleNotFound
+	}
+	if _, ok := rr.groups[cur]; ok {
+		return GroupRoleAlreadyExisting
+	}
+	if err := e.record(journalRecord{Op: opAddGroupRole, Group: g.Name, Role: r.Name}); err != nil {
+		return Internal
+	}
+	addGroupRole(cur, rr)
+	return GroupRoleAdded
+}
+
+func (e *inmemEngine) RemoveGroupRole(g Group, r Role) StatusCode {
+	e.rolelock.Lock()
+	defer e.rolelock.Unlock()
+
+	cur, ok := e.groups[g.Name]
+	if !ok {
+		return GroupNotFound
+	}
+	rr, ok := e.roles[r.Name]
+	if !ok {
+		return RoleNotFound
+	}
+	if _, ok := rr.groups[cur]; !ok {
+		return GroupRoleNotFound
+	}
+	if err := e.record(journalRecord{Op: opRemoveGroupRole, Group: g.Name, Role: r.Name}); err != nil {
+		return Internal
+	}
+	removeGroupRole(cur, rr)
+	return GroupRoleRemoved
+}
+
+func (g *Group) loadClosure() *groupClosure {
+	if c, ok := g.closure.Load().(*groupClosure); ok {
+		return c
+	}
+	return &groupClosure{}
+}
+
+// nestedIn reports whether g is or is nested in the group named name.
+func (g *Group) nestedIn(name string) bool {
+	_, ok := g.loadClosure().groups[name]
+	return ok
+}
+
+func (g *Group) isDeleted() bool {
+	return atomic.LoadInt32(&g.deleted) != 0
+}
+
+// createGroup adds g, must hold the lock of roles.
+func (e *inmemEngine) createGroup(g *Group) {
+	e.groups[g.Name] = g
+	refreshGroupClosures(g)
+}
+
+// deleteGroup removes g from groups, the hierarchy and its roles, and
+// returns its members which still refer to it. Must hold the lock of roles.
+func (e *inmemEngine) deleteGroup(g *Group) map[*User]struct{} {
+	// Readers skip the group from now on, before it's removed from users
+	atomic.StoreInt32(&g.deleted, 1)
+	delete(e.groups, g.Name)
+	for _, p := range g.parents {
+		delete(p.children, g)
+	}
+	g.parents = nil
+	for c := range g.children {
+		removeGroupParent(c, g)
+		refreshGroupClosures(c)
+	}
+	g.children = nil
+	for _, r := range g.roles {
+		delete(r.groups, g)
+	}
+	g.roles = nil
+	members := g.members
+	g.members = nil
+	return members
+}
+
+// addGroupMember adds u to g, must hold the locks of u and roles.
+func addGroupMember(g *Group, u *User) {
+	u.groups = append(u.groups, g)
+	if g.members == nil {
+		g.members = make(map[*User]struct{})
+	}
+	g.members[u] = struct{}{}
+}
+
+// removeGroupMember removes u from g, must hold the locks of u and roles.
+func removeGroupMember(g *Group, u *User) {
+	u.groups = withoutGroup(u.groups, g)
+	delete(g.members, u)
+}
+
+// addGroupParent nests g in parent, must hold the lock of roles and
+// refresh the closures of g afterwards.
+func addGroupParent(g, parent *Group) {
+	g.parents = append(g.parents, parent)
+	if parent.children == nil {
+		parent.children = make(map[*Group]struct{})
+	}
+	parent.children[g] = struct{}{}
+}
+
+// removeGroupParent takes g out of parent, must hold the lock of roles and
+// refresh the closures of g afterwards.
+func removeGroupParent(g, parent *Group) {
+	g.parents = withoutGroup(g.parents, parent)
+	delete(parent.children, g)
+}
+
+// hasGroupParent reports whether g is nested in parent directly, must hold
+// the lock of roles.
+func hasGroupParent(g, parent *Group) bool {
+	for _, v := range g.parents {
+		if v == parent {
+			return true
+		}
+	}
+	return false
+}
+
+// addGroupRole grants r to g, must hold the lock of roles.
+func addGroupRole(g *Group, r *Role) {
+	g.roles = append(g.roles, r)
+	if r.groups == nil {
+		r.groups = make(map[*Group]struct{})
+	}
+	r.groups[g] = struct{}{}
+	refreshGroupClosures(g)
+}
+
+// removeGroupRole revokes r from g, must hold the lock of roles.
+func removeGroupRole(g *Group, r *Role) {
+	g.roles = withoutRole(g.roles, r)
+	delete(r.groups, g)
+	refreshGroupClosures(g)
+}
+
+// refreshGroupClosures recomputes the closures of g and the groups nested
+// in it, must hold the lock of roles.
+func refreshGroupClosures(g *Group) {
+	affected := map[*Group]struct{}{}
+	var collect func(*Group)
+	collect = func(v *Group) {
+		if _, ok := affected[v]; ok {
+			return
+		}
+		affected[v] = struct{}{}
+		for c := range v.children {
+			collect(c)
+		}
+	}
+	collect(g)
+
+	computed := make(map[*Group]*groupClosure, len(affected))
+	var compute func(*Group) *groupClosure
+	compute = func(v *Group) *groupClosure {
+		if _, ok := affected[v]; !ok {
+			return v.loadClosure()
+		}
+		if c, ok := computed[v]; ok {
+			return c
+		}
+		c := &groupClosure{groups: map[string]struct{}{v.Name: {}}}
+		seen := make(map[*Role]struct{})
+		add := func(roles []*Role) {
+			for _, r := range roles {
+				if _, ok := seen[r]; !ok {
+					seen[r] = struct{}{}
+					c.roles = append(c.roles, r)
+				}
+			}
+		}
+		add(v.roles)
+		for _, p := range v.parents {
+			pc := compute(p)
+			for name := range pc.groups {
+				c.groups[name] = struct{}{}
+			}
+			add(pc.roles)
+		}
+		computed[v] = c
+		return c
+	}
+	for v := range affected {
+		v.closure.Store(compute(v))
+	}
+}
+
+// groupRoles returns the roles granted to the groups of u, including the
+// groups they are nested in, must hold the lock of u. Deleted roles may be
+// among them.
+func groupRoles(u *User) []*Role {
+	var res []*Role
+	for _, g := range u.groups {
+		if !g.isDeleted() {
+			res = append(res, g.loadClosure().roles...)
+		}
+	}
+	return res
+}
+
+func withoutGroup(groups []*Group, g *Group) []*Group {
+	res := make([]*Group, 0, len(groups))
+	for _, v := range groups {
+		if v != g {
+			res = append(res, v)
+		}
+	}
+	return res
+}
@@ -0,0 +1,244 @@
+package model
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// This file implements role hierarchy. A role may declare parent roles, and
+// a user having a role has all of its ancestors as well. Every role keeps
+// its closure, the names of itself and its ancestors and the permissions
+// granted to them, which is recomputed on writes so that a check is a
+// lookup per role of the user. Closures are never mutated once stored, so
+// readers only need the lock of the user.
+
+type closure struct {
+	roles       map[string]struct{}
+	permissions map[string]struct{}
+	wildcards   []Permission // granted with wildcards
+}
+
+func (r *Role) loadClosure() *closure {
+	if c, ok := r.closure.Load().(*closure); ok {
+		return c
+	}
+	return &closure{}
+}
+
+// ancestors returns the names of r and its ancestors, which must not be
+// modified.
+func (r *Role) ancestors() map[string]struct{} {
+	return r.loadClosure().roles
+}
+
+// allows reports whether r or its ancestors are granted a permission
+// matching name.
+func (r *Role) allows(name string) bool {
+	c := r.loadClosure()
+	if _, ok := c.permissions[name]; ok {
+		return true
+	}
+	for _, w := range c.wildcards {
+		if w.Allows(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// inherits reports whether r is or descends from the role named name.
+func (r *Role) inherits(name string) bool {
+	_, ok := r.ancestors()[name]
+	return ok
+}
+
+// addParent links r to its parent, must hold the lock of roles and refresh
+// the closures of r afterwards.
+func addParent(r, parent *Role) {
+	r.parents = append(r.parents, parent)
+	if parent.children == nil {
+		parent.children = make(map[*Role]struct{})
+	}
+	parent.children[r] = struct{}{}
+}
+
+// removeParent unlinks r from its parent, must hold the lock of roles and
+// refresh the closures of r afterwards.
+func removeParent(r, parent *Role) {
+	res := make([]*Role, 0, len(r.parents))
+	for _, v := range r.parents {
+		if v != parent {
+			res = append(res, v)
+		}
+	}
+	r.parents = res
+	delete(parent.children, r)
+}
+
+// grantPermission grants name to r, must hold the lock of roles.
+func grantPermission(r *Role, name string) {
+	if r.permissions == nil {
+		r.permissions = make(map[string]struct{})
+	}
+	r.permissions[name] = struct{}{}
+	refreshClosures(r)
+}
+
+// hasParent reports whether parent is a direct parent of r, must hold the
+// lock of roles.
+func hasParent(r, parent *Role) bool {
+	for _, v := range r.parents {
+		if v == parent {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshClosures recomputes the closures of r and its descendants, must
+// hold the lock of roles.
+func refreshClosures(r *Role) {
+	affected := map[*Role]struct{}{}
+	var collect func(*Role)
+	collect = func(v *Role) {
+		if _, ok := affected[v]; ok {
+			return
+		}
+		affected[v] = struct{}{}
+		for c := range v.children {
+			collect(c)
+		}
+	}
+	collect(r)
+
+	computed := make(map[*Role]*closure, len(affected))
+	var compute func(*Role) *closure
+	compute = func(v *Role) *closure {
+		if _, ok := affected[v]; !ok {
+			return v.loadClosure()
+		}
+		if c, ok := computed[v]; ok {
+			return c
+		}
+		c := &closure{
+			roles:       map[string]struct{}{v.Name: {}},
+			permissions: make(map[string]struct{}, len(v.permissions)),
+		}
+		for name := range v.permissions {
+			c.permissions[name] = struct{}{}
+		}
+		for _, p := range v.parents {
+			pc := compute(p)
+			for name := range pc.roles {
+				c.roles[name] = struct{}{}
+			}
+			for name := range pc.permissions {
+				c.permissions[name] = struct{}{}
+			}
+		}
+		for name := range c.permissions {
+			if isWildcardPermission(name) {
+				c.wildcards = append(c.wildcards, Permission{Name: name})
+			}
+		}
+		computed[v] = c
+		return c
+	}
+	for v := range affected {
+		v.closure.Store(compute(v))
+	}
+}
+
+// getParents resolves the distinct roles of names, must hold the lock of
+// roles.
+func (e *inmemEngine) getParents(names []string) ([]*Role, StatusCode) {
+	var res []*Role
+	seen := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		r, ok := e.roles[name]
+		if !ok {
+			return nil, RoleNotFound
+		}
+		res = append(res, r)
+	}
+	return res, OK
+}
+
+// createRole adds r inheriting from parents, must hold the lock of roles.
+func (e *inmemEngine) createRole(r *Role, parents []*Role) {
+	e.roles[r.Name] = r
+	for _, p := range parents {
+		addParent(r, p)
+	}
+	refreshClosures(r)
+}
+
+// deleteRole removes r from roles, the hierarchy and groups, and returns
+// its members which still refer to it. Must hold the lock of roles.
+func (e *inmemEngine) deleteRole(r *Role) map[*User]struct{} {
+	// Readers skip the role from now on, before it's removed from users
+	atomic.StoreInt32(&r.deleted, 1)
+	delete(e.roles, r.Name)
+	for _, p := range r.parents {
+		delete(p.children, r)
+	}
+	r.parents = nil
+	for c := range r.children {
+		removeParent(c, r)
+		refreshClosures(c)
+	}
+	r.children = nil
+	for g := range r.groups {
+		g.roles = withoutRole(g.roles, r)
+		refreshGroupClosures(g)
+	}
+	r.groups = nil
+	members := r.members
+	r.members = nil
+	return members
+}
+
+// parentNames returns the names of roles.
+func parentNames(roles []*Role) []string {
+	var res []string
+	for _, r := range roles {
+		res = append(res, r.Name)
+	}
+	return res
+}
+
+// effectiveRoles returns the direct roles of u followed by the inherited
+// ones by name, including the ones granted by groups, must hold the lock
+// of u.
+func effectiveRoles(u *User) []Role {
+	res := make([]Role, 0, len(u.roles))
+	seen := make(map[string]struct{})
+	for _, v := range u.roles {
+		if !v.isDeleted() {
+			res = append(res, Role{Name: v.Name})
+			seen[v.Name] = struct{}{}
+		}
+	}
+	var inherited []string
+	// groupRoles returns a new slice to append to
+	for _, v := range append(groupRoles(u), u.roles...) {
+		if v.isDeleted() {
+			continue
+		}
+		for name := range v.ancestors() {
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				inherited = append(inherited, name)
+			}
+		}
+	}
+	sort.Strings(inherited)
+	for _, name := range inherited {
+		res = append(res, Role{Name: name})
+	}
+	return res
+}
@@ -2,17 +2,16 @@ package model
 
 import (
 	"crypto/md5"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var (
-	userShardSize  uint32 = 1024
-	tokenShardSize uint32 = 1024
-)
-
 type userPartition struct {
 	sync.RWMutex // rw lock for concurrent control
 	users        map[string]*User
@@ -21,6 +20,8 @@ type userPartition struct {
 type tokenPartition struct {
 	sync.RWMutex // rw lock for concurrent control
 	tokens       map[string]*Token
+	expiry       tokenHeap // tokens by expiration
+	peak         int       // max len(tokens) since the last shrink
 }
 
 type inmemEngine struct {
@@ -28,42 +29,172 @@ type inmemEngine struct {
 	users    []*userPartition  // UserName - User
 	tokens   []*tokenPartition // TokenID - User
 	roles    map[string]*Role  // RoleName - Role
+	groups   map[string]*Group // GroupName - Group, guarded by rolelock
 	rolelock sync.RWMutex
 
+	// Tenants other than the default one, the lock is taken after others
+	tenants    map[string]struct{}
+	tenantlock sync.RWMutex
+
+	// For password hashing and token generation, and token expiration,
+	// which may be changed while serving under settingsLock
+	settingsLock sync.RWMutex
+	hasher       PasswordHasher
+	dummyHash    string // by hasher, verified for missing users
+	tokenGen     TokenGenerator
+	tokenTTL     time.Duration
+
 	// For token expiration
-	tokenTTL                   time.Duration
+	clock                      Clock
 	tokenExpirationCheckPeriod time.Duration
 
+	// Sessions of each user, 0 for unlimited
+	maxSessions int
+
+	// Last passwords of each user a new one must differ from, 0 for no check
+	passwordHistory int
+
+	// For persistence, records every mutation before applying it
+	journal func(journalRecord) error
+
 	// Signal to exit back ground routines
 	exitChan chan struct{}
 }
 
 // NewInmemEngine inits a new instance of inmemEngine and start background job
-// to delete expired tokens.
-func NewInmemEngine() AuthenticateAuthorizationEngine {
+// to delete expired tokens. It panics if opts are invalid, which can be
+// checked by NewOptions beforehand.
+func NewInmemEngine(opts ...Option) AuthenticateAuthorizationEngine {
+	o, err := NewOptions(opts...)
+	if err != nil {
+		panic(err)
+	}
+	e := newInmemEngine(o)
+	go e.deleteExpiredTokens()
+	return e
+}
+
+func newInmemEngine(o Options) *inmemEngine {
 	e := &inmemEngine{
-		users:                      make([]*userPartition, userShardSize),
-		tokens:                     make([]*tokenPartition, tokenShardSize),
+		users:                      make([]*userPartition, o.UserShards),
+		tokens:                     make([]*tokenPartition, o.TokenShards),
 		roles:                      make(map[string]*Role),
-		tokenTTL:                   2 * time.Hour,
-		tokenExpirationCheckPeriod: time.Millisecond * 200,
+		groups:                     make(map[string]*Group),
+		tenants:                    make(map[string]struct{}),
+		hasher:                     o.Hasher,
+		dummyHash:                  DummyHash(o.Hasher),
+		tokenGen:                   o.TokenGenerator,
+		clock:                      o.Clock,
+		tokenTTL:                   o.TokenTTL,
+		tokenExpirationCheckPeriod: o.SweepInterval,
+		maxSessions:                o.MaxSessions,
+		passwordHistory:            o.PasswordHistory,
 		exitChan:                   make(chan struct{}),
 	}
-	for i := uint32(0); i < userShardSize; i++ {
+	for i := range e.users {
 		e.users[i] = &userPartition{users: make(map[string]*User)}
 	}
-	for i := uint32(0); i < tokenShardSize; i++ {
+	for i := range e.tokens {
 		e.tokens[i] = &tokenPartition{tokens: make(map[string]*Token)}
 	}
-	go e.deleteExpiredTokens()
 	return e
 }
 
 func (e *inmemEngine) SetTokenTTL(du time.Duration) {
+	e.settingsLock.Lock()
+	defer e.settingsLock.Unlock()
 	e.tokenTTL = du
 }
 
+// SetPasswordHasher changes the hasher for new passwords. Existing hashes
+// are still verified and upgraded on the next successful Authenticate.
+func (e *inmemEngine) SetPasswordHasher(h PasswordHasher) {
+	dummy := DummyHash(h)
+	e.settingsLock.Lock()
+	defer e.settingsLock.Unlock()
+	e.hasher = h
+	e.dummyHash = dummy
+}
+
+// SetTokenGenerator changes the generator of new token IDs.
+func (e *inmemEngine) SetTokenGenerator(g TokenGenerator) {
+	e.settingsLock.Lock()
+	defer e.settingsLock.Unlock()
+	e.tokenGen = g
+}
+
+// passwordHasher returns the hasher for passwords and its dummy hash.
+func (e *inmemEngine) passwordHasher() (PasswordHasher, string) {
+	e.settingsLock.RLock()
+	defer e.settingsLock.RUnlock()
+	return e.hasher, e.dummyHash
+}
+
+// tokenSettings returns the generator and lifetime of new tokens.
+func (e *inmemEngine) tokenSettings() (TokenGenerator, time.Duration) {
+	e.settingsLock.RLock()
+	defer e.settingsLock.RUnlock()
+	return e.tokenGen, e.tokenTTL
+}
+
+func (e *inmemEngine) CreateTenant(t Tenant) StatusCode {
+	if !t.Valid() {
+		return TenantInvalid
+	}
+	e.tenantlock.Lock()
+	defer e.tenantlock.Unlock()
+	if _, ok := e.tenants[t.Name]; ok {
+		return TenantAlreadyExisting
+	}
+	if err := e.record(journalRecord{Op: opCreateTenant, Tenant: t.Name}); err != nil {
+		return Internal
+	}
+	e.tenants[t.Name] = struct{}{}
+	return TenantCreated
+}
+
+// DeleteTenant deletes t with its users, roles and tokens.
+func (e *inmemEngine) DeleteTenant(t Tenant) StatusCode {
+	if !t.Valid() {
+		return TenantInvalid
+	}
+	e.tenantlock.Lock()
+	if _, ok := e.tenants[t.Name]; !ok {
+		e.tenantlock.Unlock()
+		return TenantNotFound
+	}
+	if err := e.record(journalRecord{Op: opDeleteTenant, Tenant: t.Name}); err != nil {
+		e.tenantlock.Unlock()
+		return Internal
+	}
+	delete(e.tenants, t.Name)
+	e.tenantlock.Unlock()
+
+	// Nothing can be created in t any more, so whatever is found below
+	// is all of it
+	e.deleteTenantData(t)
+	return TenantDeleted
+}
+
+func (e *inmemEngine) ListTenants() ([]Tenant, StatusCode) {
+	e.tenantlock.RLock()
+	defer e.tenantlock.RUnlock()
+	res := make([]Tenant, 0, len(e.tenants))
+	for name := range e.tenants {
+		res = append(res, Tenant{Name: name})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, OK
+}
+
 func (e *inmemEngine) CreateUser(u User) StatusCode {
+	// Hash outside of the lock as it's intentionally slow
+	hasher, _ := e.passwordHasher()
+	pwd, err := hasher.Hash(u.Password)
+	if err != nil {
+		return Internal
+	}
+
 	p := e.getUserPartition(u.Name)
 	p.Lock()
 	defer p.Unlock()
@@ -71,30 +202,146 @@ func (e *inmemEngine) CreateUser(u User) StatusCode {
 	if _, ok := p.users[u.Name]; ok {
 		return UserAlreadyExisting
 	}
+	if status := e.checkTenant(u.Name); status != OK {
+		return status
+	}
+	if err := e.record(journalRecord{Op: opCreateUser, User: u.Name, Pwd: pwd}); err != nil {
+		return Internal
+	}
 	p.users[u.Name] = &User{
 		Name:         u.Name,
-		PwdEncrypted: u.PwdEncrypted,
+		PwdEncrypted: pwd,
 	}
 	return UserCreated
 }
 
 func (e *inmemEngine) DeleteUser(u User) StatusCode {
 	p := e.getUserPartition(u.Name)
+	stored, status := e.checkUserPassword(p, u)
+	if status != OK {
+		return status
+	}
+
 	p.Lock()
 	defer p.Unlock()
-
-	if status := e.checkUserPassword(p, u); status != OK {
+	if status := checkPasswordUnchanged(p, u.Name, stored); status != OK {
 		return status
 	}
-	if t := p.users[u.Name].token; t != nil {
-		t.user = nil
-		t.invalid = true
-		p.users[u.Name].token = nil
+	if err := e.record(journalRecord{Op: opDeleteUser, User: u.Name}); err != nil {
+		return Internal
 	}
+	cur := p.users[u.Name]
+	for _, t := range cur.sessions {
+		e.invalidateToken(t)
+	}
+	cur.sessions = nil
 	delete(p.users, u.Name)
+	e.rolelock.Lock()
+	removeMember(cur)
+	e.rolelock.Unlock()
 	return UserDeleted
 }
 
+// GetUser returns u with its global roles in the order granted and its
+// groups sorted by name.
+func (e *inmemEngine) GetUser(u User) (User, StatusCode) {
+	p := e.getUserPartition(u.Name)
+	p.RLock()
+	defer p.RUnlock()
+
+	cur, ok := p.users[u.Name]
+	if !ok {
+		return nilUser, UserNotFound
+	}
+	res := User{Name: cur.Name, MustChangePassword: cur.mustChange}
+	for _, r := range cur.roles {
+		if !r.isDeleted() {
+			res.Roles = append(res.Roles, r.Name)
+		}
+	}
+	for _, g := range cur.groups {
+		if !g.isDeleted() {
+			res.Groups = append(res.Groups, g.Name)
+		}
+	}
+	sort.Strings(res.Groups)
+	return res, OK
+}
+
+// ChangePassword replaces the password of u given by u.Password with
+// password, and revokes all sessions of u.
+func (e *inmemEngine) ChangePassword(u User, password string) StatusCode {
+	hasher, _ := e.passwordHasher()
+	pwd, err := hasher.Hash(password)
+	if err != nil {
+		return Internal
+	}
+	p := e.getUserPartition(u.Name)
+	stored, status := e.checkUserPassword(p, u)
+	if status != OK {
+		return status
+	}
+	if _, status := e.checkPasswordReused(p, u.Name, password); status != OK {
+		return status
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if status := checkPasswordUnchanged(p, u.Name, stored); status != OK {
+		return status
+	}
+	if err := e.setPassword(p.users[u.Name], pwd, false); err != nil {
+		return Internal
+	}
+	return PasswordChanged
+}
+
+// ResetPassword replaces the password of u with the temporary u.Password,
+// which must be changed by ChangePassword before authenticating, and
+// revokes all sessions of u.
+func (e *inmemEngine) ResetPassword(u User) StatusCode {
+	hasher, _ := e.passwordHasher()
+	pwd, err := hasher.Hash(u.Password)
+	if err != nil {
+		return Internal
+	}
+	p := e.getUserPartition(u.Name)
+	for {
+		stored, status := e.checkPasswordReused(p, u.Name, u.Password)
+		if status != OK {
+			return status
+		}
+		if status := e.resetPassword(p, u.Name, stored, pwd); status != Unknown {
+			return status
+		}
+		// The password was changed meanwhile, check the new history
+	}
+}
+
+// resetPassword sets the temporary pwd of the user name if its password is
+// still stored, or returns Unknown.
+func (e *inmemEngine) resetPassword(p *userPartition, name, stored, pwd string) StatusCode {
+	p.Lock()
+	defer p.Unlock()
+	cur, ok := p.users[name]
+	if !ok {
+		return UserNotFound
+	}
+	if cur.PwdEncrypted != stored {
+		return Unknown
+	}
+	if err := e.setPassword(cur, pwd, true); err != nil {
+		return Internal
+	}
+	return PasswordReset
+}
+
+// ListUsers returns the page p of users by name.
+func (e *inmemEngine) ListUsers(p Page) ([]User, string, StatusCode) {
+	names, next := e.listUsers(p, func(*User) bool { return true })
+	return userNames(names), next, OK
+}
+
 func (e *inmemEngine) CreateRole(r Role) StatusCode {
 	e.rolelock.Lock()
 	defer e.rolelock.Unlock()
@@ -102,13 +349,151 @@ func (e *inmemEngine) CreateRole(r Role) StatusCode {
 	if _, ok := e.roles[r.Name]; ok {
 		return RoleAlreadyExisting
 	}
-	e.roles[r.Name] = &Role{
-		Name: r.Name,
+	if status := e.checkTenant(r.Name); status != OK {
+		return status
+	}
+	parents, status := e.getParents(r.Parents)
+	if status != OK {
+		return status
 	}
+	cur := &Role{Name: r.Name}
+	if err := e.record(journalRecord{Op: opCreateRole, Role: r.Name, Parents: parentNames(parents)}); err != nil {
+		return Internal
+	}
+	e.createRole(cur, parents)
 	return RoleCreated
 }
 
 func (e *inmemEngine) DeleteRole(r Role) StatusCode {
+	e.rolelock.Lock()
+	cur, ok := e.roles[r.Name]
+	if !ok {
+		e.rolelock.Unlock()
+		return RoleNotFound
+	}
+	if err := e.record(journalRecord{Op: opDeleteRole, Role: r.Name}); err != nil {
+		e.rolelock.Unlock()
+		return Internal
+	}
+	members := e.deleteRole(cur)
+	e.rolelock.Unlock()
+
+	// Lock users after the role lock is released to keep the user -> role
+	// order
+	for u := range members {
+		p := e.getUserPartition(u.Name)
+		p.Lock()
+		removeRole(u, cur)
+		p.Unlock()
+	}
+	return RoleDeleted
+}
+
+// GetRole returns r with its parents and permissions sorted by name.
+func (e *inmemEngine) GetRole(r Role) (Role, StatusCode) {
+	e.rolelock.RLock()
+	defer e.rolelock.RUnlock()
+
+	cur, ok := e.roles[r.Name]
+	if !ok {
+		return nilRole, RoleNotFound
+	}
+	res := Role{Name: cur.Name, Parents: parentNames(cur.parents)}
+	for p := range cur.permissions {
+		res.Permissions = append(res.Permissions, p)
+	}
+	sort.Strings(res.Parents)
+	sort.Strings(res.Permissions)
+	return res, OK
+}
+
+// ListRoles returns the page p of roles by name. Every page visits all
+// roles, see pageSelector.
+func (e *inmemEngine) ListRoles(p Page) ([]Role, string, StatusCode) {
+	e.rolelock.RLock()
+	s := pageSelector{page: p}
+	for name := range e.roles {
+		if p.Match(name) {
+			s.add(name)
+		}
+	}
+	e.rolelock.RUnlock()
+	names, next := s.cut()
+	res := make([]Role, 0, len(names))
+	for _, name := range names {
+		res = append(res, Role{Name: name})
+	}
+	return res, next, OK
+}
+
+// ListRoleMembers returns the page p of users having r globally, granted to
+// them or their groups, by itself or a role inheriting it, like CheckRole.
+func (e *inmemEngine) ListRoleMembers(r Role, p Page) ([]User, string, StatusCode) {
+	e.rolelock.RLock()
+	_, ok := e.roles[r.Name]
+	e.rolelock.RUnlock()
+	if !ok {
+		return nil, "", RoleNotFound
+	}
+	names, next := e.listUsers(p, func(u *User) bool {
+		for _, v := range append(groupRoles(u), u.roles...) {
+			if !v.isDeleted() && v.inherits(r.Name) {
+				return true
+			}
+		}
+		return false
+	})
+	return userNames(names), next, OK
+}
+
+func (e *inmemEngine) AddRoleParent(r, parent Role) StatusCode {
+	e.rolelock.Lock()
+	defer e.rolelock.Unlock()
+
+	cur, ok := e.roles[r.Name]
+	pr, ok2 := e.roles[parent.Name]
+	if !ok || !ok2 {
+		return RoleNotFound
+	}
+	if hasParent(cur, pr) {
+		return RoleParentAlreadyExisting
+	}
+	// The parent must not be the role or one of its descendants
+	if pr.inherits(cur.Name) {
+		return RoleCycle
+	}
+	if err := e.record(journalRecord{Op: opAddRoleParent, Role: r.Name, Parent: parent.Name}); err != nil {
+		return Internal
+	}
+	addParent(cur, pr)
+	refreshClosures(cur)
+	return RoleParentAdded
+}
+
+func (e *inmemEngine) RemoveRoleParent(r, parent Role) StatusCode {
+	e.rolelock.Lock()
+	defer e.rolelock.Unlock()
+
+	cur, ok := e.roles[r.Name]
+	pr, ok2 := e.roles[parent.Name]
+	if !ok || !ok2 {
+		return RoleNotFound
+	}
+	if !hasParent(cur, pr) {
+		return RoleParentNotFound
+	}
+	if err := e.record(journalRecord{Op: opRemoveRoleParent, Role: r.Name, Parent: parent.Name}); err != nil {
+		return Internal
+	}
+	removeParent(cur, pr)
+	refreshClosures(cur)
+	return RoleParentRemoved
+}
+
+func (e *inmemEngine) GrantPermission(r Role, p Permission) StatusCode {
+	if !p.Valid() {
+		return PermissionInvalid
+	}
 	e.rolelock.Lock()
 	defer e.rolelock.Unlock()
 
@@ -116,12 +501,43 @@ func (e *inmemEngine) DeleteRole(r Role) StatusCode {
 	if !ok {
 		return RoleNotFound
 	}
-	cur.deleted = true
-	delete(e.roles, r.Name)
-	return RoleDeleted
+	if _, ok := cur.permissions[p.Name]; ok {
+		return PermissionAlreadyGranted
+	}
+	if err := e.record(journalRecord{Op: opGrantPermission, Role: r.Name, Permission: p.Name}); err != nil {
+		return Internal
+	}
+	grantPermission(cur, p.Name)
+	return PermissionGranted
+}
+
+func (e *inmemEngine) RevokePermission(r Role, p Permission) StatusCode {
+	e.rolelock.Lock()
+	defer e.rolelock.Unlock()
+
+	cur, ok := e.roles[r.Name]
+	if !ok {
+		return RoleNotFound
+	}
+	if _, ok := cur.permissions[p.Name]; !ok {
+		return PermissionNotGranted
+	}
+	if err := e.record(journalRecord{Op: opRevokePermission, Role: r.Name, Permission: p.Name}); err != nil {
+		return Internal
+	}
+	delete(cur.permissions, p.Name)
+	refreshClosures(cur)
+	return PermissionRevoked
 }
 
 func (e *inmemEngine) AddUserRole(u User, r Role) StatusCode {
+	return e.AddUserRoleOn(u, r, Resource{})
+}
+
+func (e *inmemEngine) AddUserRoleOn(u User, r Role, res Resource) StatusCode {
+	if !res.Valid() {
+		return ResourceInvalid
+	}
 	p := e.getUserPartition(u.Name)
 	p.Lock()
 	defer p.Unlock()
@@ -130,89 +546,335 @@ func (e *inmemEngine) AddUserRole(u User, r Role) StatusCode {
 	if !ok {
 		return UserNotFound
 	}
-	if checkUserRole(r, p.users[u.Name]) {
+	if checkUserRole(r, cur, res.Path) {
 		return UserRoleAlreadyExisting
 	}
-	e.rolelock.RLock()
-	defer e.rolelock.RUnlock()
+	e.rolelock.Lock()
+	defer e.rolelock.Unlock()
 	rr, ok := e.roles[r.Name]
 	if !ok {
 		return RoleNotFound
 	}
-	cur.roles = append(cur.roles, rr)
+	if err := e.record(journalRecord{Op: opAddUserRole, User: u.Name, Role: r.Name, Resource: res.Path}); err != nil {
+		return Internal
+	}
+	addMember(cur, rr, res.Path)
 	return UserRoleAdded
 }
 
-func (e *inmemEngine) Authenticate(u User) (Token, StatusCode) {
+func (e *inmemEngine) RemoveUserRole(u User, r Role) StatusCode {
+	return e.RemoveUserRoleOn(u, r, Resource{})
+}
+
+func (e *inmemEngine) RemoveUserRoleOn(u User, r Role, res Resource) StatusCode {
+	if !res.Valid() {
+		return ResourceInvalid
+	}
 	p := e.getUserPartition(u.Name)
 	p.Lock()
 	defer p.Unlock()
 
-	if status := e.checkUserPassword(p, u); status != OK {
+	cur, ok := p.users[u.Name]
+	if !ok {
+		return UserNotFound
+	}
+	e.rolelock.Lock()
+	defer e.rolelock.Unlock()
+	rr, ok := e.roles[r.Name]
+	if !ok {
+		return RoleNotFound
+	}
+	if !hasBinding(cur, rr, res.Path) {
+		return UserRoleNotFound
+	}
+	if err := e.record(journalRecord{Op: opRemoveUserRole, User: u.Name, Role: r.Name, Resource: res.Path}); err != nil {
+		return Internal
+	}
+	unbind(cur, rr, res.Path)
+	return UserRoleRemoved
+}
+
+func (e *inmemEngine) Authenticate(u User, info SessionInfo) (Token, StatusCode) {
+	p := e.getUserPartition(u.Name)
+	stored, status := e.checkUserPassword(p, u)
+	if status != OK {
+		return nilToken, status
+	}
+	hasher, _ := e.passwordHasher()
+	rehashed := ""
+	if hasher.NeedsRehash(stored) {
+		// Failing to upgrade the hash should not fail the login
+		rehashed, _ = hasher.Hash(u.Password)
+	}
+	tokenGen, tokenTTL := e.tokenSettings()
+	id, err := tokenGen.Generate()
+	if err != nil {
+		return nilToken, Internal
+	}
+	sid, err := generateSessionID()
+	if err != nil {
+		return nilToken, Internal
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if status := checkPasswordUnchanged(p, u.Name, stored); status != OK {
 		return nilToken, status
 	}
 	cur := p.users[u.Name]
-	if cur.token != nil && !cur.token.invalid {
-		// Extend the expiration of token
-		cur.token.ExpiredAtInUsec = tokenExpirationInUsecFromTime(time.Now(), e.tokenTTL)
-		return Token{ID: cur.token.ID}, TokenRenewed
-	}
-	cur.token = &Token{
-		ID:              generateToken(u.Name, u.PwdEncrypted, time.Now()),
-		ExpiredAtInUsec: tokenExpirationInUsecFromTime(time.Now(), e.tokenTTL),
-		user:            cur,
+	if cur.mustChange {
+		return nilToken, PasswordChangeRequired
+	}
+	now := e.clock.Now()
+	if status := e.evictSessions(cur, now); status != OK {
+		return nilToken, status
 	}
 
-	pp := e.getTokePartition(cur.token.ID)
+	key := tokenKey(id)
+	pp := e.getTokePartition(key)
 	pp.Lock()
 	defer pp.Unlock()
-	pp.tokens[cur.token.ID] = cur.token
-	return Token{ID: cur.token.ID, ExpiredAtInUsec: cur.token.ExpiredAtInUsec}, TokenCreated
+	if _, ok := pp.tokens[key]; ok {
+		// Never hand out a token owned by someone else
+		return nilToken, Internal
+	}
+	token := &Token{
+		ID:              key,
+		SessionID:       sid,
+		CreatedAtInUsec: now.UnixNano() / 1000,
+		ExpiredAtInUsec: tokenExpirationInUsecFromTime(now, tokenTTL),
+		Info:            info,
+		Tenant:          TenantOf(cur.Name).Name,
+		user:            cur,
+	}
+	if err := e.record(journalRecord{Op: opCreateSession, User: u.Name, Pwd: rehashed, Session: newSessionRecord(token)}); err != nil {
+		return nilToken, Internal
+	}
+	if rehashed != "" {
+		cur.PwdEncrypted = rehashed
+	}
+	if cur.sessions == nil {
+		cur.sessions = make(map[string]*Token)
+	}
+	cur.sessions[sid] = token
+	pp.add(token)
+	res := token.public()
+	res.ID = id
+	return res, TokenCreated
 }
 
 func (e *inmemEngine) Invalidate(t string) StatusCode {
-	pp := e.getTokePartition(t)
+	key := tokenKey(t)
+	pp := e.getTokePartition(key)
 	pp.Lock()
-	defer pp.Unlock()
-
-	token, status := getValidToken(pp, t)
+	token, status := e.getValidToken(pp, key)
 	if token == nil {
+		pp.Unlock()
 		return status
 	}
+	u := token.user
+	if err := e.record(journalRecord{Op: opRevokeSession, User: u.Name, SessionID: token.SessionID}); err != nil {
+		pp.Unlock()
+		return Internal
+	}
 	token.invalid = true
 	token.user = nil
+	pp.Unlock()
+
+	// Lock users after tokens are released to keep the user -> token order
+	p := e.getUserPartition(u.Name)
+	p.Lock()
+	defer p.Unlock()
+	if u.sessions[token.SessionID] == token {
+		delete(u.sessions, token.SessionID)
+	}
 	return TokenInvalidated
 }
 
+func (e *inmemEngine) ListSessions(t string) ([]Token, StatusCode) {
+	u, status := e.getTokenUser(t)
+	if u == nil {
+		return nil, status
+	}
+	p := e.getUserPartition(u.Name)
+	p.RLock()
+	defer p.RUnlock()
+	if p.users[u.Name] != u {
+		return nil, TokenIsInvalid
+	}
+
+	now := e.clock.Now()
+	res := make([]Token, 0, len(u.sessions))
+	for _, v := range u.sessions {
+		if !expiredByTime(v.ExpiredAtInUsec, now) {
+			res = append(res, v.public())
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].CreatedAtInUsec != res[j].CreatedAtInUsec {
+			return res[i].CreatedAtInUsec < res[j].CreatedAtInUsec
+		}
+		return res[i].SessionID < res[j].SessionID
+	})
+	return res, OK
+}
+
+func (e *inmemEngine) RevokeSession(t, sessionID string) StatusCode {
+	u, status := e.getTokenUser(t)
+	if u == nil {
+		return status
+	}
+	p := e.getUserPartition(u.Name)
+	p.Lock()
+	defer p.Unlock()
+	if p.users[u.Name] != u {
+		return TokenIsInvalid
+	}
+
+	session, ok := u.sessions[sessionID]
+	if !ok {
+		return SessionNotFound
+	}
+	if err := e.record(journalRecord{Op: opRevokeSession, User: u.Name, SessionID: sessionID}); err != nil {
+		return Internal
+	}
+	e.invalidateToken(session)
+	delete(u.sessions, sessionID)
+	return SessionRevoked
+}
+
+func (e *inmemEngine) RevokeAllSessions(t string) StatusCode {
+	u, status := e.getTokenUser(t)
+	if u == nil {
+		return status
+	}
+	p := e.getUserPartition(u.Name)
+	p.Lock()
+	defer p.Unlock()
+	if p.users[u.Name] != u {
+		return TokenIsInvalid
+	}
+
+	if err := e.record(journalRecord{Op: opRevokeAllSessions, User: u.Name}); err != nil {
+		return Internal
+	}
+	for _, session := range u.sessions {
+		e.invalidateToken(session)
+	}
+	u.sessions = nil
+	return SessionRevoked
+}
+
 func (e *inmemEngine) CheckRole(t, r string) StatusCode {
-	pp := e.getTokePartition(t)
-	pp.RLock()
-	defer pp.RUnlock()
+	return e.CheckRoleOn(t, r, Resource{})
+}
 
-	token, status := getValidToken(pp, t)
-	if token == nil {
+// CheckRoleOn checks the user of t is bound to r, or one of its
+// descendants, on res or any resource above it, or granted it by a group.
+func (e *inmemEngine) CheckRoleOn(t, r string, res Resource) StatusCode {
+	if !res.Valid() {
+		return ResourceInvalid
+	}
+	u, status := e.getTokenUser(t)
+	if u == nil {
 		return status
 	}
+	p := e.getUserPartition(u.Name)
+	p.RLock()
+	defer p.RUnlock()
+	if p.users[u.Name] != u {
+		return TokenIsInvalid
+	}
 
-	if checkUserRole(Role{Name: r}, token.user) {
-		return TokenRoleOK
+	for _, scope := range res.Scopes() {
+		for _, v := range u.bindings(scope) {
+			if !v.isDeleted() && v.inherits(r) {
+				return TokenRoleOK
+			}
+		}
+	}
+	for _, v := range groupRoles(u) {
+		if !v.isDeleted() && v.inherits(r) {
+			return TokenRoleOK
+		}
 	}
 	return TokenRoleNotFound
 }
 
+func (e *inmemEngine) CheckPermission(t, perm string) StatusCode {
+	u, status := e.getTokenUser(t)
+	if u == nil {
+		return status
+	}
+	p := e.getUserPartition(u.Name)
+	p.RLock()
+	defer p.RUnlock()
+	if p.users[u.Name] != u {
+		return TokenIsInvalid
+	}
+
+	for _, v := range u.roles {
+		if !v.isDeleted() && v.allows(perm) {
+			return TokenPermissionOK
+		}
+	}
+	for _, v := range groupRoles(u) {
+		if !v.isDeleted() && v.allows(perm) {
+			return TokenPermissionOK
+		}
+	}
+	return TokenPermissionNotFound
+}
+
+// TokenUser returns the user of t, with only the name set.
+func (e *inmemEngine) TokenUser(t string) (User, StatusCode) {
+	u, status := e.getTokenUser(t)
+	if u == nil {
+		return User{}, status
+	}
+	p := e.getUserPartition(u.Name)
+	p.RLock()
+	defer p.RUnlock()
+	if p.users[u.Name] != u {
+		return User{}, TokenIsInvalid
+	}
+	return User{Name: u.Name}, OK
+}
+
+// AllRoles returns the effective roles of the user of t, the direct ones
+// followed by the inherited ones, including the ones granted by groups.
 func (e *inmemEngine) AllRoles(t string) ([]Role, StatusCode) {
-	pp := e.getTokePartition(t)
-	pp.RLock()
-	defer pp.RUnlock()
+	u, status := e.getTokenUser(t)
+	if u == nil {
+		return nil, status
+	}
+	p := e.getUserPartition(u.Name)
+	p.RLock()
+	defer p.RUnlock()
+	if p.users[u.Name] != u {
+		return nil, TokenIsInvalid
+	}
+	return effectiveRoles(u), OK
+}
 
-	token, status := getValidToken(pp, t)
-	if token == nil {
+// DirectRoles returns the roles granted to the user of t by AddUserRole.
+func (e *inmemEngine) DirectRoles(t string) ([]Role, StatusCode) {
+	u, status := e.getTokenUser(t)
+	if u == nil {
 		return nil, status
 	}
-	deleteInvalidRoles(token.user)
-	res := make([]Role, 0, len(token.user.roles))
-	for _, v := range token.user.roles {
-		res = append(res, Role{Name: v.Name})
+	p := e.getUserPartition(u.Name)
+	p.RLock()
+	defer p.RUnlock()
+	if p.users[u.Name] != u {
+		return nil, TokenIsInvalid
+	}
+
+	res := make([]Role, 0, len(u.roles))
+	for _, v := range u.roles {
+		if !v.isDeleted() {
+			res = append(res, Role{Name: v.Name})
+		}
 	}
 	return res, OK
 }
@@ -221,25 +883,13 @@ func (e *inmemEngine) Shutdown() {
 	close(e.exitChan)
 }
 
-//
 // lower level funcs
-//
 func (e *inmemEngine) deleteExpiredTokens() {
 	t := time.NewTicker(e.tokenExpirationCheckPeriod)
-	tokenShardIndex := 0
 	for {
 		select {
 		case <-t.C:
-			pp := e.tokens[tokenShardIndex]
-			pp.Lock()
-			nowInUsec := time.Now().UnixNano() / 1000
-			for id, v := range pp.tokens {
-				if v.ExpiredAtInUsec < nowInUsec {
-					delete(pp.tokens, id)
-				}
-			}
-			pp.Unlock()
-			tokenShardIndex = (tokenShardIndex + 1) % int(tokenShardSize)
+			e.sweep()
 		case <-e.exitChan:
 			t.Stop()
 			return
@@ -247,31 +897,297 @@ func (e *inmemEngine) deleteExpiredTokens() {
 	}
 }
 
+func (e *inmemEngine) record(r journalRecord) error {
+	if e.journal == nil {
+		return nil
+	}
+	return e.journal(r)
+}
+
+// deleteSessions removes expired tokens from the sessions of their users.
+func (e *inmemEngine) deleteSessions(tokens map[*Token]*User) {
+	for t, u := range tokens {
+		p := e.getUserPartition(u.Name)
+		p.Lock()
+		if u.sessions[t.SessionID] == t {
+			delete(u.sessions, t.SessionID)
+			if len(u.sessions) == 0 {
+				// Give the memory of the map back
+				u.sessions = nil
+			}
+		}
+		p.Unlock()
+	}
+}
+
+// invalidateToken marks a session token invalid, must be called with the
+// user partition of the token locked.
+func (e *inmemEngine) invalidateToken(t *Token) {
+	pp := e.getTokePartition(t.ID)
+	pp.Lock()
+	defer pp.Unlock()
+	t.invalid = true
+	t.user = nil
+}
+
+// setPassword replaces the password hash of u, and revokes all sessions of
+// u, must hold the lock of u.
+func (e *inmemEngine) setPassword(u *User, pwd string, temporary bool) error {
+	if err := e.record(journalRecord{Op: opSetPassword, User: u.Name, Pwd: pwd, Temporary: temporary}); err != nil {
+		return err
+	}
+	u.history = pushHistory(u.history, u.PwdEncrypted, e.passwordHistory-1)
+	u.PwdEncrypted = pwd
+	u.mustChange = temporary
+	for _, t := range u.sessions {
+		e.invalidateToken(t)
+	}
+	u.sessions = nil
+	return nil
+}
+
+// pushHistory returns history with pwd prepended, the latest n hashes.
+func pushHistory(history []string, pwd string, n int) []string {
+	if n <= 0 {
+		return nil
+	}
+	res := append([]string{pwd}, history...)
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// evictSessions revokes the oldest sessions of u to make room for a new one
+// under maxSessions, must hold the lock of u.
+func (e *inmemEngine) evictSessions(u *User, now time.Time) StatusCode {
+	if e.maxSessions == 0 {
+		return OK
+	}
+	active := make([]*Token, 0, len(u.sessions))
+	for _, v := range u.sessions {
+		if !expiredByTime(v.ExpiredAtInUsec, now) {
+			active = append(active, v)
+		}
+	}
+	if len(active) < e.maxSessions {
+		return OK
+	}
+	sort.Slice(active, func(i, j int) bool {
+		if active[i].CreatedAtInUsec != active[j].CreatedAtInUsec {
+			return active[i].CreatedAtInUsec < active[j].CreatedAtInUsec
+		}
+		return active[i].SessionID < active[j].SessionID
+	})
+	for _, v := range active[:len(active)-e.maxSessions+1] {
+		if err := e.record(journalRecord{Op: opRevokeSession, User: u.Name, SessionID: v.SessionID}); err != nil {
+			return Internal
+		}
+		e.invalidateToken(v)
+		delete(u.sessions, v.SessionID)
+	}
+	return OK
+}
+
+// checkTenant checks the tenant of the qualified name exists, it must be
+// called under the lock of the user partition or the role lock, so that
+// DeleteTenant finds whatever is created.
+func (e *inmemEngine) checkTenant(name string) StatusCode {
+	t := TenantOf(name)
+	if t.IsDefault() {
+		return OK
+	}
+	e.tenantlock.RLock()
+	defer e.tenantlock.RUnlock()
+	if _, ok := e.tenants[t.Name]; !ok {
+		return TenantNotFound
+	}
+	return OK
+}
+
+// deleteTenantData deletes the users, roles and groups of t.
+func (e *inmemEngine) deleteTenantData(t Tenant) {
+	prefix := t.Prefix()
+	for _, p := range e.users {
+		p.Lock()
+		for name, u := range p.users {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			for _, tok := range u.sessions {
+				e.invalidateToken(tok)
+			}
+			u.sessions = nil
+			delete(p.users, name)
+			e.rolelock.Lock()
+			removeMember(u)
+			e.rolelock.Unlock()
+		}
+		p.Unlock()
+	}
+
+	e.rolelock.Lock()
+	members := make(map[*User][]*Role)
+	for name, r := range e.roles {
+		if strings.HasPrefix(name, prefix) {
+			for u := range e.deleteRole(r) {
+				members[u] = append(members[u], r)
+			}
+		}
+	}
+	groupMembers := make(map[*User][]*Group)
+	for name, g := range e.groups {
+		if strings.HasPrefix(name, prefix) {
+			for u := range e.deleteGroup(g) {
+				groupMembers[u] = append(groupMembers[u], g)
+			}
+		}
+	}
+	e.rolelock.Unlock()
+	// Only users of other tenants are left, given the roles and groups by
+	// the engine rather than a view
+	for u, roles := range members {
+		p := e.getUserPartition(u.Name)
+		p.Lock()
+		for _, r := range roles {
+			removeRole(u, r)
+		}
+		p.Unlock()
+	}
+	for u, groups := range groupMembers {
+		p := e.getUserPartition(u.Name)
+		p.Lock()
+		for _, g := range groups {
+			u.groups = withoutGroup(u.groups, g)
+		}
+		p.Unlock()
+	}
+}
+
+// getTokenUser returns the user of a valid token.
+func (e *inmemEngine) getTokenUser(t string) (*User, StatusCode) {
+	key := tokenKey(t)
+	pp := e.getTokePartition(key)
+	pp.RLock()
+	defer pp.RUnlock()
+
+	token, status := e.getValidToken(pp, key)
+	if token == nil {
+		return nil, status
+	}
+	return token.user, OK
+}
+
+// listUsers returns the page p of the names of users matching keep, which
+// is called under the lock of their partitions, across all partitions.
+// Users are kept by hash, so every page visits all users, see pageSelector.
+func (e *inmemEngine) listUsers(p Page, keep func(*User) bool) ([]string, string) {
+	s := pageSelector{page: p}
+	for _, part := range e.users {
+		part.RLock()
+		for name, u := range part.users {
+			if p.Match(name) && keep(u) {
+				s.add(name)
+			}
+		}
+		part.RUnlock()
+	}
+	return s.cut()
+}
+
+func userNames(names []string) []User {
+	res := make([]User, 0, len(names))
+	for _, name := range names {
+		res = append(res, User{Name: name})
+	}
+	return res
+}
+
 func (e *inmemEngine) getUserPartition(name string) *userPartition {
-	return e.users[hashStringToInt32(name)%tokenShardSize]
+	return e.users[hashStringToInt32(name)%uint32(len(e.users))]
 }
 
-func (e *inmemEngine) getTokePartition(token string) *tokenPartition {
-	return e.tokens[hashStringToInt32(token)%tokenShardSize]
+// getTokePartition returns the partition of a token by its key, see
+// tokenKey.
+func (e *inmemEngine) getTokePartition(key string) *tokenPartition {
+	return e.tokens[hashStringToInt32(key)%uint32(len(e.tokens))]
 }
 
-func (e *inmemEngine) checkUserPassword(p *userPartition, u User) StatusCode {
+// checkUserPassword verifies the password of u without holding the lock of
+// p during the slow hashing, and returns the verified password hash.
+func (e *inmemEngine) checkUserPassword(p *userPartition, u User) (string, StatusCode) {
+	p.RLock()
 	cur, ok := p.users[u.Name]
+	stored := ""
+	if ok {
+		stored = cur.PwdEncrypted
+	}
+	p.RUnlock()
+
+	hasher, dummyHash := e.passwordHasher()
+	if !ok {
+		hasher.Verify(u.Password, dummyHash)
+		return "", UserNotFound
+	}
+	matched, err := hasher.Verify(u.Password, stored)
+	if err != nil {
+		return "", Internal
+	}
+	if !matched {
+		return "", UserPasswordNotMatch
+	}
+	return stored, OK
+}
+
+// checkPasswordReused verifies password against the last passwords of the
+// user name up to passwordHistory, and returns its current password hash.
+func (e *inmemEngine) checkPasswordReused(p *userPartition, name, password string) (string, StatusCode) {
+	p.RLock()
+	cur, ok := p.users[name]
+	var hashes []string
+	if ok {
+		hashes = append([]string{cur.PwdEncrypted}, cur.history...)
+	}
+	p.RUnlock()
+
+	if !ok {
+		return "", UserNotFound
+	}
+	if e.passwordHistory > 0 {
+		hasher, _ := e.passwordHasher()
+		for _, h := range hashes {
+			matched, err := hasher.Verify(password, h)
+			if err != nil {
+				return "", Internal
+			}
+			if matched {
+				return "", PasswordReused
+			}
+		}
+	}
+	return hashes[0], OK
+}
+
+// checkPasswordUnchanged makes sure the user verified by checkUserPassword
+// is still there with the same password, must be called with p locked.
+func checkPasswordUnchanged(p *userPartition, name, stored string) StatusCode {
+	cur, ok := p.users[name]
 	if !ok {
 		return UserNotFound
 	}
-	if cur.PwdEncrypted != u.PwdEncrypted {
+	if cur.PwdEncrypted != stored {
 		return UserPasswordNotMatch
 	}
 	return OK
 }
 
-func getValidToken(pp *tokenPartition, t string) (*Token, StatusCode) {
-	token, ok := pp.tokens[t]
+// getValidToken returns the valid token of pp by its key, see tokenKey.
+func (e *inmemEngine) getValidToken(pp *tokenPartition, key string) (*Token, StatusCode) {
+	token, ok := pp.tokens[key]
 	if !ok {
 		return nil, TokenNotFound
 	}
-	if expiredByTime(token.ExpiredAtInUsec, time.Now()) {
+	if expiredByTime(token.ExpiredAtInUsec, e.clock.Now()) {
 		return nil, TokenExpired
 	}
 	if token.invalid || token.user == nil {
@@ -280,33 +1196,114 @@ func getValidToken(pp *tokenPartition, t string) (*Token, StatusCode) {
 	return token, OK
 }
 
-func deleteInvalidRoles(u *User) {
-	if u == nil {
+// bindings returns the roles of u bound on the resource of path scope, must
+// hold the lock of u.
+func (u *User) bindings(scope string) []*Role {
+	if scope == "" {
+		return u.roles
+	}
+	return u.scoped[scope]
+}
+
+func (u *User) setBindings(scope string, roles []*Role) {
+	if scope == "" {
+		u.roles = roles
 		return
 	}
-	res := make([]*Role, 0, len(u.roles))
-	for i := 0; i < len(u.roles); i++ {
-		if !u.roles[i].deleted {
-			res = append(res, u.roles[i])
-		}
+	if len(roles) == 0 {
+		delete(u.scoped, scope)
+		return
 	}
-	u.roles = res
-	return
+	if u.scoped == nil {
+		u.scoped = make(map[string][]*Role)
+	}
+	u.scoped[scope] = roles
 }
 
-func checkUserRole(r Role, u *User) bool {
-	if u == nil {
-		return false
+// checkUserRole must hold the lock of u.
+func checkUserRole(r Role, u *User, scope string) bool {
+	for _, v := range u.bindings(scope) {
+		if v.Name == r.Name && !v.isDeleted() {
+			return true
+		}
 	}
-	deleteInvalidRoles(u)
-	for _, v := range u.roles {
-		if v.Name == r.Name && !v.deleted {
+	return false
+}
+
+// hasBinding reports whether r is bound to u on scope, must hold the lock
+// of u.
+func hasBinding(u *User, r *Role, scope string) bool {
+	for _, v := range u.bindings(scope) {
+		if v == r {
 			return true
 		}
 	}
 	return false
 }
 
+// addMember grants r to u on scope, must hold the locks of u and roles.
+func addMember(u *User, r *Role, scope string) {
+	u.setBindings(scope, append(u.bindings(scope), r))
+	if r.members == nil {
+		r.members = make(map[*User]struct{})
+	}
+	r.members[u] = struct{}{}
+}
+
+// unbind revokes r from u on scope, and drops u from the members of r once
+// it's bound nowhere. Must hold the locks of u and roles.
+func unbind(u *User, r *Role, scope string) {
+	u.setBindings(scope, withoutRole(u.bindings(scope), r))
+	if hasBinding(u, r, "") {
+		return
+	}
+	for s := range u.scoped {
+		if hasBinding(u, r, s) {
+			return
+		}
+	}
+	delete(r.members, u)
+}
+
+// removeMember drops deleted u from the members of its roles and groups,
+// must hold the locks of u and roles.
+func removeMember(u *User) {
+	for _, g := range u.groups {
+		delete(g.members, u)
+	}
+	for _, r := range u.roles {
+		delete(r.members, u)
+	}
+	for _, roles := range u.scoped {
+		for _, r := range roles {
+			delete(r.members, u)
+		}
+	}
+}
+
+// removeRole drops deleted r from the roles of u on all resources, must
+// hold the lock of u.
+func removeRole(u *User, r *Role) {
+	u.roles = withoutRole(u.roles, r)
+	for s, roles := range u.scoped {
+		u.setBindings(s, withoutRole(roles, r))
+	}
+}
+
+func withoutRole(roles []*Role, r *Role) []*Role {
+	res := make([]*Role, 0, len(roles))
+	for _, v := range roles {
+		if v != r {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func (r *Role) isDeleted() bool {
+	return atomic.LoadInt32(&r.deleted) != 0
+}
+
 func tokenExpirationInUsecFromTime(t time.Time, du time.Duration) int64 {
 	return t.Add(du).UnixNano() / 1000
 }
@@ -322,12 +1319,10 @@ func hashStringToInt32(s string) uint32 {
 	return binary.BigEndian.Uint32(b)
 }
 
-func generateToken(name, pwd string, t time.Time) string {
-	b := make([]byte, 8)
-	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
-	h := md5.New()
-	h.Write([]byte(name))
-	h.Write([]byte(pwd))
-	h.Write(b)
-	return base64.URLEncoding.EncodeToString(h.Sum(nil))
+func generateSessionID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
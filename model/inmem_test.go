@@ -8,9 +8,9 @@ import (
 )
 
 var (
-	u1               = User{Name: "u1", PwdEncrypted: "xxxx"}
-	u12              = User{Name: "u1", PwdEncrypted: "yyyy"}
-	u2               = User{Name: "u2", PwdEncrypted: "zzzz"}
+	u1               = User{Name: "u1", Password: "xxxx"}
+	u12              = User{Name: "u1", Password: "yyyy"}
+	u2               = User{Name: "u2", Password: "zzzz"}
 	r1               = Role{Name: "r1"}
 	r2               = Role{Name: "r2"}
 	r3               = Role{Name: "r3"}
@@ -22,12 +22,6 @@ func statusCodeEqual(t *testing.T, expected, actual StatusCode) {
 	assert.Equal(t, expected.String(), actual.String())
 }
 
-func TestTokenGenerator(t *testing.T) {
-	tt, _ := time.Parse(time.RFC3339, "2022-08-06T15:04:05Z07:00")
-	token := generateToken("__test_user__", "__pass_word__", tt)
-	assert.Equal(t, "ITnCejjs1pXtVDpI-6eDfw==", token)
-}
-
 func TestUserBasic(t *testing.T) {
 	e := NewInmemEngine()
 	statusCodeEqual(t, UserCreated, e.CreateUser(u1))
@@ -59,14 +53,87 @@ func TestAuthenticate(t *testing.T) {
 	e := NewInmemEngine()
 	var code StatusCode
 	statusCodeEqual(t, UserCreated, e.CreateUser(u1))
-	_, code = e.Authenticate(u12)
+	_, code = e.Authenticate(u12, SessionInfo{})
 	statusCodeEqual(t, UserPasswordNotMatch, code)
-	_, code = e.Authenticate(u2)
+	_, code = e.Authenticate(u2, SessionInfo{})
 	statusCodeEqual(t, UserNotFound, code)
-	_, code = e.Authenticate(u1)
+	t1, code := e.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	t2, code := e.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	assert.NotEqual(t, t1.ID, t2.ID)
+	assert.NotEqual(t, t1.SessionID, t2.SessionID)
+}
+
+func TestRehashOnLogin(t *testing.T) {
+	e := NewInmemEngine()
+	e.(*inmemEngine).SetPasswordHasher(NewPBKDF2Hasher(1000))
+	statusCodeEqual(t, UserCreated, e.CreateUser(u1))
+	stored := e.(*inmemEngine).getUserPartition(u1.Name).users[u1.Name].PwdEncrypted
+	assert.NotContains(t, stored, u1.Password)
+	assert.Contains(t, stored, "$pbkdf2-sha256$i=1000$")
+
+	// Same algorithm and cost, the hash is kept
+	_, code := e.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	assert.Equal(t, stored, e.(*inmemEngine).getUserPartition(u1.Name).users[u1.Name].PwdEncrypted)
+
+	// Upgraded transparently after the algorithm changes
+	e.(*inmemEngine).SetPasswordHasher(NewBcryptHasher(4))
+	_, code = e.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	upgraded := e.(*inmemEngine).getUserPartition(u1.Name).users[u1.Name].PwdEncrypted
+	assert.Contains(t, upgraded, "$2a$04$")
+	_, code = e.Authenticate(u12, SessionInfo{})
+	statusCodeEqual(t, UserPasswordNotMatch, code)
+	_, code = e.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	e.Shutdown()
+}
+
+func TestSessions(t *testing.T) {
+	e := NewInmemEngine()
+	statusCodeEqual(t, UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, UserCreated, e.CreateUser(u2))
+	laptop, code := e.Authenticate(u1, SessionInfo{UserAgent: "firefox", IP: "10.0.0.1", Label: "laptop"})
+	statusCodeEqual(t, TokenCreated, code)
+	phone, code := e.Authenticate(u1, SessionInfo{UserAgent: "safari", IP: "10.0.0.2", Label: "phone"})
+	statusCodeEqual(t, TokenCreated, code)
+	tablet, code := e.Authenticate(u1, SessionInfo{Label: "tablet"})
+	statusCodeEqual(t, TokenCreated, code)
+	other, code := e.Authenticate(u2, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+
+	ss, code := e.ListSessions(phone.ID)
+	statusCodeEqual(t, OK, code)
+	assert.Equal(t, 3, len(ss))
+	assert.Equal(t, laptop.SessionID, ss[0].SessionID)
+	assert.Equal(t, "", ss[0].ID, "secret token must not be listed")
+	assert.Equal(t, SessionInfo{UserAgent: "firefox", IP: "10.0.0.1", Label: "laptop"}, ss[0].Info)
+	assert.Equal(t, "phone", ss[1].Info.Label)
+	_, code = e.ListSessions(tokenNotExisting.ID)
+	statusCodeEqual(t, TokenNotFound, code)
+
+	// Revoke one session
+	statusCodeEqual(t, SessionNotFound, e.RevokeSession(phone.ID, "__not_existing__"))
+	statusCodeEqual(t, SessionNotFound, e.RevokeSession(phone.ID, other.SessionID))
+	statusCodeEqual(t, SessionRevoked, e.RevokeSession(phone.ID, laptop.SessionID))
+	statusCodeEqual(t, TokenIsInvalid, e.CheckRole(laptop.ID, r1.Name))
+	statusCodeEqual(t, TokenRoleNotFound, e.CheckRole(phone.ID, r1.Name))
+	statusCodeEqual(t, TokenInvalidated, e.Invalidate(tablet.ID))
+	ss, code = e.ListSessions(phone.ID)
+	statusCodeEqual(t, OK, code)
+	assert.Equal(t, 1, len(ss))
+	assert.Equal(t, phone.SessionID, ss[0].SessionID)
+
+	// Revoke all sessions of the user only
+	_, code = e.Authenticate(u1, SessionInfo{})
 	statusCodeEqual(t, TokenCreated, code)
-	_, code = e.Authenticate(u1)
-	statusCodeEqual(t, TokenRenewed, code)
+	statusCodeEqual(t, SessionRevoked, e.RevokeAllSessions(phone.ID))
+	statusCodeEqual(t, TokenIsInvalid, e.CheckRole(phone.ID, r1.Name))
+	statusCodeEqual(t, TokenIsInvalid, e.RevokeAllSessions(phone.ID))
+	statusCodeEqual(t, TokenRoleNotFound, e.CheckRole(other.ID, r1.Name))
+	e.Shutdown()
 }
 
 func TestInvalidate(t *testing.T) {
@@ -74,7 +141,7 @@ func TestInvalidate(t *testing.T) {
 	var code StatusCode
 	var token Token
 	statusCodeEqual(t, UserCreated, e.CreateUser(u1))
-	token, code = e.Authenticate(u1)
+	token, code = e.Authenticate(u1, SessionInfo{})
 	statusCodeEqual(t, TokenCreated, code)
 	statusCodeEqual(t, TokenNotFound, e.Invalidate(tokenNotExisting.ID))
 	statusCodeEqual(t, TokenInvalidated, e.Invalidate(token.ID))
@@ -82,27 +149,44 @@ func TestInvalidate(t *testing.T) {
 }
 
 func TestTokenExpired(t *testing.T) {
-	tokenShardSize = 1
-	e := NewInmemEngine()
-	e.(*inmemEngine).SetTokenTTL(time.Millisecond * 100)
+	clock := NewFakeClock(time.Unix(1600000000, 0))
+	o, err := NewOptions(WithClock(clock), WithTokenTTL(time.Minute), WithTokenShards(4))
+	assert.Nil(t, err)
+	// Without the background job, expired tokens are deleted on demand below
+	e := newInmemEngine(o)
 	var code StatusCode
 	var token Token
 	statusCodeEqual(t, UserCreated, e.CreateUser(u1))
-	token, code = e.Authenticate(u1)
+	token, code = e.Authenticate(u1, SessionInfo{})
 	statusCodeEqual(t, TokenCreated, code)
+	assert.Equal(t, clock.Now().Add(time.Minute).UnixNano()/1000, token.ExpiredAtInUsec)
 	statusCodeEqual(t, TokenNotFound, e.Invalidate(tokenNotExisting.ID))
-	time.Sleep(time.Millisecond * 100)
+
+	// Valid until the very end of its TTL
+	clock.Advance(time.Minute)
+	statusCodeEqual(t, TokenRoleNotFound, e.CheckRole(token.ID, r1.Name))
+	clock.Advance(time.Microsecond)
 	statusCodeEqual(t, TokenExpired, e.Invalidate(token.ID))
-	time.Sleep(time.Millisecond * 150)
+	statusCodeEqual(t, TokenExpired, e.CheckRole(token.ID, r1.Name))
+
+	// A new session is not affected by the expired one
+	fresh, code := e.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	ss, code := e.ListSessions(fresh.ID)
+	statusCodeEqual(t, OK, code)
+	assert.Equal(t, 1, len(ss))
+
+	assert.Equal(t, 1, e.sweep())
 	statusCodeEqual(t, TokenNotFound, e.Invalidate(token.ID))
-	tokenShardSize = 1024
+	assert.Equal(t, 1, len(e.getUserPartition(u1.Name).users[u1.Name].sessions))
+	statusCodeEqual(t, TokenInvalidated, e.Invalidate(fresh.ID))
 }
 
 func TestDeleteUserWithToken(t *testing.T) {
 	e := NewInmemEngine()
 	var code StatusCode
 	statusCodeEqual(t, UserCreated, e.CreateUser(u1))
-	_, code = e.Authenticate(u1)
+	_, code = e.Authenticate(u1, SessionInfo{})
 	statusCodeEqual(t, TokenCreated, code)
 	statusCodeEqual(t, UserDeleted, e.DeleteUser(u1))
 }
@@ -113,7 +197,7 @@ func TestCheckRole(t *testing.T) {
 	var token Token
 	statusCodeEqual(t, TokenNotFound, e.CheckRole(tokenNotExisting.ID, r1.Name))
 	statusCodeEqual(t, UserCreated, e.CreateUser(u1))
-	token, code = e.Authenticate(u1)
+	token, code = e.Authenticate(u1, SessionInfo{})
 	statusCodeEqual(t, TokenCreated, code)
 	statusCodeEqual(t, TokenRoleNotFound, e.CheckRole(token.ID, u1.Name))
 	statusCodeEqual(t, RoleCreated, e.CreateRole(r1))
@@ -129,7 +213,7 @@ func TestAllRoles(t *testing.T) {
 	_, code = e.AllRoles(tokenNotExisting.ID)
 	statusCodeEqual(t, TokenNotFound, code)
 	statusCodeEqual(t, UserCreated, e.CreateUser(u1))
-	token, code = e.Authenticate(u1)
+	token, code = e.Authenticate(u1, SessionInfo{})
 	statusCodeEqual(t, TokenCreated, code)
 	statusCodeEqual(t, RoleCreated, e.CreateRole(r1))
 	statusCodeEqual(t, RoleCreated, e.CreateRole(r2))
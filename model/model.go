@@ -1,5 +1,7 @@
 package model
 
+import "sync/atomic"
+
 var (
 	nilUser  = User{}
 	nilRole  = Role{}
@@ -7,34 +9,128 @@ var (
 )
 
 type User struct {
-	Name         string
+	Name string
+	// Password is the plain text password given by callers, engines never
+	// keep it.
+	Password string
+	// PwdEncrypted is the encoded password hash, see password.go.
 	PwdEncrypted string
-	roles        []*Role
-	token        *Token
+	// Roles are the names of the roles granted globally to the user in the
+	// order granted, and Groups the names of its groups, filled by GetUser.
+	Roles  []string
+	Groups []string
+	// MustChangePassword tells the password was reset by ResetPassword and
+	// must be changed before authenticating, filled by GetUser.
+	MustChangePassword bool
+	mustChange         bool
+	roles              []*Role
+	scoped             map[string][]*Role // Resource path - roles bound on it
+	groups             []*Group           // groups having the user as a member
+	sessions           map[string]*Token  // SessionID - Token
+	history            []string           // previous password hashes, the latest first
 }
 
+// Role is granted to users, along with all of its ancestors. Parents are
+// the names of the roles it inherits from, see hierarchy.go.
 type Role struct {
-	Name    string
-	deleted bool
+	Name        string
+	Parents     []string
+	Permissions []string            // granted directly, filled by GetRole
+	deleted     int32               // set atomically once the role is deleted
+	members     map[*User]struct{}  // users having the role, guarded by the role lock
+	groups      map[*Group]struct{} // groups having the role, guarded by the role lock
+	parents     []*Role             // guarded by the role lock
+	children    map[*Role]struct{}  // guarded by the role lock
+	permissions map[string]struct{} // granted directly, guarded by the role lock
+	closure     atomic.Value        // *closure of itself and its ancestors
+}
+
+// Group has users as members, along with the members of the groups nested
+// in it, and its roles are granted to all of them, see group.go.
+type Group struct {
+	Name     string
+	deleted  int32               // set atomically once the group is deleted
+	members  map[*User]struct{}  // guarded by the role lock
+	parents  []*Group            // groups it's nested in, guarded by the role lock
+	children map[*Group]struct{} // groups nested in it, guarded by the role lock
+	roles    []*Role             // granted directly, guarded by the role lock
+	closure  atomic.Value        // *groupClosure of itself and its ancestors
 }
 
+// Token is the session created by each successful Authenticate. ID is the
+// secret handed out to the client, while SessionID is a public handle which
+// is safe to list and revoke sessions with.
 type Token struct {
-	ID              string
+	ID              string // secret, the in memory engine keeps its tokenKey only
+	SessionID       string
+	CreatedAtInUsec int64
 	ExpiredAtInUsec int64
+	Info            SessionInfo
+	Tenant          string // of the user
 	invalid         bool
 	user            *User
 }
 
+// SessionInfo describes the client a session is created for.
+type SessionInfo struct {
+	UserAgent string
+	IP        string
+	Label     string
+}
+
+// public copies the exported fields of t, without the ID.
+func (t *Token) public() Token {
+	return Token{
+		SessionID:       t.SessionID,
+		CreatedAtInUsec: t.CreatedAtInUsec,
+		ExpiredAtInUsec: t.ExpiredAtInUsec,
+		Info:            t.Info,
+		Tenant:          t.Tenant,
+	}
+}
+
 // AuthenticateAuthorizationEngine defines db level interfaces
 type AuthenticateAuthorizationEngine interface {
+	CreateTenant(t Tenant) StatusCode
+	DeleteTenant(t Tenant) StatusCode
+	ListTenants() ([]Tenant, StatusCode)
 	CreateUser(u User) StatusCode
 	DeleteUser(u User) StatusCode
+	GetUser(u User) (User, StatusCode)
+	ListUsers(p Page) ([]User, string, StatusCode)
+	ChangePassword(u User, password string) StatusCode
+	ResetPassword(u User) StatusCode
 	CreateRole(r Role) StatusCode
 	DeleteRole(r Role) StatusCode
+	GetRole(r Role) (Role, StatusCode)
+	ListRoles(p Page) ([]Role, string, StatusCode)
+	ListRoleMembers(r Role, p Page) ([]User, string, StatusCode)
+	AddRoleParent(r, parent Role) StatusCode
+	RemoveRoleParent(r, parent Role) StatusCode
 	AddUserRole(u User, r Role) StatusCode
-	Authenticate(u User) (Token, StatusCode)
+	RemoveUserRole(u User, r Role) StatusCode
+	AddUserRoleOn(u User, r Role, res Resource) StatusCode
+	RemoveUserRoleOn(u User, r Role, res Resource) StatusCode
+	GrantPermission(r Role, p Permission) StatusCode
+	RevokePermission(r Role, p Permission) StatusCode
+	Authenticate(u User, info SessionInfo) (Token, StatusCode)
 	Invalidate(t string) StatusCode
+	ListSessions(t string) ([]Token, StatusCode)
+	RevokeSession(t, sessionID string) StatusCode
+	RevokeAllSessions(t string) StatusCode
+	TokenUser(t string) (User, StatusCode)
 	CheckRole(t, r string) StatusCode
+	CheckRoleOn(t, r string, res Resource) StatusCode
+	CheckPermission(t, p string) StatusCode
 	AllRoles(t string) ([]Role, StatusCode)
+	DirectRoles(t string) ([]Role, StatusCode)
+	CreateGroup(g Group) StatusCode
+	DeleteGroup(g Group) StatusCode
+	AddGroupMember(g Group, u User) StatusCode
+	RemoveGroupMember(g Group, u User) StatusCode
+	AddGroupParent(g, parent Group) StatusCode
+	RemoveGroupParent(g, parent Group) StatusCode
+	AddGroupRole(g Group, r Role) StatusCode
+	RemoveGroupRole(g Group, r Role) StatusCode
 	Shutdown()
 }
@@ -0,0 +1,105 @@
+package model
+
+import "fmt"
+
+// Namespace configures the relations of the objects in it. Each relation
+// is computed as the union of its usersets, which are the tuples of the
+// relation itself by default.
+type Namespace struct {
+	Name      string     `json:"name" yaml:"name"`
+	Relations []Relation `json:"relations" yaml:"relations"`
+}
+
+// Relation is rewritten to the union of Union, or its own tuples if empty.
+type Relation struct {
+	Name  string    `json:"name" yaml:"name"`
+	Union []Userset `json:"union,omitempty" yaml:"union,omitempty"`
+}
+
+// Userset is exactly one of:
+//
+//   - This, the subjects of the tuples of the relation itself.
+//   - ComputedUserset, the subjects having another relation to the same
+//     object, e.g. editors are viewers as well.
+//   - TupleToUserset, the subjects having a relation to the objects which
+//     are subjects of another relation, e.g. viewers of the parent folder
+//     are viewers of the document.
+type Userset struct {
+	This            bool            `json:"this,omitempty" yaml:"this,omitempty"`
+	ComputedUserset string          `json:"computed_userset,omitempty" yaml:"computed_userset,omitempty"`
+	TupleToUserset  *TupleToUserset `json:"tuple_to_userset,omitempty" yaml:"tuple_to_userset,omitempty"`
+}
+
+// TupleToUserset follows the tuples of Tupleset of the object, then takes
+// ComputedUserset of their subjects.
+type TupleToUserset struct {
+	Tupleset        string `json:"tupleset" yaml:"tupleset"`
+	ComputedUserset string `json:"computed_userset" yaml:"computed_userset"`
+}
+
+var thisUserset = []Userset{{This: true}}
+
+// Validate checks names are valid and unique, and rewrites refer to the
+// relations of n. Relations of other namespaces are not checked.
+func (n Namespace) Validate() error {
+	if !validName(n.Name) {
+		return fmt.Errorf("model: invalid namespace name %q", n.Name)
+	}
+	relations := make(map[string]struct{}, len(n.Relations))
+	for _, r := range n.Relations {
+		if !validName(r.Name) {
+			return fmt.Errorf("model: invalid relation name %q of %s", r.Name, n.Name)
+		}
+		if _, ok := relations[r.Name]; ok {
+			return fmt.Errorf("model: duplicated relation %s of %s", r.Name, n.Name)
+		}
+		relations[r.Name] = struct{}{}
+	}
+	for _, r := range n.Relations {
+		for _, u := range r.Union {
+			if err := u.validate(relations); err != nil {
+				return fmt.Errorf("model: relation %s of %s: %v", r.Name, n.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (u Userset) validate(relations map[string]struct{}) error {
+	n := 0
+	if u.This {
+		n++
+	}
+	if u.ComputedUserset != "" {
+		n++
+		if _, ok := relations[u.ComputedUserset]; !ok {
+			return fmt.Errorf("undefined computed userset %s", u.ComputedUserset)
+		}
+	}
+	if t := u.TupleToUserset; t != nil {
+		n++
+		if _, ok := relations[t.Tupleset]; !ok {
+			return fmt.Errorf("undefined tupleset %s", t.Tupleset)
+		}
+		if !validName(t.ComputedUserset) {
+			return fmt.Errorf("invalid computed userset %q", t.ComputedUserset)
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("userset must be exactly one of this, computed_userset and tuple_to_userset")
+	}
+	return nil
+}
+
+// relation returns the usersets of the relation named name.
+func (n Namespace) relation(name string) ([]Userset, bool) {
+	for _, r := range n.Relations {
+		if r.Name == name {
+			if len(r.Union) == 0 {
+				return thisUserset, true
+			}
+			return r.Union, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,142 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// Options is the configuration of an engine. Engines build it from Option
+// values by NewOptions, fields an engine has no use for are ignored.
+type Options struct {
+	// UserShards and TokenShards are the numbers of partitions of the in
+	// memory lookup tables, 1024 by default.
+	UserShards  int
+	TokenShards int
+	// TokenTTL is the lifetime of new tokens, 2h by default.
+	TokenTTL time.Duration
+	// SweepInterval is the period of deleting expired tokens, 200ms by
+	// default. The in memory engine sweeps every token partition each
+	// period, so an expired token is deleted within one period.
+	SweepInterval time.Duration
+	// MaxSessions limits the sessions of each user, the oldest session is
+	// revoked when a new one exceeds it. 0 means unlimited, the default.
+	MaxSessions int
+	// PasswordHistory is the number of the last passwords of each user,
+	// the current one included, a new password must differ from. 0 means
+	// no check, the default.
+	PasswordHistory int
+	// Hasher hashes new passwords, DefaultPasswordHasher by default.
+	Hasher PasswordHasher
+	// TokenGenerator generates token IDs, DefaultTokenGenerator by default.
+	TokenGenerator TokenGenerator
+	// Clock tells the time of token expiry, RealClock by default.
+	Clock Clock
+}
+
+// Option sets a field of Options.
+type Option func(*Options)
+
+const maxShards = 1 << 20
+
+// WithUserShards sets the number of user partitions, 1024 by default, in
+// [1, 1<<20].
+func WithUserShards(n int) Option {
+	return func(o *Options) { o.UserShards = n }
+}
+
+// WithTokenShards sets the number of token partitions, 1024 by default, in
+// [1, 1<<20].
+func WithTokenShards(n int) Option {
+	return func(o *Options) { o.TokenShards = n }
+}
+
+// WithTokenTTL sets the lifetime of new tokens, 2h by default, must be
+// positive.
+func WithTokenTTL(du time.Duration) Option {
+	return func(o *Options) { o.TokenTTL = du }
+}
+
+// WithSweepInterval sets the period of deleting expired tokens, 200ms by
+// default, must be positive.
+func WithSweepInterval(du time.Duration) Option {
+	return func(o *Options) { o.SweepInterval = du }
+}
+
+// WithMaxSessions sets the sessions of each user at most, 0 for unlimited by
+// default, must not be negative.
+func WithMaxSessions(n int) Option {
+	return func(o *Options) { o.MaxSessions = n }
+}
+
+// WithPasswordHistory sets the last passwords a new one must differ from, 0
+// for no check by default, must not be negative.
+func WithPasswordHistory(n int) Option {
+	return func(o *Options) { o.PasswordHistory = n }
+}
+
+// WithPasswordHasher sets the hasher of new passwords, DefaultPasswordHasher
+// by default, must not be nil.
+func WithPasswordHasher(h PasswordHasher) Option {
+	return func(o *Options) { o.Hasher = h }
+}
+
+// WithTokenGenerator sets the generator of token IDs, DefaultTokenGenerator by
+// default, must not be nil.
+func WithTokenGenerator(g TokenGenerator) Option {
+	return func(o *Options) { o.TokenGenerator = g }
+}
+
+// WithClock sets the clock of token expiry, RealClock by default, must not be
+// nil.
+func WithClock(c Clock) Option {
+	return func(o *Options) { o.Clock = c }
+}
+
+// NewOptions applies opts over the defaults, and returns an error if the
+// result is invalid.
+func NewOptions(opts ...Option) (Options, error) {
+	o := Options{
+		UserShards:     1024,
+		TokenShards:    1024,
+		TokenTTL:       2 * time.Hour,
+		SweepInterval:  200 * time.Millisecond,
+		Hasher:         DefaultPasswordHasher(),
+		TokenGenerator: DefaultTokenGenerator(),
+		Clock:          RealClock(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o, o.validate()
+}
+
+func (o Options) validate() error {
+	if o.UserShards < 1 || o.UserShards > maxShards {
+		return fmt.Errorf("model: invalid user shards %d, must be in [1, %d]", o.UserShards, maxShards)
+	}
+	if o.TokenShards < 1 || o.TokenShards > maxShards {
+		return fmt.Errorf("model: invalid token shards %d, must be in [1, %d]", o.TokenShards, maxShards)
+	}
+	if o.TokenTTL <= 0 {
+		return fmt.Errorf("model: invalid token TTL %v, must be positive", o.TokenTTL)
+	}
+	if o.SweepInterval <= 0 {
+		return fmt.Errorf("model: invalid sweep interval %v, must be positive", o.SweepInterval)
+	}
+	if o.MaxSessions < 0 {
+		return fmt.Errorf("model: invalid max sessions %d, must not be negative", o.MaxSessions)
+	}
+	if o.PasswordHistory < 0 {
+		return fmt.Errorf("model: invalid password history %d, must not be negative", o.PasswordHistory)
+	}
+	if o.Hasher == nil {
+		return fmt.Errorf("model: password hasher must not be nil")
+	}
+	if o.TokenGenerator == nil {
+		return fmt.Errorf("model: token generator must not be nil")
+	}
+	if o.Clock == nil {
+		return fmt.Errorf("model: clock must not be nil")
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptions(t *testing.T) {
+	o, err := NewOptions()
+	assert.Nil(t, err)
+	assert.Equal(t, 1024, o.UserShards)
+	assert.Equal(t, 1024, o.TokenShards)
+	assert.Equal(t, 2*time.Hour, o.TokenTTL)
+	assert.Equal(t, 200*time.Millisecond, o.SweepInterval)
+	assert.Equal(t, 0, o.MaxSessions)
+	assert.Equal(t, 0, o.PasswordHistory)
+
+	o, err = NewOptions(WithUserShards(1), WithTokenShards(2), WithTokenTTL(time.Minute),
+		WithSweepInterval(time.Second), WithMaxSessions(3), WithPasswordHistory(4), WithPasswordHasher(testHasher))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, o.UserShards)
+	assert.Equal(t, 2, o.TokenShards)
+	assert.Equal(t, time.Minute, o.TokenTTL)
+	assert.Equal(t, time.Second, o.SweepInterval)
+	assert.Equal(t, 3, o.MaxSessions)
+	assert.Equal(t, 4, o.PasswordHistory)
+	assert.Equal(t, testHasher, o.Hasher)
+
+	for _, opt := range []Option{
+		WithUserShards(0),
+		WithTokenShards(maxShards + 1),
+		WithTokenTTL(0),
+		WithSweepInterval(-time.Second),
+		WithMaxSessions(-1),
+		WithPasswordHistory(-1),
+		WithPasswordHasher(nil),
+		WithTokenGenerator(nil),
+		WithClock(nil),
+	} {
+		_, err := NewOptions(opt)
+		assert.NotNil(t, err)
+	}
+	assert.Panics(t, func() { NewInmemEngine(WithTokenTTL(-time.Hour)) })
+}
+
+func TestShards(t *testing.T) {
+	e := NewInmemEngine(WithUserShards(1), WithTokenShards(3), WithPasswordHasher(testHasher)).(*inmemEngine)
+	defer e.Shutdown()
+	assert.Equal(t, 1, len(e.users))
+	assert.Equal(t, 3, len(e.tokens))
+	for _, u := range []User{u1, u2} {
+		statusCodeEqual(t, UserCreated, e.CreateUser(u))
+		_, code := e.Authenticate(u, SessionInfo{})
+		statusCodeEqual(t, TokenCreated, code)
+	}
+	assert.Equal(t, 2, len(e.users[0].users))
+}
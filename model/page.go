@@ -0,0 +1,99 @@
+package model
+
+import (
+	"container/heap"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultPageLimit = 100  // Limit of a Page if not given
+	MaxPageLimit     = 1000 // Limit of a Page at most
+)
+
+// Page selects the names of a listing, which are sorted, starting with
+// Prefix and after Cursor, at most Limit of them. The cursor of the next
+// page is the last name of the page, returned along with it, so that names
+// created or deleted in between don't shift the pages.
+//
+// Only the names in the tenant of Prefix are selected, so that names of
+// other tenants aren't listed in the default tenant.
+type Page struct {
+	Prefix string
+	Cursor string // empty for the first page
+	Limit  int    // DefaultPageLimit if not positive, up to MaxPageLimit
+}
+
+// Size returns the number of names of p at most.
+func (p Page) Size() int {
+	if p.Limit <= 0 {
+		return DefaultPageLimit
+	}
+	if p.Limit > MaxPageLimit {
+		return MaxPageLimit
+	}
+	return p.Limit
+}
+
+// Match reports whether name is selected by p, regardless of the limit.
+func (p Page) Match(name string) bool {
+	return strings.HasPrefix(name, p.Prefix) && name > p.Cursor && TenantOf(name) == TenantOf(p.Prefix)
+}
+
+// Cut returns the first names of sorted up to the size of p, and the cursor
+// of the next page, or empty if there are no more names.
+func (p Page) Cut(sorted []string) ([]string, string) {
+	if len(sorted) <= p.Size() {
+		return sorted, ""
+	}
+	sorted = sorted[:p.Size()]
+	return sorted, sorted[len(sorted)-1]
+}
+
+// pageSelector selects the names of a page out of unsorted ones, for the
+// in memory engine, which keeps no sorted index of names. It keeps only the
+// first names seen so far, one more than the page to tell if there are more,
+// so a page of size k out of n names costs O(n log k) instead of sorting all
+// of them. Every page still visits all n names, so walking all pages costs
+// O(n²/k), which the SQL engine avoids by its indexes.
+type pageSelector struct {
+	page  Page
+	names maxNameHeap
+}
+
+// add selects name if it's among the first names of the page, name must be
+// matched by the page already.
+func (s *pageSelector) add(name string) {
+	if len(s.names) <= s.page.Size() {
+		heap.Push(&s.names, name)
+	} else if name < s.names[0] {
+		s.names[0] = name
+		heap.Fix(&s.names, 0)
+	}
+}
+
+// cut returns the names of the page and the cursor of the next one, like
+// Page.Cut.
+func (s *pageSelector) cut() ([]string, string) {
+	names := []string(s.names)
+	sort.Strings(names)
+	return s.page.Cut(names)
+}
+
+// maxNameHeap is a max-heap of names.
+type maxNameHeap []string
+
+func (h maxNameHeap) Len() int           { return len(h) }
+func (h maxNameHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h maxNameHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *maxNameHeap) Push(x interface{}) {
+	*h = append(*h, x.(string))
+}
+
+func (h *maxNameHeap) Pop() interface{} {
+	old := *h
+	name := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return name
+}
@@ -0,0 +1,58 @@
+package model
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPage(t *testing.T) {
+	assert.Equal(t, DefaultPageLimit, Page{}.Size())
+	assert.Equal(t, DefaultPageLimit, Page{Limit: -1}.Size())
+	assert.Equal(t, 3, Page{Limit: 3}.Size())
+	assert.Equal(t, MaxPageLimit, Page{Limit: MaxPageLimit + 1}.Size())
+
+	p := Page{Prefix: "ab", Cursor: "abc"}
+	for _, name := range []string{"abd", "abcd", "abz"} {
+		assert.True(t, p.Match(name), name)
+	}
+	for _, name := range []string{"ab", "abc", "aa", "b", "acme/abd"} {
+		assert.False(t, p.Match(name), name)
+	}
+	assert.True(t, Page{Prefix: "acme/"}.Match("acme/ab"))
+	assert.False(t, Page{Prefix: "acme/"}.Match("acme"))
+	assert.False(t, Page{Prefix: "acme"}.Match("acme/ab"))
+
+	names, next := Page{Limit: 2}.Cut([]string{"a", "b", "c"})
+	assert.Equal(t, []string{"a", "b"}, names)
+	assert.Equal(t, "b", next)
+	names, next = Page{Limit: 3}.Cut([]string{"a", "b", "c"})
+	assert.Equal(t, []string{"a", "b", "c"}, names)
+	assert.Empty(t, next)
+}
+
+func TestPageSelector(t *testing.T) {
+	names := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		names = append(names, fmt.Sprintf("u%03d", i))
+	}
+	for _, limit := range []int{1, 7, 99, 100, 101} {
+		p := Page{Limit: limit}
+		s := pageSelector{page: p}
+		for _, i := range rand.Perm(len(names)) {
+			s.add(names[i])
+		}
+		sorted := append([]string(nil), names...)
+		sort.Strings(sorted)
+		expected, expectedNext := p.Cut(sorted)
+		got, next := s.cut()
+		assert.Equal(t, expected, got, "limit %d", limit)
+		assert.Equal(t, expectedNext, next, "limit %d", limit)
+	}
+	names, next := (&pageSelector{page: Page{}}).cut()
+	assert.Empty(t, names)
+	assert.Empty(t, next)
+}
@@ -0,0 +1,305 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// This file implements password hashing. Every hash is encoded in a
+// self-describing PHC-like string, e.g.
+//
+//	$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+//	$scrypt$ln=15,r=8,p=1$<salt>$<hash>
+//	$pbkdf2-sha256$i=600000$<salt>$<hash>
+//	$2a$10$<bcrypt salt and hash>
+//
+// so a hash can always be verified no matter which hasher is configured now.
+
+const saltLength = 16
+
+var (
+	ErrUnknownHashFormat = errors.New("unknown password hash format")
+	ErrMalformedHash     = errors.New("malformed password hash")
+
+	b64 = base64.RawStdEncoding
+)
+
+// PasswordHasher hashes and verifies user passwords.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of pwd with a fresh random salt.
+	Hash(pwd string) (string, error)
+	// Verify reports whether pwd matches encoded, which may have been
+	// produced by any supported algorithm.
+	Verify(pwd, encoded string) (bool, error)
+	// NeedsRehash reports whether encoded was produced by another
+	// algorithm or with other parameters than the hasher's.
+	NeedsRehash(encoded string) bool
+}
+
+// DefaultPasswordHasher returns argon2id with the OWASP recommended
+// parameters (19 MiB memory, 2 iterations, 1 thread).
+func DefaultPasswordHasher() PasswordHasher {
+	return NewArgon2idHasher(19*1024, 2, 1)
+}
+
+// DummyHash returns the hash of a random password by h. Engines verify the
+// passwords of missing users against it, so that they are refused as slowly
+// as wrong passwords, and the time taken doesn't tell which user names
+// exist. It's empty if h fails.
+func DummyHash(h PasswordHasher) string {
+	salt, err := newSalt()
+	if err != nil {
+		return ""
+	}
+	hash, err := h.Hash(b64.EncodeToString(salt))
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+// VerifyPassword checks pwd against an encoded hash of any supported
+// algorithm in constant time.
+func VerifyPassword(pwd, encoded string) (bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		h, salt, sum, err := parseArgon2id(encoded)
+		if err != nil {
+			return false, err
+		}
+		return equalHash(h.key(pwd, salt, uint32(len(sum))), sum), nil
+	case strings.HasPrefix(encoded, "$scrypt$"):
+		h, salt, sum, err := parseScrypt(encoded)
+		if err != nil {
+			return false, err
+		}
+		key, err := h.key(pwd, salt, len(sum))
+		if err != nil {
+			return false, err
+		}
+		return equalHash(key, sum), nil
+	case strings.HasPrefix(encoded, "$pbkdf2-sha256$"):
+		h, salt, sum, err := parsePBKDF2(encoded)
+		if err != nil {
+			return false, err
+		}
+		return equalHash(h.key(pwd, salt, len(sum)), sum), nil
+	case isBcrypt(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(pwd))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	return false, ErrUnknownHashFormat
+}
+
+// argon2id
+type argon2idHasher struct {
+	memory  uint32 // in KiB
+	time    uint32
+	threads uint8
+}
+
+// NewArgon2idHasher returns a hasher using argon2id with the memory in KiB,
+// number of iterations and parallelism.
+func NewArgon2idHasher(memory, time uint32, threads uint8) PasswordHasher {
+	return argon2idHasher{memory: memory, time: time, threads: threads}
+}
+
+func (h argon2idHasher) Hash(pwd string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.memory, h.time, h.threads,
+		b64.EncodeToString(salt), b64.EncodeToString(h.key(pwd, salt, 32))), nil
+}
+
+func (h argon2idHasher) Verify(pwd, encoded string) (bool, error) {
+	return VerifyPassword(pwd, encoded)
+}
+
+func (h argon2idHasher) NeedsRehash(encoded string) bool {
+	cur, _, _, err := parseArgon2id(encoded)
+	return err != nil || cur != h
+}
+
+func (h argon2idHasher) key(pwd string, salt []byte, n uint32) []byte {
+	return argon2.IDKey([]byte(pwd), salt, h.time, h.memory, h.threads, n)
+}
+
+func parseArgon2id(encoded string) (h argon2idHasher, salt, sum []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return h, nil, nil, ErrMalformedHash
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return h, nil, nil, ErrMalformedHash
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return h, nil, nil, ErrMalformedHash
+	}
+	salt, sum, err = decodeSaltAndSum(parts[4], parts[5])
+	return h, salt, sum, err
+}
+
+// scrypt
+type scryptHasher struct {
+	logN, r, p int
+}
+
+// NewScryptHasher returns a hasher using scrypt with N = 2^logN.
+func NewScryptHasher(logN, r, p int) PasswordHasher {
+	return scryptHasher{logN: logN, r: r, p: p}
+}
+
+func (h scryptHasher) Hash(pwd string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	key, err := h.key(pwd, salt, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", h.logN, h.r, h.p,
+		b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h scryptHasher) Verify(pwd, encoded string) (bool, error) {
+	return VerifyPassword(pwd, encoded)
+}
+
+func (h scryptHasher) NeedsRehash(encoded string) bool {
+	cur, _, _, err := parseScrypt(encoded)
+	return err != nil || cur != h
+}
+
+func (h scryptHasher) key(pwd string, salt []byte, n int) ([]byte, error) {
+	return scrypt.Key([]byte(pwd), salt, 1<<uint(h.logN), h.r, h.p, n)
+}
+
+func parseScrypt(encoded string) (h scryptHasher, salt, sum []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return h, nil, nil, ErrMalformedHash
+	}
+	if _, err = fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &h.logN, &h.r, &h.p); err != nil || h.logN <= 0 || h.logN >= 32 {
+		return h, nil, nil, ErrMalformedHash
+	}
+	salt, sum, err = decodeSaltAndSum(parts[3], parts[4])
+	return h, salt, sum, err
+}
+
+// PBKDF2
+type pbkdf2Hasher struct {
+	iterations int
+}
+
+// NewPBKDF2Hasher returns a hasher using PBKDF2 with HMAC-SHA256.
+func NewPBKDF2Hasher(iterations int) PasswordHasher {
+	return pbkdf2Hasher{iterations: iterations}
+}
+
+func (h pbkdf2Hasher) Hash(pwd string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", h.iterations,
+		b64.EncodeToString(salt), b64.EncodeToString(h.key(pwd, salt, 32))), nil
+}
+
+func (h pbkdf2Hasher) Verify(pwd, encoded string) (bool, error) {
+	return VerifyPassword(pwd, encoded)
+}
+
+func (h pbkdf2Hasher) NeedsRehash(encoded string) bool {
+	cur, _, _, err := parsePBKDF2(encoded)
+	return err != nil || cur != h
+}
+
+func (h pbkdf2Hasher) key(pwd string, salt []byte, n int) []byte {
+	return pbkdf2.Key([]byte(pwd), salt, h.iterations, n, sha256.New)
+}
+
+func parsePBKDF2(encoded string) (h pbkdf2Hasher, salt, sum []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[1] != "pbkdf2-sha256" {
+		return h, nil, nil, ErrMalformedHash
+	}
+	if _, err = fmt.Sscanf(parts[2], "i=%d", &h.iterations); err != nil || h.iterations <= 0 {
+		return h, nil, nil, ErrMalformedHash
+	}
+	salt, sum, err = decodeSaltAndSum(parts[3], parts[4])
+	return h, salt, sum, err
+}
+
+// bcrypt, which generates its own salt and encoding.
+type bcryptHasher struct {
+	cost int
+}
+
+// NewBcryptHasher returns a hasher using bcrypt with the cost.
+func NewBcryptHasher(cost int) PasswordHasher {
+	return bcryptHasher{cost: cost}
+}
+
+func (h bcryptHasher) Hash(pwd string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(pwd), h.cost)
+	return string(b), err
+}
+
+func (h bcryptHasher) Verify(pwd, encoded string) (bool, error) {
+	return VerifyPassword(pwd, encoded)
+}
+
+func (h bcryptHasher) NeedsRehash(encoded string) bool {
+	if !isBcrypt(encoded) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.cost
+}
+
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+// helpers
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltLength)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+func decodeSaltAndSum(s1, s2 string) ([]byte, []byte, error) {
+	salt, err := b64.DecodeString(s1)
+	if err != nil {
+		return nil, nil, ErrMalformedHash
+	}
+	sum, err := b64.DecodeString(s2)
+	if err != nil || len(sum) == 0 {
+		return nil, nil, ErrMalformedHash
+	}
+	return salt, sum, nil
+}
+
+func equalHash(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
@@ -0,0 +1,67 @@
+package model
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testHashers = map[string]PasswordHasher{
+	"argon2id": NewArgon2idHasher(1024, 1, 1),
+	"scrypt":   NewScryptHasher(10, 8, 1),
+	"pbkdf2":   NewPBKDF2Hasher(1000),
+	"bcrypt":   NewBcryptHasher(4),
+}
+
+func TestPasswordHashers(t *testing.T) {
+	for name, h := range testHashers {
+		t.Run(name, func(t *testing.T) {
+			enc1, err := h.Hash("p@ssw0rd")
+			assert.Nil(t, err)
+			enc2, err := h.Hash("p@ssw0rd")
+			assert.Nil(t, err)
+			assert.NotEqual(t, enc1, enc2, "salt should be random")
+			assert.False(t, strings.Contains(enc1, "p@ssw0rd"))
+
+			ok, err := h.Verify("p@ssw0rd", enc1)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			ok, err = h.Verify("p@ssw0rD", enc1)
+			assert.Nil(t, err)
+			assert.False(t, ok)
+			assert.False(t, h.NeedsRehash(enc1))
+		})
+	}
+}
+
+func TestPasswordHashersCrossVerify(t *testing.T) {
+	for name, h := range testHashers {
+		enc, err := h.Hash("secret")
+		assert.Nil(t, err)
+		for other, o := range testHashers {
+			ok, err := o.Verify("secret", enc)
+			assert.Nil(t, err, "%v verifies %v", other, name)
+			assert.True(t, ok, "%v verifies %v", other, name)
+			assert.Equal(t, name != other, o.NeedsRehash(enc), "%v rehash %v", other, name)
+		}
+	}
+}
+
+func TestPasswordNeedsRehashOnCost(t *testing.T) {
+	enc, _ := NewPBKDF2Hasher(1000).Hash("secret")
+	assert.True(t, NewPBKDF2Hasher(2000).NeedsRehash(enc))
+	enc, _ = NewArgon2idHasher(1024, 1, 1).Hash("secret")
+	assert.True(t, NewArgon2idHasher(1024, 2, 1).NeedsRehash(enc))
+	enc, _ = NewBcryptHasher(4).Hash("secret")
+	assert.True(t, NewBcryptHasher(5).NeedsRehash(enc))
+}
+
+func TestVerifyMalformedPassword(t *testing.T) {
+	_, err := VerifyPassword("secret", "c2VjcmV0")
+	assert.Equal(t, ErrUnknownHashFormat, err)
+	_, err = VerifyPassword("secret", "$pbkdf2-sha256$i=x$abc$def")
+	assert.Equal(t, ErrMalformedHash, err)
+	_, err = VerifyPassword("secret", "$argon2id$v=19$m=1024,t=1,p=1$!!$!!")
+	assert.Equal(t, ErrMalformedHash, err)
+}
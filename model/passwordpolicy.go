@@ -0,0 +1,144 @@
+package model
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rules of password policy violations.
+const (
+	RuleMinLength = "min_length"
+	RuleMaxLength = "max_length"
+	RuleLowercase = "lowercase"
+	RuleUppercase = "uppercase"
+	RuleDigit     = "digit"
+	RuleSymbol    = "symbol"
+	RuleBanned    = "banned"
+	RuleUserName  = "user_name"
+	// RuleReuse is violated by one of the last Options.PasswordHistory
+	// passwords, which only engines can tell by PasswordReused.
+	RuleReuse = "reuse"
+)
+
+// PasswordViolation is a rule of a PasswordPolicy a password breaks.
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicy is the rules new passwords must follow. The zero value
+// accepts any password.
+type PasswordPolicy struct {
+	// MinLength and MaxLength bound the number of characters, 0 for no
+	// bound.
+	MinLength int
+	MaxLength int
+	// Lowercase, Uppercase, Digit and Symbol require at least one character
+	// of the class, symbols being any other printable characters.
+	Lowercase bool
+	Uppercase bool
+	Digit     bool
+	Symbol    bool
+	// Banned is the set of lowercased passwords refused regardless of case,
+	// see LoadBannedPasswords.
+	Banned map[string]struct{}
+	// RejectUserName refuses passwords containing the user name, regardless
+	// of case and tenant.
+	RejectUserName bool
+}
+
+// Validate returns an error if the bounds of p are inconsistent.
+func (p *PasswordPolicy) Validate() error {
+	if p.MinLength < 0 {
+		return fmt.Errorf("model: invalid password min length %d, must not be negative", p.MinLength)
+	}
+	if p.MaxLength < 0 {
+		return fmt.Errorf("model: invalid password max length %d, must not be negative", p.MaxLength)
+	}
+	if p.MaxLength > 0 && p.MaxLength < p.MinLength {
+		return fmt.Errorf("model: invalid password max length %d, must not be less than min length %d", p.MaxLength, p.MinLength)
+	}
+	return nil
+}
+
+// Check returns the rules of p password breaks for the user named user, in
+// the order of the fields of PasswordPolicy, or nil if it follows them all.
+func (p *PasswordPolicy) Check(user, password string) []PasswordViolation {
+	if p == nil {
+		return nil
+	}
+	var res []PasswordViolation
+	add := func(rule, format string, args ...interface{}) {
+		res = append(res, PasswordViolation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	n := utf8.RuneCountInString(password)
+	if n < p.MinLength {
+		add(RuleMinLength, "must have at least %d characters", p.MinLength)
+	}
+	if p.MaxLength > 0 && n > p.MaxLength {
+		add(RuleMaxLength, "must have at most %d characters", p.MaxLength)
+	}
+	var lower, upper, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPrint(c) && !unicode.IsLetter(c):
+			symbol = true
+		}
+	}
+	if p.Lowercase && !lower {
+		add(RuleLowercase, "must have a lowercase letter")
+	}
+	if p.Uppercase && !upper {
+		add(RuleUppercase, "must have an uppercase letter")
+	}
+	if p.Digit && !digit {
+		add(RuleDigit, "must have a digit")
+	}
+	if p.Symbol && !symbol {
+		add(RuleSymbol, "must have a symbol")
+	}
+	if _, ok := p.Banned[strings.ToLower(password)]; ok {
+		add(RuleBanned, "is too common")
+	}
+	if name, _ := TenantOf(user).Local(user); p.RejectUserName && name != "" &&
+		strings.Contains(strings.ToLower(password), strings.ToLower(name)) {
+		add(RuleUserName, "must not contain the user name")
+	}
+	return res
+}
+
+// LoadBannedPasswords reads the file at path of one password per line into
+// a set for PasswordPolicy.Banned. Blank lines and lines starting with #
+// are skipped.
+func LoadBannedPasswords(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := make(map[string]struct{})
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		res[strings.ToLower(line)] = struct{}{}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("model: read banned passwords %s: %v", path, err)
+	}
+	return res, nil
+}
@@ -0,0 +1,61 @@
+package model
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func rules(vs []PasswordViolation) []string {
+	var res []string
+	for _, v := range vs {
+		res = append(res, v.Rule)
+	}
+	return res
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	var none *PasswordPolicy
+	assert.Nil(t, none.Check("alice", ""))
+	assert.Nil(t, new(PasswordPolicy).Check("alice", ""))
+
+	p := &PasswordPolicy{
+		MinLength:      8,
+		MaxLength:      12,
+		Lowercase:      true,
+		Uppercase:      true,
+		Digit:          true,
+		Symbol:         true,
+		Banned:         map[string]struct{}{"password1!": {}},
+		RejectUserName: true,
+	}
+	assert.Nil(t, p.Validate())
+	assert.Nil(t, p.Check("alice", "Tr0ub4dor&3"))
+	assert.Nil(t, p.Check("alice", "Ünïcödé-1ß"))
+	assert.Equal(t, []string{RuleMinLength, RuleUppercase, RuleDigit, RuleSymbol}, rules(p.Check("alice", "abc")))
+	assert.Equal(t, []string{RuleMaxLength, RuleLowercase}, rules(p.Check("alice", "ABCDEFGHIJK1!X")))
+	assert.Equal(t, []string{RuleBanned}, rules(p.Check("alice", "PassWord1!")))
+	assert.Equal(t, []string{RuleUserName}, rules(p.Check("acme/alice", "x-ALICE-9Y")))
+	assert.Nil(t, p.Check("acme/bob", "x-Acme/9Yz"))
+	assert.Equal(t, "must have at least 8 characters", p.Check("alice", "aB1!")[0].Message)
+
+	for _, p := range []PasswordPolicy{{MinLength: -1}, {MaxLength: -1}, {MinLength: 8, MaxLength: 4}} {
+		assert.NotNil(t, p.Validate())
+	}
+}
+
+func TestLoadBannedPasswords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "banned")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "banned.txt")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("# common passwords\n123456\n\n  Password  \n"), 0600))
+
+	banned, err := LoadBannedPasswords(path)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]struct{}{"123456": {}, "password": {}}, banned)
+
+	_, err = LoadBannedPasswords(filepath.Join(dir, "missing.txt"))
+	assert.NotNil(t, err)
+}
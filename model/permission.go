@@ -0,0 +1,55 @@
+package model
+
+import "strings"
+
+// Permission is what a role allows to do, named by segments separated by
+// colons like "orders:refund". A granted permission may use "*" as a whole
+// segment to match any segment, and as the last one to match all the rest,
+// so "orders:*" allows both "orders:refund" and "orders:refund:partial".
+type Permission struct {
+	Name string
+}
+
+const (
+	permissionSep      = ":"
+	permissionWildcard = "*"
+)
+
+// Valid reports whether p has no empty segment, and wildcards only as whole
+// segments.
+func (p Permission) Valid() bool {
+	if p.Name == "" {
+		return false
+	}
+	for _, s := range strings.Split(p.Name, permissionSep) {
+		if s == "" || (s != permissionWildcard && strings.Contains(s, permissionWildcard)) {
+			return false
+		}
+	}
+	return true
+}
+
+func isWildcardPermission(name string) bool {
+	return strings.Contains(name, permissionWildcard)
+}
+
+// Allows reports whether p granted allows the permission named name.
+func (p Permission) Allows(name string) bool {
+	ps := strings.Split(p.Name, permissionSep)
+	ns := strings.Split(name, permissionSep)
+	for i, s := range ps {
+		if i == len(ns) {
+			return false
+		}
+		if s == permissionWildcard {
+			if i == len(ps)-1 {
+				return true
+			}
+			continue
+		}
+		if s != ns[i] {
+			return false
+		}
+	}
+	return len(ps) == len(ns)
+}
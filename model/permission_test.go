@@ -0,0 +1,40 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPermissionValid(t *testing.T) {
+	for _, p := range []string{"orders", "orders:refund", "orders:*", "*", "*:read", "a:*:c"} {
+		assert.True(t, Permission{Name: p}.Valid(), p)
+	}
+	for _, p := range []string{"", ":", "orders:", ":refund", "orders::refund", "orders:re*", "**"} {
+		assert.False(t, Permission{Name: p}.Valid(), p)
+	}
+}
+
+func TestPermissionAllows(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, name string
+		matched       bool
+	}{
+		{"orders:refund", "orders:refund", true},
+		{"orders:refund", "orders:create", false},
+		{"orders:refund", "orders", false},
+		{"orders", "orders:refund", false},
+		{"orders:*", "orders:refund", true},
+		{"orders:*", "orders:refund:partial", true},
+		{"orders:*", "orders", false},
+		{"orders:*", "users:create", false},
+		{"*", "orders:refund", true},
+		{"*:read", "orders:read", true},
+		{"*:read", "orders:write", false},
+		{"*:read", "orders:read:all", false},
+		{"orders:*:all", "orders:read:all", true},
+		{"orders:*:all", "orders:read:one", false},
+	} {
+		assert.Equal(t, tt.matched, Permission{Name: tt.pattern}.Allows(tt.name), "%s %s", tt.pattern, tt.name)
+	}
+}
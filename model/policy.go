@@ -0,0 +1,660 @@
+package model
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// This file defines a small policy language of attribute-based access
+// control. A policy is a list of rules, like
+//
+//	# Support works from the office network in office hours
+//	allow support-office-hours if "support" in roles
+//	    && attr.hour >= 9 && attr.hour < 18
+//	    && cidr(attr.ip, "10.0.0.0/8")
+//	deny weekend if attr.weekday in ["Sat", "Sun"]
+//	allow owner if attr.owner == user
+//
+// which are evaluated in order, and the first matching one decides. A rule
+// without a condition always matches, and nothing is allowed if no rule
+// matches. In conditions,
+//
+//   - user is the name of the user, and roles are the names of its
+//     effective global roles, both in tenant, which is the name of the
+//     tenant of the user, empty for the default one.
+//   - attr.<key> is an attribute given by the caller, nested attributes are
+//     written like attr.device.os, and a missing one is null.
+//   - Literals are strings, numbers, true, false, null and lists of them.
+//   - Operators are ||, &&, !, ==, !=, <, <=, >, >= of numbers or strings,
+//     and in of lists.
+//   - cidr(ip, network) reports whether ip is in network.
+//
+// Evaluation never fails, an operand of a wrong type makes the operator
+// false, so does a condition which is not a boolean.
+
+// PolicyRequest is what policies are evaluated against.
+type PolicyRequest struct {
+	Tenant     string
+	User       string
+	Roles      []string
+	Attributes map[string]interface{}
+}
+
+// Decision is the result of evaluating policies. Rule is the name of the
+// matched rule, empty if none matched and it's denied by default.
+type Decision struct {
+	Allow bool
+	Rule  string
+}
+
+// PolicyEvaluator is implemented by Policy and PolicyStore.
+type PolicyEvaluator interface {
+	Evaluate(req PolicyRequest) Decision
+}
+
+// Policy is a parsed list of rules, the zero value denies everything.
+type Policy struct {
+	rules []policyRule
+}
+
+type policyRule struct {
+	name  string
+	allow bool
+	cond  policyExpr // nil for always
+	pos   string     // file:line
+}
+
+// ParsePolicy parses src, where name is the file name used in errors.
+func ParsePolicy(name, src string) (*Policy, error) {
+	tokens, err := lexPolicy(name, src)
+	if err != nil {
+		return nil, err
+	}
+	p := &policyParser{name: name, tokens: tokens}
+	res := new(Policy)
+	for !p.done() {
+		r, err := p.rule()
+		if err != nil {
+			return nil, err
+		}
+		res.rules = append(res.rules, r)
+	}
+	return res, res.check()
+}
+
+// Evaluate returns the decision of the first rule matching req.
+func (p *Policy) Evaluate(req PolicyRequest) Decision {
+	env := &policyEnv{req: req}
+	for _, r := range p.rules {
+		if r.cond == nil || r.cond.eval(env) == true {
+			return Decision{Allow: r.allow, Rule: r.name}
+		}
+	}
+	return Decision{}
+}
+
+// Rules returns the number of rules of p.
+func (p *Policy) Rules() int {
+	return len(p.rules)
+}
+
+// concat returns the rules of ps in order, rule names must be unique.
+func concat(ps ...*Policy) (*Policy, error) {
+	res := new(Policy)
+	for _, p := range ps {
+		res.rules = append(res.rules, p.rules...)
+	}
+	return res, res.check()
+}
+
+func (p *Policy) check() error {
+	seen := make(map[string]string, len(p.rules))
+	for _, r := range p.rules {
+		if pos, ok := seen[r.name]; ok {
+			return fmt.Errorf("model: policy %s: rule %s already defined at %s", r.pos, r.name, pos)
+		}
+		seen[r.name] = r.pos
+	}
+	return nil
+}
+
+//
+// lexer
+//
+
+type policyTokenKind int
+
+const (
+	tokenIdent policyTokenKind = iota
+	tokenString
+	tokenNumber
+	tokenPunct
+	tokenEOF
+)
+
+type policyToken struct {
+	kind policyTokenKind
+	text string // unquoted for strings
+	line int
+}
+
+func lexPolicy(name, src string) ([]policyToken, error) {
+	var res []policyToken
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) || src[j] != '"' {
+				return nil, fmt.Errorf("model: policy %s:%d: unterminated string", name, line)
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("model: policy %s:%d: invalid string %s", name, line, src[i:j+1])
+			}
+			res = append(res, policyToken{tokenString, s, line})
+			i = j + 1
+		case isDigit(c) || c == '-' && i+1 < len(src) && isDigit(src[i+1]):
+			j := i + 1
+			for j < len(src) && (isDigit(src[j]) || src[j] == '.') {
+				j++
+			}
+			if _, err := strconv.ParseFloat(src[i:j], 64); err != nil {
+				return nil, fmt.Errorf("model: policy %s:%d: invalid number %s", name, line, src[i:j])
+			}
+			res = append(res, policyToken{tokenNumber, src[i:j], line})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] == '-' || isDigit(src[j]) || unicode.IsLetter(rune(src[j]))) {
+				j++
+			}
+			res = append(res, policyToken{tokenIdent, src[i:j], line})
+			i = j
+		default:
+			punct := ""
+			for _, p := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ",", "."} {
+				if strings.HasPrefix(src[i:], p) {
+					punct = p
+					break
+				}
+			}
+			if punct == "" {
+				return nil, fmt.Errorf("model: policy %s:%d: unexpected %q", name, line, c)
+			}
+			res = append(res, policyToken{tokenPunct, punct, line})
+			i += len(punct)
+		}
+	}
+	return append(res, policyToken{kind: tokenEOF, line: line}), nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+//
+// parser
+//
+
+type policyParser struct {
+	name   string
+	tokens []policyToken
+	i      int
+}
+
+func (p *policyParser) peek() policyToken {
+	return p.tokens[p.i]
+}
+
+func (p *policyParser) next() policyToken {
+	t := p.tokens[p.i]
+	if t.kind != tokenEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *policyParser) done() bool {
+	return p.peek().kind == tokenEOF
+}
+
+// accept consumes the next token if it's the punctuation or keyword s.
+func (p *policyParser) accept(s string) bool {
+	t := p.peek()
+	if (t.kind == tokenPunct || t.kind == tokenIdent) && t.text == s {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *policyParser) errorf(t policyToken, format string, args ...interface{}) error {
+	return fmt.Errorf("model: policy %s:%d: %s", p.name, t.line, fmt.Sprintf(format, args...))
+}
+
+func (t policyToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of file"
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return t.text
+}
+
+// isRuleStart reports whether t starts the next rule, which ends the
+// condition of the current one.
+func (t policyToken) isRuleStart() bool {
+	return t.kind == tokenEOF || t.kind == tokenIdent && (t.text == "allow" || t.text == "deny")
+}
+
+func (p *policyParser) rule() (policyRule, error) {
+	t := p.next()
+	if t.kind != tokenIdent || t.text != "allow" && t.text != "deny" {
+		return policyRule{}, p.errorf(t, "expect allow or deny, found %v", t)
+	}
+	r := policyRule{allow: t.text == "allow", pos: fmt.Sprintf("%s:%d", p.name, t.line)}
+	name := p.next()
+	if name.kind != tokenIdent || name.isRuleStart() || name.text == "if" {
+		return policyRule{}, p.errorf(name, "expect rule name, found %v", name)
+	}
+	r.name = name.text
+	if p.peek().isRuleStart() {
+		return r, nil
+	}
+	if t := p.next(); t.kind != tokenIdent || t.text != "if" {
+		return policyRule{}, p.errorf(t, "expect if, found %v", t)
+	}
+	cond, err := p.or()
+	if err != nil {
+		return policyRule{}, err
+	}
+	if t := p.peek(); !t.isRuleStart() {
+		return policyRule{}, p.errorf(t, "unexpected %v", t)
+	}
+	r.cond = cond
+	return r, nil
+}
+
+func (p *policyParser) or() (policyExpr, error) {
+	l, err := p.and()
+	for err == nil && p.accept("||") {
+		var r policyExpr
+		if r, err = p.and(); err == nil {
+			l = orExpr{l, r}
+		}
+	}
+	return l, err
+}
+
+func (p *policyParser) and() (policyExpr, error) {
+	l, err := p.not()
+	for err == nil && p.accept("&&") {
+		var r policyExpr
+		if r, err = p.not(); err == nil {
+			l = andExpr{l, r}
+		}
+	}
+	return l, err
+}
+
+func (p *policyParser) not() (policyExpr, error) {
+	if p.accept("!") {
+		x, err := p.not()
+		return notExpr{x}, err
+	}
+	return p.compare()
+}
+
+func (p *policyParser) compare() (policyExpr, error) {
+	l, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if p.accept(op) {
+			r, err := p.primary()
+			return compareExpr{op, l, r}, err
+		}
+	}
+	return l, nil
+}
+
+func (p *policyParser) primary() (policyExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return literalExpr{t.text}, nil
+	case tokenNumber:
+		f, _ := strconv.ParseFloat(t.text, 64)
+		return literalExpr{f}, nil
+	case tokenPunct:
+		switch t.text {
+		case "(":
+			x, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			if t := p.next(); t.text != ")" || t.kind != tokenPunct {
+				return nil, p.errorf(t, "expect ), found %v", t)
+			}
+			return x, nil
+		case "[":
+			return p.list()
+		}
+	case tokenIdent:
+		switch t.text {
+		case "true", "false":
+			return literalExpr{t.text == "true"}, nil
+		case "null":
+			return literalExpr{nil}, nil
+		case "tenant":
+			return tenantExpr{}, nil
+		case "user":
+			return userExpr{}, nil
+		case "roles":
+			return rolesExpr{}, nil
+		case "attr":
+			return p.attr()
+		}
+		if fn, ok := policyFuncs[t.text]; ok {
+			return p.call(t, fn)
+		}
+		if !t.isRuleStart() {
+			return nil, p.errorf(t, "undefined %v", t)
+		}
+	}
+	return nil, p.errorf(t, "unexpected %v", t)
+}
+
+func (p *policyParser) list() (policyExpr, error) {
+	var res listExpr
+	if p.accept("]") {
+		return res, nil
+	}
+	for {
+		x, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, x)
+		if p.accept("]") {
+			return res, nil
+		}
+		if t := p.next(); t.text != "," || t.kind != tokenPunct {
+			return nil, p.errorf(t, "expect , or ], found %v", t)
+		}
+	}
+}
+
+func (p *policyParser) attr() (policyExpr, error) {
+	var res attrExpr
+	for len(res) == 0 || p.peek().text == "." && p.peek().kind == tokenPunct {
+		if t := p.next(); t.text != "." || t.kind != tokenPunct {
+			return nil, p.errorf(t, "expect ., found %v", t)
+		}
+		t := p.next()
+		if t.kind != tokenIdent {
+			return nil, p.errorf(t, "expect attribute name, found %v", t)
+		}
+		res = append(res, t.text)
+	}
+	return res, nil
+}
+
+func (p *policyParser) call(name policyToken, fn policyFunc) (policyExpr, error) {
+	if t := p.next(); t.text != "(" || t.kind != tokenPunct {
+		return nil, p.errorf(t, "expect (, found %v", t)
+	}
+	res := callExpr{fn: fn.fn}
+	for !p.accept(")") {
+		if len(res.args) > 0 {
+			if t := p.next(); t.text != "," || t.kind != tokenPunct {
+				return nil, p.errorf(t, "expect , or ), found %v", t)
+			}
+		}
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		res.args = append(res.args, x)
+	}
+	if len(res.args) != fn.args {
+		return nil, p.errorf(name, "%s takes %d arguments, found %d", name.text, fn.args, len(res.args))
+	}
+	return res, nil
+}
+
+//
+// evaluation
+//
+
+type policyEnv struct {
+	req PolicyRequest
+}
+
+// policyExpr evaluates to nil, bool, float64, string or []interface{}, or
+// map[string]interface{} of nested attributes.
+type policyExpr interface {
+	eval(env *policyEnv) interface{}
+}
+
+type (
+	literalExpr struct{ v interface{} }
+	listExpr    []policyExpr
+	tenantExpr  struct{}
+	userExpr    struct{}
+	rolesExpr   struct{}
+	attrExpr    []string
+	notExpr     struct{ x policyExpr }
+	andExpr     struct{ l, r policyExpr }
+	orExpr      struct{ l, r policyExpr }
+	compareExpr struct {
+		op   string
+		l, r policyExpr
+	}
+	callExpr struct {
+		fn   func(args []interface{}) interface{}
+		args []policyExpr
+	}
+)
+
+func (x literalExpr) eval(*policyEnv) interface{} { return x.v }
+
+func (x listExpr) eval(env *policyEnv) interface{} {
+	res := make([]interface{}, 0, len(x))
+	for _, v := range x {
+		res = append(res, v.eval(env))
+	}
+	return res
+}
+
+func (tenantExpr) eval(env *policyEnv) interface{} { return env.req.Tenant }
+
+func (userExpr) eval(env *policyEnv) interface{} { return env.req.User }
+
+func (rolesExpr) eval(env *policyEnv) interface{} {
+	res := make([]interface{}, 0, len(env.req.Roles))
+	for _, r := range env.req.Roles {
+		res = append(res, r)
+	}
+	return res
+}
+
+func (x attrExpr) eval(env *policyEnv) interface{} {
+	var v interface{} = env.req.Attributes
+	for _, k := range x {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return normalize(v)
+}
+
+func (x notExpr) eval(env *policyEnv) interface{} {
+	b, ok := x.x.eval(env).(bool)
+	return ok && !b
+}
+
+func (x andExpr) eval(env *policyEnv) interface{} {
+	return x.l.eval(env) == true && x.r.eval(env) == true
+}
+
+func (x orExpr) eval(env *policyEnv) interface{} {
+	return x.l.eval(env) == true || x.r.eval(env) == true
+}
+
+func (x compareExpr) eval(env *policyEnv) interface{} {
+	l, r := x.l.eval(env), x.r.eval(env)
+	switch x.op {
+	case "==":
+		return equal(l, r)
+	case "!=":
+		return !equal(l, r)
+	case "in":
+		list, ok := r.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, v := range list {
+			if equal(l, v) {
+				return true
+			}
+		}
+		return false
+	}
+	var c int
+	switch l := l.(type) {
+	case float64:
+		r, ok := r.(float64)
+		if !ok {
+			return false
+		}
+		if l < r {
+			c = -1
+		} else if l > r {
+			c = 1
+		}
+	case string:
+		r, ok := r.(string)
+		if !ok {
+			return false
+		}
+		c = strings.Compare(l, r)
+	default:
+		return false
+	}
+	switch x.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func (x callExpr) eval(env *policyEnv) interface{} {
+	args := make([]interface{}, 0, len(x.args))
+	for _, v := range x.args {
+		args = append(args, v.eval(env))
+	}
+	return x.fn(args)
+}
+
+func equal(l, r interface{}) bool {
+	switch l := l.(type) {
+	case []interface{}:
+		r, ok := r.([]interface{})
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for i := range l {
+			if !equal(l[i], r[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		return false
+	}
+	if _, ok := r.(map[string]interface{}); ok {
+		return false
+	}
+	if _, ok := r.([]interface{}); ok {
+		return false
+	}
+	return l == r
+}
+
+// normalize converts attributes given by Go callers to the values of
+// policyExpr, while JSON decoded ones are already.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case []string:
+		res := make([]interface{}, 0, len(v))
+		for _, s := range v {
+			res = append(res, s)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, 0, len(v))
+		for _, s := range v {
+			res = append(res, normalize(s))
+		}
+		return res
+	}
+	return v
+}
+
+type policyFunc struct {
+	args int
+	fn   func(args []interface{}) interface{}
+}
+
+var policyFuncs = map[string]policyFunc{
+	"cidr": {2, func(args []interface{}) interface{} {
+		ip, _ := args[0].(string)
+		network, _ := args[1].(string)
+		_, n, err := net.ParseCIDR(network)
+		parsed := net.ParseIP(ip)
+		return err == nil && parsed != nil && n.Contains(parsed)
+	}},
+}
@@ -0,0 +1,123 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `
+# Blocked countries first, whoever it is
+deny blocked if attr.country in ["XX", "YY"]
+
+allow admin if "admin" in roles
+allow support-office-hours if "support" in roles
+    && attr.hour >= 9 && attr.hour < 18
+    && cidr(attr.ip, "10.0.0.0/8")
+allow owner if attr.resource.owner == user && !attr.resource.locked
+allow public if attr.visibility == "public" || attr.tags == ["public"]
+`
+
+func TestPolicyEvaluate(t *testing.T) {
+	p, err := ParsePolicy("test.policy", testPolicy)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, p.Rules())
+
+	office := map[string]interface{}{"hour": 10, "ip": "10.1.2.3"}
+	for _, tt := range []struct {
+		req PolicyRequest
+		exp Decision
+	}{
+		{PolicyRequest{User: "alice", Roles: []string{"admin"}}, Decision{true, "admin"}},
+		{PolicyRequest{User: "alice", Roles: []string{"admin"}, Attributes: map[string]interface{}{"country": "XX"}}, Decision{false, "blocked"}},
+		{PolicyRequest{User: "bob", Roles: []string{"support"}, Attributes: office}, Decision{true, "support-office-hours"}},
+		{PolicyRequest{User: "bob", Roles: []string{"support"}, Attributes: map[string]interface{}{"hour": 8.5, "ip": "10.1.2.3"}}, Decision{}},
+		{PolicyRequest{User: "bob", Roles: []string{"support"}, Attributes: map[string]interface{}{"hour": 10, "ip": "192.168.1.1"}}, Decision{}},
+		{PolicyRequest{User: "bob", Roles: []string{"support"}, Attributes: map[string]interface{}{"hour": "10", "ip": "10.1.2.3"}}, Decision{}},
+		{PolicyRequest{User: "bob", Roles: []string{"support"}}, Decision{}},
+		{PolicyRequest{User: "bob", Attributes: office}, Decision{}},
+		{PolicyRequest{User: "carol", Attributes: map[string]interface{}{
+			"resource": map[string]interface{}{"owner": "carol"}}}, Decision{}},
+		{PolicyRequest{User: "carol", Attributes: map[string]interface{}{
+			"resource": map[string]interface{}{"owner": "carol", "locked": false}}}, Decision{true, "owner"}},
+		{PolicyRequest{User: "carol", Attributes: map[string]interface{}{
+			"resource": map[string]interface{}{"owner": "dave", "locked": false}}}, Decision{}},
+		{PolicyRequest{Attributes: map[string]interface{}{"visibility": "public"}}, Decision{true, "public"}},
+		{PolicyRequest{Attributes: map[string]interface{}{"tags": []string{"public"}}}, Decision{true, "public"}},
+		{PolicyRequest{Attributes: map[string]interface{}{"tags": []interface{}{"public", "new"}}}, Decision{}},
+		{PolicyRequest{}, Decision{}},
+	} {
+		assert.Equal(t, tt.exp, p.Evaluate(tt.req), "%+v", tt.req)
+	}
+}
+
+func TestPolicyOperators(t *testing.T) {
+	req := PolicyRequest{Tenant: "acme", User: "alice", Roles: []string{"a", "b"}, Attributes: map[string]interface{}{
+		"n": 3, "s": "abc", "t": true, "l": []interface{}{1.0, "x"},
+	}}
+	for cond, exp := range map[string]bool{
+		`attr.n == 3`:                    true,
+		`attr.n != 3`:                    false,
+		`attr.n > -1 && attr.n <= 3.0`:   true,
+		`attr.n < 3 || attr.n >= 4`:      false,
+		`attr.s > "abb" && attr.s < "b"`: true,
+		`attr.s < 4`:                     false,
+		`!(attr.s < 4)`:                  true,
+		`attr.t`:                         true,
+		`!attr.t`:                        false,
+		`attr.s`:                         false,
+		`!attr.s`:                        false,
+		`attr.missing == null`:           true,
+		`attr.missing.deeper == null`:    true,
+		`attr.missing != 3`:              true,
+		`"x" in attr.l && 1 in attr.l`:   true,
+		`"y" in attr.l`:                  false,
+		`"a" in attr.s`:                  false,
+		`roles == ["a", "b"]`:            true,
+		`tenant == "acme"`:               true,
+		`user in []`:                     false,
+		`cidr("::1", "::1/128")`:         true,
+		`cidr("1.2.3.4", "bad")`:         false,
+		`cidr(attr.n, "10.0.0.0/8")`:     false,
+		`true && (false || !false)`:      true,
+	} {
+		p, err := ParsePolicy("test.policy", "allow x if "+cond)
+		assert.Nil(t, err, cond)
+		assert.Equal(t, exp, p.Evaluate(req).Allow, cond)
+	}
+}
+
+func TestParsePolicyInvalid(t *testing.T) {
+	p, err := ParsePolicy("empty.policy", "# nothing\n")
+	assert.Nil(t, err)
+	assert.Equal(t, Decision{}, p.Evaluate(PolicyRequest{}))
+	p, err = ParsePolicy("always.policy", "deny nobody if false\nallow everyone")
+	assert.Nil(t, err)
+	assert.Equal(t, Decision{true, "everyone"}, p.Evaluate(PolicyRequest{}))
+
+	for src, msg := range map[string]string{
+		`permit x`:                         "bad.policy:1: expect allow or deny, found permit",
+		`allow`:                            "bad.policy:1: expect rule name, found end of file",
+		`allow if true`:                    "bad.policy:1: expect rule name, found if",
+		`allow x when true`:                "bad.policy:1: expect if, found when",
+		"allow x if\n\n":                   "bad.policy:3: unexpected end of file",
+		"allow x if true\ndeny x if false": "bad.policy:2: rule x already defined at bad.policy:1",
+		`allow x if "a" in roles roles`:    "bad.policy:1: unexpected roles",
+		`allow x if name == "a"`:           "bad.policy:1: undefined name",
+		`allow x if attr.`:                 "bad.policy:1: expect attribute name, found end of file",
+		`allow x if attr`:                  "bad.policy:1: expect ., found end of file",
+		`allow x if (true`:                 "bad.policy:1: expect ), found end of file",
+		`allow x if [1 2]`:                 "bad.policy:1: expect , or ], found 2",
+		`allow x if cidr("a")`:             "bad.policy:1: cidr takes 2 arguments, found 1",
+		`allow x if cidr "a"`:              `bad.policy:1: expect (, found "a"`,
+		`allow x if "a`:                    "bad.policy:1: unterminated string",
+		`allow x if 1.2.3 == 1`:            "bad.policy:1: invalid number 1.2.3",
+		`allow x if a = b`:                 "bad.policy:1: unexpected '='",
+		"allow x if true\nallow y if deny": "bad.policy:2: unexpected deny",
+	} {
+		_, err := ParsePolicy("bad.policy", src)
+		if assert.NotNil(t, err, src) {
+			assert.Equal(t, "model: policy "+msg, err.Error(), src)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package model
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PolicyExt is the extension of policy files in a directory.
+const PolicyExt = ".policy"
+
+// PolicyStore serves the policy loaded from a file, or from the *.policy
+// files in a directory in the order of their names, and reloads it when the
+// files change. It's safe for concurrent use.
+type PolicyStore struct {
+	path   string
+	policy atomic.Value // *Policy
+
+	mu    sync.Mutex // serializes reloads
+	stamp string     // names, sizes and modification times of the files
+
+	closeOnce sync.Once
+	exitChan  chan struct{}
+}
+
+// NewPolicyStore loads the policy from path, which is a file or directory.
+func NewPolicyStore(path string) (*PolicyStore, error) {
+	s := &PolicyStore{path: path, exitChan: make(chan struct{})}
+	s.policy.Store(new(Policy))
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Evaluate evaluates req against the current policy.
+func (s *PolicyStore) Evaluate(req PolicyRequest) Decision {
+	return s.Policy().Evaluate(req)
+}
+
+// Policy returns the current policy.
+func (s *PolicyStore) Policy() *Policy {
+	return s.policy.Load().(*Policy)
+}
+
+// Reload loads the policy again if the files changed since last time, and
+// reports whether it did. The current policy is kept if the files are
+// invalid, so a bad edit never takes effect partially.
+func (s *PolicyStore) Reload() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, stamp, err := policyFiles(s.path)
+	if err != nil {
+		return false, err
+	}
+	if stamp == s.stamp {
+		return false, nil
+	}
+	policies := make([]*Policy, 0, len(files))
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return false, err
+		}
+		p, err := ParsePolicy(f, string(b))
+		if err != nil {
+			return false, err
+		}
+		policies = append(policies, p)
+	}
+	p, err := concat(policies...)
+	if err != nil {
+		return false, err
+	}
+	s.policy.Store(p)
+	s.stamp = stamp
+	return true, nil
+}
+
+// Watch reloads the policy every interval in background until Close, and
+// calls onReload, if not nil, after each reload with nil, or with an error
+// unless it's the same as the last one.
+func (s *PolicyStore) Watch(interval time.Duration, onReload func(error)) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		last := ""
+		for {
+			select {
+			case <-t.C:
+				reloaded, err := s.Reload()
+				msg := ""
+				if err != nil {
+					msg = err.Error()
+				}
+				if (reloaded || msg != last) && onReload != nil {
+					onReload(err)
+				}
+				last = msg
+			case <-s.exitChan:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops watching.
+func (s *PolicyStore) Close() {
+	s.closeOnce.Do(func() { close(s.exitChan) })
+}
+
+// policyFiles returns the policy files of path, and a stamp which changes
+// when any of them changes.
+func policyFiles(path string) ([]string, string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	var files []string
+	if fi.IsDir() {
+		files, err = filepath.Glob(filepath.Join(path, "*"+PolicyExt))
+		if err != nil {
+			return nil, "", err
+		}
+		sort.Strings(files)
+	} else {
+		files = []string{path}
+	}
+	var stamp strings.Builder
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, "", err
+		}
+		if fi.IsDir() {
+			return nil, "", fmt.Errorf("model: policy %s is a directory", f)
+		}
+		fmt.Fprintf(&stamp, "%s %d %d\n", f, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return files, stamp.String(), nil
+}
@@ -0,0 +1,78 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePolicy(t *testing.T, path, src string) {
+	assert.Nil(t, ioutil.WriteFile(path, []byte(src), 0600))
+	// Make sure the change is seen on file systems with coarse timestamps
+	mtime := time.Now().Add(time.Duration(len(src)) * time.Second)
+	assert.Nil(t, os.Chtimes(path, mtime, mtime))
+}
+
+func TestPolicyStoreDir(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPolicyStore(dir)
+	assert.Nil(t, err)
+	defer s.Close()
+	admin := PolicyRequest{User: "alice", Roles: []string{"admin"}}
+	assert.Equal(t, Decision{}, s.Evaluate(admin))
+
+	writePolicy(t, filepath.Join(dir, "10-deny.policy"), `deny blocked if attr.country == "XX"`)
+	writePolicy(t, filepath.Join(dir, "20-allow.policy"), `allow admin if "admin" in roles`)
+	writePolicy(t, filepath.Join(dir, "ignored.txt"), `allow everyone`)
+	reloaded, err := s.Reload()
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, Decision{true, "admin"}, s.Evaluate(admin))
+	admin.Attributes = map[string]interface{}{"country": "XX"}
+	assert.Equal(t, Decision{false, "blocked"}, s.Evaluate(admin))
+
+	reloaded, err = s.Reload()
+	assert.Nil(t, err)
+	assert.False(t, reloaded)
+
+	// An invalid file keeps the current policy
+	writePolicy(t, filepath.Join(dir, "30-bad.policy"), `allow admin`)
+	_, err = s.Reload()
+	assert.EqualError(t, err, "model: policy "+filepath.Join(dir, "30-bad.policy")+":1: rule admin already defined at "+filepath.Join(dir, "20-allow.policy")+":1")
+	assert.Equal(t, Decision{false, "blocked"}, s.Evaluate(admin))
+	assert.Nil(t, os.Remove(filepath.Join(dir, "30-bad.policy")))
+	assert.Nil(t, os.Remove(filepath.Join(dir, "10-deny.policy")))
+	reloaded, err = s.Reload()
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, Decision{true, "admin"}, s.Evaluate(admin))
+}
+
+func TestPolicyStoreWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.policy")
+	_, err := NewPolicyStore(path)
+	assert.NotNil(t, err)
+	writePolicy(t, path, `allow admin if "admin" in roles`)
+	s, err := NewPolicyStore(path)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	reloads := make(chan error, 10)
+	s.Watch(time.Millisecond, func(err error) { reloads <- err })
+	req := PolicyRequest{User: "alice", Roles: []string{"admin"}}
+	assert.Equal(t, Decision{true, "admin"}, s.Evaluate(req))
+
+	writePolicy(t, path, `allow everyone if user == "bob"`)
+	assert.Nil(t, <-reloads)
+	assert.Equal(t, Decision{}, s.Evaluate(req))
+	writePolicy(t, path, `allow everyone if`)
+	assert.NotNil(t, <-reloads)
+	req.User = "bob"
+	assert.Equal(t, Decision{true, "everyone"}, s.Evaluate(req))
+	s.Close()
+	s.Close()
+}
@@ -0,0 +1,242 @@
+package model
+
+import (
+	"sort"
+	"sync"
+)
+
+// RelationEngine stores relation tuples, see tuple.go, and evaluates them
+// by the namespace configurations, see namespace.go.
+type RelationEngine interface {
+	SetNamespace(n Namespace) StatusCode
+	WriteTuple(t RelationTuple) StatusCode
+	DeleteTuple(t RelationTuple) StatusCode
+	Check(o Object, relation string, s Subject) StatusCode
+	Expand(o Object, relation string) (UsersetTree, StatusCode)
+	ListObjects(namespace, relation string, s Subject) ([]Object, StatusCode)
+}
+
+// UsersetTree is the expansion of Relation of Object. Subjects are the ones
+// of its own tuples, where usersets are left to be expanded by the caller,
+// and Children are the expansions of the computed and tuple to usersets.
+type UsersetTree struct {
+	Object   Object
+	Relation string
+	Subjects []Subject
+	Children []UsersetTree
+}
+
+type objectRelation struct {
+	Object   Object
+	Relation string
+}
+
+type inmemRelationEngine struct {
+	sync.RWMutex
+	namespaces map[string]Namespace
+	tuples     map[objectRelation]map[Subject]struct{}
+	objects    map[string]map[string]int // Namespace - ID - number of tuples
+}
+
+// NewInmemRelationEngine returns an empty relation engine in memory.
+func NewInmemRelationEngine() RelationEngine {
+	return &inmemRelationEngine{
+		namespaces: make(map[string]Namespace),
+		tuples:     make(map[objectRelation]map[Subject]struct{}),
+		objects:    make(map[string]map[string]int),
+	}
+}
+
+// SetNamespace creates or replaces the configuration of n.Name. Tuples of
+// relations which are removed are kept, but never evaluated.
+func (e *inmemRelationEngine) SetNamespace(n Namespace) StatusCode {
+	if err := n.Validate(); err != nil {
+		return NamespaceInvalid
+	}
+	e.Lock()
+	defer e.Unlock()
+	e.namespaces[n.Name] = n
+	return NamespaceSaved
+}
+
+func (e *inmemRelationEngine) WriteTuple(t RelationTuple) StatusCode {
+	if !validTuple(t) {
+		return TupleInvalid
+	}
+	e.Lock()
+	defer e.Unlock()
+	if status := e.checkRelation(t.Object.Namespace, t.Relation); status != OK {
+		return status
+	}
+	key := objectRelation{t.Object, t.Relation}
+	subjects, ok := e.tuples[key]
+	if !ok {
+		subjects = make(map[Subject]struct{})
+		e.tuples[key] = subjects
+	}
+	if _, ok := subjects[t.Subject]; ok {
+		return TupleAlreadyExisting
+	}
+	subjects[t.Subject] = struct{}{}
+	ids, ok := e.objects[t.Object.Namespace]
+	if !ok {
+		ids = make(map[string]int)
+		e.objects[t.Object.Namespace] = ids
+	}
+	ids[t.Object.ID]++
+	return TupleWritten
+}
+
+func (e *inmemRelationEngine) DeleteTuple(t RelationTuple) StatusCode {
+	e.Lock()
+	defer e.Unlock()
+	key := objectRelation{t.Object, t.Relation}
+	if _, ok := e.tuples[key][t.Subject]; !ok {
+		return TupleNotFound
+	}
+	delete(e.tuples[key], t.Subject)
+	if len(e.tuples[key]) == 0 {
+		delete(e.tuples, key)
+	}
+	ids := e.objects[t.Object.Namespace]
+	if ids[t.Object.ID]--; ids[t.Object.ID] == 0 {
+		delete(ids, t.Object.ID)
+	}
+	return TupleDeleted
+}
+
+// Check reports whether s has relation to o, directly or through the
+// rewrites of the relation.
+func (e *inmemRelationEngine) Check(o Object, relation string, s Subject) StatusCode {
+	e.RLock()
+	defer e.RUnlock()
+	if status := e.checkRelation(o.Namespace, relation); status != OK {
+		return status
+	}
+	if e.check(o, relation, s, make(map[objectRelation]struct{})) {
+		return CheckOK
+	}
+	return CheckDenied
+}
+
+func (e *inmemRelationEngine) Expand(o Object, relation string) (UsersetTree, StatusCode) {
+	e.RLock()
+	defer e.RUnlock()
+	if status := e.checkRelation(o.Namespace, relation); status != OK {
+		return UsersetTree{}, status
+	}
+	return e.expand(o, relation, make(map[objectRelation]struct{})), OK
+}
+
+// ListObjects returns the objects of namespace which s has relation to, by
+// checking every object of the namespace having any tuple.
+func (e *inmemRelationEngine) ListObjects(namespace, relation string, s Subject) ([]Object, StatusCode) {
+	e.RLock()
+	defer e.RUnlock()
+	if status := e.checkRelation(namespace, relation); status != OK {
+		return nil, status
+	}
+	res := make([]Object, 0)
+	for id := range e.objects[namespace] {
+		o := Object{Namespace: namespace, ID: id}
+		if e.check(o, relation, s, make(map[objectRelation]struct{})) {
+			res = append(res, o)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, OK
+}
+
+// checkRelation must hold the lock.
+func (e *inmemRelationEngine) checkRelation(namespace, relation string) StatusCode {
+	n, ok := e.namespaces[namespace]
+	if !ok {
+		return NamespaceNotFound
+	}
+	if _, ok := n.relation(relation); !ok {
+		return RelationUndefined
+	}
+	return OK
+}
+
+// check walks the rewrites depth first, visiting each relation of an
+// object once, as it's either being checked or failed already.
+func (e *inmemRelationEngine) check(o Object, relation string, s Subject, visited map[objectRelation]struct{}) bool {
+	key := objectRelation{o, relation}
+	if _, ok := visited[key]; ok {
+		return false
+	}
+	visited[key] = struct{}{}
+	if s.Object == o && s.Relation == relation {
+		return true
+	}
+	usersets, ok := e.namespaces[o.Namespace].relation(relation)
+	if !ok {
+		return false
+	}
+	for _, u := range usersets {
+		switch {
+		case u.This:
+			subjects := e.tuples[key]
+			if _, ok := subjects[s]; ok {
+				return true
+			}
+			for v := range subjects {
+				if v.Relation != "" && e.check(v.Object, v.Relation, s, visited) {
+					return true
+				}
+			}
+		case u.ComputedUserset != "":
+			if e.check(o, u.ComputedUserset, s, visited) {
+				return true
+			}
+		case u.TupleToUserset != nil:
+			for v := range e.tuples[objectRelation{o, u.TupleToUserset.Tupleset}] {
+				if e.check(v.Object, u.TupleToUserset.ComputedUserset, s, visited) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// expand must hold the lock, path guards against cycles.
+func (e *inmemRelationEngine) expand(o Object, relation string, path map[objectRelation]struct{}) UsersetTree {
+	res := UsersetTree{Object: o, Relation: relation}
+	key := objectRelation{o, relation}
+	usersets, ok := e.namespaces[o.Namespace].relation(relation)
+	if _, cycle := path[key]; cycle || !ok {
+		return res
+	}
+	path[key] = struct{}{}
+	defer delete(path, key)
+
+	for _, u := range usersets {
+		switch {
+		case u.This:
+			for v := range e.tuples[key] {
+				res.Subjects = append(res.Subjects, v)
+			}
+			sort.Slice(res.Subjects, func(i, j int) bool { return res.Subjects[i].String() < res.Subjects[j].String() })
+		case u.ComputedUserset != "":
+			res.Children = append(res.Children, e.expand(o, u.ComputedUserset, path))
+		case u.TupleToUserset != nil:
+			var objects []Object
+			for v := range e.tuples[objectRelation{o, u.TupleToUserset.Tupleset}] {
+				objects = append(objects, v.Object)
+			}
+			sort.Slice(objects, func(i, j int) bool { return objects[i].String() < objects[j].String() })
+			for _, v := range objects {
+				res.Children = append(res.Children, e.expand(v, u.TupleToUserset.ComputedUserset, path))
+			}
+		}
+	}
+	return res
+}
+
+// validTuple reports whether t is written the same as parsed.
+func validTuple(t RelationTuple) bool {
+	parsed, err := ParseRelationTuple(t.String())
+	return err == nil && parsed == t
+}
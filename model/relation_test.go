@@ -0,0 +1,177 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testNamespaces = []Namespace{
+	{Name: "group", Relations: []Relation{{Name: "member"}}},
+	{Name: "folder", Relations: []Relation{
+		{Name: "owner"},
+		{Name: "viewer", Union: []Userset{{This: true}, {ComputedUserset: "owner"}}},
+	}},
+	{Name: "doc", Relations: []Relation{
+		{Name: "parent"},
+		{Name: "owner"},
+		{Name: "editor", Union: []Userset{{This: true}, {ComputedUserset: "owner"}}},
+		{Name: "viewer", Union: []Userset{
+			{This: true},
+			{ComputedUserset: "editor"},
+			{TupleToUserset: &TupleToUserset{Tupleset: "parent", ComputedUserset: "viewer"}},
+		}},
+	}},
+}
+
+func mustTuple(t *testing.T, s string) RelationTuple {
+	tuple, err := ParseRelationTuple(s)
+	assert.Nil(t, err)
+	return tuple
+}
+
+func mustSubject(t *testing.T, s string) Subject {
+	sub, err := ParseSubject(s)
+	assert.Nil(t, err)
+	return sub
+}
+
+func newRelationEngineForTesting(t *testing.T, tuples ...string) RelationEngine {
+	e := NewInmemRelationEngine()
+	for _, n := range testNamespaces {
+		statusCodeEqual(t, NamespaceSaved, e.SetNamespace(n))
+	}
+	for _, s := range tuples {
+		statusCodeEqual(t, TupleWritten, e.WriteTuple(mustTuple(t, s)))
+	}
+	return e
+}
+
+func TestNamespaceValidate(t *testing.T) {
+	for _, n := range testNamespaces {
+		assert.Nil(t, n.Validate())
+	}
+	for _, n := range []Namespace{
+		{Name: ""},
+		{Name: "doc:x"},
+		{Name: "doc", Relations: []Relation{{Name: "viewer"}, {Name: "viewer"}}},
+		{Name: "doc", Relations: []Relation{{Name: "viewer#x"}}},
+		{Name: "doc", Relations: []Relation{{Name: "viewer", Union: []Userset{{ComputedUserset: "editor"}}}}},
+		{Name: "doc", Relations: []Relation{{Name: "viewer", Union: []Userset{{}}}}},
+		{Name: "doc", Relations: []Relation{{Name: "viewer", Union: []Userset{{This: true, ComputedUserset: "viewer"}}}}},
+		{Name: "doc", Relations: []Relation{{Name: "viewer", Union: []Userset{
+			{TupleToUserset: &TupleToUserset{Tupleset: "parent", ComputedUserset: "viewer"}}}}}},
+		{Name: "doc", Relations: []Relation{{Name: "parent"}, {Name: "viewer", Union: []Userset{
+			{TupleToUserset: &TupleToUserset{Tupleset: "parent"}}}}}},
+	} {
+		assert.NotNil(t, n.Validate(), "%+v", n)
+	}
+}
+
+func TestRelationWrite(t *testing.T) {
+	e := newRelationEngineForTesting(t)
+	tuple := mustTuple(t, "doc:readme#viewer@user:alice")
+	statusCodeEqual(t, NamespaceInvalid, e.SetNamespace(Namespace{Name: "doc", Relations: []Relation{{Name: "viewer"}, {Name: "viewer"}}}))
+	statusCodeEqual(t, TupleInvalid, e.WriteTuple(RelationTuple{Object: tuple.Object, Subject: tuple.Subject}))
+	statusCodeEqual(t, NamespaceNotFound, e.WriteTuple(mustTuple(t, "video:cat#viewer@user:alice")))
+	statusCodeEqual(t, RelationUndefined, e.WriteTuple(mustTuple(t, "doc:readme#commenter@user:alice")))
+	statusCodeEqual(t, TupleWritten, e.WriteTuple(tuple))
+	statusCodeEqual(t, TupleAlreadyExisting, e.WriteTuple(tuple))
+	statusCodeEqual(t, CheckOK, e.Check(tuple.Object, tuple.Relation, tuple.Subject))
+	statusCodeEqual(t, TupleDeleted, e.DeleteTuple(tuple))
+	statusCodeEqual(t, TupleNotFound, e.DeleteTuple(tuple))
+	statusCodeEqual(t, CheckDenied, e.Check(tuple.Object, tuple.Relation, tuple.Subject))
+	objects, code := e.ListObjects("doc", "viewer", tuple.Subject)
+	statusCodeEqual(t, OK, code)
+	assert.Empty(t, objects)
+}
+
+func TestRelationCheck(t *testing.T) {
+	e := newRelationEngineForTesting(t,
+		"group:eng#member@user:alice",
+		"group:eng#member@group:sre#member",
+		"group:sre#member@user:bob",
+		"folder:plans#owner@user:carol",
+		"folder:plans#viewer@group:eng#member",
+		"doc:roadmap#parent@folder:plans",
+		"doc:roadmap#owner@user:dave",
+		"doc:readme#editor@user:erin",
+		// Cycles are harmless
+		"group:sre#member@group:eng#member",
+	)
+	roadmap := Object{Namespace: "doc", ID: "roadmap"}
+	readme := Object{Namespace: "doc", ID: "readme"}
+	for _, tt := range []struct {
+		object   Object
+		relation string
+		subject  string
+		code     StatusCode
+	}{
+		{roadmap, "owner", "user:dave", CheckOK},
+		// Computed usersets
+		{roadmap, "editor", "user:dave", CheckOK},
+		{roadmap, "viewer", "user:dave", CheckOK},
+		{readme, "viewer", "user:erin", CheckOK},
+		{readme, "owner", "user:erin", CheckDenied},
+		// Tuple to usersets through the parent folder and nested groups
+		{roadmap, "viewer", "user:carol", CheckOK},
+		{roadmap, "viewer", "user:alice", CheckOK},
+		{roadmap, "viewer", "user:bob", CheckOK},
+		{roadmap, "viewer", "group:eng#member", CheckOK},
+		{roadmap, "editor", "user:alice", CheckDenied},
+		{readme, "viewer", "user:alice", CheckDenied},
+		{roadmap, "viewer", "user:mallory", CheckDenied},
+		{roadmap, "commenter", "user:alice", RelationUndefined},
+		{Object{Namespace: "video", ID: "cat"}, "viewer", "user:alice", NamespaceNotFound},
+	} {
+		assert.Equal(t, tt.code, e.Check(tt.object, tt.relation, mustSubject(t, tt.subject)), "%s#%s@%s", tt.object, tt.relation, tt.subject)
+	}
+}
+
+func TestRelationExpand(t *testing.T) {
+	e := newRelationEngineForTesting(t,
+		"folder:plans#owner@user:carol",
+		"folder:plans#viewer@group:eng#member",
+		"doc:roadmap#parent@folder:plans",
+		"doc:roadmap#owner@user:dave",
+		"doc:roadmap#viewer@user:erin",
+	)
+	roadmap := Object{Namespace: "doc", ID: "roadmap"}
+	plans := Object{Namespace: "folder", ID: "plans"}
+	tree, code := e.Expand(roadmap, "viewer")
+	statusCodeEqual(t, OK, code)
+	assert.Equal(t, UsersetTree{
+		Object:   roadmap,
+		Relation: "viewer",
+		Subjects: []Subject{mustSubject(t, "user:erin")},
+		Children: []UsersetTree{
+			{Object: roadmap, Relation: "editor", Children: []UsersetTree{
+				{Object: roadmap, Relation: "owner", Subjects: []Subject{mustSubject(t, "user:dave")}},
+			}},
+			{Object: plans, Relation: "viewer", Subjects: []Subject{mustSubject(t, "group:eng#member")}, Children: []UsersetTree{
+				{Object: plans, Relation: "owner", Subjects: []Subject{mustSubject(t, "user:carol")}},
+			}},
+		},
+	}, tree)
+	_, code = e.Expand(roadmap, "commenter")
+	statusCodeEqual(t, RelationUndefined, code)
+}
+
+func TestRelationListObjects(t *testing.T) {
+	e := newRelationEngineForTesting(t,
+		"group:eng#member@user:alice",
+		"folder:plans#viewer@group:eng#member",
+		"doc:roadmap#parent@folder:plans",
+		"doc:budget#parent@folder:plans",
+		"doc:readme#owner@user:alice",
+		"doc:secret#owner@user:bob",
+	)
+	objects, code := e.ListObjects("doc", "viewer", mustSubject(t, "user:alice"))
+	statusCodeEqual(t, OK, code)
+	assert.Equal(t, []Object{{"doc", "budget"}, {"doc", "readme"}, {"doc", "roadmap"}}, objects)
+	objects, code = e.ListObjects("doc", "owner", mustSubject(t, "user:alice"))
+	statusCodeEqual(t, OK, code)
+	assert.Equal(t, []Object{{"doc", "readme"}}, objects)
+	_, code = e.ListObjects("video", "viewer", mustSubject(t, "user:alice"))
+	statusCodeEqual(t, NamespaceNotFound, code)
+}
@@ -0,0 +1,74 @@
+package model
+
+import "strings"
+
+// Resource scopes a role binding. It's a path of type and ID pairs from the
+// outermost resource, like "org/1/project/42", and a binding on a resource
+// applies to the resources under it as well. The empty resource is global.
+type Resource struct {
+	Path string
+}
+
+const resourceSep = "/"
+
+// NewResource returns the resource of type typ and ID id under parent.
+func NewResource(parent Resource, typ, id string) Resource {
+	if parent.Path == "" {
+		return Resource{Path: typ + resourceSep + id}
+	}
+	return Resource{Path: parent.Path + resourceSep + typ + resourceSep + id}
+}
+
+// Valid reports whether r is global or made of non-empty type and ID pairs.
+func (r Resource) Valid() bool {
+	if r.Path == "" {
+		return true
+	}
+	ss := strings.Split(r.Path, resourceSep)
+	if len(ss)%2 != 0 {
+		return false
+	}
+	for _, s := range ss {
+		if s == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// IsGlobal reports whether r is the global resource.
+func (r Resource) IsGlobal() bool {
+	return r.Path == ""
+}
+
+// Type returns the type of r, empty if global.
+func (r Resource) Type() string {
+	ss := strings.Split(r.Path, resourceSep)
+	if len(ss) < 2 {
+		return ""
+	}
+	return ss[len(ss)-2]
+}
+
+// ID returns the ID of r, empty if global.
+func (r Resource) ID() string {
+	ss := strings.Split(r.Path, resourceSep)
+	if len(ss) < 2 {
+		return ""
+	}
+	return ss[len(ss)-1]
+}
+
+// Scopes returns the paths of the resources whose bindings apply to valid r,
+// from the global one to r itself.
+func (r Resource) Scopes() []string {
+	res := []string{""}
+	if r.Path == "" {
+		return res
+	}
+	ss := strings.Split(r.Path, resourceSep)
+	for i := 2; i <= len(ss); i += 2 {
+		res = append(res, strings.Join(ss[:i], resourceSep))
+	}
+	return res
+}
@@ -0,0 +1,24 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResource(t *testing.T) {
+	project := NewResource(NewResource(Resource{}, "org", "1"), "project", "42")
+	assert.Equal(t, "org/1/project/42", project.Path)
+	assert.Equal(t, "project", project.Type())
+	assert.Equal(t, "42", project.ID())
+	assert.Equal(t, []string{"", "org/1", "org/1/project/42"}, project.Scopes())
+	assert.True(t, Resource{}.IsGlobal())
+	assert.Equal(t, []string{""}, Resource{}.Scopes())
+
+	for _, p := range []string{"", "org/1", "org/1/project/42"} {
+		assert.True(t, Resource{Path: p}.Valid(), p)
+	}
+	for _, p := range []string{"org", "org/", "/1", "org/1/project", "org//project/42", "org/1/"} {
+		assert.False(t, Resource{Path: p}.Valid(), p)
+	}
+}
@@ -30,35 +30,224 @@ const (
 	TokenIsInvalid
 	TokenRoleNotFound
 	Internal StatusCode = 50000
+
+	// Codes below are appended to keep the earlier ones unchanged
+	SessionRevoked             StatusCode = 20000 + iota
+	SessionNotFound            StatusCode = 40000 + iota
+	UserRoleRemoved            StatusCode = 20000 + iota
+	UserRoleNotFound           StatusCode = 40000 + iota
+	RoleParentAdded            StatusCode = 20000 + iota
+	RoleParentRemoved          StatusCode = 20000 + iota
+	RoleParentAlreadyExisting  StatusCode = 40000 + iota
+	RoleParentNotFound         StatusCode = 40000 + iota
+	RoleCycle                  StatusCode = 40000 + iota
+	PermissionGranted          StatusCode = 20000 + iota
+	PermissionRevoked          StatusCode = 20000 + iota
+	PermissionAlreadyGranted   StatusCode = 40000 + iota
+	PermissionNotGranted       StatusCode = 40000 + iota
+	PermissionInvalid          StatusCode = 40000 + iota
+	TokenPermissionOK          StatusCode = 20000 + iota
+	TokenPermissionNotFound    StatusCode = 40000 + iota
+	ResourceInvalid            StatusCode = 40000 + iota
+	NamespaceSaved             StatusCode = 20000 + iota
+	NamespaceInvalid           StatusCode = 40000 + iota
+	NamespaceNotFound          StatusCode = 40000 + iota
+	RelationUndefined          StatusCode = 40000 + iota
+	TupleWritten               StatusCode = 20000 + iota
+	TupleDeleted               StatusCode = 20000 + iota
+	TupleAlreadyExisting       StatusCode = 40000 + iota
+	TupleNotFound              StatusCode = 40000 + iota
+	TupleInvalid               StatusCode = 40000 + iota
+	CheckOK                    StatusCode = 20000 + iota
+	CheckDenied                StatusCode = 40000 + iota
+	PolicyAllowed              StatusCode = 20000 + iota
+	PolicyDenied               StatusCode = 40000 + iota
+	TenantCreated              StatusCode = 20000 + iota
+	TenantDeleted              StatusCode = 20000 + iota
+	TenantAlreadyExisting      StatusCode = 40000 + iota
+	TenantNotFound             StatusCode = 40000 + iota
+	TenantInvalid              StatusCode = 40000 + iota
+	GroupCreated               StatusCode = 20000 + iota
+	GroupDeleted               StatusCode = 20000 + iota
+	GroupAlreadyExisting       StatusCode = 40000 + iota
+	GroupNotFound              StatusCode = 40000 + iota
+	GroupMemberAdded           StatusCode = 20000 + iota
+	GroupMemberRemoved         StatusCode = 20000 + iota
+	GroupMemberAlreadyExisting StatusCode = 40000 + iota
+	GroupMemberNotFound        StatusCode = 40000 + iota
+	GroupParentAdded           StatusCode = 20000 + iota
+	GroupParentRemoved         StatusCode = 20000 + iota
+	GroupParentAlreadyExisting StatusCode = 40000 + iota
+	GroupParentNotFound        StatusCode = 40000 + iota
+	GroupCycle                 StatusCode = 40000 + iota
+	GroupRoleAdded             StatusCode = 20000 + iota
+	GroupRoleRemoved           StatusCode = 20000 + iota
+	GroupRoleAlreadyExisting   StatusCode = 40000 + iota
+	GroupRoleNotFound          StatusCode = 40000 + iota
+	Unauthorized               StatusCode = 40100 + iota
+	Forbidden                  StatusCode = 40300 + iota
+	RouteNotFound              StatusCode = 40400 + iota
+	MethodNotAllowed           StatusCode = 40500 + iota
+	PasswordChanged            StatusCode = 20000 + iota
+	PasswordReset              StatusCode = 20000 + iota
+	PasswordChangeRequired     StatusCode = 40300 + iota
+	PasswordReused             StatusCode = 40000 + iota
+	PasswordPolicyViolated     StatusCode = 40000 + iota
 )
 
 var (
 	codeDesc = map[StatusCode]string{
-		Unknown:                 "unknown",
-		OK:                      "ok",
-		InvalidArgument:         "invalid argument",
-		UserAlreadyExisting:     "user already existing",
-		UserCreated:             "user created",
-		UserDeleted:             "user deleted",
-		UserNotFound:            "user not found",
-		UserPasswordNotMatch:    "user password not match",
-		UserRoleAlreadyExisting: "user role already existing",
-		UserRoleAdded:           "user role added",
-		RoleAlreadyExisting:     "role already existing",
-		RoleCreated:             "role created",
-		RoleDeleted:             "role deleted",
-		RoleNotFound:            "role not found",
-		TokenRenewed:            "token renewed",
-		TokenCreated:            "token created",
-		TokenNotFound:           "token not found",
-		TokenExpired:            "token expired",
-		TokenIsInvalid:          "token is invalid",
-		TokenInvalidated:        "token invalidated",
-		TokenRoleOK:             "token role ok",
-		TokenRoleNotFound:       "token role not found",
+		Unknown:                    "unknown",
+		OK:                         "ok",
+		InvalidArgument:            "invalid argument",
+		UserAlreadyExisting:        "user already existing",
+		UserCreated:                "user created",
+		UserDeleted:                "user deleted",
+		UserNotFound:               "user not found",
+		UserPasswordNotMatch:       "user password not match",
+		UserRoleAlreadyExisting:    "user role already existing",
+		UserRoleAdded:              "user role added",
+		RoleAlreadyExisting:        "role already existing",
+		RoleCreated:                "role created",
+		RoleDeleted:                "role deleted",
+		RoleNotFound:               "role not found",
+		TokenRenewed:               "token renewed",
+		TokenCreated:               "token created",
+		TokenNotFound:              "token not found",
+		TokenExpired:               "token expired",
+		TokenIsInvalid:             "token is invalid",
+		TokenInvalidated:           "token invalidated",
+		TokenRoleOK:                "token role ok",
+		TokenRoleNotFound:          "token role not found",
+		Internal:                   "internal",
+		SessionRevoked:             "session revoked",
+		SessionNotFound:            "session not found",
+		UserRoleRemoved:            "user role removed",
+		UserRoleNotFound:           "user role not found",
+		RoleParentAdded:            "role parent added",
+		RoleParentRemoved:          "role parent removed",
+		RoleParentAlreadyExisting:  "role parent already existing",
+		RoleParentNotFound:         "role parent not found",
+		RoleCycle:                  "role cycle",
+		PermissionGranted:          "permission granted",
+		PermissionRevoked:          "permission revoked",
+		PermissionAlreadyGranted:   "permission already granted",
+		PermissionNotGranted:       "permission not granted",
+		PermissionInvalid:          "permission invalid",
+		TokenPermissionOK:          "token permission ok",
+		TokenPermissionNotFound:    "token permission not found",
+		ResourceInvalid:            "resource invalid",
+		NamespaceSaved:             "namespace saved",
+		NamespaceInvalid:           "namespace invalid",
+		NamespaceNotFound:          "namespace not found",
+		RelationUndefined:          "relation undefined",
+		TupleWritten:               "tuple written",
+		TupleDeleted:               "tuple deleted",
+		TupleAlreadyExisting:       "tuple already existing",
+		TupleNotFound:              "tuple not found",
+		TupleInvalid:               "tuple invalid",
+		CheckOK:                    "check ok",
+		CheckDenied:                "check denied",
+		PolicyAllowed:              "policy allowed",
+		PolicyDenied:               "policy denied",
+		TenantCreated:              "tenant created",
+		TenantDeleted:              "tenant deleted",
+		TenantAlreadyExisting:      "tenant already existing",
+		TenantNotFound:             "tenant not found",
+		TenantInvalid:              "tenant invalid",
+		GroupCreated:               "group created",
+		GroupDeleted:               "group deleted",
+		GroupAlreadyExisting:       "group already existing",
+		GroupNotFound:              "group not found",
+		GroupMemberAdded:           "group member added",
+		GroupMemberRemoved:         "group member removed",
+		GroupMemberAlreadyExisting: "group member already existing",
+		GroupMemberNotFound:        "group member not found",
+		GroupParentAdded:           "group parent added",
+		GroupParentRemoved:         "group parent removed",
+		GroupParentAlreadyExisting: "group parent already existing",
+		GroupParentNotFound:        "group parent not found",
+		GroupCycle:                 "group cycle",
+		GroupRoleAdded:             "group role added",
+		GroupRoleRemoved:           "group role removed",
+		GroupRoleAlreadyExisting:   "group role already existing",
+		GroupRoleNotFound:          "group role not found",
+		Unauthorized:               "unauthorized",
+		Forbidden:                  "forbidden",
+		RouteNotFound:              "route not found",
+		MethodNotAllowed:           "method not allowed",
+		PasswordChanged:            "password changed",
+		PasswordReset:              "password reset",
+		PasswordChangeRequired:     "password change required",
+		PasswordReused:             "password reused",
+		PasswordPolicyViolated:     "password policy violated",
 	}
 )
 
+// httpStatus maps the codes whose HTTP status is more precise than their
+// class.
+var httpStatus = map[StatusCode]int{
+	Unknown:       500,
+	UserCreated:   201,
+	RoleCreated:   201,
+	TokenCreated:  201,
+	TenantCreated: 201,
+	GroupCreated:  201,
+
+	UserPasswordNotMatch: 401,
+	TokenNotFound:        401,
+	TokenExpired:         401,
+	TokenIsInvalid:       401,
+	Unauthorized:         401,
+
+	TokenRoleNotFound:       403,
+	TokenPermissionNotFound: 403,
+	CheckDenied:             403,
+	PolicyDenied:            403,
+	Forbidden:               403,
+	PasswordChangeRequired:  403,
+
+	UserNotFound:         404,
+	RoleNotFound:         404,
+	SessionNotFound:      404,
+	UserRoleNotFound:     404,
+	RoleParentNotFound:   404,
+	PermissionNotGranted: 404,
+	NamespaceNotFound:    404,
+	TupleNotFound:        404,
+	TenantNotFound:       404,
+	GroupNotFound:        404,
+	GroupMemberNotFound:  404,
+	GroupParentNotFound:  404,
+	GroupRoleNotFound:    404,
+	RouteNotFound:        404,
+
+	MethodNotAllowed: 405,
+
+	UserAlreadyExisting:        409,
+	UserRoleAlreadyExisting:    409,
+	RoleAlreadyExisting:        409,
+	RoleParentAlreadyExisting:  409,
+	RoleCycle:                  409,
+	PermissionAlreadyGranted:   409,
+	TupleAlreadyExisting:       409,
+	TenantAlreadyExisting:      409,
+	GroupAlreadyExisting:       409,
+	GroupMemberAlreadyExisting: 409,
+	GroupParentAlreadyExisting: 409,
+	GroupCycle:                 409,
+	GroupRoleAlreadyExisting:   409,
+
+	PermissionInvalid:      422,
+	ResourceInvalid:        422,
+	NamespaceInvalid:       422,
+	RelationUndefined:      422,
+	TupleInvalid:           422,
+	TenantInvalid:          422,
+	PasswordReused:         422,
+	PasswordPolicyViolated: 422,
+}
+
 func (c StatusCode) String() string {
 	v, ok := codeDesc[c]
 	if !ok {
@@ -67,6 +256,22 @@ func (c StatusCode) String() string {
 	return v
 }
 
+// HTTPCode returns the class of c as 200, 400 or 500, besides 401, 403, 404
+// and 405, which is the HTTP status of the legacy responses.
 func (c StatusCode) HTTPCode() int {
 	return int(c) / 100
 }
+
+// HTTPStatus returns the precise HTTP status of c.
+func (c StatusCode) HTTPStatus() int {
+	if v, ok := httpStatus[c]; ok {
+		return v
+	}
+	return int(c) / 10000 * 100
+}
+
+// Succeeded reports whether c tells a success, which may have any 2xx
+// status.
+func (c StatusCode) Succeeded() bool {
+	return c.HTTPStatus()/100 == 2
+}
@@ -0,0 +1,40 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPStatus(t *testing.T) {
+	assert.Equal(t, 200, OK.HTTPStatus())
+	assert.Equal(t, 201, UserCreated.HTTPStatus())
+	assert.Equal(t, 200, GroupRoleAdded.HTTPStatus())
+	assert.Equal(t, 400, InvalidArgument.HTTPStatus())
+	assert.Equal(t, 401, TokenExpired.HTTPStatus())
+	assert.Equal(t, 403, TokenRoleNotFound.HTTPStatus())
+	assert.Equal(t, 404, UserNotFound.HTTPStatus())
+	assert.Equal(t, 409, RoleCycle.HTTPStatus())
+	assert.Equal(t, 422, TupleInvalid.HTTPStatus())
+	assert.Equal(t, 500, Internal.HTTPStatus())
+	assert.Equal(t, 500, Unknown.HTTPStatus())
+
+	// The precise status keeps the class of the code
+	for c := range codeDesc {
+		if c != Unknown {
+			assert.Equal(t, int(c)/10000, c.HTTPStatus()/100, c.String())
+		}
+	}
+	assert.Equal(t, 400, UserNotFound.HTTPCode())
+}
+
+func TestSucceeded(t *testing.T) {
+	for c := range codeDesc {
+		assert.Equal(t, int(c)/10000 == 2, c.Succeeded(), c.String())
+	}
+	assert.True(t, UserCreated.Succeeded())
+	assert.False(t, UserNotFound.Succeeded())
+	// Beyond the codes whose integer division tells 200
+	assert.True(t, StatusCode(20100).Succeeded())
+	assert.False(t, StatusCode(40100).Succeeded())
+}
@@ -0,0 +1,189 @@
+package model
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestStress races every operation over a few names, meant to be run with
+// go test -race, then checks the engine is left consistent.
+func TestStress(t *testing.T) {
+	options := []Option{
+		WithPasswordHasher(testHasher),
+		WithTokenTTL(20 * time.Millisecond),
+		WithSweepInterval(time.Millisecond),
+		WithUserShards(4),
+		WithTokenShards(4),
+		WithMaxSessions(3),
+	}
+	t.Run("inmem", func(t *testing.T) {
+		e := NewInmemEngine(options...).(*inmemEngine)
+		defer e.Shutdown()
+		stress(t, e)
+		checkConsistent(t, e)
+	})
+	t.Run("durable", func(t *testing.T) {
+		dir := t.TempDir()
+		d, err := openDurableEngine(dir, DurableOptions{Fsync: FsyncNever, SnapshotThreshold: 50}, options...)
+		assert.Nil(t, err)
+		stress(t, d)
+		checkConsistent(t, d.inmemEngine)
+		d.Shutdown()
+
+		// And so is the state recovered from it
+		d, err = openDurableEngine(dir, DurableOptions{Fsync: FsyncNever}, options...)
+		assert.Nil(t, err)
+		checkConsistent(t, d.inmemEngine)
+		d.Shutdown()
+	})
+}
+
+func stress(t *testing.T, e AuthenticateAuthorizationEngine) {
+	const workers = 8
+	const rounds = 300
+	users := make([]User, 4)
+	for i := range users {
+		users[i] = User{Name: fmt.Sprintf("u%d", i), Password: "pwd"}
+	}
+	roles := make([]Role, 4)
+	for i := range roles {
+		roles[i] = Role{Name: fmt.Sprintf("r%d", i)}
+	}
+
+	var mu sync.Mutex
+	var tokens []string
+	randomToken := func(r *rand.Rand) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(tokens) == 0 {
+			return tokenNotExisting.ID
+		}
+		return tokens[r.Intn(len(tokens))]
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < rounds; i++ {
+				u := users[r.Intn(len(users))]
+				role := roles[r.Intn(len(roles))]
+				parent := roles[r.Intn(len(roles))]
+				var code StatusCode
+				switch r.Intn(17) {
+				case 0:
+					code = e.CreateUser(u)
+				case 1:
+					code = e.DeleteUser(u)
+				case 2:
+					code = e.CreateRole(role)
+				case 3:
+					code = e.DeleteRole(role)
+				case 4:
+					code = e.AddUserRole(u, role)
+				case 5:
+					var token Token
+					if token, code = e.Authenticate(u, SessionInfo{}); code == TokenCreated {
+						mu.Lock()
+						tokens = append(tokens, token.ID)
+						mu.Unlock()
+					}
+				case 6:
+					code = e.Invalidate(randomToken(r))
+				case 7:
+					_, code = e.AllRoles(randomToken(r))
+				case 8:
+					code = e.RevokeAllSessions(randomToken(r))
+				case 9:
+					code = e.AddRoleParent(role, parent)
+				case 10:
+					code = e.RemoveRoleParent(role, parent)
+				case 11:
+					code = e.GrantPermission(role, Permission{Name: "p:" + parent.Name})
+				case 12:
+					code = e.RevokePermission(role, Permission{Name: "p:" + parent.Name})
+				case 13:
+					code = e.AddUserRoleOn(u, role, Resource{Path: "p/" + parent.Name})
+				case 14:
+					code = e.RemoveUserRoleOn(u, role, Resource{Path: "p/" + parent.Name})
+				case 15:
+					code = e.CheckRoleOn(randomToken(r), role.Name, Resource{Path: "p/" + parent.Name})
+				default:
+					code = e.CheckRole(randomToken(r), role.Name)
+				}
+				assert.NotEqual(t, Internal, code)
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+}
+
+// checkConsistent checks users, roles and tokens refer to each other, and
+// closures match the hierarchy.
+func checkConsistent(t *testing.T, e *inmemEngine) {
+	e.rolelock.RLock()
+	defer e.rolelock.RUnlock()
+	for _, p := range e.users {
+		p.RLock()
+		for name, u := range p.users {
+			for _, scope := range append([]string{""}, scopes(t, u)...) {
+				for _, r := range u.bindings(scope) {
+					assert.False(t, r.isDeleted(), "deleted role %s of %s", r.Name, name)
+					assert.Equal(t, r, e.roles[r.Name])
+					assert.Contains(t, r.members, u)
+				}
+			}
+			for sid, s := range u.sessions {
+				assert.Equal(t, sid, s.SessionID)
+			}
+		}
+		p.RUnlock()
+	}
+	for name, r := range e.roles {
+		assert.False(t, r.isDeleted())
+		for u := range r.members {
+			assert.Equal(t, u, e.getUserPartition(u.Name).users[u.Name], "deleted member %s of %s", u.Name, name)
+			bound := false
+			for _, scope := range append([]string{""}, scopes(t, u)...) {
+				bound = bound || hasBinding(u, r, scope)
+			}
+			assert.True(t, bound, "member %s not bound to %s", u.Name, name)
+		}
+		roles := map[string]struct{}{name: {}}
+		permissions := map[string]struct{}{}
+		for p := range r.permissions {
+			permissions[p] = struct{}{}
+		}
+		for _, p := range r.parents {
+			assert.Equal(t, p, e.roles[p.Name], "deleted parent %s of %s", p.Name, name)
+			assert.Contains(t, p.children, r)
+			for v := range p.ancestors() {
+				roles[v] = struct{}{}
+			}
+			for v := range p.loadClosure().permissions {
+				permissions[v] = struct{}{}
+			}
+		}
+		assert.Equal(t, roles, r.ancestors(), "closure of %s", name)
+		assert.Equal(t, permissions, r.loadClosure().permissions, "permissions of %s", name)
+		for c := range r.children {
+			assert.Equal(t, c, e.roles[c.Name], "deleted child %s of %s", c.Name, name)
+		}
+	}
+}
+
+func scopes(t *testing.T, u *User) []string {
+	var res []string
+	for s, roles := range u.scoped {
+		assert.NotEmpty(t, roles, "empty scope %s of %s", s, u.Name)
+		res = append(res, s)
+	}
+	return res
+}
@@ -0,0 +1,472 @@
+package model
+
+import "strings"
+
+// Tenant partitions users, roles, groups and their tokens, so that the same
+// names can be used in different tenants. Engines keep the users, roles and
+// groups of a tenant under names qualified by it, like "acme/alice", and
+// tokens belong to the tenant of their users. The default tenant, whose
+// name is empty, is the global namespace of unqualified names.
+type Tenant struct {
+	Name string
+}
+
+// TenantSep separates the tenant and the name in qualified names, so it's
+// never used in tenant, user or role names.
+const TenantSep = "/"
+
+// Valid reports whether t can be created, the default tenant always exists.
+func (t Tenant) Valid() bool {
+	return t.Name != "" && !strings.Contains(t.Name, TenantSep)
+}
+
+// IsDefault reports whether t is the default tenant.
+func (t Tenant) IsDefault() bool {
+	return t.Name == ""
+}
+
+// Prefix returns the prefix of the qualified names in t.
+func (t Tenant) Prefix() string {
+	if t.Name == "" {
+		return ""
+	}
+	return t.Name + TenantSep
+}
+
+// Qualify returns the qualified name of name in t.
+func (t Tenant) Qualify(name string) string {
+	return t.Prefix() + name
+}
+
+// Local returns the name in t of the qualified name, and whether it's in t.
+func (t Tenant) Local(qualified string) (string, bool) {
+	if TenantOf(qualified) != t {
+		return "", false
+	}
+	return strings.TrimPrefix(qualified, t.Prefix()), true
+}
+
+// TenantOf returns the tenant of the qualified name.
+func TenantOf(qualified string) Tenant {
+	i := strings.Index(qualified, TenantSep)
+	if i < 0 {
+		return Tenant{}
+	}
+	return Tenant{Name: qualified[:i]}
+}
+
+// ForTenant returns the view of e in tenant t, where users and roles are
+// named without the tenant and tokens of other tenants are not found. Names
+// with TenantSep are refused, even in the default tenant. Tenants are only
+// managed in the view of the default tenant, and Shutdown of a view does
+// nothing, e is shut down by its owner.
+func ForTenant(e AuthenticateAuthorizationEngine, t Tenant) AuthenticateAuthorizationEngine {
+	return &tenantEngine{e: e, t: t}
+}
+
+type tenantEngine struct {
+	e AuthenticateAuthorizationEngine
+	t Tenant
+}
+
+// validNames reports whether names are valid local names.
+func validNames(names ...string) bool {
+	for _, n := range names {
+		if strings.Contains(n, TenantSep) {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *tenantEngine) user(u User) User {
+	u.Name = v.t.Qualify(u.Name)
+	return u
+}
+
+func (v *tenantEngine) group(g Group) Group {
+	return Group{Name: v.t.Qualify(g.Name)}
+}
+
+func (v *tenantEngine) role(r Role) Role {
+	res := Role{Name: v.t.Qualify(r.Name)}
+	for _, p := range r.Parents {
+		res.Parents = append(res.Parents, v.t.Qualify(p))
+	}
+	return res
+}
+
+// roles returns the roles in the tenant by their local names.
+func (v *tenantEngine) roles(rs []Role, status StatusCode) ([]Role, StatusCode) {
+	if status != OK {
+		return nil, status
+	}
+	res := make([]Role, 0, len(rs))
+	for _, r := range rs {
+		if name, ok := v.t.Local(r.Name); ok {
+			res = append(res, Role{Name: name})
+		}
+	}
+	return res, status
+}
+
+// locals returns the names in the tenant by their local names.
+func (v *tenantEngine) locals(names []string) []string {
+	var res []string
+	for _, n := range names {
+		if name, ok := v.t.Local(n); ok {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// page returns p with the qualified prefix and cursor.
+func (v *tenantEngine) page(p Page) Page {
+	p.Prefix = v.t.Qualify(p.Prefix)
+	if p.Cursor != "" {
+		p.Cursor = v.t.Qualify(p.Cursor)
+	}
+	return p
+}
+
+// local returns the local name of the qualified name, or empty if it's
+// empty or not in the tenant.
+func (v *tenantEngine) local(name string) string {
+	res, _ := v.t.Local(name)
+	return res
+}
+
+// users returns the users in the tenant by their local names.
+func (v *tenantEngine) users(us []User) []User {
+	res := make([]User, 0, len(us))
+	for _, u := range us {
+		if name, ok := v.t.Local(u.Name); ok {
+			res = append(res, User{Name: name})
+		}
+	}
+	return res
+}
+
+// checkToken returns TokenNotFound for tokens of other tenants, so their
+// existence isn't told.
+func (v *tenantEngine) checkToken(t string) StatusCode {
+	u, status := v.e.TokenUser(t)
+	if status != OK {
+		return status
+	}
+	if TenantOf(u.Name) != v.t {
+		return TokenNotFound
+	}
+	return OK
+}
+
+func (v *tenantEngine) CreateTenant(t Tenant) StatusCode {
+	if !v.t.IsDefault() {
+		return InvalidArgument
+	}
+	return v.e.CreateTenant(t)
+}
+
+func (v *tenantEngine) DeleteTenant(t Tenant) StatusCode {
+	if !v.t.IsDefault() {
+		return InvalidArgument
+	}
+	return v.e.DeleteTenant(t)
+}
+
+func (v *tenantEngine) ListTenants() ([]Tenant, StatusCode) {
+	if !v.t.IsDefault() {
+		return nil, InvalidArgument
+	}
+	return v.e.ListTenants()
+}
+
+func (v *tenantEngine) CreateUser(u User) StatusCode {
+	if !validNames(u.Name) {
+		return InvalidArgument
+	}
+	return v.e.CreateUser(v.user(u))
+}
+
+func (v *tenantEngine) DeleteUser(u User) StatusCode {
+	if !validNames(u.Name) {
+		return InvalidArgument
+	}
+	return v.e.DeleteUser(v.user(u))
+}
+
+func (v *tenantEngine) GetUser(u User) (User, StatusCode) {
+	if !validNames(u.Name) {
+		return User{}, InvalidArgument
+	}
+	res, status := v.e.GetUser(v.user(u))
+	if status != OK {
+		return User{}, status
+	}
+	res.Name, res.Roles, res.Groups = u.Name, v.locals(res.Roles), v.locals(res.Groups)
+	return res, OK
+}
+
+func (v *tenantEngine) ChangePassword(u User, password string) StatusCode {
+	if !validNames(u.Name) {
+		return InvalidArgument
+	}
+	return v.e.ChangePassword(v.user(u), password)
+}
+
+func (v *tenantEngine) ResetPassword(u User) StatusCode {
+	if !validNames(u.Name) {
+		return InvalidArgument
+	}
+	return v.e.ResetPassword(v.user(u))
+}
+
+func (v *tenantEngine) ListUsers(p Page) ([]User, string, StatusCode) {
+	if !validNames(p.Prefix, p.Cursor) {
+		return nil, "", InvalidArgument
+	}
+	res, next, status := v.e.ListUsers(v.page(p))
+	if status != OK {
+		return nil, "", status
+	}
+	return v.users(res), v.local(next), OK
+}
+
+func (v *tenantEngine) CreateRole(r Role) StatusCode {
+	if !validNames(append([]string{r.Name}, r.Parents...)...) {
+		return InvalidArgument
+	}
+	return v.e.CreateRole(v.role(r))
+}
+
+func (v *tenantEngine) DeleteRole(r Role) StatusCode {
+	if !validNames(r.Name) {
+		return InvalidArgument
+	}
+	return v.e.DeleteRole(v.role(r))
+}
+
+func (v *tenantEngine) GetRole(r Role) (Role, StatusCode) {
+	if !validNames(r.Name) {
+		return Role{}, InvalidArgument
+	}
+	res, status := v.e.GetRole(v.role(r))
+	if status != OK {
+		return Role{}, status
+	}
+	return Role{Name: r.Name, Parents: v.locals(res.Parents), Permissions: res.Permissions}, OK
+}
+
+func (v *tenantEngine) ListRoles(p Page) ([]Role, string, StatusCode) {
+	if !validNames(p.Prefix, p.Cursor) {
+		return nil, "", InvalidArgument
+	}
+	res, next, status := v.e.ListRoles(v.page(p))
+	if status != OK {
+		return nil, "", status
+	}
+	res, _ = v.roles(res, status)
+	return res, v.local(next), OK
+}
+
+func (v *tenantEngine) ListRoleMembers(r Role, p Page) ([]User, string, StatusCode) {
+	if !validNames(r.Name, p.Prefix, p.Cursor) {
+		return nil, "", InvalidArgument
+	}
+	res, next, status := v.e.ListRoleMembers(v.role(r), v.page(p))
+	if status != OK {
+		return nil, "", status
+	}
+	return v.users(res), v.local(next), OK
+}
+
+func (v *tenantEngine) AddRoleParent(r, parent Role) StatusCode {
+	if !validNames(r.Name, parent.Name) {
+		return InvalidArgument
+	}
+	return v.e.AddRoleParent(v.role(r), v.role(parent))
+}
+
+func (v *tenantEngine) RemoveRoleParent(r, parent Role) StatusCode {
+	if !validNames(r.Name, parent.Name) {
+		return InvalidArgument
+	}
+	return v.e.RemoveRoleParent(v.role(r), v.role(parent))
+}
+
+func (v *tenantEngine) AddUserRole(u User, r Role) StatusCode {
+	return v.AddUserRoleOn(u, r, Resource{})
+}
+
+func (v *tenantEngine) RemoveUserRole(u User, r Role) StatusCode {
+	return v.RemoveUserRoleOn(u, r, Resource{})
+}
+
+func (v *tenantEngine) AddUserRoleOn(u User, r Role, res Resource) StatusCode {
+	if !validNames(u.Name, r.Name) {
+		return InvalidArgument
+	}
+	return v.e.AddUserRoleOn(v.user(u), v.role(r), res)
+}
+
+func (v *tenantEngine) RemoveUserRoleOn(u User, r Role, res Resource) StatusCode {
+	if !validNames(u.Name, r.Name) {
+		return InvalidArgument
+	}
+	return v.e.RemoveUserRoleOn(v.user(u), v.role(r), res)
+}
+
+func (v *tenantEngine) GrantPermission(r Role, p Permission) StatusCode {
+	if !validNames(r.Name) {
+		return InvalidArgument
+	}
+	return v.e.GrantPermission(v.role(r), p)
+}
+
+func (v *tenantEngine) RevokePermission(r Role, p Permission) StatusCode {
+	if !validNames(r.Name) {
+		return InvalidArgument
+	}
+	return v.e.RevokePermission(v.role(r), p)
+}
+
+func (v *tenantEngine) Authenticate(u User, info SessionInfo) (Token, StatusCode) {
+	if !validNames(u.Name) {
+		return Token{}, InvalidArgument
+	}
+	return v.e.Authenticate(v.user(u), info)
+}
+
+func (v *tenantEngine) Invalidate(t string) StatusCode {
+	if status := v.checkToken(t); status != OK {
+		return status
+	}
+	return v.e.Invalidate(t)
+}
+
+func (v *tenantEngine) ListSessions(t string) ([]Token, StatusCode) {
+	if status := v.checkToken(t); status != OK {
+		return nil, status
+	}
+	return v.e.ListSessions(t)
+}
+
+func (v *tenantEngine) RevokeSession(t, sessionID string) StatusCode {
+	if status := v.checkToken(t); status != OK {
+		return status
+	}
+	return v.e.RevokeSession(t, sessionID)
+}
+
+func (v *tenantEngine) RevokeAllSessions(t string) StatusCode {
+	if status := v.checkToken(t); status != OK {
+		return status
+	}
+	return v.e.RevokeAllSessions(t)
+}
+
+func (v *tenantEngine) TokenUser(t string) (User, StatusCode) {
+	u, status := v.e.TokenUser(t)
+	if status != OK {
+		return User{}, status
+	}
+	name, ok := v.t.Local(u.Name)
+	if !ok {
+		return User{}, TokenNotFound
+	}
+	return User{Name: name}, OK
+}
+
+func (v *tenantEngine) CheckRole(t, r string) StatusCode {
+	return v.CheckRoleOn(t, r, Resource{})
+}
+
+func (v *tenantEngine) CheckRoleOn(t, r string, res Resource) StatusCode {
+	if !validNames(r) {
+		return InvalidArgument
+	}
+	if status := v.checkToken(t); status != OK {
+		return status
+	}
+	return v.e.CheckRoleOn(t, v.t.Qualify(r), res)
+}
+
+func (v *tenantEngine) CheckPermission(t, p string) StatusCode {
+	if status := v.checkToken(t); status != OK {
+		return status
+	}
+	return v.e.CheckPermission(t, p)
+}
+
+func (v *tenantEngine) AllRoles(t string) ([]Role, StatusCode) {
+	if status := v.checkToken(t); status != OK {
+		return nil, status
+	}
+	return v.roles(v.e.AllRoles(t))
+}
+
+func (v *tenantEngine) DirectRoles(t string) ([]Role, StatusCode) {
+	if status := v.checkToken(t); status != OK {
+		return nil, status
+	}
+	return v.roles(v.e.DirectRoles(t))
+}
+
+func (v *tenantEngine) CreateGroup(g Group) StatusCode {
+	if !validNames(g.Name) {
+		return InvalidArgument
+	}
+	return v.e.CreateGroup(v.group(g))
+}
+
+func (v *tenantEngine) DeleteGroup(g Group) StatusCode {
+	if !validNames(g.Name) {
+		return InvalidArgument
+	}
+	return v.e.DeleteGroup(v.group(g))
+}
+
+func (v *tenantEngine) AddGroupMember(g Group, u User) StatusCode {
+	if !validNames(g.Name, u.Name) {
+		return InvalidArgument
+	}
+	return v.e.AddGroupMember(v.group(g), v.user(u))
+}
+
+func (v *tenantEngine) RemoveGroupMember(g Group, u User) StatusCode {
+	if !validNames(g.Name, u.Name) {
+		return InvalidArgument
+	}
+	return v.e.RemoveGroupMember(v.group(g), v.user(u))
+}
+
+func (v *tenantEngine) AddGroupParent(g, parent Group) StatusCode {
+	if !validNames(g.Name, parent.Name) {
+		return InvalidArgument
+	}
+	return v.e.AddGroupParent(v.group(g), v.group(parent))
+}
+
+func (v *tenantEngine) RemoveGroupParent(g, parent Group) StatusCode {
+	if !validNames(g.Name, parent.Name) {
+		return InvalidArgument
+	}
+	return v.e.RemoveGroupParent(v.group(g), v.group(parent))
+}
+
+func (v *tenantEngine) AddGroupRole(g Group, r Role) StatusCode {
+	if !validNames(g.Name, r.Name) {
+		return InvalidArgument
+	}
+	return v.e.AddGroupRole(v.group(g), v.role(r))
+}
+
+func (v *tenantEngine) RemoveGroupRole(g Group, r Role) StatusCode {
+	if !validNames(g.Name, r.Name) {
+		return InvalidArgument
+	}
+	return v.e.RemoveGroupRole(v.group(g), v.role(r))
+}
+
+func (v *tenantEngine) Shutdown() {}
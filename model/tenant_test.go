@@ -0,0 +1,33 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantNames(t *testing.T) {
+	acme := Tenant{Name: "acme"}
+	assert.True(t, acme.Valid())
+	assert.False(t, Tenant{}.Valid())
+	assert.False(t, Tenant{Name: "acme/eu"}.Valid())
+	assert.True(t, Tenant{}.IsDefault())
+
+	assert.Equal(t, "acme/alice", acme.Qualify("alice"))
+	assert.Equal(t, "alice", Tenant{}.Qualify("alice"))
+	assert.Equal(t, acme, TenantOf("acme/alice"))
+	assert.Equal(t, Tenant{}, TenantOf("alice"))
+
+	name, ok := acme.Local("acme/alice")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", name)
+	_, ok = acme.Local("alice")
+	assert.False(t, ok)
+	_, ok = acme.Local("acme2/alice")
+	assert.False(t, ok)
+	name, ok = Tenant{}.Local("alice")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", name)
+	_, ok = Tenant{}.Local("acme/alice")
+	assert.False(t, ok)
+}
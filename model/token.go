@@ -0,0 +1,108 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"math/big"
+	"strings"
+)
+
+// This file implements token ID generation. Default tokens look like
+//
+//	hsbc_at_<43 base62 chars of 256 random bits><6 base62 chars of CRC32>
+//
+// The prefix lets secret scanners spot leaked tokens and the checksum lets
+// them tell real tokens from look-alikes without asking the server.
+
+const (
+	DefaultTokenPrefix = "hsbc_at_"
+
+	tokenRandomBytes  = 32
+	tokenBodyLength   = 43 // 62^43 > 2^256
+	tokenCheckLength  = 6  // 62^6 > 2^32
+	base62Alphabet    = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	tokenBase62Length = tokenBodyLength + tokenCheckLength
+)
+
+// tokenKey returns the SHA-256 of the token ID t, which engines keep instead
+// of t, so that their memory dumps, logs and snapshots don't give sessions
+// away.
+func tokenKey(t string) string {
+	sum := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenGenerator generates the IDs of new tokens.
+type TokenGenerator interface {
+	Generate() (string, error)
+}
+
+// TokenGeneratorFunc adapts a function to a TokenGenerator.
+type TokenGeneratorFunc func() (string, error)
+
+func (f TokenGeneratorFunc) Generate() (string, error) {
+	return f()
+}
+
+type randomTokenGenerator struct {
+	prefix string
+	rand   io.Reader
+}
+
+// DefaultTokenGenerator returns a generator of crypto/rand tokens with the
+// DefaultTokenPrefix.
+func DefaultTokenGenerator() TokenGenerator {
+	return NewTokenGenerator(DefaultTokenPrefix, rand.Reader)
+}
+
+// NewTokenGenerator returns a generator of prefixed and checksummed tokens
+// reading 256 bits from r for each token. Tests can pass a deterministic
+// reader to get reproducible tokens.
+func NewTokenGenerator(prefix string, r io.Reader) TokenGenerator {
+	return &randomTokenGenerator{prefix: prefix, rand: r}
+}
+
+func (g *randomTokenGenerator) Generate() (string, error) {
+	b := make([]byte, tokenRandomBytes)
+	if _, err := io.ReadFull(g.rand, b); err != nil {
+		return "", err
+	}
+	body := encodeBase62(new(big.Int).SetBytes(b), tokenBodyLength)
+	return g.prefix + body + tokenChecksum(g.prefix, body), nil
+}
+
+// CheckTokenFormat reports whether token is made by a generator from
+// NewTokenGenerator with the prefix, by validating its checksum.
+func CheckTokenFormat(prefix, token string) bool {
+	if !strings.HasPrefix(token, prefix) || len(token) != len(prefix)+tokenBase62Length {
+		return false
+	}
+	rest := token[len(prefix):]
+	for _, c := range rest {
+		if !strings.ContainsRune(base62Alphabet, c) {
+			return false
+		}
+	}
+	body, sum := rest[:tokenBodyLength], rest[tokenBodyLength:]
+	return tokenChecksum(prefix, body) == sum
+}
+
+func tokenChecksum(prefix, body string) string {
+	sum := crc32.ChecksumIEEE([]byte(prefix + body))
+	return encodeBase62(new(big.Int).SetUint64(uint64(sum)), tokenCheckLength)
+}
+
+// encodeBase62 encodes n left padded with zeros to width.
+func encodeBase62(n *big.Int, width int) string {
+	b := make([]byte, width)
+	base := big.NewInt(62)
+	mod := new(big.Int)
+	for i := width - 1; i >= 0; i-- {
+		n.DivMod(n, base, mod)
+		b[i] = base62Alphabet[mod.Int64()]
+	}
+	return string(b)
+}
@@ -0,0 +1,68 @@
+package model
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenGenerator(t *testing.T) {
+	g := NewTokenGenerator("test_", bytes.NewReader(make([]byte, 64)))
+	token, err := g.Generate()
+	assert.Nil(t, err)
+	assert.Equal(t, "test_"+strings.Repeat("0", tokenBodyLength)+"0SGess", token)
+	assert.True(t, CheckTokenFormat("test_", token))
+	_, err = g.Generate()
+	assert.Nil(t, err)
+	_, err = g.Generate()
+	assert.NotNil(t, err, "reader exhausted")
+}
+
+func TestDefaultTokenGenerator(t *testing.T) {
+	g := DefaultTokenGenerator()
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		token, err := g.Generate()
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(token, DefaultTokenPrefix))
+		assert.True(t, CheckTokenFormat(DefaultTokenPrefix, token))
+		assert.False(t, seen[token])
+		seen[token] = true
+	}
+}
+
+func TestCheckTokenFormat(t *testing.T) {
+	token, _ := NewTokenGenerator(DefaultTokenPrefix, rand.Reader).Generate()
+	assert.False(t, CheckTokenFormat("other_", token))
+	assert.False(t, CheckTokenFormat(DefaultTokenPrefix, token[:len(token)-1]))
+	assert.False(t, CheckTokenFormat(DefaultTokenPrefix, token+"0"))
+	// Flip one char of the random part
+	b := []byte(token)
+	i := len(DefaultTokenPrefix) + 3
+	if b[i] == 'a' {
+		b[i] = 'b'
+	} else {
+		b[i] = 'a'
+	}
+	assert.False(t, CheckTokenFormat(DefaultTokenPrefix, string(b)))
+	assert.False(t, CheckTokenFormat(DefaultTokenPrefix, strings.Replace(token, token[len(token)-2:], "!!", 1)))
+}
+
+func TestInjectedTokenGenerator(t *testing.T) {
+	e := NewInmemEngine()
+	e.(*inmemEngine).SetTokenGenerator(TokenGeneratorFunc(func() (string, error) {
+		return "__fixed__", nil
+	}))
+	statusCodeEqual(t, UserCreated, e.CreateUser(u1))
+	statusCodeEqual(t, UserCreated, e.CreateUser(u2))
+	token, code := e.Authenticate(u1, SessionInfo{})
+	statusCodeEqual(t, TokenCreated, code)
+	assert.Equal(t, "__fixed__", token.ID)
+	// Colliding token ID must not be shared with another user
+	_, code = e.Authenticate(u2, SessionInfo{})
+	statusCodeEqual(t, Internal, code)
+	e.Shutdown()
+}
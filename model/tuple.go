@@ -0,0 +1,101 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// This file defines relation tuples of relationship-based access control,
+// written as "object#relation@subject" like "doc:readme#viewer@user:alice".
+// A subject is either an object, or a userset like "group:eng#member",
+// which is all subjects having the relation to the object.
+
+// Object is named by its namespace and ID, like "doc:readme".
+type Object struct {
+	Namespace string
+	ID        string
+}
+
+// Subject is an object, or the userset of the objects having Relation to
+// it if Relation is not empty.
+type Subject struct {
+	Object
+	Relation string
+}
+
+// RelationTuple tells Subject has Relation to Object.
+type RelationTuple struct {
+	Object   Object
+	Relation string
+	Subject  Subject
+}
+
+func (o Object) String() string {
+	return o.Namespace + ":" + o.ID
+}
+
+func (s Subject) String() string {
+	if s.Relation == "" {
+		return s.Object.String()
+	}
+	return s.Object.String() + "#" + s.Relation
+}
+
+func (t RelationTuple) String() string {
+	return t.Object.String() + "#" + t.Relation + "@" + t.Subject.String()
+}
+
+// ParseObject parses "namespace:id".
+func ParseObject(s string) (Object, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return Object{}, fmt.Errorf("model: invalid object %q", s)
+	}
+	o := Object{Namespace: s[:i], ID: s[i+1:]}
+	if !validName(o.Namespace) || o.ID == "" || strings.ContainsAny(o.ID, "#@") {
+		return Object{}, fmt.Errorf("model: invalid object %q", s)
+	}
+	return o, nil
+}
+
+// ParseSubject parses "namespace:id" or "namespace:id#relation".
+func ParseSubject(s string) (Subject, error) {
+	rel := ""
+	if i := strings.Index(s, "#"); i >= 0 {
+		s, rel = s[:i], s[i+1:]
+		if !validName(rel) {
+			return Subject{}, fmt.Errorf("model: invalid subject relation %q", rel)
+		}
+	}
+	o, err := ParseObject(s)
+	if err != nil {
+		return Subject{}, err
+	}
+	return Subject{Object: o, Relation: rel}, nil
+}
+
+// ParseRelationTuple parses "namespace:id#relation@subject".
+func ParseRelationTuple(s string) (RelationTuple, error) {
+	i := strings.Index(s, "@")
+	if i < 0 {
+		return RelationTuple{}, fmt.Errorf("model: invalid relation tuple %q", s)
+	}
+	j := strings.LastIndex(s[:i], "#")
+	if j < 0 || !validName(s[j+1:i]) {
+		return RelationTuple{}, fmt.Errorf("model: invalid relation tuple %q", s)
+	}
+	o, err := ParseObject(s[:j])
+	if err != nil {
+		return RelationTuple{}, err
+	}
+	sub, err := ParseSubject(s[i+1:])
+	if err != nil {
+		return RelationTuple{}, err
+	}
+	return RelationTuple{Object: o, Relation: s[j+1 : i], Subject: sub}, nil
+}
+
+// validName reports whether s names a namespace or relation.
+func validName(s string) bool {
+	return s != "" && !strings.ContainsAny(s, ":#@")
+}
@@ -0,0 +1,44 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRelationTuple(t *testing.T) {
+	for _, tt := range []struct {
+		s string
+		t RelationTuple
+	}{
+		{"doc:readme#viewer@user:alice", RelationTuple{
+			Object:   Object{Namespace: "doc", ID: "readme"},
+			Relation: "viewer",
+			Subject:  Subject{Object: Object{Namespace: "user", ID: "alice"}},
+		}},
+		{"doc:readme#viewer@group:eng#member", RelationTuple{
+			Object:   Object{Namespace: "doc", ID: "readme"},
+			Relation: "viewer",
+			Subject:  Subject{Object: Object{Namespace: "group", ID: "eng"}, Relation: "member"},
+		}},
+		{"doc:2022:q3#parent@folder:a:b", RelationTuple{
+			Object:   Object{Namespace: "doc", ID: "2022:q3"},
+			Relation: "parent",
+			Subject:  Subject{Object: Object{Namespace: "folder", ID: "a:b"}},
+		}},
+	} {
+		parsed, err := ParseRelationTuple(tt.s)
+		assert.Nil(t, err, tt.s)
+		assert.Equal(t, tt.t, parsed)
+		assert.Equal(t, tt.s, parsed.String())
+	}
+
+	for _, s := range []string{
+		"", "doc:readme", "doc:readme#viewer", "doc:readme@user:alice", "doc#viewer@user:alice",
+		":readme#viewer@user:alice", "doc:#viewer@user:alice", "doc:readme#@user:alice",
+		"doc:readme#viewer@user", "doc:readme#viewer@user:", "doc:readme#viewer@group:eng#",
+	} {
+		_, err := ParseRelationTuple(s)
+		assert.NotNil(t, err, s)
+	}
+}
@@ -0,0 +1,217 @@
+package model
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// This file implements the write-ahead log of durableEngine. The log is a
+// sequence of frames, each of
+//
+//	| length uint32 | crc32c of payload uint32 | json payload |
+//
+// A frame which is cut short or fails the checksum marks the end of the
+// log, as it can only come from a write interrupted by a crash.
+
+const (
+	frameHeaderSize = 8
+	maxFrameSize    = 16 << 20
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptFrame = errors.New("corrupt log frame")
+)
+
+// FsyncPolicy decides when log writes are flushed to stable storage.
+type FsyncPolicy int
+
+const (
+	// FsyncAlways syncs every record before the mutation is applied.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncInterval syncs periodically, records written since the last
+	// sync may be lost on a machine crash.
+	FsyncInterval
+	// FsyncNever leaves syncing to the operating system.
+	FsyncNever
+)
+
+type wal struct {
+	sync.Mutex
+	f       *os.File
+	policy  FsyncPolicy
+	seq     uint64 // sequence of the last record
+	records int    // records since the log was reset
+	dirty   bool   // unsynced writes
+	err     error  // sticky error, the log can't be trusted after a failed write
+
+	fsync func(*os.File) error // (*os.File).Sync, replaced by tests
+}
+
+// openWAL opens the log at path for appending after the first valid size
+// bytes, dropping any torn tail.
+func openWAL(path string, size int64, seq uint64, policy FsyncPolicy) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &wal{f: f, policy: policy, seq: seq, fsync: (*os.File).Sync}, nil
+}
+
+// append assigns the next sequence to r and writes it to the log, returns
+// the number of records since the last reset.
+func (w *wal) append(r *journalRecord) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.err != nil {
+		return w.records, w.err
+	}
+	offset, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		w.err = err
+		return w.records, err
+	}
+	// Every frame is handed to the OS right away, so that only a machine
+	// crash may lose unsynced records
+	r.Seq = w.seq + 1
+	if err := writeFrame(w.f, r); err != nil {
+		w.fail(offset, err)
+		return w.records, err
+	}
+	w.dirty = true
+	if w.policy == FsyncAlways {
+		if err := w.syncLocked(); err != nil {
+			w.fail(offset, err)
+			return w.records, err
+		}
+	}
+	w.seq = r.Seq
+	w.records++
+	return w.records, nil
+}
+
+// fail marks the log failed by err, and cuts the frame written from offset
+// on, so that the mutation refused isn't replayed by the next start.
+func (w *wal) fail(offset int64, err error) {
+	w.err = err
+	if w.f.Truncate(offset) == nil {
+		w.f.Seek(offset, io.SeekStart)
+	}
+}
+
+func (w *wal) sync() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.syncLocked()
+}
+
+func (w *wal) syncLocked() error {
+	if w.err != nil || !w.dirty {
+		return w.err
+	}
+	if err := w.fsync(w.f); err != nil {
+		w.err = err
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// reset empties the log once its records are covered by a snapshot, which
+// recovers it from a failure as well.
+func (w *wal) reset() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.records = 0
+	w.dirty = false
+	w.err = w.fsync(w.f)
+	return w.err
+}
+
+// failure returns the error the log failed by, or nil.
+func (w *wal) failure() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.err
+}
+
+func (w *wal) close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if err := w.syncLocked(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+func writeFrame(w io.Writer, r *journalRecord) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:8], crc32.Checksum(payload, crcTable))
+	copy(b[frameHeaderSize:], payload)
+	_, err = w.Write(b)
+	return err
+}
+
+// readFrames calls fn for every valid record of r and returns the size of
+// the valid prefix, with errCorruptFrame if a torn or corrupt frame follows.
+func readFrames(r io.Reader, fn func(journalRecord) error) (int64, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, frameHeaderSize)
+	var size int64
+	for {
+		if _, err := io.ReadFull(br, header); err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return size, errCorruptFrame
+		}
+		n := binary.BigEndian.Uint32(header[0:4])
+		if n > maxFrameSize {
+			return size, errCorruptFrame
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return size, errCorruptFrame
+		}
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+			return size, errCorruptFrame
+		}
+		var rec journalRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return size, errCorruptFrame
+		}
+		if err := fn(rec); err != nil {
+			return size, err
+		}
+		size += int64(frameHeaderSize + n)
+	}
+}
@@ -0,0 +1,162 @@
+package serving
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	mdl "hsbc-hw/model"
+)
+
+// This file guards the management handlers by built-in system roles. The
+// caller gives its token by the Authorization header, like
+// "Authorization: Bearer hsbc_at_...", and is refused with Unauthorized
+// without a valid one, or Forbidden without the role required.
+//
+// System roles are roles named with SystemPrefix, which are created by
+// Bootstrap. SystemAdmin inherits the others, and is required for anything
+// naming a system role or group, so that managers can't grant themselves
+// more than they have. For the same reason, system roles and groups can't
+// be inherited by roles and groups which aren't system ones.
+//
+// Roles of the default tenant hold in all tenants, while roles of another
+// tenant only hold in it.
+
+const (
+	SystemPrefix      = "system:"
+	SystemAdmin       = "system:admin"        // manages everything, including tenants and relations
+	SystemUserManager = "system:user-manager" // creates users and grants them roles and groups
+	SystemRoleManager = "system:role-manager" // manages roles, permissions and groups
+)
+
+// Bootstrap creates the system roles if missing, and admin unless its name
+// is empty, so that the first start has someone to manage the server. The
+// admin is granted SystemAdmin even if it exists already, so that a start
+// stopped between creating and granting it doesn't leave the server without
+// an admin. The password of a new admin must follow the password policy.
+func Bootstrap(admin mdl.User) error {
+	for _, r := range []mdl.Role{
+		{Name: SystemUserManager},
+		{Name: SystemRoleManager},
+		{Name: SystemAdmin, Parents: []string{SystemUserManager, SystemRoleManager}},
+	} {
+		if code := engine.CreateRole(r); code != mdl.RoleCreated && code != mdl.RoleAlreadyExisting {
+			return fmt.Errorf("failed to create role %s: %v", r.Name, code)
+		}
+	}
+	if admin.Name == "" {
+		return nil
+	}
+	if _, code := engine.GetUser(mdl.User{Name: admin.Name}); code != mdl.OK {
+		if resp, ok := checkPassword(admin.Name, admin.Password); !ok {
+			return fmt.Errorf("failed to create admin %s: %s", admin.Name, resp.Message)
+		}
+		if code := engine.CreateUser(admin); code != mdl.UserCreated && code != mdl.UserAlreadyExisting {
+			return fmt.Errorf("failed to create admin %s: %v", admin.Name, code)
+		}
+	}
+	if code := engine.AddUserRole(admin, mdl.Role{Name: SystemAdmin}); code != mdl.UserRoleAdded && code != mdl.UserRoleAlreadyExisting {
+		return fmt.Errorf("failed to grant %s to %s: %v", SystemAdmin, admin.Name, code)
+	}
+	return nil
+}
+
+// adminRequest has the fields of management requests which decide the
+// system role required.
+type adminRequest struct {
+	Tenant     string   `json:"tenant"`
+	RoleName   string   `json:"role_name"`
+	ParentName string   `json:"parent_name"`
+	Parents    []string `json:"parents"`
+	GroupName  string   `json:"group_name"`
+}
+
+// requireRole guards h by role, or SystemAdmin if the request names a
+// system role or group.
+func requireRole(role string, h handlerFunc) handlerFunc {
+	return func(req *http.Request, b []byte) ResponseCommon {
+		token := bearerToken(req)
+		if token == "" {
+			return newResponse(mdl.Unauthorized, "missing bearer token")
+		}
+		in := new(adminRequest)
+		if err := decodeRequest(req, b, in); err != nil {
+			return newResponse(mdl.InvalidArgument, err.Error())
+		}
+		child := in.RoleName
+		if in.GroupName != "" {
+			child = in.GroupName
+		}
+		parents := append([]string{in.ParentName}, in.Parents...)
+		if (req.Method == "POST" || req.Method == "PUT") && !isSystem(child) {
+			// A group granted a system role is a parent of sorts as well
+			if in.GroupName != "" {
+				parents = append(parents, in.RoleName)
+			}
+			for _, p := range parents {
+				if isSystem(p) {
+					return newResponse(mdl.InvalidArgument, fmt.Sprintf("%s can only be inherited by system roles and groups", p))
+				}
+			}
+		}
+		// Per request, as role is shared by all requests of the route
+		required := role
+		for _, name := range append(parents, in.RoleName, in.GroupName) {
+			if isSystem(name) {
+				required = SystemAdmin
+			}
+		}
+		if resp, ok := authorize(token, in.Tenant, required); !ok {
+			return resp
+		}
+		return h(req, b)
+	}
+}
+
+// authorize checks whether token has role in the named tenant.
+func authorize(token, tenant, role string) (ResponseCommon, bool) {
+	caller, code := tokenTenant(token)
+	if code != mdl.OK {
+		return newResponse(mdl.Unauthorized, code.String()), false
+	}
+	if !caller.IsDefault() && caller.Name != tenant {
+		return newResponse(mdl.Forbidden, "token of another tenant"), false
+	}
+	switch code = mdl.ForTenant(engine, caller).CheckRole(token, role); code {
+	case mdl.TokenRoleOK:
+		return ResponseCommon{}, true
+	case mdl.TokenRoleNotFound:
+		return newResponse(mdl.Forbidden, fmt.Sprintf("%s required", role)), false
+	case mdl.Internal:
+		return newResponse(code, code.String()), false
+	default:
+		return newResponse(mdl.Unauthorized, code.String()), false
+	}
+}
+
+// bearerToken returns the token of the Authorization header, or empty if
+// there is none.
+func bearerToken(req *http.Request) string {
+	const prefix = "Bearer "
+	h := req.Header.Get("Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// hasSystemRole reports whether a system role or group is granted to u
+// directly, which is the only way to have one as they can't be inherited
+// otherwise.
+func hasSystemRole(u mdl.User) bool {
+	for _, name := range append(u.Roles, u.Groups...) {
+		if isSystem(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSystem(name string) bool {
+	return strings.HasPrefix(name, SystemPrefix)
+}
@@ -1,190 +1,1038 @@
 package serving
 
 import (
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 
 	mdl "hsbc-hw/model"
 )
 
 var (
-	mux    = make(map[string]map[string]func([]byte) ResponseCommon)
+	routes router
 	engine mdl.AuthenticateAuthorizationEngine
-)
+	policy mdl.PolicyEvaluator
 
-func registerHandler(path, method string, h func([]byte) ResponseCommon) {
-	m, ok := mux[path]
-	if !ok {
-		m = make(map[string]func([]byte) ResponseCommon)
-		mux[path] = m
-	}
-	m[method] = h
-}
+	// passwordPolicy is checked on every new password, nil accepts any
+	// non-empty one.
+	passwordPolicy *mdl.PasswordPolicy
 
-func newMultiplexer(path string, m map[string]func([]byte) ResponseCommon) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, req *http.Request) {
-		var resp ResponseCommon
-		defer func() {
-			code := resp.Status.HTTPCode()
-			if code != 200 {
-				resp.Data = nil
-			}
-			w.WriteHeader(code)
-			log.Printf("%v %v, resp %+v", req.URL.Path, req.Method, resp)
-			b, _ := json.Marshal(resp)
-			w.Write(b)
-		}()
-		log.Printf("%v %v", req.URL.Path, req.Method)
-		h, ok := m[req.Method]
-		if !ok {
-			resp = newResponse(mdl.InvalidArgument, fmt.Sprintf("method %v not implemented for url '%v'", req.Method, path))
-			return
-		}
-		b, err := ioutil.ReadAll(req.Body)
-		if err != nil {
-			resp = newResponse(mdl.Internal, err.Error())
-			return
-		}
-		req.Body.Close()
-		resp = h(b)
-	}
+	// relations are the relation engines of the tenants, created on their
+	// first use by newRelations.
+	relations     map[string]mdl.RelationEngine
+	relationsLock sync.Mutex
+	newRelations  func(mdl.Tenant) mdl.RelationEngine
+)
+
+func registerHandler(pattern, method string, h handlerFunc) {
+	routes.handle(pattern, method, h)
 }
 
 func init() {
-	registerHandler("/user", "POST", CreateUser)
+	registerHandler("/user", "POST", requireRole(SystemUserManager, CreateUser))
 	registerHandler("/user", "DELETE", DeleteUser)
-	registerHandler("/user/role", "POST", AddUserRole)
+	registerHandler("/user/role", "POST", requireRole(SystemUserManager, AddUserRole))
+	registerHandler("/user/role", "DELETE", requireRole(SystemUserManager, RemoveUserRole))
 	registerHandler("/user/auth", "POST", AuthenticateUser)
-	registerHandler("/role", "POST", CreateRole)
-	registerHandler("/role", "DELETE", DeleteRole)
+	registerHandler("/user/password", "POST", ChangePassword)
+	registerHandler("/user/password/reset", "POST", requireRole(SystemUserManager, ResetPassword))
+	registerHandler("/role", "POST", requireRole(SystemRoleManager, CreateRole))
+	registerHandler("/role", "DELETE", requireRole(SystemRoleManager, DeleteRole))
+	registerHandler("/role/parent", "POST", requireRole(SystemRoleManager, AddRoleParent))
+	registerHandler("/role/parent", "DELETE", requireRole(SystemRoleManager, RemoveRoleParent))
+	registerHandler("/role/permission", "POST", requireRole(SystemRoleManager, GrantPermission))
+	registerHandler("/role/permission", "DELETE", requireRole(SystemRoleManager, RevokePermission))
+	registerHandler("/group", "POST", requireRole(SystemRoleManager, CreateGroup))
+	registerHandler("/group", "DELETE", requireRole(SystemRoleManager, DeleteGroup))
+	registerHandler("/group/member", "POST", requireRole(SystemUserManager, AddGroupMember))
+	registerHandler("/group/member", "DELETE", requireRole(SystemUserManager, RemoveGroupMember))
+	registerHandler("/group/parent", "POST", requireRole(SystemRoleManager, AddGroupParent))
+	registerHandler("/group/parent", "DELETE", requireRole(SystemRoleManager, RemoveGroupParent))
+	registerHandler("/group/role", "POST", requireRole(SystemRoleManager, AddGroupRole))
+	registerHandler("/group/role", "DELETE", requireRole(SystemRoleManager, RemoveGroupRole))
 	registerHandler("/token", "DELETE", Invalidate)
 	registerHandler("/token/role", "GET", CheckRole)
+	registerHandler("/token/role/{role_name}", "GET", CheckRole)
 	registerHandler("/token/roles", "GET", AllRoles)
-	for path, m := range mux {
-		http.HandleFunc(path, newMultiplexer(path, m))
+	registerHandler("/token/permission", "GET", CheckPermission)
+	registerHandler("/token/permission/{permission}", "GET", CheckPermission)
+	registerHandler("/token/policy", "GET", EvaluatePolicy)
+	registerHandler("/token/sessions", "GET", ListSessions)
+	registerHandler("/token/sessions", "DELETE", RevokeAllSessions)
+	registerHandler("/token/session", "DELETE", RevokeSession)
+	registerHandler("/namespace", "POST", requireRole(SystemAdmin, SetNamespace))
+	registerHandler("/relation/tuple", "POST", requireRole(SystemAdmin, WriteTuple))
+	registerHandler("/relation/tuple", "DELETE", requireRole(SystemAdmin, DeleteTuple))
+	registerHandler("/relation/check", "GET", CheckRelation)
+	registerHandler("/relation/expand", "GET", ExpandRelation)
+	registerHandler("/relation/objects", "GET", ListObjects)
+	registerHandler("/tenant", "POST", requireRole(SystemAdmin, CreateTenant))
+	registerHandler("/tenant", "DELETE", requireRole(SystemAdmin, DeleteTenant))
+	registerHandler("/tenants", "GET", requireRole(SystemAdmin, ListTenants))
+	registerHandler("/users", "GET", requireRole(SystemUserManager, ListUsers))
+	registerHandler("/users/{user_name}", "GET", requireRole(SystemUserManager, GetUser))
+	registerHandler("/users/{user_name}", "PUT", requireRole(SystemUserManager, CreateUser))
+	registerHandler("/users/{user_name}", "DELETE", DeleteUser)
+	registerHandler("/users/{user_name}/password", "PUT", ChangePassword)
+	registerHandler("/users/{user_name}/password/reset", "POST", requireRole(SystemUserManager, ResetPassword))
+	registerHandler("/users/{user_name}/roles/{role_name}", "PUT", requireRole(SystemUserManager, AddUserRole))
+	registerHandler("/users/{user_name}/roles/{role_name}", "DELETE", requireRole(SystemUserManager, RemoveUserRole))
+	registerHandler("/roles", "GET", requireRole(SystemRoleManager, ListRoles))
+	registerHandler("/roles/{role_name}", "GET", requireRole(SystemRoleManager, GetRole))
+	registerHandler("/roles/{role_name}", "PUT", requireRole(SystemRoleManager, CreateRole))
+	registerHandler("/roles/{role_name}", "DELETE", requireRole(SystemRoleManager, DeleteRole))
+	registerHandler("/roles/{role_name}/members", "GET", requireRole(SystemUserManager, ListRoleMembers))
+	registerHandler("/roles/{role_name}/parents/{parent_name}", "PUT", requireRole(SystemRoleManager, AddRoleParent))
+	registerHandler("/roles/{role_name}/parents/{parent_name}", "DELETE", requireRole(SystemRoleManager, RemoveRoleParent))
+	registerHandler("/roles/{role_name}/permissions/{permission}", "PUT", requireRole(SystemRoleManager, GrantPermission))
+	registerHandler("/roles/{role_name}/permissions/{permission}", "DELETE", requireRole(SystemRoleManager, RevokePermission))
+	registerHandler("/sessions", "POST", AuthenticateUser)
+	registerHandler("/sessions", "GET", ListSessions)
+	registerHandler("/sessions", "DELETE", RevokeAllSessions)
+	registerHandler("/sessions/{session_id}", "GET", GetSession)
+	registerHandler("/sessions/{session_id}", "DELETE", RevokeSession)
+	for _, root := range routes.roots() {
+		http.Handle(root, routes.handler("", writeResponse))
 	}
-	engine = mdl.NewInmemEngine()
+	http.Handle(APIPrefix+"/", routes.handler(APIPrefix, writeResponse))
+	http.Handle(LegacyPrefix+"/", routes.handler(LegacyPrefix, writeLegacyResponse))
+	newEngineForTesting()
 }
 
 func newEngineForTesting() {
 	engine = mdl.NewInmemEngine()
+	SetRelationEngines(func(mdl.Tenant) mdl.RelationEngine {
+		return mdl.NewInmemRelationEngine()
+	})
+	policy = new(mdl.Policy)
+	passwordPolicy = nil
+}
+
+// SetEngine replaces the default in-memory engine, e.g. with a durable one.
+func SetEngine(e mdl.AuthenticateAuthorizationEngine) {
+	engine.Shutdown()
+	engine = e
+}
+
+// SetPolicy replaces the default policy, which denies everything.
+func SetPolicy(p mdl.PolicyEvaluator) {
+	policy = p
+}
+
+// SetPasswordPolicy replaces the default password policy, which accepts any
+// non-empty password. Passwords set before are not checked.
+func SetPasswordPolicy(p *mdl.PasswordPolicy) {
+	passwordPolicy = p
+}
+
+// SetRelationEngines replaces the relation engines of all tenants with the
+// ones created by newEngine, which are in-memory by default.
+func SetRelationEngines(newEngine func(mdl.Tenant) mdl.RelationEngine) {
+	relationsLock.Lock()
+	defer relationsLock.Unlock()
+	relations = make(map[string]mdl.RelationEngine)
+	newRelations = newEngine
+}
+
+// tenantEngine returns the view of the engine in the named tenant.
+func tenantEngine(name string) (mdl.AuthenticateAuthorizationEngine, mdl.StatusCode) {
+	t := mdl.Tenant{Name: name}
+	if !t.IsDefault() && !t.Valid() {
+		return nil, mdl.TenantInvalid
+	}
+	return mdl.ForTenant(engine, t), mdl.OK
+}
+
+// tokenTenant returns the tenant of the user of token.
+func tokenTenant(token string) (mdl.Tenant, mdl.StatusCode) {
+	u, code := engine.TokenUser(token)
+	if code != mdl.OK {
+		return mdl.Tenant{}, code
+	}
+	return mdl.TenantOf(u.Name), mdl.OK
+}
+
+// tokenEngine returns the view of the engine in the tenant of token.
+func tokenEngine(token string) (mdl.AuthenticateAuthorizationEngine, mdl.StatusCode) {
+	t, code := tokenTenant(token)
+	if code != mdl.OK {
+		return nil, code
+	}
+	return mdl.ForTenant(engine, t), mdl.OK
+}
+
+// relationEngine returns the relation engine of the named tenant, and
+// creates it if the tenant exists.
+func relationEngine(name string) (mdl.RelationEngine, mdl.StatusCode) {
+	t := mdl.Tenant{Name: name}
+	if !t.IsDefault() && !t.Valid() {
+		return nil, mdl.TenantInvalid
+	}
+	relationsLock.Lock()
+	defer relationsLock.Unlock()
+	if e, ok := relations[name]; ok {
+		return e, mdl.OK
+	}
+	if !t.IsDefault() {
+		tenants, code := engine.ListTenants()
+		if code != mdl.OK {
+			return nil, code
+		}
+		found := false
+		for _, tt := range tenants {
+			if tt == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, mdl.TenantNotFound
+		}
+	}
+	e := newRelations(t)
+	relations[name] = e
+	return e, mdl.OK
+}
+
+// tokenRelationEngine returns the relation engine of the tenant of token.
+func tokenRelationEngine(token string) (mdl.RelationEngine, mdl.StatusCode) {
+	t, code := tokenTenant(token)
+	if code != mdl.OK {
+		return nil, code
+	}
+	return relationEngine(t.Name)
 }
 
 func Cleanup() {
 	engine.Shutdown()
 }
 
-func CreateUser(b []byte) ResponseCommon {
+func CreateUser(req *http.Request, b []byte) ResponseCommon {
 	in := new(CreateUserRequest)
-	if err := json.Unmarshal(b, &in); err != nil {
+	if err := decodeRequest(req, b, in); err != nil {
 		return newResponse(mdl.InvalidArgument, err.Error())
 	}
 	if in.UserName == "" || in.Password == "" {
 		return newResponse(mdl.InvalidArgument, "empty user_name or password")
 	}
 
-	code := engine.CreateUser(mdl.User{
-		Name:         in.UserName,
-		PwdEncrypted: encryptPassword(in.Password),
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	if resp, ok := checkPassword(in.UserName, in.Password); !ok {
+		return resp
+	}
+	code = e.CreateUser(mdl.User{
+		Name:     in.UserName,
+		Password: in.Password,
 	})
 	return newResponse(code, code.String())
 }
 
-func DeleteUser(b []byte) ResponseCommon {
+func DeleteUser(req *http.Request, b []byte) ResponseCommon {
 	in := new(DeleteUserRequest)
-	if err := json.Unmarshal(b, &in); err != nil {
+	if err := decodeRequest(req, b, in); err != nil {
 		return newResponse(mdl.InvalidArgument, err.Error())
 	}
-	code := engine.DeleteUser(mdl.User{
-		Name:         in.UserName,
-		PwdEncrypted: encryptPassword(in.Password),
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.DeleteUser(mdl.User{
+		Name:     in.UserName,
+		Password: in.Password,
 	})
 	return newResponse(code, code.String())
 }
 
-func AddUserRole(b []byte) ResponseCommon {
+func GetUser(req *http.Request, b []byte) ResponseCommon {
+	in := new(GetUserRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	u, code := e.GetUser(mdl.User{Name: in.UserName})
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	return newResponseData(code, code.String(), GetUserResponse{
+		UserName:           u.Name,
+		Roles:              nonNil(u.Roles),
+		Groups:             nonNil(u.Groups),
+		MustChangePassword: u.MustChangePassword,
+	})
+}
+
+func ListUsers(req *http.Request, b []byte) ResponseCommon {
+	in := new(ListRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.Limit < 0 {
+		return newResponse(mdl.InvalidArgument, "negative limit")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	users, next, code := e.ListUsers(in.page())
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	return newResponseData(code, code.String(), newListUsersResponse(users, next))
+}
+
+func AddUserRole(req *http.Request, b []byte) ResponseCommon {
 	in := new(AddUserRoleRequest)
-	if err := json.Unmarshal(b, &in); err != nil {
+	if err := decodeRequest(req, b, in); err != nil {
 		return newResponse(mdl.InvalidArgument, err.Error())
 	}
 	if in.UserName == "" || in.RoleName == "" {
 		return newResponse(mdl.InvalidArgument, "empty user_name or role_name")
 	}
-	code := engine.AddUserRole(
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.AddUserRoleOn(
 		mdl.User{Name: in.UserName}, // no password required
 		mdl.Role{Name: in.RoleName},
+		mdl.Resource{Path: in.Resource},
 	)
 	return newResponse(code, code.String())
 }
 
-func AuthenticateUser(b []byte) ResponseCommon {
+func RemoveUserRole(req *http.Request, b []byte) ResponseCommon {
+	in := new(RemoveUserRoleRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.UserName == "" || in.RoleName == "" {
+		return newResponse(mdl.InvalidArgument, "empty user_name or role_name")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.RemoveUserRoleOn(
+		mdl.User{Name: in.UserName}, // no password required
+		mdl.Role{Name: in.RoleName},
+		mdl.Resource{Path: in.Resource},
+	)
+	return newResponse(code, code.String())
+}
+
+// ChangePassword changes the password of the user given the current one,
+// and revokes all of its sessions.
+func ChangePassword(req *http.Request, b []byte) ResponseCommon {
+	in := new(ChangePasswordRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.UserName == "" || in.NewPassword == "" {
+		return newResponse(mdl.InvalidArgument, "empty user_name or new_password")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	if resp, ok := checkPassword(in.UserName, in.NewPassword); !ok {
+		return resp
+	}
+	code = e.ChangePassword(mdl.User{Name: in.UserName, Password: in.Password}, in.NewPassword)
+	return newPasswordResponse(code)
+}
+
+// ResetPassword sets a temporary password of the user, which must be
+// changed by ChangePassword before authenticating, and revokes all of its
+// sessions.
+func ResetPassword(req *http.Request, b []byte) ResponseCommon {
+	in := new(ResetPasswordRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.UserName == "" || in.Password == "" {
+		return newResponse(mdl.InvalidArgument, "empty user_name or password")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	u, code := e.GetUser(mdl.User{Name: in.UserName})
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	// Resetting the password of a user takes over its roles, which needs
+	// SystemAdmin for system ones like granting them
+	if hasSystemRole(u) {
+		if resp, ok := authorize(bearerToken(req), in.Tenant, SystemAdmin); !ok {
+			return resp
+		}
+	}
+	if resp, ok := checkPassword(in.UserName, in.Password); !ok {
+		return resp
+	}
+	code = e.ResetPassword(mdl.User{Name: in.UserName, Password: in.Password})
+	return newPasswordResponse(code)
+}
+
+// checkPassword checks the new password of the user named name against
+// the password policy, and returns the violations if it's not ok.
+func checkPassword(name, password string) (ResponseCommon, bool) {
+	vs := passwordPolicy.Check(name, password)
+	if len(vs) == 0 {
+		return ResponseCommon{}, true
+	}
+	return newViolationsResponse(mdl.PasswordPolicyViolated, vs), false
+}
+
+// newPasswordResponse tells a reused password as a violation of the
+// password policy.
+func newPasswordResponse(code mdl.StatusCode) ResponseCommon {
+	if code == mdl.PasswordReused {
+		return newViolationsResponse(code, []mdl.PasswordViolation{{
+			Rule:    mdl.RuleReuse,
+			Message: "must differ from the last passwords",
+		}})
+	}
+	return newResponse(code, code.String())
+}
+
+// newViolationsResponse lists the violations in the message as well, for
+// the legacy envelope which drops the data of failures.
+func newViolationsResponse(code mdl.StatusCode, vs []mdl.PasswordViolation) ResponseCommon {
+	msgs := make([]string, 0, len(vs))
+	for _, v := range vs {
+		msgs = append(msgs, v.Message)
+	}
+	return newResponseData(code, code.String()+": "+strings.Join(msgs, "; "), PasswordViolationsResponse{Violations: vs})
+}
+
+func AuthenticateUser(req *http.Request, b []byte) ResponseCommon {
 	in := new(AuthenticateRequest)
-	if err := json.Unmarshal(b, &in); err != nil {
+	if err := decodeRequest(req, b, in); err != nil {
 		return newResponse(mdl.InvalidArgument, err.Error())
 	}
-	token, code := engine.Authenticate(mdl.User{
-		Name:         in.UserName,
-		PwdEncrypted: encryptPassword(in.Password),
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	token, code := e.Authenticate(mdl.User{
+		Name:     in.UserName,
+		Password: in.Password,
+	}, mdl.SessionInfo{
+		UserAgent: req.UserAgent(),
+		IP:        clientIP(req),
+		Label:     in.Label,
 	})
 	return newResponseData(code, code.String(), AuthenticateResponse{
+		Tenant:          token.Tenant,
 		Token:           token.ID,
+		SessionID:       token.SessionID,
 		ExpiredAtInUsec: token.ExpiredAtInUsec,
 	})
 }
 
-func CreateRole(b []byte) ResponseCommon {
+func CreateRole(req *http.Request, b []byte) ResponseCommon {
 	in := new(CreateRoleRequest)
-	if err := json.Unmarshal(b, &in); err != nil {
+	if err := decodeRequest(req, b, in); err != nil {
 		return newResponse(mdl.InvalidArgument, err.Error())
 	}
 	if in.RoleName == "" {
 		return newResponse(mdl.InvalidArgument, "empty role_name")
 	}
-	code := engine.CreateRole(mdl.Role{Name: in.RoleName})
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.CreateRole(mdl.Role{Name: in.RoleName, Parents: in.Parents})
 	return newResponse(code, code.String())
 }
 
-func DeleteRole(b []byte) ResponseCommon {
+func DeleteRole(req *http.Request, b []byte) ResponseCommon {
 	in := new(DeleteRoleRequest)
-	if err := json.Unmarshal(b, &in); err != nil {
+	if err := decodeRequest(req, b, in); err != nil {
 		return newResponse(mdl.InvalidArgument, err.Error())
 	}
-	code := engine.DeleteRole(mdl.Role{Name: in.RoleName})
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.DeleteRole(mdl.Role{Name: in.RoleName})
 	return newResponse(code, code.String())
 }
 
-func Invalidate(b []byte) ResponseCommon {
+func GetRole(req *http.Request, b []byte) ResponseCommon {
+	in := new(GetRoleRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	r, code := e.GetRole(mdl.Role{Name: in.RoleName})
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	return newResponseData(code, code.String(), GetRoleResponse{
+		RoleName:    r.Name,
+		Parents:     nonNil(r.Parents),
+		Permissions: nonNil(r.Permissions),
+	})
+}
+
+func ListRoles(req *http.Request, b []byte) ResponseCommon {
+	in := new(ListRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.Limit < 0 {
+		return newResponse(mdl.InvalidArgument, "negative limit")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	roles, next, code := e.ListRoles(in.page())
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	resp := ListRolesResponse{Roles: make([]string, 0, len(roles)), NextCursor: next}
+	for _, r := range roles {
+		resp.Roles = append(resp.Roles, r.Name)
+	}
+	return newResponseData(code, code.String(), resp)
+}
+
+// ListRoleMembers lists the users having the role globally, including the
+// ones inheriting it by other roles or groups.
+func ListRoleMembers(req *http.Request, b []byte) ResponseCommon {
+	in := new(ListRoleMembersRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.Limit < 0 {
+		return newResponse(mdl.InvalidArgument, "negative limit")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	users, next, code := e.ListRoleMembers(mdl.Role{Name: in.RoleName}, in.page())
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	return newResponseData(code, code.String(), newListUsersResponse(users, next))
+}
+
+func AddRoleParent(req *http.Request, b []byte) ResponseCommon {
+	in := new(AddRoleParentRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.RoleName == "" || in.ParentName == "" {
+		return newResponse(mdl.InvalidArgument, "empty role_name or parent_name")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.AddRoleParent(mdl.Role{Name: in.RoleName}, mdl.Role{Name: in.ParentName})
+	return newResponse(code, code.String())
+}
+
+func RemoveRoleParent(req *http.Request, b []byte) ResponseCommon {
+	in := new(RemoveRoleParentRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.RoleName == "" || in.ParentName == "" {
+		return newResponse(mdl.InvalidArgument, "empty role_name or parent_name")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.RemoveRoleParent(mdl.Role{Name: in.RoleName}, mdl.Role{Name: in.ParentName})
+	return newResponse(code, code.String())
+}
+
+func GrantPermission(req *http.Request, b []byte) ResponseCommon {
+	in := new(GrantPermissionRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.RoleName == "" || in.Permission == "" {
+		return newResponse(mdl.InvalidArgument, "empty role_name or permission")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.GrantPermission(mdl.Role{Name: in.RoleName}, mdl.Permission{Name: in.Permission})
+	return newResponse(code, code.String())
+}
+
+func RevokePermission(req *http.Request, b []byte) ResponseCommon {
+	in := new(RevokePermissionRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.RoleName == "" || in.Permission == "" {
+		return newResponse(mdl.InvalidArgument, "empty role_name or permission")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.RevokePermission(mdl.Role{Name: in.RoleName}, mdl.Permission{Name: in.Permission})
+	return newResponse(code, code.String())
+}
+
+func CreateGroup(req *http.Request, b []byte) ResponseCommon {
+	in := new(CreateGroupRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.GroupName == "" {
+		return newResponse(mdl.InvalidArgument, "empty group_name")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.CreateGroup(mdl.Group{Name: in.GroupName})
+	return newResponse(code, code.String())
+}
+
+func DeleteGroup(req *http.Request, b []byte) ResponseCommon {
+	in := new(DeleteGroupRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.DeleteGroup(mdl.Group{Name: in.GroupName})
+	return newResponse(code, code.String())
+}
+
+func AddGroupMember(req *http.Request, b []byte) ResponseCommon {
+	in := new(AddGroupMemberRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.GroupName == "" || in.UserName == "" {
+		return newResponse(mdl.InvalidArgument, "empty group_name or user_name")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.AddGroupMember(mdl.Group{Name: in.GroupName}, mdl.User{Name: in.UserName})
+	return newResponse(code, code.String())
+}
+
+func RemoveGroupMember(req *http.Request, b []byte) ResponseCommon {
+	in := new(RemoveGroupMemberRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.GroupName == "" || in.UserName == "" {
+		return newResponse(mdl.InvalidArgument, "empty group_name or user_name")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.RemoveGroupMember(mdl.Group{Name: in.GroupName}, mdl.User{Name: in.UserName})
+	return newResponse(code, code.String())
+}
+
+func AddGroupParent(req *http.Request, b []byte) ResponseCommon {
+	in := new(AddGroupParentRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.GroupName == "" || in.ParentName == "" {
+		return newResponse(mdl.InvalidArgument, "empty group_name or parent_name")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.AddGroupParent(mdl.Group{Name: in.GroupName}, mdl.Group{Name: in.ParentName})
+	return newResponse(code, code.String())
+}
+
+func RemoveGroupParent(req *http.Request, b []byte) ResponseCommon {
+	in := new(RemoveGroupParentRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.GroupName == "" || in.ParentName == "" {
+		return newResponse(mdl.InvalidArgument, "empty group_name or parent_name")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.RemoveGroupParent(mdl.Group{Name: in.GroupName}, mdl.Group{Name: in.ParentName})
+	return newResponse(code, code.String())
+}
+
+func AddGroupRole(req *http.Request, b []byte) ResponseCommon {
+	in := new(AddGroupRoleRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.GroupName == "" || in.RoleName == "" {
+		return newResponse(mdl.InvalidArgument, "empty group_name or role_name")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.AddGroupRole(mdl.Group{Name: in.GroupName}, mdl.Role{Name: in.RoleName})
+	return newResponse(code, code.String())
+}
+
+func RemoveGroupRole(req *http.Request, b []byte) ResponseCommon {
+	in := new(RemoveGroupRoleRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if in.GroupName == "" || in.RoleName == "" {
+		return newResponse(mdl.InvalidArgument, "empty group_name or role_name")
+	}
+	e, code := tenantEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.RemoveGroupRole(mdl.Group{Name: in.GroupName}, mdl.Role{Name: in.RoleName})
+	return newResponse(code, code.String())
+}
+
+func Invalidate(req *http.Request, b []byte) ResponseCommon {
 	in := new(InvalidateRequest)
-	if err := json.Unmarshal(b, &in); err != nil {
+	if err := decodeRequest(req, b, in); err != nil {
 		return newResponse(mdl.InvalidArgument, err.Error())
 	}
-	code := engine.Invalidate(in.Token)
+	in.Token = requestToken(req, in.Token)
+	e, code := tokenEngine(in.Token)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.Invalidate(in.Token)
 	return newResponse(code, code.String())
 }
 
-func CheckRole(b []byte) ResponseCommon {
+func CheckRole(req *http.Request, b []byte) ResponseCommon {
 	in := new(CheckRoleRequest)
-	if err := json.Unmarshal(b, &in); err != nil {
+	if err := decodeRequest(req, b, in); err != nil {
 		return newResponse(mdl.InvalidArgument, err.Error())
 	}
-	code := engine.CheckRole(in.Token, in.RoleName)
+	in.Token = requestToken(req, in.Token)
+	e, code := tokenEngine(in.Token)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.CheckRoleOn(in.Token, in.RoleName, mdl.Resource{Path: in.Resource})
 	return newResponse(code, code.String())
 }
 
-func AllRoles(b []byte) ResponseCommon {
+func CheckPermission(req *http.Request, b []byte) ResponseCommon {
+	in := new(CheckPermissionRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	in.Token = requestToken(req, in.Token)
+	if in.Permission == "" {
+		return newResponse(mdl.InvalidArgument, "empty permission")
+	}
+	e, code := tokenEngine(in.Token)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.CheckPermission(in.Token, in.Permission)
+	return newResponse(code, code.String())
+}
+
+func EvaluatePolicy(req *http.Request, b []byte) ResponseCommon {
+	in := new(EvaluatePolicyRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	in.Token = requestToken(req, in.Token)
+	tenant, code := tokenTenant(in.Token)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	e := mdl.ForTenant(engine, tenant)
+	u, code := e.TokenUser(in.Token)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	roles, code := e.AllRoles(in.Token)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	pr := mdl.PolicyRequest{Tenant: tenant.Name, User: u.Name, Attributes: in.Attributes}
+	for _, r := range roles {
+		pr.Roles = append(pr.Roles, r.Name)
+	}
+	d := policy.Evaluate(pr)
+	code = mdl.PolicyDenied
+	if d.Allow {
+		code = mdl.PolicyAllowed
+	}
+	msg := fmt.Sprintf("%v by rule %s", code, d.Rule)
+	if d.Rule == "" {
+		msg = fmt.Sprintf("%v by default", code)
+	}
+	return newResponseData(code, msg, EvaluatePolicyResponse{UserName: u.Name, Allow: d.Allow, Rule: d.Rule})
+}
+
+func AllRoles(req *http.Request, b []byte) ResponseCommon {
 	in := new(AllRolesRequest)
-	if err := json.Unmarshal(b, &in); err != nil {
+	if err := decodeRequest(req, b, in); err != nil {
 		return newResponse(mdl.InvalidArgument, err.Error())
 	}
-	roles, code := engine.AllRoles(in.Token)
+	in.Token = requestToken(req, in.Token)
+	e, code := tokenEngine(in.Token)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	roles, code := e.AllRoles(in.Token)
 	resp := AllRolesResponse{Token: in.Token}
 	for _, r := range roles {
 		resp.Roles = append(resp.Roles, r.Name)
 	}
+	if code != mdl.OK {
+		return newResponseData(code, code.String(), resp)
+	}
+	direct, code := e.DirectRoles(in.Token)
+	for _, r := range direct {
+		resp.DirectRoles = append(resp.DirectRoles, r.Name)
+	}
+	return newResponseData(code, code.String(), resp)
+}
+
+func ListSessions(req *http.Request, b []byte) ResponseCommon {
+	in := new(ListSessionsRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	in.Token = requestToken(req, in.Token)
+	e, code := tokenEngine(in.Token)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	sessions, code := e.ListSessions(in.Token)
+	resp := ListSessionsResponse{Sessions: make([]Session, 0, len(sessions))}
+	for _, s := range sessions {
+		resp.Sessions = append(resp.Sessions, newSession(s))
+	}
+	return newResponseData(code, code.String(), resp)
+}
+
+// GetSession returns the session of the user of the token named by
+// session_id.
+func GetSession(req *http.Request, b []byte) ResponseCommon {
+	in := new(RevokeSessionRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	in.Token = requestToken(req, in.Token)
+	e, code := tokenEngine(in.Token)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	sessions, code := e.ListSessions(in.Token)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	for _, s := range sessions {
+		if s.SessionID == in.SessionID {
+			return newResponseData(code, code.String(), newSession(s))
+		}
+	}
+	return newResponse(mdl.SessionNotFound, mdl.SessionNotFound.String())
+}
+
+func RevokeSession(req *http.Request, b []byte) ResponseCommon {
+	in := new(RevokeSessionRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	in.Token = requestToken(req, in.Token)
+	if in.SessionID == "" {
+		return newResponse(mdl.InvalidArgument, "empty session_id")
+	}
+	e, code := tokenEngine(in.Token)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.RevokeSession(in.Token, in.SessionID)
+	return newResponse(code, code.String())
+}
+
+func RevokeAllSessions(req *http.Request, b []byte) ResponseCommon {
+	in := new(RevokeAllSessionsRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	in.Token = requestToken(req, in.Token)
+	e, code := tokenEngine(in.Token)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = e.RevokeAllSessions(in.Token)
+	return newResponse(code, code.String())
+}
+
+func CreateTenant(req *http.Request, b []byte) ResponseCommon {
+	in := new(TenantRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	code := engine.CreateTenant(mdl.Tenant{Name: in.TenantName})
+	return newResponse(code, code.String())
+}
+
+func DeleteTenant(req *http.Request, b []byte) ResponseCommon {
+	in := new(TenantRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	code := engine.DeleteTenant(mdl.Tenant{Name: in.TenantName})
+	if code == mdl.TenantDeleted {
+		relationsLock.Lock()
+		delete(relations, in.TenantName)
+		relationsLock.Unlock()
+	}
+	return newResponse(code, code.String())
+}
+
+func ListTenants(_ *http.Request, _ []byte) ResponseCommon {
+	tenants, code := engine.ListTenants()
+	resp := ListTenantsResponse{Tenants: make([]string, 0, len(tenants))}
+	for _, t := range tenants {
+		resp.Tenants = append(resp.Tenants, t.Name)
+	}
+	return newResponseData(code, code.String(), resp)
+}
+
+func SetNamespace(req *http.Request, b []byte) ResponseCommon {
+	in := new(SetNamespaceRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	if err := in.Validate(); err != nil {
+		return newResponse(mdl.NamespaceInvalid, err.Error())
+	}
+	rel, code := relationEngine(in.Tenant)
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = rel.SetNamespace(in.Namespace)
+	return newResponse(code, code.String())
+}
+
+func WriteTuple(req *http.Request, b []byte) ResponseCommon {
+	rel, tuple, resp, ok := parseTuple(req, b)
+	if !ok {
+		return resp
+	}
+	code := rel.WriteTuple(tuple)
+	return newResponse(code, code.String())
+}
+
+func DeleteTuple(req *http.Request, b []byte) ResponseCommon {
+	rel, tuple, resp, ok := parseTuple(req, b)
+	if !ok {
+		return resp
+	}
+	code := rel.DeleteTuple(tuple)
+	return newResponse(code, code.String())
+}
+
+func parseTuple(req *http.Request, b []byte) (mdl.RelationEngine, mdl.RelationTuple, ResponseCommon, bool) {
+	in := new(RelationTupleRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return nil, mdl.RelationTuple{}, newResponse(mdl.InvalidArgument, err.Error()), false
+	}
+	tuple, err := mdl.ParseRelationTuple(in.Object + "#" + in.Relation + "@" + in.Subject)
+	if err != nil {
+		return nil, mdl.RelationTuple{}, newResponse(mdl.TupleInvalid, err.Error()), false
+	}
+	rel, code := relationEngine(in.Tenant)
+	if code != mdl.OK {
+		return nil, mdl.RelationTuple{}, newResponse(code, code.String()), false
+	}
+	return rel, tuple, ResponseCommon{}, true
+}
+
+func CheckRelation(req *http.Request, b []byte) ResponseCommon {
+	in := new(CheckRelationRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	tuple, err := mdl.ParseRelationTuple(in.Object + "#" + in.Relation + "@" + in.Subject)
+	if err != nil {
+		return newResponse(mdl.TupleInvalid, err.Error())
+	}
+	rel, code := tokenRelationEngine(requestToken(req, in.Token))
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	code = rel.Check(tuple.Object, tuple.Relation, tuple.Subject)
+	return newResponse(code, code.String())
+}
+
+func ExpandRelation(req *http.Request, b []byte) ResponseCommon {
+	in := new(ExpandRelationRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	o, err := mdl.ParseObject(in.Object)
+	if err != nil {
+		return newResponse(mdl.TupleInvalid, err.Error())
+	}
+	rel, code := tokenRelationEngine(requestToken(req, in.Token))
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	tree, code := rel.Expand(o, in.Relation)
+	return newResponseData(code, code.String(), newUsersetTree(tree))
+}
+
+func ListObjects(req *http.Request, b []byte) ResponseCommon {
+	in := new(ListObjectsRequest)
+	if err := decodeRequest(req, b, in); err != nil {
+		return newResponse(mdl.InvalidArgument, err.Error())
+	}
+	s, err := mdl.ParseSubject(in.Subject)
+	if err != nil {
+		return newResponse(mdl.TupleInvalid, err.Error())
+	}
+	rel, code := tokenRelationEngine(requestToken(req, in.Token))
+	if code != mdl.OK {
+		return newResponse(code, code.String())
+	}
+	objects, code := rel.ListObjects(in.Namespace, in.Relation, s)
+	resp := ListObjectsResponse{Objects: make([]string, 0, len(objects))}
+	for _, o := range objects {
+		resp.Objects = append(resp.Objects, o.String())
+	}
 	return newResponseData(code, code.String(), resp)
 }
 
@@ -210,36 +1058,206 @@ func newResponseData(s mdl.StatusCode, m string, data interface{}) ResponseCommo
 type CreateUserRequest struct {
 	UserName string `json:"user_name"`
 	Password string `json:"password"`
+	Tenant   string `json:"tenant,omitempty"` // default if empty
 }
 
 type DeleteUserRequest struct {
 	UserName string `json:"user_name"`
 	Password string `json:"password"`
+	Tenant   string `json:"tenant,omitempty"` // default if empty
+}
+
+type GetUserRequest struct {
+	UserName string `json:"user_name"`
+	Tenant   string `json:"tenant,omitempty"` // default if empty
+}
+
+// GetUserResponse lists the roles granted to the user directly, in the
+// order granted, and its groups.
+type GetUserResponse struct {
+	UserName           string   `json:"user_name"`
+	Roles              []string `json:"roles"`
+	Groups             []string `json:"groups"`
+	MustChangePassword bool     `json:"must_change_password,omitempty"`
+}
+
+type ChangePasswordRequest struct {
+	UserName    string `json:"user_name"`
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"`
+	Tenant      string `json:"tenant,omitempty"` // default if empty
+}
+
+// ResetPasswordRequest gives the temporary password by password.
+type ResetPasswordRequest struct {
+	UserName string `json:"user_name"`
+	Password string `json:"password"`
+	Tenant   string `json:"tenant,omitempty"` // default if empty
+}
+
+// PasswordViolationsResponse lists the rules of the password policy a new
+// password breaks, in the violations of the Problem.
+type PasswordViolationsResponse struct {
+	Violations []mdl.PasswordViolation `json:"violations"`
 }
 
 type CreateRoleRequest struct {
-	RoleName string `json:"role_name"`
+	RoleName string   `json:"role_name"`
+	Parents  []string `json:"parents,omitempty"`
+	Tenant   string   `json:"tenant,omitempty"` // default if empty
 }
 
 type DeleteRoleRequest struct {
 	RoleName string `json:"role_name"`
+	Tenant   string `json:"tenant,omitempty"` // default if empty
+}
+
+// ListRequest selects a page of a listing, the names starting with prefix
+// after cursor, which is the next_cursor of the previous page.
+type ListRequest struct {
+	Prefix string   `json:"prefix,omitempty"`
+	Cursor string   `json:"cursor,omitempty"`
+	Limit  intParam `json:"limit,omitempty"`  // mdl.DefaultPageLimit if 0
+	Tenant string   `json:"tenant,omitempty"` // default if empty
+}
+
+func (in *ListRequest) page() mdl.Page {
+	return mdl.Page{Prefix: in.Prefix, Cursor: in.Cursor, Limit: int(in.Limit)}
+}
+
+type ListRoleMembersRequest struct {
+	RoleName string `json:"role_name"`
+	ListRequest
+}
+
+// ListUsersResponse has no next_cursor on the last page.
+type ListUsersResponse struct {
+	Users      []string `json:"users"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+func newListUsersResponse(users []mdl.User, next string) ListUsersResponse {
+	resp := ListUsersResponse{Users: make([]string, 0, len(users)), NextCursor: next}
+	for _, u := range users {
+		resp.Users = append(resp.Users, u.Name)
+	}
+	return resp
+}
+
+type ListRolesResponse struct {
+	Roles      []string `json:"roles"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+type GetRoleRequest struct {
+	RoleName string `json:"role_name"`
+	Tenant   string `json:"tenant,omitempty"` // default if empty
+}
+
+type GetRoleResponse struct {
+	RoleName    string   `json:"role_name"`
+	Parents     []string `json:"parents"`
+	Permissions []string `json:"permissions"`
 }
 
 type AddUserRoleRequest struct {
 	UserName string `json:"user_name"`
 	RoleName string `json:"role_name"`
+	Resource string `json:"resource,omitempty"` // global if empty
+	Tenant   string `json:"tenant,omitempty"`   // default if empty
+}
+
+type RemoveUserRoleRequest struct {
+	UserName string `json:"user_name"`
+	RoleName string `json:"role_name"`
+	Resource string `json:"resource,omitempty"` // global if empty
+	Tenant   string `json:"tenant,omitempty"`   // default if empty
+}
+
+type AddRoleParentRequest struct {
+	RoleName   string `json:"role_name"`
+	ParentName string `json:"parent_name"`
+	Tenant     string `json:"tenant,omitempty"` // default if empty
+}
+
+type RemoveRoleParentRequest struct {
+	RoleName   string `json:"role_name"`
+	ParentName string `json:"parent_name"`
+	Tenant     string `json:"tenant,omitempty"` // default if empty
+}
+
+type GrantPermissionRequest struct {
+	RoleName   string `json:"role_name"`
+	Permission string `json:"permission"`
+	Tenant     string `json:"tenant,omitempty"` // default if empty
+}
+
+type RevokePermissionRequest struct {
+	RoleName   string `json:"role_name"`
+	Permission string `json:"permission"`
+	Tenant     string `json:"tenant,omitempty"` // default if empty
 }
 
 type AuthenticateRequest struct {
 	UserName string `json:"user_name"`
 	Password string `json:"password"`
+	Label    string `json:"label,omitempty"`
+	Tenant   string `json:"tenant,omitempty"` // default if empty
 }
 
 type AuthenticateResponse struct {
+	Tenant          string `json:"tenant,omitempty"`
 	Token           string `json:"token"`
+	SessionID       string `json:"session_id"`
 	ExpiredAtInUsec int64  `json:"expired_at_in_usec"`
 }
 
+type CreateGroupRequest struct {
+	GroupName string `json:"group_name"`
+	Tenant    string `json:"tenant,omitempty"` // default if empty
+}
+
+type DeleteGroupRequest struct {
+	GroupName string `json:"group_name"`
+	Tenant    string `json:"tenant,omitempty"` // default if empty
+}
+
+type AddGroupMemberRequest struct {
+	GroupName string `json:"group_name"`
+	UserName  string `json:"user_name"`
+	Tenant    string `json:"tenant,omitempty"` // default if empty
+}
+
+type RemoveGroupMemberRequest struct {
+	GroupName string `json:"group_name"`
+	UserName  string `json:"user_name"`
+	Tenant    string `json:"tenant,omitempty"` // default if empty
+}
+
+type AddGroupParentRequest struct {
+	GroupName  string `json:"group_name"`
+	ParentName string `json:"parent_name"`
+	Tenant     string `json:"tenant,omitempty"` // default if empty
+}
+
+type RemoveGroupParentRequest struct {
+	GroupName  string `json:"group_name"`
+	ParentName string `json:"parent_name"`
+	Tenant     string `json:"tenant,omitempty"` // default if empty
+}
+
+type AddGroupRoleRequest struct {
+	GroupName string `json:"group_name"`
+	RoleName  string `json:"role_name"`
+	Tenant    string `json:"tenant,omitempty"` // default if empty
+}
+
+type RemoveGroupRoleRequest struct {
+	GroupName string `json:"group_name"`
+	RoleName  string `json:"role_name"`
+	Tenant    string `json:"tenant,omitempty"` // default if empty
+}
+
 type InvalidateRequest struct {
 	Token string `json:"token"`
 }
@@ -247,17 +1265,149 @@ type InvalidateRequest struct {
 type CheckRoleRequest struct {
 	Token    string `json:"token"`
 	RoleName string `json:"role_name"`
+	Resource string `json:"resource,omitempty"` // global if empty
+}
+
+type CheckPermissionRequest struct {
+	Token      string `json:"token"`
+	Permission string `json:"permission"`
 }
 
 type AllRolesRequest struct {
 	Token string `json:"token"`
 }
 
+// AllRolesResponse lists the effective roles, including the inherited
+// ones, and the roles granted directly.
 type AllRolesResponse struct {
-	Token string   `json:"token"`
-	Roles []string `json:"roles"`
+	Token       string   `json:"token"`
+	Roles       []string `json:"roles"`
+	DirectRoles []string `json:"direct_roles"`
+}
+
+type ListSessionsRequest struct {
+	Token string `json:"token"`
+}
+
+type ListSessionsResponse struct {
+	Sessions []Session `json:"sessions"`
+}
+
+type Session struct {
+	SessionID       string `json:"session_id"`
+	CreatedAtInUsec int64  `json:"created_at_in_usec"`
+	ExpiredAtInUsec int64  `json:"expired_at_in_usec"`
+	UserAgent       string `json:"user_agent,omitempty"`
+	IP              string `json:"ip,omitempty"`
+	Label           string `json:"label,omitempty"`
+}
+
+func newSession(s mdl.Token) Session {
+	return Session{
+		SessionID:       s.SessionID,
+		CreatedAtInUsec: s.CreatedAtInUsec,
+		ExpiredAtInUsec: s.ExpiredAtInUsec,
+		UserAgent:       s.Info.UserAgent,
+		IP:              s.Info.IP,
+		Label:           s.Info.Label,
+	}
+}
+
+type RevokeSessionRequest struct {
+	Token     string `json:"token"`
+	SessionID string `json:"session_id"`
+}
+
+type RevokeAllSessionsRequest struct {
+	Token string `json:"token"`
+}
+
+type EvaluatePolicyRequest struct {
+	Token      string          `json:"token"`
+	Attributes attributesParam `json:"attributes,omitempty"`
+}
+
+type EvaluatePolicyResponse struct {
+	UserName string `json:"user_name"`
+	Allow    bool   `json:"allow"`
+	Rule     string `json:"rule,omitempty"`
+}
+
+type TenantRequest struct {
+	TenantName string `json:"tenant_name"`
+}
+
+type ListTenantsResponse struct {
+	Tenants []string `json:"tenants"`
+}
+
+type SetNamespaceRequest struct {
+	Tenant string `json:"tenant,omitempty"` // default if empty
+	mdl.Namespace
+}
+
+type RelationTupleRequest struct {
+	Object   string `json:"object"`           // like "doc:readme"
+	Relation string `json:"relation"`         // like "viewer"
+	Subject  string `json:"subject"`          // like "user:alice" or "group:eng#member"
+	Tenant   string `json:"tenant,omitempty"` // default if empty
 }
 
-func encryptPassword(pwd string) string {
-	return base64.URLEncoding.EncodeToString([]byte(pwd))
+type CheckRelationRequest struct {
+	Token    string `json:"token"`
+	Object   string `json:"object"`
+	Relation string `json:"relation"`
+	Subject  string `json:"subject"`
+}
+
+type ExpandRelationRequest struct {
+	Token    string `json:"token"`
+	Object   string `json:"object"`
+	Relation string `json:"relation"`
+}
+
+type UsersetTree struct {
+	Object   string        `json:"object"`
+	Relation string        `json:"relation"`
+	Subjects []string      `json:"subjects,omitempty"`
+	Children []UsersetTree `json:"children,omitempty"`
+}
+
+func newUsersetTree(t mdl.UsersetTree) UsersetTree {
+	res := UsersetTree{Object: t.Object.String(), Relation: t.Relation}
+	for _, s := range t.Subjects {
+		res.Subjects = append(res.Subjects, s.String())
+	}
+	for _, c := range t.Children {
+		res.Children = append(res.Children, newUsersetTree(c))
+	}
+	return res
+}
+
+type ListObjectsRequest struct {
+	Token     string `json:"token"`
+	Namespace string `json:"namespace"`
+	Relation  string `json:"relation"`
+	Subject   string `json:"subject"`
+}
+
+type ListObjectsResponse struct {
+	Objects []string `json:"objects"`
+}
+
+// nonNil returns v, or an empty slice if nil, which is encoded as [].
+func nonNil(v []string) []string {
+	if v == nil {
+		return []string{}
+	}
+	return v
+}
+
+// clientIP returns the host part of the remote address of req.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
 }
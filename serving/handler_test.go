@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
@@ -22,13 +24,20 @@ const (
 var (
 	cli *http.Client
 	srv *http.Server
+	// bearer is sent by doRequest as the token of the caller if not empty
+	bearer string
 )
 
 func initialize() {
 	cli = &http.Client{}
 	srv = &http.Server{Addr: serverPort}
+	// Listen before serving so that tests never race with the server start
+	l, err := net.Listen("tcp", serverPort)
+	if err != nil {
+		panic(err)
+	}
 	go func() {
-		srv.ListenAndServe()
+		srv.Serve(l)
 	}()
 }
 
@@ -50,40 +59,1025 @@ func expected(url, method, payload string, respCode mdl.StatusCode, httpCode int
 	}
 }
 
-func makeRequestsAndAssert(t *testing.T, seq ...req2resp) {
-	for _, v := range seq {
-		req, _ := http.NewRequest(
-			v.method,
-			serverAddr+v.url,
-			strings.NewReader(v.payload),
-		)
-		resp, err := cli.Do(req)
-		assert.Nil(t, err)
+func doRequest(t *testing.T, method, url, payload string) (*ResponseCommon, int) {
+	req, _ := http.NewRequest(
+		method,
+		serverAddr+url,
+		strings.NewReader(payload),
+	)
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := cli.Do(req)
+	assert.Nil(t, err)
 
-		b, _ := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
 
-		data := new(ResponseCommon)
+	data := new(ResponseCommon)
+	if resp.Header.Get("Content-Type") == "application/problem+json" {
+		p := new(Problem)
+		assert.Nil(t, json.Unmarshal(b, p))
+		assert.Equal(t, resp.StatusCode, p.Status)
+		data.Status, data.Message = p.Code, p.Detail
+	} else {
 		assert.Nil(t, json.Unmarshal(b, data))
+	}
+	return data, resp.StatusCode
+}
+
+func makeRequestsAndAssert(t *testing.T, seq ...req2resp) {
+	for _, v := range seq {
+		data, httpCode := doRequest(t, v.method, v.url, v.payload)
 		assert.Equal(t, v.respCode, data.Status)
-		assert.Equal(t, v.httpCode, resp.StatusCode)
+		assert.Equal(t, v.httpCode, httpCode)
 	}
 }
 
-func TestBasic(t *testing.T) {
+// authenticate logs in and returns the token and session ID.
+func authenticate(t *testing.T, payload string) (string, string) {
+	data, _ := doRequest(t, "POST", "/user/auth", payload)
+	assert.Equal(t, mdl.TokenCreated, data.Status)
+	m := data.Data.(map[string]interface{})
+	return m["token"].(string), m["session_id"].(string)
+}
+
+// newServerForTesting resets the engine with an admin, whose token is sent
+// by later requests.
+func newServerForTesting(t *testing.T) {
 	newEngineForTesting()
+	assert.Nil(t, Bootstrap(mdl.User{Name: "admin", Password: "admin-pwd"}))
+	bearer = ""
+	bearer, _ = authenticate(t, `{"user_name": "admin", "password": "admin-pwd"}`)
+}
+
+func TestBasic(t *testing.T) {
+	newServerForTesting(t)
 	makeRequestsAndAssert(t,
 		expected("/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
-			mdl.UserCreated, 200),
+			mdl.UserCreated, 201),
 		expected("/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
-			mdl.UserAlreadyExisting, 400),
+			mdl.UserAlreadyExisting, 409),
 		expected("/user", "DELETE", `{"user_name": "qwer", "password": "qsc1234"}`,
-			mdl.UserPasswordNotMatch, 400),
+			mdl.UserPasswordNotMatch, 401),
 		expected("/user", "DELETE", `{"user_name": "qwer", "password": "qsc123"}`,
 			mdl.UserDeleted, 200),
 		expected("/user", "DELETE", `{"user_name": "qwer", "password": "qsc123"}`,
-			mdl.UserNotFound, 400),
+			mdl.UserNotFound, 404),
+	)
+}
+
+func TestSessions(t *testing.T) {
+	newServerForTesting(t)
+	makeRequestsAndAssert(t,
+		expected("/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+	)
+	t1, s1 := authenticate(t, `{"user_name": "qwer", "password": "qsc123", "label": "laptop"}`)
+	t2, _ := authenticate(t, `{"user_name": "qwer", "password": "qsc123", "label": "phone"}`)
+	assert.NotEqual(t, t1, t2)
+
+	data, _ := doRequest(t, "GET", "/token/sessions", `{"token": "`+t2+`"}`)
+	assert.Equal(t, mdl.OK, data.Status)
+	sessions := data.Data.(map[string]interface{})["sessions"].([]interface{})
+	assert.Equal(t, 2, len(sessions))
+	assert.Equal(t, "laptop", sessions[0].(map[string]interface{})["label"])
+	assert.Equal(t, "127.0.0.1", sessions[0].(map[string]interface{})["ip"])
+	assert.Nil(t, sessions[0].(map[string]interface{})["token"])
+
+	makeRequestsAndAssert(t,
+		expected("/token/session", "DELETE", `{"token": "`+t2+`", "session_id": "`+s1+`"}`,
+			mdl.SessionRevoked, 200),
+		expected("/token/session", "DELETE", `{"token": "`+t2+`", "session_id": "`+s1+`"}`,
+			mdl.SessionNotFound, 404),
+		expected("/token/roles", "GET", `{"token": "`+t1+`"}`,
+			mdl.TokenIsInvalid, 401),
+		expected("/token/sessions", "DELETE", `{"token": "`+t2+`"}`,
+			mdl.SessionRevoked, 200),
+		expected("/token/roles", "GET", `{"token": "`+t2+`"}`,
+			mdl.TokenIsInvalid, 401),
+	)
+}
+
+func TestUserRoles(t *testing.T) {
+	newServerForTesting(t)
+	makeRequestsAndAssert(t,
+		expected("/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/role", "POST", `{"role_name": "admin"}`,
+			mdl.RoleCreated, 201),
+		expected("/user/role", "DELETE", `{"user_name": "qwer", "role_name": "admin"}`,
+			mdl.UserRoleNotFound, 404),
+		expected("/user/role", "POST", `{"user_name": "qwer", "role_name": "admin"}`,
+			mdl.UserRoleAdded, 200),
+	)
+	token, _ := authenticate(t, `{"user_name": "qwer", "password": "qsc123"}`)
+	makeRequestsAndAssert(t,
+		expected("/token/role", "GET", `{"token": "`+token+`", "role_name": "admin"}`,
+			mdl.TokenRoleOK, 200),
+		expected("/user/role", "DELETE", `{"user_name": "qwer"}`,
+			mdl.InvalidArgument, 400),
+		expected("/user/role", "DELETE", `{"user_name": "qwer", "role_name": "admin"}`,
+			mdl.UserRoleRemoved, 200),
+		expected("/token/role", "GET", `{"token": "`+token+`", "role_name": "admin"}`,
+			mdl.TokenRoleNotFound, 403),
+		expected("/user/role", "DELETE", `{"user_name": "qwer", "role_name": "admin"}`,
+			mdl.UserRoleNotFound, 404),
+		expected("/user/role", "DELETE", `{"user_name": "qwer", "role_name": "guest"}`,
+			mdl.RoleNotFound, 404),
+		expected("/user/role", "DELETE", `{"user_name": "asdf", "role_name": "admin"}`,
+			mdl.UserNotFound, 404),
+	)
+}
+
+func TestRoleHierarchy(t *testing.T) {
+	newServerForTesting(t)
+	makeRequestsAndAssert(t,
+		expected("/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/role", "POST", `{"role_name": "reader"}`,
+			mdl.RoleCreated, 201),
+		expected("/role", "POST", `{"role_name": "admin", "parents": ["writer"]}`,
+			mdl.RoleNotFound, 404),
+		expected("/role", "POST", `{"role_name": "writer", "parents": ["reader"]}`,
+			mdl.RoleCreated, 201),
+		expected("/role", "POST", `{"role_name": "admin"}`,
+			mdl.RoleCreated, 201),
+		expected("/role/parent", "POST", `{"role_name": "admin"}`,
+			mdl.InvalidArgument, 400),
+		expected("/role/parent", "POST", `{"role_name": "admin", "parent_name": "writer"}`,
+			mdl.RoleParentAdded, 200),
+		expected("/role/parent", "POST", `{"role_name": "reader", "parent_name": "admin"}`,
+			mdl.RoleCycle, 409),
+		expected("/user/role", "POST", `{"user_name": "qwer", "role_name": "admin"}`,
+			mdl.UserRoleAdded, 200),
+	)
+	token, _ := authenticate(t, `{"user_name": "qwer", "password": "qsc123"}`)
+	makeRequestsAndAssert(t,
+		expected("/token/role", "GET", `{"token": "`+token+`", "role_name": "reader"}`,
+			mdl.TokenRoleOK, 200),
+	)
+	data, _ := doRequest(t, "GET", "/token/roles", `{"token": "`+token+`"}`)
+	assert.Equal(t, mdl.OK, data.Status)
+	m := data.Data.(map[string]interface{})
+	assert.Equal(t, []interface{}{"admin", "reader", "writer"}, m["roles"])
+	assert.Equal(t, []interface{}{"admin"}, m["direct_roles"])
+
+	makeRequestsAndAssert(t,
+		expected("/role/parent", "DELETE", `{"role_name": "admin", "parent_name": "writer"}`,
+			mdl.RoleParentRemoved, 200),
+		expected("/role/parent", "DELETE", `{"role_name": "admin", "parent_name": "writer"}`,
+			mdl.RoleParentNotFound, 404),
+		expected("/token/role", "GET", `{"token": "`+token+`", "role_name": "reader"}`,
+			mdl.TokenRoleNotFound, 403),
+	)
+}
+
+func TestPermissions(t *testing.T) {
+	newServerForTesting(t)
+	makeRequestsAndAssert(t,
+		expected("/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/role", "POST", `{"role_name": "support"}`,
+			mdl.RoleCreated, 201),
+		expected("/role/permission", "POST", `{"role_name": "support"}`,
+			mdl.InvalidArgument, 400),
+		expected("/role/permission", "POST", `{"role_name": "support", "permission": "orders::refund"}`,
+			mdl.PermissionInvalid, 422),
+		expected("/role/permission", "POST", `{"role_name": "support", "permission": "orders:*"}`,
+			mdl.PermissionGranted, 200),
+		expected("/role/permission", "POST", `{"role_name": "support", "permission": "orders:*"}`,
+			mdl.PermissionAlreadyGranted, 409),
+		expected("/user/role", "POST", `{"user_name": "qwer", "role_name": "support"}`,
+			mdl.UserRoleAdded, 200),
+	)
+	token, _ := authenticate(t, `{"user_name": "qwer", "password": "qsc123"}`)
+	makeRequestsAndAssert(t,
+		expected("/token/permission", "GET", `{"token": "`+token+`"}`,
+			mdl.InvalidArgument, 400),
+		expected("/token/permission", "GET", `{"token": "`+token+`", "permission": "orders:refund"}`,
+			mdl.TokenPermissionOK, 200),
+		expected("/token/permission", "GET", `{"token": "`+token+`", "permission": "users:create"}`,
+			mdl.TokenPermissionNotFound, 403),
+		expected("/role/permission", "DELETE", `{"role_name": "support", "permission": "orders:*"}`,
+			mdl.PermissionRevoked, 200),
+		expected("/role/permission", "DELETE", `{"role_name": "support", "permission": "orders:*"}`,
+			mdl.PermissionNotGranted, 404),
+		expected("/token/permission", "GET", `{"token": "`+token+`", "permission": "orders:refund"}`,
+			mdl.TokenPermissionNotFound, 403),
+	)
+}
+
+func TestScopedRoles(t *testing.T) {
+	newServerForTesting(t)
+	makeRequestsAndAssert(t,
+		expected("/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/role", "POST", `{"role_name": "editor"}`,
+			mdl.RoleCreated, 201),
+		expected("/user/role", "POST", `{"user_name": "qwer", "role_name": "editor", "resource": "org/1/project"}`,
+			mdl.ResourceInvalid, 422),
+		expected("/user/role", "POST", `{"user_name": "qwer", "role_name": "editor", "resource": "org/1"}`,
+			mdl.UserRoleAdded, 200),
+	)
+	token, _ := authenticate(t, `{"user_name": "qwer", "password": "qsc123"}`)
+	makeRequestsAndAssert(t,
+		expected("/token/role", "GET", `{"token": "`+token+`", "role_name": "editor", "resource": "org/1/project/42"}`,
+			mdl.TokenRoleOK, 200),
+		expected("/token/role", "GET", `{"token": "`+token+`", "role_name": "editor", "resource": "org/2"}`,
+			mdl.TokenRoleNotFound, 403),
+		expected("/token/role", "GET", `{"token": "`+token+`", "role_name": "editor"}`,
+			mdl.TokenRoleNotFound, 403),
+		expected("/user/role", "DELETE", `{"user_name": "qwer", "role_name": "editor"}`,
+			mdl.UserRoleNotFound, 404),
+		expected("/user/role", "DELETE", `{"user_name": "qwer", "role_name": "editor", "resource": "org/1"}`,
+			mdl.UserRoleRemoved, 200),
+		expected("/token/role", "GET", `{"token": "`+token+`", "role_name": "editor", "resource": "org/1/project/42"}`,
+			mdl.TokenRoleNotFound, 403),
+	)
+}
+
+func TestRelations(t *testing.T) {
+	newServerForTesting(t)
+	makeRequestsAndAssert(t,
+		expected("/namespace", "POST", `{"name": "group", "relations": [{"name": "member"}]}`,
+			mdl.NamespaceSaved, 200),
+		expected("/namespace", "POST", `{"name": "folder", "relations": [{"name": "viewer"}]}`,
+			mdl.NamespaceSaved, 200),
+		expected("/namespace", "POST", `{"name": "doc", "relations": [{"name": "viewer", "union": [{"computed_userset": "owner"}]}]}`,
+			mdl.NamespaceInvalid, 422),
+		expected("/namespace", "POST", `{"name": "doc", "relations": [
+			{"name": "parent"},
+			{"name": "owner"},
+			{"name": "viewer", "union": [
+				{"this": true},
+				{"computed_userset": "owner"},
+				{"tuple_to_userset": {"tupleset": "parent", "computed_userset": "viewer"}}
+			]}
+		]}`,
+			mdl.NamespaceSaved, 200),
+		expected("/relation/tuple", "POST", `{"object": "doc", "relation": "viewer", "subject": "user:alice"}`,
+			mdl.TupleInvalid, 422),
+		expected("/relation/tuple", "POST", `{"object": "doc:readme", "relation": "commenter", "subject": "user:alice"}`,
+			mdl.RelationUndefined, 422),
+		expected("/relation/tuple", "POST", `{"object": "doc:readme", "relation": "owner", "subject": "user:alice"}`,
+			mdl.TupleWritten, 200),
+		expected("/relation/tuple", "POST", `{"object": "doc:readme", "relation": "owner", "subject": "user:alice"}`,
+			mdl.TupleAlreadyExisting, 409),
+		expected("/relation/tuple", "POST", `{"object": "doc:roadmap", "relation": "parent", "subject": "folder:plans"}`,
+			mdl.TupleWritten, 200),
+		expected("/relation/tuple", "POST", `{"object": "folder:plans", "relation": "viewer", "subject": "group:eng#member"}`,
+			mdl.TupleWritten, 200),
+		expected("/relation/tuple", "POST", `{"object": "group:eng", "relation": "member", "subject": "user:bob"}`,
+			mdl.TupleWritten, 200),
+		expected("/relation/check", "GET", `{"object": "doc:readme", "relation": "viewer", "subject": "user:alice"}`,
+			mdl.CheckOK, 200),
+		expected("/relation/check", "GET", `{"object": "doc:roadmap", "relation": "viewer", "subject": "user:bob"}`,
+			mdl.CheckOK, 200),
+		expected("/relation/check", "GET", `{"object": "doc:roadmap", "relation": "viewer", "subject": "user:alice"}`,
+			mdl.CheckDenied, 403),
+		expected("/relation/check", "GET", `{"object": "video:cat", "relation": "viewer", "subject": "user:alice"}`,
+			mdl.NamespaceNotFound, 404),
+	)
+
+	data, _ := doRequest(t, "GET", "/relation/objects", `{"namespace": "doc", "relation": "viewer", "subject": "user:bob"}`)
+	assert.Equal(t, mdl.OK, data.Status)
+	assert.Equal(t, map[string]interface{}{"objects": []interface{}{"doc:roadmap"}}, data.Data)
+
+	data, _ = doRequest(t, "GET", "/relation/expand", `{"object": "doc:roadmap", "relation": "viewer"}`)
+	assert.Equal(t, mdl.OK, data.Status)
+	tree := data.Data.(map[string]interface{})
+	assert.Equal(t, "doc:roadmap", tree["object"])
+	children := tree["children"].([]interface{})
+	assert.Len(t, children, 2)
+	assert.Equal(t, []interface{}{"group:eng#member"}, children[1].(map[string]interface{})["subjects"])
+
+	makeRequestsAndAssert(t,
+		expected("/relation/tuple", "DELETE", `{"object": "group:eng", "relation": "member", "subject": "user:bob"}`,
+			mdl.TupleDeleted, 200),
+		expected("/relation/tuple", "DELETE", `{"object": "group:eng", "relation": "member", "subject": "user:bob"}`,
+			mdl.TupleNotFound, 404),
+		expected("/relation/check", "GET", `{"object": "doc:roadmap", "relation": "viewer", "subject": "user:bob"}`,
+			mdl.CheckDenied, 403),
+	)
+}
+
+func TestPolicy(t *testing.T) {
+	newServerForTesting(t)
+	p, err := mdl.ParsePolicy("test.policy", `
+deny blocked if attr.country == "XX"
+allow support-office-hours if "support" in roles && attr.hour >= 9 && attr.hour < 18
+`)
+	assert.Nil(t, err)
+	SetPolicy(p)
+	makeRequestsAndAssert(t,
+		expected("/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/role", "POST", `{"role_name": "support"}`,
+			mdl.RoleCreated, 201),
+		expected("/token/policy", "GET", `{"token": "not_existing"}`,
+			mdl.TokenNotFound, 401),
+	)
+	token, _ := authenticate(t, `{"user_name": "qwer", "password": "qsc123"}`)
+	data, _ := doRequest(t, "GET", "/token/policy", `{"token": "`+token+`", "attributes": {"hour": 10}}`)
+	assert.Equal(t, mdl.PolicyDenied, data.Status)
+	assert.Equal(t, "policy denied by default", data.Message)
+
+	makeRequestsAndAssert(t,
+		expected("/user/role", "POST", `{"user_name": "qwer", "role_name": "support"}`,
+			mdl.UserRoleAdded, 200),
+	)
+	data, _ = doRequest(t, "GET", "/token/policy", `{"token": "`+token+`", "attributes": {"hour": 10}}`)
+	assert.Equal(t, mdl.PolicyAllowed, data.Status)
+	assert.Equal(t, "policy allowed by rule support-office-hours", data.Message)
+	assert.Equal(t, map[string]interface{}{"user_name": "qwer", "allow": true, "rule": "support-office-hours"}, data.Data)
+	data, _ = doRequest(t, "GET", "/token/policy", `{"token": "`+token+`", "attributes": {"hour": 10, "country": "XX"}}`)
+	assert.Equal(t, mdl.PolicyDenied, data.Status)
+	assert.Equal(t, "policy denied by rule blocked", data.Message)
+	data, _ = doRequest(t, "GET", "/token/policy?token="+token+"&attributes="+url.QueryEscape(`{"hour": 10}`), ``)
+	assert.Equal(t, mdl.PolicyAllowed, data.Status)
+}
+
+func TestGroups(t *testing.T) {
+	newServerForTesting(t)
+	makeRequestsAndAssert(t,
+		expected("/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/role", "POST", `{"role_name": "viewer"}`,
+			mdl.RoleCreated, 201),
+		expected("/role", "POST", `{"role_name": "editor"}`,
+			mdl.RoleCreated, 201),
+		expected("/group", "POST", `{"group_name": ""}`,
+			mdl.InvalidArgument, 400),
+		expected("/group", "POST", `{"group_name": "eng"}`,
+			mdl.GroupCreated, 201),
+		expected("/group", "POST", `{"group_name": "eng"}`,
+			mdl.GroupAlreadyExisting, 409),
+		expected("/group", "POST", `{"group_name": "all"}`,
+			mdl.GroupCreated, 201),
+		expected("/group/member", "POST", `{"group_name": "eng", "user_name": "qwer"}`,
+			mdl.GroupMemberAdded, 200),
+		expected("/group/member", "POST", `{"group_name": "eng", "user_name": "qwer"}`,
+			mdl.GroupMemberAlreadyExisting, 409),
+		expected("/group/parent", "POST", `{"group_name": "eng", "parent_name": "all"}`,
+			mdl.GroupParentAdded, 200),
+		expected("/group/parent", "POST", `{"group_name": "all", "parent_name": "eng"}`,
+			mdl.GroupCycle, 409),
+		expected("/group/role", "POST", `{"group_name": "all", "role_name": "viewer"}`,
+			mdl.GroupRoleAdded, 200),
+		expected("/group/role", "POST", `{"group_name": "eng", "role_name": "editor"}`,
+			mdl.GroupRoleAdded, 200),
+		expected("/group/role", "POST", `{"group_name": "eng", "role_name": "admin"}`,
+			mdl.RoleNotFound, 404),
+	)
+	token, _ := authenticate(t, `{"user_name": "qwer", "password": "qsc123"}`)
+	makeRequestsAndAssert(t,
+		expected("/token/role", "GET", `{"token": "`+token+`", "role_name": "viewer"}`,
+			mdl.TokenRoleOK, 200),
+		expected("/token/role", "GET", `{"token": "`+token+`", "role_name": "editor"}`,
+			mdl.TokenRoleOK, 200),
+	)
+	data, _ := doRequest(t, "GET", "/token/roles", `{"token": "`+token+`"}`)
+	assert.Equal(t, mdl.OK, data.Status)
+	assert.Equal(t, []interface{}{"editor", "viewer"}, data.Data.(map[string]interface{})["roles"])
+	assert.Nil(t, data.Data.(map[string]interface{})["direct_roles"])
+
+	makeRequestsAndAssert(t,
+		expected("/group/parent", "DELETE", `{"group_name": "eng", "parent_name": "all"}`,
+			mdl.GroupParentRemoved, 200),
+		expected("/token/role", "GET", `{"token": "`+token+`", "role_name": "viewer"}`,
+			mdl.TokenRoleNotFound, 403),
+		expected("/group/role", "DELETE", `{"group_name": "eng", "role_name": "editor"}`,
+			mdl.GroupRoleRemoved, 200),
+		expected("/group/role", "DELETE", `{"group_name": "eng", "role_name": "editor"}`,
+			mdl.GroupRoleNotFound, 404),
+		expected("/token/role", "GET", `{"token": "`+token+`", "role_name": "editor"}`,
+			mdl.TokenRoleNotFound, 403),
+		expected("/group/member", "DELETE", `{"group_name": "eng", "user_name": "qwer"}`,
+			mdl.GroupMemberRemoved, 200),
+		expected("/group/member", "DELETE", `{"group_name": "eng", "user_name": "qwer"}`,
+			mdl.GroupMemberNotFound, 404),
+		expected("/group", "DELETE", `{"group_name": "eng"}`,
+			mdl.GroupDeleted, 200),
+		expected("/group", "DELETE", `{"group_name": "eng"}`,
+			mdl.GroupNotFound, 404),
+	)
+}
+
+func TestTenants(t *testing.T) {
+	newServerForTesting(t)
+	makeRequestsAndAssert(t,
+		expected("/tenant", "POST", `{"tenant_name": "acme"}`,
+			mdl.TenantCreated, 201),
+		expected("/tenant", "POST", `{"tenant_name": "acme"}`,
+			mdl.TenantAlreadyExisting, 409),
+		expected("/tenant", "POST", `{"tenant_name": "a/b"}`,
+			mdl.TenantInvalid, 422),
+		expected("/tenant", "POST", `{"tenant_name": "globex"}`,
+			mdl.TenantCreated, 201),
+		expected("/user", "POST", `{"tenant": "initech", "user_name": "qwer", "password": "qsc123"}`,
+			mdl.TenantNotFound, 404),
+		expected("/user", "POST", `{"tenant": "acme", "user_name": "a/qwer", "password": "qsc123"}`,
+			mdl.InvalidArgument, 400),
+	)
+	// The same names in every tenant, with different passwords and roles
+	for _, tenant := range []string{"", "acme", "globex"} {
+		makeRequestsAndAssert(t,
+			expected("/user", "POST", `{"tenant": "`+tenant+`", "user_name": "qwer", "password": "qsc123`+tenant+`"}`,
+				mdl.UserCreated, 201),
+			expected("/role", "POST", `{"tenant": "`+tenant+`", "role_name": "admin`+tenant+`"}`,
+				mdl.RoleCreated, 201),
+			expected("/user/role", "POST", `{"tenant": "`+tenant+`", "user_name": "qwer", "role_name": "admin`+tenant+`"}`,
+				mdl.UserRoleAdded, 200),
+		)
+	}
+	makeRequestsAndAssert(t,
+		expected("/user/auth", "POST", `{"tenant": "acme", "user_name": "qwer", "password": "qsc123globex"}`,
+			mdl.UserPasswordNotMatch, 401),
+		expected("/user/role", "POST", `{"tenant": "acme", "user_name": "qwer", "role_name": "adminglobex"}`,
+			mdl.RoleNotFound, 404),
+	)
+
+	data, _ := doRequest(t, "GET", "/tenants", ``)
+	assert.Equal(t, mdl.OK, data.Status)
+	assert.Equal(t, map[string]interface{}{"tenants": []interface{}{"acme", "globex"}}, data.Data)
+
+	data, _ = doRequest(t, "POST", "/user/auth", `{"tenant": "acme", "user_name": "qwer", "password": "qsc123acme"}`)
+	assert.Equal(t, mdl.TokenCreated, data.Status)
+	assert.Equal(t, "acme", data.Data.(map[string]interface{})["tenant"])
+	acme := data.Data.(map[string]interface{})["token"].(string)
+	globex, _ := authenticate(t, `{"tenant": "globex", "user_name": "qwer", "password": "qsc123globex"}`)
+
+	data, _ = doRequest(t, "GET", "/token/roles", `{"token": "`+acme+`"}`)
+	assert.Equal(t, mdl.OK, data.Status)
+	assert.Equal(t, []interface{}{"adminacme"}, data.Data.(map[string]interface{})["roles"])
+	makeRequestsAndAssert(t,
+		expected("/token/role", "GET", `{"token": "`+acme+`", "role_name": "adminacme"}`,
+			mdl.TokenRoleOK, 200),
+		expected("/token/role", "GET", `{"token": "`+acme+`", "role_name": "adminglobex"}`,
+			mdl.TokenRoleNotFound, 403),
+		expected("/token/role", "GET", `{"token": "`+globex+`", "role_name": "adminglobex"}`,
+			mdl.TokenRoleOK, 200),
+	)
+
+	// Relations are kept per tenant, and read in the tenant of the token
+	makeRequestsAndAssert(t,
+		expected("/namespace", "POST", `{"tenant": "acme", "name": "doc", "relations": [{"name": "viewer"}]}`,
+			mdl.NamespaceSaved, 200),
+		expected("/relation/tuple", "POST", `{"tenant": "acme", "object": "doc:readme", "relation": "viewer", "subject": "user:qwer"}`,
+			mdl.TupleWritten, 200),
+		expected("/relation/check", "GET", `{"token": "`+acme+`", "object": "doc:readme", "relation": "viewer", "subject": "user:qwer"}`,
+			mdl.CheckOK, 200),
+		expected("/relation/check", "GET", `{"token": "`+globex+`", "object": "doc:readme", "relation": "viewer", "subject": "user:qwer"}`,
+			mdl.NamespaceNotFound, 404),
+		expected("/relation/check", "GET", `{"tenant": "acme", "object": "doc:readme", "relation": "viewer", "subject": "user:qwer"}`,
+			mdl.NamespaceNotFound, 404),
+		expected("/relation/expand", "GET", `{"token": "`+globex+`", "object": "doc:readme", "relation": "viewer"}`,
+			mdl.NamespaceNotFound, 404),
+		expected("/relation/objects", "GET", `{"token": "`+globex+`", "namespace": "doc", "relation": "viewer", "subject": "user:qwer"}`,
+			mdl.NamespaceNotFound, 404),
+	)
+	data, _ = doRequest(t, "GET", "/relation/objects", `{"token": "`+acme+`", "namespace": "doc", "relation": "viewer", "subject": "user:qwer"}`)
+	assert.Equal(t, map[string]interface{}{"objects": []interface{}{"doc:readme"}}, data.Data)
+
+	// Deleting a tenant deletes its users, roles, tokens and relations
+	makeRequestsAndAssert(t,
+		expected("/tenant", "DELETE", `{"tenant_name": "acme"}`,
+			mdl.TenantDeleted, 200),
+		expected("/tenant", "DELETE", `{"tenant_name": "acme"}`,
+			mdl.TenantNotFound, 404),
+		expected("/token/role", "GET", `{"token": "`+acme+`", "role_name": "adminacme"}`,
+			mdl.TokenIsInvalid, 401),
+		expected("/token/role", "GET", `{"token": "`+globex+`", "role_name": "adminglobex"}`,
+			mdl.TokenRoleOK, 200),
+		expected("/tenant", "POST", `{"tenant_name": "acme"}`,
+			mdl.TenantCreated, 201),
+		expected("/user/auth", "POST", `{"tenant": "acme", "user_name": "qwer", "password": "qsc123acme"}`,
+			mdl.UserNotFound, 404),
+		expected("/relation/check", "GET", `{"token": "`+acme+`", "object": "doc:readme", "relation": "viewer", "subject": "user:qwer"}`,
+			mdl.TokenIsInvalid, 401),
+		expected("/user/auth", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.TokenCreated, 201),
+		expected("/user", "POST", `{"tenant": "acme", "user_name": "qwer", "password": "qsc123acme"}`,
+			mdl.UserCreated, 201),
+	)
+	acme, _ = authenticate(t, `{"tenant": "acme", "user_name": "qwer", "password": "qsc123acme"}`)
+	makeRequestsAndAssert(t,
+		expected("/relation/check", "GET", `{"token": "`+acme+`", "object": "doc:readme", "relation": "viewer", "subject": "user:qwer"}`,
+			mdl.NamespaceNotFound, 404),
+	)
+}
+
+func TestAdmin(t *testing.T) {
+	newServerForTesting(t)
+	admin := bearer
+	makeRequestsAndAssert(t,
+		expected("/user", "POST", `{"user_name": "mgr", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/user/role", "POST", `{"user_name": "mgr", "role_name": "system:user-manager"}`,
+			mdl.UserRoleAdded, 200),
+		expected("/group", "POST", `{"group_name": "eng"}`,
+			mdl.GroupCreated, 201),
+		// System roles are only inherited by system roles and groups
+		expected("/role", "POST", `{"role_name": "ops", "parents": ["system:admin"]}`,
+			mdl.InvalidArgument, 400),
+		expected("/group/role", "POST", `{"group_name": "eng", "role_name": "system:admin"}`,
+			mdl.InvalidArgument, 400),
+		expected("/tenant", "POST", `{"tenant_name": "acme"}`,
+			mdl.TenantCreated, 201),
+		expected("/user", "POST", `{"tenant": "acme", "user_name": "qwer", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+	)
+
+	bearer = ""
+	makeRequestsAndAssert(t,
+		expected("/role", "POST", `{"role_name": "ops"}`,
+			mdl.Unauthorized, 401),
+		expected("/user/auth", "POST", `{"user_name": "mgr", "password": "qsc123"}`,
+			mdl.TokenCreated, 201),
+		// Relations are read with a token only
+		expected("/relation/check", "GET", `{"object": "doc:readme", "relation": "viewer", "subject": "user:qwer"}`,
+			mdl.TokenNotFound, 401),
+		expected("/relation/expand", "GET", `{"object": "doc:readme", "relation": "viewer"}`,
+			mdl.TokenNotFound, 401),
+		expected("/relation/objects", "GET", `{"namespace": "doc", "relation": "viewer", "subject": "user:qwer"}`,
+			mdl.TokenNotFound, 401),
+	)
+	bearer = "hsbc_at_unknown"
+	makeRequestsAndAssert(t,
+		expected("/role", "POST", `{"role_name": "ops"}`,
+			mdl.Unauthorized, 401),
+		expected("/relation/check", "GET", `{"object": "doc:readme", "relation": "viewer", "subject": "user:qwer"}`,
+			mdl.TokenNotFound, 401),
+		expected("/relation/expand", "GET", `{"object": "doc:readme", "relation": "viewer"}`,
+			mdl.TokenNotFound, 401),
+		expected("/relation/objects", "GET", `{"namespace": "doc", "relation": "viewer", "subject": "user:qwer"}`,
+			mdl.TokenNotFound, 401),
+	)
+
+	bearer, _ = authenticate(t, `{"user_name": "mgr", "password": "qsc123"}`)
+	makeRequestsAndAssert(t,
+		expected("/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/user", "POST", `{"tenant": "acme", "user_name": "asdf", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/group/member", "POST", `{"group_name": "eng", "user_name": "qwer"}`,
+			mdl.GroupMemberAdded, 200),
+		expected("/role", "POST", `{"role_name": "ops"}`,
+			mdl.Forbidden, 403),
+		expected("/tenants", "GET", ``,
+			mdl.Forbidden, 403),
+		// Managers can't grant system roles, even the ones they have
+		expected("/user/role", "POST", `{"user_name": "mgr", "role_name": "system:admin"}`,
+			mdl.Forbidden, 403),
+		expected("/user/role", "POST", `{"user_name": "qwer", "role_name": "system:user-manager"}`,
+			mdl.Forbidden, 403),
+	)
+
+	// The role required by a request naming a system role is not kept for
+	// later requests of the route
+	mgr := bearer
+	for i := 0; i < 2; i++ {
+		bearer = mgr
+		makeRequestsAndAssert(t,
+			expected("/user/role", "DELETE", `{"user_name": "qwer", "role_name": "ops"}`,
+				mdl.RoleNotFound, 404),
+			expected("/user/role", "DELETE", `{"user_name": "qwer", "role_name": "system:admin"}`,
+				mdl.Forbidden, 403),
+		)
+		bearer = admin
+		makeRequestsAndAssert(t,
+			expected("/user/role", "DELETE", `{"user_name": "qwer", "role_name": "system:admin"}`,
+				mdl.UserRoleNotFound, 404),
+		)
+	}
+	bearer = mgr
+
+	// Roles of other tenants only hold in them
+	bearer = admin
+	makeRequestsAndAssert(t,
+		expected("/role", "POST", `{"tenant": "acme", "role_name": "system:user-manager"}`,
+			mdl.RoleCreated, 201),
+		expected("/user/role", "POST", `{"tenant": "acme", "user_name": "qwer", "role_name": "system:user-manager"}`,
+			mdl.UserRoleAdded, 200),
+	)
+	bearer, _ = authenticate(t, `{"tenant": "acme", "user_name": "qwer", "password": "qsc123"}`)
+	makeRequestsAndAssert(t,
+		expected("/user", "POST", `{"tenant": "acme", "user_name": "zxcv", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/user", "POST", `{"user_name": "zxcv", "password": "qsc123"}`,
+			mdl.Forbidden, 403),
+	)
+}
+
+func TestProblems(t *testing.T) {
+	newServerForTesting(t)
+	makeRequestsAndAssert(t,
+		expected("/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+	)
+	req, _ := http.NewRequest("POST", serverAddr+"/user", strings.NewReader(`{"user_name": "qwer", "password": "qsc123"}`))
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	resp, err := cli.Do(req)
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 409, resp.StatusCode)
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"type": "about:blank", "title": "Conflict", "status": 409, "detail": "user already existing",
+		"instance": "/user", "code": 40012}`, string(b))
+
+	// The legacy envelope keeps the class of the code only
+	makeRequestsAndAssert(t,
+		expected("/v0/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.UserAlreadyExisting, 400),
+		expected("/v0/user", "POST", `{"user_name": "asdf", "password": "qsc123"}`,
+			mdl.UserCreated, 200),
+		expected("/v0/user/auth", "POST", `{"user_name": "asdf", "password": "qsc1234"}`,
+			mdl.UserPasswordNotMatch, 400),
+	)
+	bearer = ""
+	makeRequestsAndAssert(t,
+		expected("/v0/role", "POST", `{"role_name": "ops"}`,
+			mdl.Unauthorized, 401),
+		expected("/user/auth", "POST", `{"user_name": "asdf", "password": "qsc1234"}`,
+			mdl.UserPasswordNotMatch, 401),
+	)
+}
+
+func TestQueries(t *testing.T) {
+	newServerForTesting(t)
+	makeRequestsAndAssert(t,
+		expected("/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/role", "POST", `{"role_name": "support"}`,
+			mdl.RoleCreated, 201),
+		expected("/user/role", "POST", `{"user_name": "qwer", "role_name": "support", "resource": "org/1"}`,
+			mdl.UserRoleAdded, 200),
+		expected("/role/permission", "POST", `{"role_name": "support", "permission": "orders:*"}`,
+			mdl.PermissionGranted, 200),
+		expected("/namespace", "POST", `{"name": "doc", "relations": [{"name": "viewer"}]}`,
+			mdl.NamespaceSaved, 200),
+		expected("/relation/tuple", "POST", `{"object": "doc:readme", "relation": "viewer", "subject": "user:qwer"}`,
+			mdl.TupleWritten, 200),
+	)
+
+	// The token of the header, and the rest of the path and query, without
+	// a body
+	bearer, _ = authenticate(t, `{"user_name": "qwer", "password": "qsc123"}`)
+	makeRequestsAndAssert(t,
+		expected("/token/role/support", "GET", ``,
+			mdl.TokenRoleNotFound, 403),
+		expected("/token/role/support?resource=org/1/project/42", "GET", ``,
+			mdl.TokenRoleOK, 200),
+		expected("/token/role?role_name=support&resource=org/1", "GET", ``,
+			mdl.TokenRoleOK, 200),
+		expected("/v0/token/role/support?resource=org/2", "GET", ``,
+			mdl.TokenRoleNotFound, 400),
+		expected("/token/permission/orders:refund", "GET", ``,
+			mdl.TokenPermissionNotFound, 403),
+		expected("/token/permission?permission=orders:refund", "GET", ``,
+			mdl.TokenPermissionNotFound, 403),
+		expected("/relation/check?object=doc:readme&relation=viewer&subject=user:qwer", "GET", ``,
+			mdl.CheckOK, 200),
+		expected("/relation/check?object=doc:readme&relation=viewer&subject=user:asdf", "GET", ``,
+			mdl.CheckDenied, 403),
+		expected("/token/policy?attributes={", "GET", ``,
+			mdl.InvalidArgument, 400),
+		// Only attributes are decoded as JSON, others are strings
+		expected("/token/role?role_name="+url.QueryEscape(`{"x": 1}`), "GET", ``,
+			mdl.TokenRoleNotFound, 403),
+	)
+	data, _ := doRequest(t, "GET", "/token/roles", ``)
+	assert.Equal(t, mdl.OK, data.Status)
+	data, _ = doRequest(t, "GET", "/token/sessions", ``)
+	assert.Equal(t, mdl.OK, data.Status)
+	assert.Len(t, data.Data.(map[string]interface{})["sessions"], 1)
+	data, _ = doRequest(t, "GET", "/relation/objects?namespace=doc&relation=viewer&subject=user:qwer", ``)
+	assert.Equal(t, map[string]interface{}{"objects": []interface{}{"doc:readme"}}, data.Data)
+
+	// The token of the body or query is taken before the header
+	other, _ := authenticate(t, `{"user_name": "qwer", "password": "qsc123"}`)
+	makeRequestsAndAssert(t,
+		expected("/token?token="+other, "DELETE", ``,
+			mdl.TokenInvalidated, 200),
+		expected("/token/role?token="+other+"&role_name=support", "GET", ``,
+			mdl.TokenIsInvalid, 401),
+		expected("/token", "DELETE", ``,
+			mdl.TokenInvalidated, 200),
+		expected("/token/roles", "GET", ``,
+			mdl.TokenIsInvalid, 401),
+	)
+
+	// Mutations take no query, and the path must agree with the body
+	bearer, _ = authenticate(t, `{"user_name": "admin", "password": "admin-pwd"}`)
+	makeRequestsAndAssert(t,
+		expected("/user?user_name=asdf", "POST", `{"user_name": "zxcv", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/v1/users/asdf", "GET", ``,
+			mdl.UserNotFound, 404),
+		expected("/v1/users/zxcv", "PUT", `{"user_name": "asdf", "password": "qsc123"}`,
+			mdl.InvalidArgument, 400),
+		expected("/v1/users/zxcv/roles/support", "PUT", `{"role_name": "staff"}`,
+			mdl.InvalidArgument, 400),
+		expected("/v1/users/asdf", "PUT", `{"user_name": "asdf", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+	)
+}
+
+func TestResources(t *testing.T) {
+	newServerForTesting(t)
+	makeRequestsAndAssert(t,
+		expected("/v1/users/qwer", "PUT", `{"password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/v1/users/qwer", "PUT", `{"password": "qsc123"}`,
+			mdl.UserAlreadyExisting, 409),
+		expected("/v1/roles/support", "PUT", ``,
+			mdl.RoleCreated, 201),
+		expected("/v1/roles/staff", "PUT", ``,
+			mdl.RoleCreated, 201),
+		expected("/v1/roles/support/parents/staff", "PUT", ``,
+			mdl.RoleParentAdded, 200),
+		expected("/v1/roles/support/permissions/orders:read", "PUT", ``,
+			mdl.PermissionGranted, 200),
+		expected("/v1/users/qwer/roles/support", "PUT", ``,
+			mdl.UserRoleAdded, 200),
+		expected("/v1/users/asdf", "GET", ``,
+			mdl.UserNotFound, 404),
+		expected("/v1/roles/ops", "GET", ``,
+			mdl.RoleNotFound, 404),
 	)
+	data, _ := doRequest(t, "GET", "/v1/users/qwer", ``)
+	assert.Equal(t, mdl.OK, data.Status)
+	assert.Equal(t, map[string]interface{}{
+		"user_name": "qwer",
+		"roles":     []interface{}{"support"},
+		"groups":    []interface{}{},
+	}, data.Data)
+	data, _ = doRequest(t, "GET", "/users/qwer", ``)
+	assert.Equal(t, mdl.OK, data.Status)
+	data, _ = doRequest(t, "GET", "/v1/roles/support", ``)
+	assert.Equal(t, map[string]interface{}{
+		"role_name":   "support",
+		"parents":     []interface{}{"staff"},
+		"permissions": []interface{}{"orders:read"},
+	}, data.Data)
+
+	// Managers can't name system roles by the path either
+	makeRequestsAndAssert(t,
+		expected("/v1/roles/support/parents/"+SystemAdmin, "PUT", ``,
+			mdl.InvalidArgument, 400),
+		expected("/v1/users/qwer/roles/support", "DELETE", ``,
+			mdl.UserRoleRemoved, 200),
+		expected("/v1/users/qwer/roles/"+SystemRoleManager, "PUT", ``,
+			mdl.UserRoleAdded, 200),
+	)
+	bearer, _ = authenticate(t, `{"user_name": "qwer", "password": "qsc123"}`)
+	makeRequestsAndAssert(t,
+		expected("/v1/roles/ops", "PUT", ``,
+			mdl.RoleCreated, 201),
+		expected("/v1/roles/"+SystemUserManager+"/parents/ops", "PUT", ``,
+			mdl.Forbidden, 403),
+		expected("/v1/users/qwer", "GET", ``,
+			mdl.Forbidden, 403),
+	)
+
+	// Sessions of the token of the header
+	data, _ = doRequest(t, "POST", "/v1/sessions", `{"user_name": "qwer", "password": "qsc123"}`)
+	assert.Equal(t, mdl.TokenCreated, data.Status)
+	session := data.Data.(map[string]interface{})["session_id"].(string)
+	data, _ = doRequest(t, "GET", "/v1/sessions", ``)
+	assert.Len(t, data.Data.(map[string]interface{})["sessions"], 2)
+	data, _ = doRequest(t, "GET", "/v1/sessions/"+session, ``)
+	assert.Equal(t, session, data.Data.(map[string]interface{})["session_id"])
+	makeRequestsAndAssert(t,
+		expected("/v1/sessions/"+session, "DELETE", ``,
+			mdl.SessionRevoked, 200),
+		expected("/v1/sessions/"+session, "GET", ``,
+			mdl.SessionNotFound, 404),
+		expected("/v1/sessions", "DELETE", ``,
+			mdl.SessionRevoked, 200),
+	)
+
+	// Unknown routes and methods
+	makeRequestsAndAssert(t,
+		expected("/v1/user/qwer", "GET", ``,
+			mdl.RouteNotFound, 404),
+		expected("/v1/users/qwer/groups", "GET", ``,
+			mdl.RouteNotFound, 404),
+		expected("/v0/users/qwer", "PATCH", ``,
+			mdl.MethodNotAllowed, 405),
+	)
+	req, _ := http.NewRequest("POST", serverAddr+"/v1/users/qwer", nil)
+	resp, err := cli.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 405, resp.StatusCode)
+	assert.Equal(t, "DELETE, GET, PUT", resp.Header.Get("Allow"))
+}
+
+func TestListing(t *testing.T) {
+	newServerForTesting(t)
+	for _, name := range []string{"qwer", "asdf", "zxcv", "qaz"} {
+		makeRequestsAndAssert(t,
+			expected("/v1/users/"+name, "PUT", `{"password": "qsc123"}`,
+				mdl.UserCreated, 201),
+		)
+	}
+	makeRequestsAndAssert(t,
+		expected("/v1/roles/payments-admin", "PUT", ``,
+			mdl.RoleCreated, 201),
+		expected("/v1/roles/payments-lead", "PUT", `{"parents": ["payments-admin"]}`,
+			mdl.RoleCreated, 201),
+		expected("/v1/users/qwer/roles/payments-admin", "PUT", ``,
+			mdl.UserRoleAdded, 200),
+		expected("/v1/users/qaz/roles/payments-lead", "PUT", ``,
+			mdl.UserRoleAdded, 200),
+		expected("/v1/users?limit=-1", "GET", ``,
+			mdl.InvalidArgument, 400),
+		expected("/v1/users?limit=ten", "GET", ``,
+			mdl.InvalidArgument, 400),
+		expected("/v1/roles/payments/members", "GET", ``,
+			mdl.RoleNotFound, 404),
+	)
+
+	data, _ := doRequest(t, "GET", "/v1/users?limit=2", ``)
+	assert.Equal(t, mdl.OK, data.Status)
+	assert.Equal(t, map[string]interface{}{
+		"users":       []interface{}{"admin", "asdf"},
+		"next_cursor": "asdf",
+	}, data.Data)
+	data, _ = doRequest(t, "GET", "/v1/users?limit=2&cursor=asdf", ``)
+	assert.Equal(t, map[string]interface{}{
+		"users":       []interface{}{"qaz", "qwer"},
+		"next_cursor": "qwer",
+	}, data.Data)
+	data, _ = doRequest(t, "GET", "/v1/users", `{"limit": 2, "cursor": "qwer"}`)
+	assert.Equal(t, map[string]interface{}{"users": []interface{}{"zxcv"}}, data.Data)
+	data, _ = doRequest(t, "GET", "/v1/users?prefix=q", ``)
+	assert.Equal(t, map[string]interface{}{"users": []interface{}{"qaz", "qwer"}}, data.Data)
+	data, _ = doRequest(t, "GET", "/v1/roles?prefix=payments-", ``)
+	assert.Equal(t, map[string]interface{}{"roles": []interface{}{"payments-admin", "payments-lead"}}, data.Data)
+	data, _ = doRequest(t, "GET", "/v1/roles/payments-admin/members", ``)
+	assert.Equal(t, map[string]interface{}{"users": []interface{}{"qaz", "qwer"}}, data.Data)
+	data, _ = doRequest(t, "GET", "/v1/roles/"+SystemAdmin+"/members", ``)
+	assert.Equal(t, map[string]interface{}{"users": []interface{}{"admin"}}, data.Data)
+
+	// Role managers don't see users
+	makeRequestsAndAssert(t,
+		expected("/v1/users/asdf/roles/"+SystemRoleManager, "PUT", ``,
+			mdl.UserRoleAdded, 200),
+	)
+	bearer, _ = authenticate(t, `{"user_name": "asdf", "password": "qsc123"}`)
+	makeRequestsAndAssert(t,
+		expected("/v1/roles", "GET", ``,
+			mdl.OK, 200),
+		expected("/v1/users", "GET", ``,
+			mdl.Forbidden, 403),
+		expected("/v1/roles/payments-admin/members", "GET", ``,
+			mdl.Forbidden, 403),
+	)
+}
+
+func TestPasswords(t *testing.T) {
+	newServerForTesting(t)
+	admin := bearer
+	makeRequestsAndAssert(t,
+		expected("/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/v1/users/asdf", "PUT", `{"password": "qsc123"}`,
+			mdl.UserCreated, 201),
+		expected("/v1/users/asdf/roles/"+SystemUserManager, "PUT", ``,
+			mdl.UserRoleAdded, 200),
+	)
+
+	// Changing needs no token but the password, and revokes the sessions
+	bearer = ""
+	token, _ := authenticate(t, `{"user_name": "qwer", "password": "qsc123"}`)
+	makeRequestsAndAssert(t,
+		expected("/user/password", "POST", `{"user_name": "qwer", "password": "qsc1234", "new_password": "edc456"}`,
+			mdl.UserPasswordNotMatch, 401),
+		expected("/user/password", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.InvalidArgument, 400),
+		expected("/user/password", "POST", `{"user_name": "qwer", "password": "qsc123", "new_password": "edc456"}`,
+			mdl.PasswordChanged, 200),
+		expected("/token/roles?token="+token, "GET", ``,
+			mdl.TokenIsInvalid, 401),
+		expected("/user/auth", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.UserPasswordNotMatch, 401),
+		expected("/v1/users/qwer/password", "PUT", `{"password": "edc456", "new_password": "rfv789"}`,
+			mdl.PasswordChanged, 200),
+		expected("/v1/users/qwer/password/reset", "POST", `{"password": "tmp000"}`,
+			mdl.Unauthorized, 401),
+	)
+
+	// A reset password must be changed before authenticating
+	bearer, _ = authenticate(t, `{"user_name": "asdf", "password": "qsc123"}`)
+	makeRequestsAndAssert(t,
+		expected("/v1/users/qwer/password/reset", "POST", `{"password": "tmp000"}`,
+			mdl.PasswordReset, 200),
+		expected("/user/auth", "POST", `{"user_name": "qwer", "password": "rfv789"}`,
+			mdl.UserPasswordNotMatch, 401),
+		expected("/user/auth", "POST", `{"user_name": "qwer", "password": "tmp000"}`,
+			mdl.PasswordChangeRequired, 403),
+		expected("/v0/user/auth", "POST", `{"user_name": "qwer", "password": "tmp000"}`,
+			mdl.PasswordChangeRequired, 403),
+	)
+	data, _ := doRequest(t, "GET", "/v1/users/qwer", ``)
+	assert.Equal(t, true, data.Data.(map[string]interface{})["must_change_password"])
+	makeRequestsAndAssert(t,
+		expected("/user/password", "POST", `{"user_name": "qwer", "password": "tmp000", "new_password": "tgb012"}`,
+			mdl.PasswordChanged, 200),
+		expected("/user/auth", "POST", `{"user_name": "qwer", "password": "tgb012"}`,
+			mdl.TokenCreated, 201),
+	)
+
+	// User managers can't take over the users having system roles
+	makeRequestsAndAssert(t,
+		expected("/user/password/reset", "POST", `{"user_name": "admin", "password": "tmp000"}`,
+			mdl.Forbidden, 403),
+		expected("/user/password/reset", "POST", `{"user_name": "zxcv", "password": "tmp000"}`,
+			mdl.UserNotFound, 404),
+	)
+	bearer = admin
+	makeRequestsAndAssert(t,
+		expected("/user/password/reset", "POST", `{"user_name": "asdf", "password": "tmp000"}`,
+			mdl.PasswordReset, 200),
+	)
+}
+
+func TestBootstrapExistingAdmin(t *testing.T) {
+	newEngineForTesting()
+	// As if the last start stopped between creating and granting the admin
+	assert.Nil(t, Bootstrap(mdl.User{}))
+	assert.Equal(t, mdl.UserCreated, engine.CreateUser(mdl.User{Name: "admin", Password: "admin-pwd"}))
+	assert.Nil(t, Bootstrap(mdl.User{Name: "admin", Password: "admin-pwd"}))
+	assert.Nil(t, Bootstrap(mdl.User{Name: "admin", Password: "admin-pwd"}))
+	bearer = ""
+	bearer, _ = authenticate(t, `{"user_name": "admin", "password": "admin-pwd"}`)
+	makeRequestsAndAssert(t,
+		expected("/role", "POST", `{"role_name": "ops"}`,
+			mdl.RoleCreated, 201),
+		expected("/tenant", "POST", `{"tenant_name": "acme"}`,
+			mdl.TenantCreated, 201),
+	)
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	newServerForTesting(t)
+	SetEngine(mdl.NewInmemEngine(mdl.WithPasswordHistory(2)))
+	SetPasswordPolicy(&mdl.PasswordPolicy{
+		MinLength:      8,
+		Digit:          true,
+		Banned:         map[string]struct{}{"password1": {}},
+		RejectUserName: true,
+	})
+	assert.NotNil(t, Bootstrap(mdl.User{Name: "admin", Password: "admin-pwd"}))
+	assert.Nil(t, Bootstrap(mdl.User{Name: "admin", Password: "secret-pwd-1"}))
+	bearer = ""
+	bearer, _ = authenticate(t, `{"user_name": "admin", "password": "secret-pwd-1"}`)
+
+	makeRequestsAndAssert(t,
+		expected("/user", "POST", `{"user_name": "qwer", "password": "qsc123"}`,
+			mdl.PasswordPolicyViolated, 422),
+		expected("/v0/user", "POST", `{"user_name": "qwer", "password": "PassWord1"}`,
+			mdl.PasswordPolicyViolated, 400),
+		expected("/user", "POST", `{"user_name": "qwer", "password": "my-QWER-1"}`,
+			mdl.PasswordPolicyViolated, 422),
+		expected("/user", "POST", `{"user_name": "qwer", "password": "edc-4567"}`,
+			mdl.UserCreated, 201),
+		expected("/user/password", "POST", `{"user_name": "qwer", "password": "edc-4567", "new_password": "edc-4567"}`,
+			mdl.PasswordReused, 422),
+		expected("/user/password", "POST", `{"user_name": "qwer", "password": "edc-4567", "new_password": "rfv"}`,
+			mdl.PasswordPolicyViolated, 422),
+		expected("/user/password", "POST", `{"user_name": "qwer", "password": "edc-4567", "new_password": "rfv-7890"}`,
+			mdl.PasswordChanged, 200),
+		expected("/v1/users/qwer/password", "PUT", `{"password": "rfv-7890", "new_password": "edc-4567"}`,
+			mdl.PasswordReused, 422),
+		expected("/v1/users/qwer/password/reset", "POST", `{"password": "tmp"}`,
+			mdl.PasswordPolicyViolated, 422),
+		expected("/v1/users/qwer/password/reset", "POST", `{"password": "tmp-0000"}`,
+			mdl.PasswordReset, 200),
+	)
+
+	// Problems list the violations, the legacy envelope in the message only
+	req, _ := http.NewRequest("PUT", serverAddr+"/v1/users/zxcv", strings.NewReader(`{"password": "zxcv"}`))
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	resp, err := cli.Do(req)
+	assert.Nil(t, err)
+	p := new(Problem)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(p))
+	resp.Body.Close()
+	assert.Equal(t, []mdl.PasswordViolation{
+		{Rule: mdl.RuleMinLength, Message: "must have at least 8 characters"},
+		{Rule: mdl.RuleDigit, Message: "must have a digit"},
+		{Rule: mdl.RuleUserName, Message: "must not contain the user name"},
+	}, p.Violations)
+	data, _ := doRequest(t, "PUT", "/v0/users/zxcv", `{"password": "zxcv"}`)
+	assert.Equal(t, "password policy violated: must have at least 8 characters; must have a digit; must not contain the user name", data.Message)
+	assert.Nil(t, data.Data)
+	data, _ = doRequest(t, "PUT", "/v1/users/qwer/password", `{"password": "tmp-0000", "new_password": "tmp-0000"}`)
+	assert.Equal(t, "password reused: must differ from the last passwords", data.Message)
 }
 
 func TestMain(m *testing.M) {
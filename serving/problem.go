@@ -0,0 +1,72 @@
+package serving
+
+import (
+	"encoding/json"
+	"net/http"
+
+	mdl "hsbc-hw/model"
+)
+
+// LegacyPrefix is the versioned route of every API responding with the
+// legacy envelope, e.g. /v0/user, whose HTTP status is the class of the
+// status code only, see StatusCode.HTTPCode.
+const LegacyPrefix = "/v0"
+
+// Problem is the body of failed responses, see RFC 7807, extended by the
+// status code of the model.
+type Problem struct {
+	Type     string         `json:"type"`
+	Title    string         `json:"title"`
+	Status   int            `json:"status"`
+	Detail   string         `json:"detail,omitempty"`
+	Instance string         `json:"instance,omitempty"`
+	Code     mdl.StatusCode `json:"code"`
+	// Violations are the rules of the password policy a new password
+	// breaks, if any.
+	Violations []mdl.PasswordViolation `json:"violations,omitempty"`
+}
+
+// writeResponse writes resp with the precise HTTP status of its code, as a
+// Problem if it failed.
+func writeResponse(w http.ResponseWriter, req *http.Request, resp ResponseCommon) {
+	code := resp.Status.HTTPStatus()
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	var b []byte
+	if code < 400 {
+		w.Header().Set("Content-Type", "application/json")
+		b, _ = json.Marshal(resp)
+	} else {
+		w.Header().Set("Content-Type", "application/problem+json")
+		p := Problem{
+			Type:     "about:blank",
+			Title:    http.StatusText(code),
+			Status:   code,
+			Detail:   resp.Message,
+			Instance: req.URL.Path,
+			Code:     resp.Status,
+		}
+		if v, ok := resp.Data.(PasswordViolationsResponse); ok {
+			p.Violations = v.Violations
+		}
+		b, _ = json.Marshal(p)
+	}
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// writeLegacyResponse writes resp in the legacy envelope, without data
+// unless it succeeded.
+func writeLegacyResponse(w http.ResponseWriter, _ *http.Request, resp ResponseCommon) {
+	code := resp.Status.HTTPCode()
+	if code != 200 {
+		resp.Data = nil
+	}
+	if resp.Status == mdl.Unauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.WriteHeader(code)
+	b, _ := json.Marshal(resp)
+	w.Write(b)
+}
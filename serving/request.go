@@ -0,0 +1,98 @@
+package serving
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// This file reads the arguments of requests from the JSON body, the query
+// parameters named like its fields, and the path parameters of the route.
+// Queries don't need a body, so that they work with plain HTTP clients, like
+//
+//	curl -H "Authorization: Bearer hsbc_at_..." localhost:8080/token/role/role1?resource=org/1
+//
+// while mutations take their arguments by the body and the path only, so
+// that a query string can't replace what the body says.
+
+// decodeRequest reads in from the JSON body b if any, then from the query
+// parameters of GET and DELETE requests, which override the body, as
+// strings. Path parameters are read last, and a body or query field naming
+// another value than the path is refused.
+func decodeRequest(req *http.Request, b []byte, in interface{}) error {
+	var body map[string]json.RawMessage
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, in); err != nil {
+			return err
+		}
+		// A body decoded into in is an object
+		json.Unmarshal(b, &body)
+	}
+	fields := make(map[string]interface{})
+	if req.Method == "GET" || req.Method == "DELETE" {
+		for k, v := range req.URL.Query() {
+			fields[k] = v[len(v)-1]
+		}
+	}
+	params, _ := req.Context().Value(paramsKey{}).(map[string]string)
+	for k, v := range params {
+		if raw, ok := body[k]; ok {
+			var s string
+			if json.Unmarshal(raw, &s) != nil || s != v {
+				return fmt.Errorf("%s of the body conflicts with the path", k)
+			}
+		}
+		if q, ok := fields[k]; ok && q != v {
+			return fmt.Errorf("%s of the query conflicts with the path", k)
+		}
+		fields[k] = v
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, in)
+}
+
+// requestToken returns token given by the body or query if not empty, or
+// the one of the Authorization header.
+func requestToken(req *http.Request, token string) string {
+	if token != "" {
+		return token
+	}
+	return bearerToken(req)
+}
+
+// intParam is an integer given by a JSON number, or a string like the query
+// parameters.
+type intParam int
+
+func (v *intParam) UnmarshalJSON(b []byte) error {
+	var n int
+	if err := json.Unmarshal(bytes.Trim(b, `"`), &n); err != nil {
+		return err
+	}
+	*v = intParam(n)
+	return nil
+}
+
+// attributesParam is a JSON object given by the body, or by a string like
+// the query parameters.
+type attributesParam map[string]interface{}
+
+func (v *attributesParam) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		b = []byte(s)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*v = m
+	return nil
+}
@@ -0,0 +1,138 @@
+package serving
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	mdl "hsbc-hw/model"
+)
+
+// APIPrefix is the versioned route of every API, e.g. /v1/users/uname1,
+// which are also served without a prefix for compatibility, and with
+// LegacyPrefix in the legacy envelope.
+const APIPrefix = "/v1"
+
+type handlerFunc func(*http.Request, []byte) ResponseCommon
+
+// router dispatches requests by their methods and paths to the handlers of
+// path patterns, whose segments like {user_name} are parameters read by
+// decodeRequest. Patterns are matched in the order registered.
+type router struct {
+	routes []*route
+}
+
+type route struct {
+	pattern  string
+	segments []string
+	handlers map[string]handlerFunc // Method - handler
+}
+
+type paramsKey struct{}
+
+func (r *router) handle(pattern, method string, h handlerFunc) {
+	for _, v := range r.routes {
+		if v.pattern == pattern {
+			v.handlers[method] = h
+			return
+		}
+	}
+	r.routes = append(r.routes, &route{
+		pattern:  pattern,
+		segments: strings.Split(strings.Trim(pattern, "/"), "/"),
+		handlers: map[string]handlerFunc{method: h},
+	})
+}
+
+// match returns the route of path and its parameters, or nil if none.
+func (r *router) match(path string) (*route, map[string]string) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, v := range r.routes {
+		if params, ok := v.match(segments); ok {
+			return v, params
+		}
+	}
+	return nil, nil
+}
+
+func (v *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(v.segments) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, s := range v.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[s[1:len(s)-1]] = segments[i]
+		} else if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// allow returns the methods of v for the Allow header.
+func (v *route) allow() string {
+	methods := make([]string, 0, len(v.handlers))
+	for m := range v.handlers {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// roots returns the paths to register the routes with in http.ServeMux,
+// which are the patterns without parameters, or their subtrees before the
+// first parameter.
+func (r *router) roots() []string {
+	var res []string
+	seen := make(map[string]struct{})
+	for _, v := range r.routes {
+		root := v.pattern
+		if i := strings.Index(root, "{"); i >= 0 {
+			root = root[:i]
+		}
+		if _, ok := seen[root]; !ok {
+			seen[root] = struct{}{}
+			res = append(res, root)
+		}
+	}
+	return res
+}
+
+// handler serves the routes under prefix, and writes the responses by
+// write.
+func (r *router) handler(prefix string, write func(http.ResponseWriter, *http.Request, ResponseCommon)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var resp ResponseCommon
+		defer func() {
+			log.Printf("%v %v, resp %+v", req.URL.Path, req.Method, resp)
+			write(w, req, resp)
+		}()
+		log.Printf("%v %v", req.URL.Path, req.Method)
+		v, params := r.match(strings.TrimPrefix(req.URL.Path, prefix))
+		if v == nil {
+			resp = newResponse(mdl.RouteNotFound, fmt.Sprintf("no route for url '%v'", req.URL.Path))
+			return
+		}
+		h, ok := v.handlers[req.Method]
+		if !ok {
+			w.Header().Set("Allow", v.allow())
+			resp = newResponse(mdl.MethodNotAllowed, fmt.Sprintf("method %v not allowed for url '%v'", req.Method, v.pattern))
+			return
+		}
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			resp = newResponse(mdl.Internal, err.Error())
+			return
+		}
+		req.Body.Close()
+		resp = h(req.WithContext(context.WithValue(req.Context(), paramsKey{}, params)), b)
+	}
+}
@@ -0,0 +1,1095 @@
+package sqlstore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	mdl "hsbc-hw/model"
+)
+
+type sqlEngine struct {
+	db      *sql.DB
+	dialect Dialect
+
+	// For password hashing and token generation, and token expiration,
+	// which may be changed while serving under settingsLock
+	settingsLock sync.RWMutex
+	hasher       mdl.PasswordHasher
+	dummyHash    string // by hasher, verified for missing users
+	tokenGen     mdl.TokenGenerator
+	tokenTTL     time.Duration
+
+	// For token expiration
+	clock                      mdl.Clock
+	tokenExpirationCheckPeriod time.Duration
+
+	// Sessions of each user, 0 for unlimited
+	maxSessions int
+
+	// Last passwords of each user a new one must differ from, 0 for no check
+	passwordHistory int
+
+	// Signal to exit back ground routines
+	exitChan chan struct{}
+}
+
+// NewSQLEngine migrates the schema of db to the latest version and returns
+// an engine storing data in it. The db is not closed by Shutdown. Shard
+// options are ignored, and the sweep interval defaults to 1s.
+func NewSQLEngine(db *sql.DB, d Dialect, opts ...mdl.Option) (mdl.AuthenticateAuthorizationEngine, error) {
+	o, err := mdl.NewOptions(append([]mdl.Option{mdl.WithSweepInterval(time.Second)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db, d); err != nil {
+		return nil, err
+	}
+	e := &sqlEngine{
+		db:                         db,
+		dialect:                    d,
+		hasher:                     o.Hasher,
+		dummyHash:                  mdl.DummyHash(o.Hasher),
+		tokenGen:                   o.TokenGenerator,
+		clock:                      o.Clock,
+		tokenTTL:                   o.TokenTTL,
+		tokenExpirationCheckPeriod: o.SweepInterval,
+		maxSessions:                o.MaxSessions,
+		passwordHistory:            o.PasswordHistory,
+		exitChan:                   make(chan struct{}),
+	}
+	go e.deleteExpiredTokens()
+	return e, nil
+}
+
+func (e *sqlEngine) SetTokenTTL(du time.Duration) {
+	e.settingsLock.Lock()
+	defer e.settingsLock.Unlock()
+	e.tokenTTL = du
+}
+
+// SetPasswordHasher changes the hasher for new passwords. Existing hashes
+// are still verified and upgraded on the next successful Authenticate.
+func (e *sqlEngine) SetPasswordHasher(h mdl.PasswordHasher) {
+	dummy := mdl.DummyHash(h)
+	e.settingsLock.Lock()
+	defer e.settingsLock.Unlock()
+	e.hasher = h
+	e.dummyHash = dummy
+}
+
+// SetTokenGenerator changes the generator of new token IDs.
+func (e *sqlEngine) SetTokenGenerator(g mdl.TokenGenerator) {
+	e.settingsLock.Lock()
+	defer e.settingsLock.Unlock()
+	e.tokenGen = g
+}
+
+// passwordHasher returns the hasher for passwords and its dummy hash.
+func (e *sqlEngine) passwordHasher() (mdl.PasswordHasher, string) {
+	e.settingsLock.RLock()
+	defer e.settingsLock.RUnlock()
+	return e.hasher, e.dummyHash
+}
+
+// tokenSettings returns the generator and lifetime of new tokens.
+func (e *sqlEngine) tokenSettings() (mdl.TokenGenerator, time.Duration) {
+	e.settingsLock.RLock()
+	defer e.settingsLock.RUnlock()
+	return e.tokenGen, e.tokenTTL
+}
+
+func (e *sqlEngine) CreateTenant(t mdl.Tenant) mdl.StatusCode {
+	if !t.Valid() {
+		return mdl.TenantInvalid
+	}
+	if _, err := e.exec(`INSERT INTO tenants (name) VALUES (?)`, t.Name); err != nil {
+		// Most likely the primary key is violated, check to tell it
+		// from other errors
+		if exists, err := e.tenantExists(e.db, t); err == nil && exists {
+			return mdl.TenantAlreadyExisting
+		}
+		return mdl.Internal
+	}
+	return mdl.TenantCreated
+}
+
+// DeleteTenant deletes t with its users, roles, groups and tokens.
+func (e *sqlEngine) DeleteTenant(t mdl.Tenant) mdl.StatusCode {
+	if !t.Valid() {
+		return mdl.TenantInvalid
+	}
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		res, err := tx.Exec(e.dialect.rebind(`DELETE FROM tenants WHERE name = ?`), t.Name)
+		if err != nil {
+			return mdl.Internal
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return mdl.Internal
+		} else if n == 0 {
+			return mdl.TenantNotFound
+		}
+		prefix := t.Prefix()
+		n := utf8.RuneCountInString(prefix)
+		users, err := e.queryNames(tx, `SELECT name FROM users WHERE SUBSTR(name, 1, ?) = ?`, n, prefix)
+		if err != nil {
+			return mdl.Internal
+		}
+		for _, u := range users {
+			if status := e.deleteUser(tx, u); status != mdl.UserDeleted {
+				return status
+			}
+		}
+		roles, err := e.queryNames(tx, `SELECT name FROM roles WHERE SUBSTR(name, 1, ?) = ?`, n, prefix)
+		if err != nil {
+			return mdl.Internal
+		}
+		for _, r := range roles {
+			if status := e.deleteRole(tx, r); status != mdl.RoleDeleted {
+				return status
+			}
+		}
+		groups, err := e.queryNames(tx, `SELECT name FROM user_groups WHERE SUBSTR(name, 1, ?) = ?`, n, prefix)
+		if err != nil {
+			return mdl.Internal
+		}
+		for _, g := range groups {
+			if status := e.deleteGroup(tx, g); status != mdl.GroupDeleted {
+				return status
+			}
+		}
+		return mdl.TenantDeleted
+	})
+}
+
+func (e *sqlEngine) ListTenants() ([]mdl.Tenant, mdl.StatusCode) {
+	names, err := e.queryNames(e.db, `SELECT name FROM tenants ORDER BY name`)
+	if err != nil {
+		return nil, mdl.Internal
+	}
+	res := make([]mdl.Tenant, 0, len(names))
+	for _, name := range names {
+		res = append(res, mdl.Tenant{Name: name})
+	}
+	return res, mdl.OK
+}
+
+func (e *sqlEngine) CreateUser(u mdl.User) mdl.StatusCode {
+	hasher, _ := e.passwordHasher()
+	pwd, err := hasher.Hash(u.Password)
+	if err != nil {
+		return mdl.Internal
+	}
+	status := e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if status := e.checkTenant(tx, u.Name); status != mdl.OK {
+			return status
+		}
+		if _, err := tx.Exec(e.dialect.rebind(`INSERT INTO users (name, pwd_encrypted) VALUES (?, ?)`), u.Name, pwd); err != nil {
+			return mdl.Internal
+		}
+		return mdl.UserCreated
+	})
+	if status == mdl.Internal {
+		// Most likely the primary key is violated, check to tell it
+		// from other errors
+		if _, status := e.getPassword(e.db, u.Name); status == mdl.OK {
+			return mdl.UserAlreadyExisting
+		}
+	}
+	return status
+}
+
+func (e *sqlEngine) DeleteUser(u mdl.User) mdl.StatusCode {
+	stored, status := e.checkUserPassword(u)
+	if status != mdl.OK {
+		return status
+	}
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if status := e.checkPasswordUnchanged(tx, u.Name, stored); status != mdl.OK {
+			return status
+		}
+		return e.deleteUser(tx, u.Name)
+	})
+}
+
+// GetUser returns u with its global roles in the order granted and its
+// groups sorted by name.
+func (e *sqlEngine) GetUser(u mdl.User) (mdl.User, mdl.StatusCode) {
+	var mustChange int
+	err := e.db.QueryRow(e.dialect.rebind(`SELECT must_change_password FROM users WHERE name = ?`), u.Name).Scan(&mustChange)
+	if err == sql.ErrNoRows {
+		return mdl.User{}, mdl.UserNotFound
+	} else if err != nil {
+		return mdl.User{}, mdl.Internal
+	}
+	roles, err := e.queryNames(e.db, `SELECT role_name FROM user_roles WHERE user_name = ? ORDER BY position`, u.Name)
+	if err != nil {
+		return mdl.User{}, mdl.Internal
+	}
+	groups, err := e.queryNames(e.db, `SELECT group_name FROM group_members WHERE user_name = ? ORDER BY group_name`, u.Name)
+	if err != nil {
+		return mdl.User{}, mdl.Internal
+	}
+	return mdl.User{Name: u.Name, Roles: roles, Groups: groups, MustChangePassword: mustChange != 0}, mdl.OK
+}
+
+// ChangePassword replaces the password of u given by u.Password with
+// password, and revokes all sessions of u.
+func (e *sqlEngine) ChangePassword(u mdl.User, password string) mdl.StatusCode {
+	hasher, _ := e.passwordHasher()
+	pwd, err := hasher.Hash(password)
+	if err != nil {
+		return mdl.Internal
+	}
+	stored, status := e.checkUserPassword(u)
+	if status != mdl.OK {
+		return status
+	}
+	if _, status := e.checkPasswordReused(u.Name, password); status != mdl.OK {
+		return status
+	}
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if status := e.checkPasswordUnchanged(tx, u.Name, stored); status != mdl.OK {
+			return status
+		}
+		if err := e.setPassword(tx, u.Name, pwd, false); err != nil {
+			return mdl.Internal
+		}
+		return mdl.PasswordChanged
+	})
+}
+
+// ResetPassword replaces the password of u with the temporary u.Password,
+// which must be changed by ChangePassword before authenticating, and
+// revokes all sessions of u.
+func (e *sqlEngine) ResetPassword(u mdl.User) mdl.StatusCode {
+	hasher, _ := e.passwordHasher()
+	pwd, err := hasher.Hash(u.Password)
+	if err != nil {
+		return mdl.Internal
+	}
+	for {
+		stored, status := e.checkPasswordReused(u.Name, u.Password)
+		if status != mdl.OK {
+			return status
+		}
+		status = e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+			cur, status := e.getPassword(tx, u.Name)
+			if status != mdl.OK {
+				return status
+			}
+			if cur != stored {
+				return mdl.Unknown
+			}
+			if err := e.setPassword(tx, u.Name, pwd, true); err != nil {
+				return mdl.Internal
+			}
+			return mdl.PasswordReset
+		})
+		if status != mdl.Unknown {
+			return status
+		}
+		// The password was changed meanwhile, check the new history
+	}
+}
+
+// ListUsers returns the page p of users by name.
+func (e *sqlEngine) ListUsers(p mdl.Page) ([]mdl.User, string, mdl.StatusCode) {
+	names, next, err := e.queryPage(`SELECT name FROM users WHERE %s ORDER BY name`, "name", p)
+	if err != nil {
+		return nil, "", mdl.Internal
+	}
+	return userNames(names), next, mdl.OK
+}
+
+func (e *sqlEngine) CreateRole(r mdl.Role) mdl.StatusCode {
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if exists, err := e.roleExists(tx, r.Name); err != nil {
+			return mdl.Internal
+		} else if exists {
+			return mdl.RoleAlreadyExisting
+		}
+		if status := e.checkTenant(tx, r.Name); status != mdl.OK {
+			return status
+		}
+		if status := e.rolesExist(tx, r.Parents); status != mdl.OK {
+			return status
+		}
+		if _, err := tx.Exec(e.dialect.rebind(`INSERT INTO roles (name) VALUES (?)`), r.Name); err != nil {
+			return mdl.Internal
+		}
+		seen := make(map[string]struct{}, len(r.Parents))
+		for _, p := range r.Parents {
+			if _, ok := seen[p]; ok {
+				continue
+			}
+			seen[p] = struct{}{}
+			if _, err := tx.Exec(e.dialect.rebind(`INSERT INTO role_parents (role_name, parent_name) VALUES (?, ?)`), r.Name, p); err != nil {
+				return mdl.Internal
+			}
+		}
+		if err := e.refreshAncestors(tx, []string{r.Name}); err != nil {
+			return mdl.Internal
+		}
+		return mdl.RoleCreated
+	})
+}
+
+func (e *sqlEngine) DeleteRole(r mdl.Role) mdl.StatusCode {
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		return e.deleteRole(tx, r.Name)
+	})
+}
+
+// GetRole returns r with its parents and permissions sorted by name.
+func (e *sqlEngine) GetRole(r mdl.Role) (mdl.Role, mdl.StatusCode) {
+	if exists, err := e.roleExists(e.db, r.Name); err != nil {
+		return mdl.Role{}, mdl.Internal
+	} else if !exists {
+		return mdl.Role{}, mdl.RoleNotFound
+	}
+	parents, err := e.queryNames(e.db, `SELECT parent_name FROM role_parents WHERE role_name = ? ORDER BY parent_name`, r.Name)
+	if err != nil {
+		return mdl.Role{}, mdl.Internal
+	}
+	permissions, err := e.queryNames(e.db, `SELECT permission FROM role_permissions WHERE role_name = ? ORDER BY permission`, r.Name)
+	if err != nil {
+		return mdl.Role{}, mdl.Internal
+	}
+	return mdl.Role{Name: r.Name, Parents: parents, Permissions: permissions}, mdl.OK
+}
+
+// ListRoles returns the page p of roles by name.
+func (e *sqlEngine) ListRoles(p mdl.Page) ([]mdl.Role, string, mdl.StatusCode) {
+	names, next, err := e.queryPage(`SELECT name FROM roles WHERE %s ORDER BY name`, "name", p)
+	if err != nil {
+		return nil, "", mdl.Internal
+	}
+	res := make([]mdl.Role, 0, len(names))
+	for _, n := range names {
+		res = append(res, mdl.Role{Name: n})
+	}
+	return res, next, mdl.OK
+}
+
+// ListRoleMembers returns the page p of users having r globally, granted to
+// them or their groups, by itself or a role inheriting it, like CheckRole.
+func (e *sqlEngine) ListRoleMembers(r mdl.Role, p mdl.Page) ([]mdl.User, string, mdl.StatusCode) {
+	if exists, err := e.roleExists(e.db, r.Name); err != nil {
+		return nil, "", mdl.Internal
+	} else if !exists {
+		return nil, "", mdl.RoleNotFound
+	}
+	names, next, err := e.queryPage(`SELECT DISTINCT b.user_name FROM (
+		SELECT user_name, role_name FROM user_roles UNION ALL
+		SELECT gm.user_name, gr.role_name FROM group_members gm
+			JOIN group_ancestors ga ON ga.group_name = gm.group_name
+			JOIN group_roles gr ON gr.group_name = ga.ancestor_name) b
+		JOIN role_ancestors ra ON ra.role_name = b.role_name
+		WHERE ra.ancestor_name = ? AND %s ORDER BY b.user_name`, "b.user_name", p, r.Name)
+	if err != nil {
+		return nil, "", mdl.Internal
+	}
+	return userNames(names), next, mdl.OK
+}
+
+func (e *sqlEngine) GrantPermission(r mdl.Role, p mdl.Permission) mdl.StatusCode {
+	if !p.Valid() {
+		return mdl.PermissionInvalid
+	}
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if exists, err := e.roleExists(tx, r.Name); err != nil {
+			return mdl.Internal
+		} else if !exists {
+			return mdl.RoleNotFound
+		}
+		var n int
+		if err := tx.QueryRow(e.dialect.rebind(`SELECT COUNT(*) FROM role_permissions WHERE role_name = ? AND permission = ?`),
+			r.Name, p.Name).Scan(&n); err != nil {
+			return mdl.Internal
+		} else if n > 0 {
+			return mdl.PermissionAlreadyGranted
+		}
+		if _, err := tx.Exec(e.dialect.rebind(`INSERT INTO role_permissions (role_name, permission) VALUES (?, ?)`),
+			r.Name, p.Name); err != nil {
+			return mdl.Internal
+		}
+		return mdl.PermissionGranted
+	})
+}
+
+func (e *sqlEngine) RevokePermission(r mdl.Role, p mdl.Permission) mdl.StatusCode {
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if exists, err := e.roleExists(tx, r.Name); err != nil {
+			return mdl.Internal
+		} else if !exists {
+			return mdl.RoleNotFound
+		}
+		res, err := tx.Exec(e.dialect.rebind(`DELETE FROM role_permissions WHERE role_name = ? AND permission = ?`), r.Name, p.Name)
+		if err != nil {
+			return mdl.Internal
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return mdl.Internal
+		} else if n == 0 {
+			return mdl.PermissionNotGranted
+		}
+		return mdl.PermissionRevoked
+	})
+}
+
+func (e *sqlEngine) AddUserRole(u mdl.User, r mdl.Role) mdl.StatusCode {
+	return e.AddUserRoleOn(u, r, mdl.Resource{})
+}
+
+func (e *sqlEngine) AddUserRoleOn(u mdl.User, r mdl.Role, res mdl.Resource) mdl.StatusCode {
+	if !res.Valid() {
+		return mdl.ResourceInvalid
+	}
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if _, status := e.getPassword(tx, u.Name); status != mdl.OK {
+			return status
+		}
+		if ok, err := e.userHasRole(tx, u.Name, r.Name, res); err != nil {
+			return mdl.Internal
+		} else if ok {
+			return mdl.UserRoleAlreadyExisting
+		}
+		if exists, err := e.roleExists(tx, r.Name); err != nil {
+			return mdl.Internal
+		} else if !exists {
+			return mdl.RoleNotFound
+		}
+		var err error
+		if res.IsGlobal() {
+			// Keep the order roles are added in for AllRoles
+			_, err = tx.Exec(e.dialect.rebind(`INSERT INTO user_roles (user_name, role_name, position)
+				SELECT ?, ?, COALESCE(MAX(position), 0) + 1 FROM user_roles WHERE user_name = ?`),
+				u.Name, r.Name, u.Name)
+		} else {
+			_, err = tx.Exec(e.dialect.rebind(`INSERT INTO scoped_user_roles (user_name, resource, role_name) VALUES (?, ?, ?)`),
+				u.Name, res.Path, r.Name)
+		}
+		if err != nil {
+			return mdl.Internal
+		}
+		return mdl.UserRoleAdded
+	})
+}
+
+func (e *sqlEngine) RemoveUserRole(u mdl.User, r mdl.Role) mdl.StatusCode {
+	return e.RemoveUserRoleOn(u, r, mdl.Resource{})
+}
+
+func (e *sqlEngine) RemoveUserRoleOn(u mdl.User, r mdl.Role, res mdl.Resource) mdl.StatusCode {
+	if !res.Valid() {
+		return mdl.ResourceInvalid
+	}
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if _, status := e.getPassword(tx, u.Name); status != mdl.OK {
+			return status
+		}
+		if exists, err := e.roleExists(tx, r.Name); err != nil {
+			return mdl.Internal
+		} else if !exists {
+			return mdl.RoleNotFound
+		}
+		var result sql.Result
+		var err error
+		if res.IsGlobal() {
+			result, err = tx.Exec(e.dialect.rebind(`DELETE FROM user_roles WHERE user_name = ? AND role_name = ?`), u.Name, r.Name)
+		} else {
+			result, err = tx.Exec(e.dialect.rebind(`DELETE FROM scoped_user_roles WHERE user_name = ? AND resource = ? AND role_name = ?`),
+				u.Name, res.Path, r.Name)
+		}
+		if err != nil {
+			return mdl.Internal
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return mdl.Internal
+		} else if n == 0 {
+			return mdl.UserRoleNotFound
+		}
+		return mdl.UserRoleRemoved
+	})
+}
+
+func (e *sqlEngine) Authenticate(u mdl.User, info mdl.SessionInfo) (mdl.Token, mdl.StatusCode) {
+	stored, status := e.checkUserPassword(u)
+	if status != mdl.OK {
+		return mdl.Token{}, status
+	}
+	hasher, _ := e.passwordHasher()
+	rehashed := ""
+	if hasher.NeedsRehash(stored) {
+		// Failing to upgrade the hash should not fail the login
+		rehashed, _ = hasher.Hash(u.Password)
+	}
+	tokenGen, tokenTTL := e.tokenSettings()
+	id, err := tokenGen.Generate()
+	if err != nil {
+		return mdl.Token{}, mdl.Internal
+	}
+	sid, err := generateSessionID()
+	if err != nil {
+		return mdl.Token{}, mdl.Internal
+	}
+	now := e.clock.Now()
+	token := mdl.Token{
+		ID:              id,
+		SessionID:       sid,
+		CreatedAtInUsec: now.UnixNano() / 1000,
+		ExpiredAtInUsec: now.Add(tokenTTL).UnixNano() / 1000,
+		Info:            info,
+		Tenant:          mdl.TenantOf(u.Name).Name,
+	}
+
+	status = e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if status := e.checkPasswordUnchanged(tx, u.Name, stored); status != mdl.OK {
+			return status
+		}
+		var mustChange int
+		if err := tx.QueryRow(e.dialect.rebind(`SELECT must_change_password FROM users WHERE name = ?`), u.Name).Scan(&mustChange); err != nil {
+			return mdl.Internal
+		} else if mustChange != 0 {
+			return mdl.PasswordChangeRequired
+		}
+		if rehashed != "" {
+			if _, err := tx.Exec(e.dialect.rebind(`UPDATE users SET pwd_encrypted = ? WHERE name = ?`), rehashed, u.Name); err != nil {
+				return mdl.Internal
+			}
+		}
+		if status := e.evictSessions(tx, u.Name, token.CreatedAtInUsec); status != mdl.OK {
+			return status
+		}
+		// Never hand out a token owned by someone else, which fails the
+		// primary key as well
+		if _, err := tx.Exec(e.dialect.rebind(`INSERT INTO tokens
+			(token_hash, session_id, user_name, created_at_in_usec, expired_at_in_usec, user_agent, ip, label)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+			hashToken(id), sid, u.Name, token.CreatedAtInUsec, token.ExpiredAtInUsec,
+			info.UserAgent, info.IP, info.Label); err != nil {
+			return mdl.Internal
+		}
+		return mdl.TokenCreated
+	})
+	if status != mdl.TokenCreated {
+		return mdl.Token{}, status
+	}
+	return token, status
+}
+
+func (e *sqlEngine) Invalidate(t string) mdl.StatusCode {
+	if _, status := e.getTokenUser(e.db, t); status != mdl.OK {
+		return status
+	}
+	if _, err := e.exec(`UPDATE tokens SET invalid = 1 WHERE token_hash = ?`, hashToken(t)); err != nil {
+		return mdl.Internal
+	}
+	return mdl.TokenInvalidated
+}
+
+func (e *sqlEngine) ListSessions(t string) ([]mdl.Token, mdl.StatusCode) {
+	name, status := e.getTokenUser(e.db, t)
+	if status != mdl.OK {
+		return nil, status
+	}
+	rows, err := e.db.Query(e.dialect.rebind(`SELECT session_id, created_at_in_usec, expired_at_in_usec, user_agent, ip, label
+		FROM tokens WHERE user_name = ? AND invalid = 0 AND expired_at_in_usec >= ?
+		ORDER BY created_at_in_usec, session_id`), name, e.nowInUsec())
+	if err != nil {
+		return nil, mdl.Internal
+	}
+	defer rows.Close()
+
+	res := make([]mdl.Token, 0)
+	for rows.Next() {
+		v := mdl.Token{Tenant: mdl.TenantOf(name).Name}
+		if err := rows.Scan(&v.SessionID, &v.CreatedAtInUsec, &v.ExpiredAtInUsec,
+			&v.Info.UserAgent, &v.Info.IP, &v.Info.Label); err != nil {
+			return nil, mdl.Internal
+		}
+		res = append(res, v)
+	}
+	if rows.Err() != nil {
+		return nil, mdl.Internal
+	}
+	return res, mdl.OK
+}
+
+func (e *sqlEngine) RevokeSession(t, sessionID string) mdl.StatusCode {
+	name, status := e.getTokenUser(e.db, t)
+	if status != mdl.OK {
+		return status
+	}
+	res, err := e.exec(`UPDATE tokens SET invalid = 1 WHERE user_name = ? AND session_id = ? AND invalid = 0`, name, sessionID)
+	if err != nil {
+		return mdl.Internal
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return mdl.Internal
+	} else if n == 0 {
+		return mdl.SessionNotFound
+	}
+	return mdl.SessionRevoked
+}
+
+func (e *sqlEngine) RevokeAllSessions(t string) mdl.StatusCode {
+	name, status := e.getTokenUser(e.db, t)
+	if status != mdl.OK {
+		return status
+	}
+	if _, err := e.exec(`UPDATE tokens SET invalid = 1 WHERE user_name = ?`, name); err != nil {
+		return mdl.Internal
+	}
+	return mdl.SessionRevoked
+}
+
+func (e *sqlEngine) CheckRole(t, r string) mdl.StatusCode {
+	return e.CheckRoleOn(t, r, mdl.Resource{})
+}
+
+// CheckRoleOn checks the global bindings of the user, the ones on res or
+// any resource above it, and the roles granted by its groups.
+func (e *sqlEngine) CheckRoleOn(t, r string, res mdl.Resource) mdl.StatusCode {
+	if !res.Valid() {
+		return mdl.ResourceInvalid
+	}
+	name, status := e.getTokenUser(e.db, t)
+	if status != mdl.OK {
+		return status
+	}
+	query := `SELECT role_name FROM user_roles WHERE user_name = ? UNION ALL ` + groupRolesQuery
+	args := []interface{}{name, name}
+	if scopes := res.Scopes()[1:]; len(scopes) > 0 {
+		query += ` UNION ALL SELECT role_name FROM scoped_user_roles WHERE user_name = ? AND resource IN (?` +
+			strings.Repeat(", ?", len(scopes)-1) + `)`
+		args = append(args, name)
+		for _, s := range scopes {
+			args = append(args, s)
+		}
+	}
+	args = append(args, r)
+	var n int
+	if err := e.db.QueryRow(e.dialect.rebind(`SELECT COUNT(*) FROM (`+query+`) b
+		JOIN role_ancestors ra ON ra.role_name = b.role_name
+		WHERE ra.ancestor_name = ?`), args...).Scan(&n); err != nil {
+		return mdl.Internal
+	}
+	if n > 0 {
+		return mdl.TokenRoleOK
+	}
+	return mdl.TokenRoleNotFound
+}
+
+func (e *sqlEngine) CheckPermission(t, p string) mdl.StatusCode {
+	name, status := e.getTokenUser(e.db, t)
+	if status != mdl.OK {
+		return status
+	}
+	granted, err := e.queryNames(e.db, `SELECT DISTINCT rp.permission FROM (
+		SELECT role_name FROM user_roles WHERE user_name = ? UNION ALL `+groupRolesQuery+`) b
+		JOIN role_ancestors ra ON ra.role_name = b.role_name
+		JOIN role_permissions rp ON rp.role_name = ra.ancestor_name`, name, name)
+	if err != nil {
+		return mdl.Internal
+	}
+	for _, g := range granted {
+		if (mdl.Permission{Name: g}).Allows(p) {
+			return mdl.TokenPermissionOK
+		}
+	}
+	return mdl.TokenPermissionNotFound
+}
+
+func (e *sqlEngine) TokenUser(t string) (mdl.User, mdl.StatusCode) {
+	name, status := e.getTokenUser(e.db, t)
+	if status != mdl.OK {
+		return mdl.User{}, status
+	}
+	return mdl.User{Name: name}, mdl.OK
+}
+
+func (e *sqlEngine) AllRoles(t string) ([]mdl.Role, mdl.StatusCode) {
+	name, status := e.getTokenUser(e.db, t)
+	if status != mdl.OK {
+		return nil, status
+	}
+	return e.effectiveRoles(name)
+}
+
+func (e *sqlEngine) DirectRoles(t string) ([]mdl.Role, mdl.StatusCode) {
+	name, status := e.getTokenUser(e.db, t)
+	if status != mdl.OK {
+		return nil, status
+	}
+	return e.directRoles(name)
+}
+
+func (e *sqlEngine) Shutdown() {
+	close(e.exitChan)
+}
+
+//
+// lower level funcs
+//
+
+// querier is either *sql.DB or *sql.Tx.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (e *sqlEngine) deleteExpiredTokens() {
+	t := time.NewTicker(e.tokenExpirationCheckPeriod)
+	for {
+		select {
+		case <-t.C:
+			e.deleteExpiredTokensNow()
+		case <-e.exitChan:
+			t.Stop()
+			return
+		}
+	}
+}
+
+func (e *sqlEngine) deleteExpiredTokensNow() {
+	e.exec(`DELETE FROM tokens WHERE expired_at_in_usec < ?`, e.nowInUsec())
+}
+
+func (e *sqlEngine) exec(query string, args ...interface{}) (sql.Result, error) {
+	return e.db.Exec(e.dialect.rebind(query), args...)
+}
+
+// inTx runs fn in a transaction, which is committed only if fn returns a
+// succeeded status.
+func (e *sqlEngine) inTx(fn func(tx *sql.Tx) mdl.StatusCode) mdl.StatusCode {
+	tx, err := e.db.Begin()
+	if err != nil {
+		return mdl.Internal
+	}
+	status := fn(tx)
+	if !status.Succeeded() {
+		tx.Rollback()
+		return status
+	}
+	if err := tx.Commit(); err != nil {
+		return mdl.Internal
+	}
+	return status
+}
+
+func (e *sqlEngine) getPassword(q querier, name string) (string, mdl.StatusCode) {
+	var pwd string
+	err := q.QueryRow(e.dialect.rebind(`SELECT pwd_encrypted FROM users WHERE name = ?`), name).Scan(&pwd)
+	if err == sql.ErrNoRows {
+		return "", mdl.UserNotFound
+	} else if err != nil {
+		return "", mdl.Internal
+	}
+	return pwd, mdl.OK
+}
+
+// checkUserPassword verifies the password of u out of any transaction, as
+// hashing is slow, and returns the verified password hash.
+func (e *sqlEngine) checkUserPassword(u mdl.User) (string, mdl.StatusCode) {
+	hasher, dummyHash := e.passwordHasher()
+	stored, status := e.getPassword(e.db, u.Name)
+	if status == mdl.UserNotFound {
+		hasher.Verify(u.Password, dummyHash)
+	}
+	if status != mdl.OK {
+		return "", status
+	}
+	matched, err := hasher.Verify(u.Password, stored)
+	if err != nil {
+		return "", mdl.Internal
+	}
+	if !matched {
+		return "", mdl.UserPasswordNotMatch
+	}
+	return stored, mdl.OK
+}
+
+// checkPasswordReused verifies password against the last passwords of the
+// user name up to passwordHistory out of any transaction, and returns its
+// current password hash.
+func (e *sqlEngine) checkPasswordReused(name, password string) (string, mdl.StatusCode) {
+	stored, status := e.getPassword(e.db, name)
+	if status != mdl.OK || e.passwordHistory == 0 {
+		return stored, status
+	}
+	history, err := e.queryNames(e.db, `SELECT pwd_encrypted FROM password_history WHERE user_name = ?
+		ORDER BY position DESC LIMIT ?`, name, e.passwordHistory-1)
+	if err != nil {
+		return "", mdl.Internal
+	}
+	hasher, _ := e.passwordHasher()
+	for _, h := range append([]string{stored}, history...) {
+		matched, err := hasher.Verify(password, h)
+		if err != nil {
+			return "", mdl.Internal
+		}
+		if matched {
+			return "", mdl.PasswordReused
+		}
+	}
+	return stored, mdl.OK
+}
+
+// checkPasswordUnchanged makes sure the user verified by checkUserPassword
+// is still there with the same password.
+func (e *sqlEngine) checkPasswordUnchanged(q querier, name, stored string) mdl.StatusCode {
+	cur, status := e.getPassword(q, name)
+	if status != mdl.OK {
+		return status
+	}
+	if cur != stored {
+		return mdl.UserPasswordNotMatch
+	}
+	return mdl.OK
+}
+
+// deleteUser deletes the user named name with its tokens, roles and
+// password history.
+func (e *sqlEngine) deleteUser(tx *sql.Tx, name string) mdl.StatusCode {
+	if _, err := tx.Exec(e.dialect.rebind(`UPDATE tokens SET invalid = 1 WHERE user_name = ?`), name); err != nil {
+		return mdl.Internal
+	}
+	for _, q := range []string{
+		`DELETE FROM user_roles WHERE user_name = ?`,
+		`DELETE FROM scoped_user_roles WHERE user_name = ?`,
+		`DELETE FROM group_members WHERE user_name = ?`,
+		`DELETE FROM password_history WHERE user_name = ?`,
+	} {
+		if _, err := tx.Exec(e.dialect.rebind(q), name); err != nil {
+			return mdl.Internal
+		}
+	}
+	if _, err := tx.Exec(e.dialect.rebind(`DELETE FROM users WHERE name = ?`), name); err != nil {
+		return mdl.Internal
+	}
+	return mdl.UserDeleted
+}
+
+// deleteRole deletes the role named name with its bindings, parents,
+// permissions and grants to groups.
+func (e *sqlEngine) deleteRole(tx *sql.Tx, name string) mdl.StatusCode {
+	res, err := tx.Exec(e.dialect.rebind(`DELETE FROM roles WHERE name = ?`), name)
+	if err != nil {
+		return mdl.Internal
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return mdl.Internal
+	} else if n == 0 {
+		return mdl.RoleNotFound
+	}
+	for _, q := range []string{
+		`DELETE FROM user_roles WHERE role_name = ?`,
+		`DELETE FROM scoped_user_roles WHERE role_name = ?`,
+		`DELETE FROM role_permissions WHERE role_name = ?`,
+		`DELETE FROM group_roles WHERE role_name = ?`,
+	} {
+		if _, err := tx.Exec(e.dialect.rebind(q), name); err != nil {
+			return mdl.Internal
+		}
+	}
+	// Descendants no longer inherit from the role
+	descendants, err := e.queryNames(tx, `SELECT role_name FROM role_ancestors WHERE ancestor_name = ? AND role_name <> ?`, name, name)
+	if err != nil {
+		return mdl.Internal
+	}
+	for _, q := range []string{
+		`DELETE FROM role_parents WHERE role_name = ? OR parent_name = ?`,
+		`DELETE FROM role_ancestors WHERE role_name = ? OR ancestor_name = ?`,
+	} {
+		if _, err := tx.Exec(e.dialect.rebind(q), name, name); err != nil {
+			return mdl.Internal
+		}
+	}
+	if err := e.refreshAncestors(tx, descendants); err != nil {
+		return mdl.Internal
+	}
+	return mdl.RoleDeleted
+}
+
+func (e *sqlEngine) tenantExists(q querier, t mdl.Tenant) (bool, error) {
+	var n int
+	err := q.QueryRow(e.dialect.rebind(`SELECT COUNT(*) FROM tenants WHERE name = ?`), t.Name).Scan(&n)
+	return n > 0, err
+}
+
+// checkTenant checks the tenant of the qualified name exists.
+func (e *sqlEngine) checkTenant(q querier, name string) mdl.StatusCode {
+	t := mdl.TenantOf(name)
+	if t.IsDefault() {
+		return mdl.OK
+	}
+	if exists, err := e.tenantExists(q, t); err != nil {
+		return mdl.Internal
+	} else if !exists {
+		return mdl.TenantNotFound
+	}
+	return mdl.OK
+}
+
+func (e *sqlEngine) roleExists(q querier, name string) (bool, error) {
+	var n int
+	err := q.QueryRow(e.dialect.rebind(`SELECT COUNT(*) FROM roles WHERE name = ?`), name).Scan(&n)
+	return n > 0, err
+}
+
+// setPassword replaces the password hash of the user, keeping the previous
+// one in its history, and revokes all of its sessions.
+func (e *sqlEngine) setPassword(tx *sql.Tx, name, pwd string, temporary bool) error {
+	if err := e.pushHistory(tx, name); err != nil {
+		return err
+	}
+	mustChange := 0
+	if temporary {
+		mustChange = 1
+	}
+	if _, err := tx.Exec(e.dialect.rebind(`UPDATE users SET pwd_encrypted = ?, must_change_password = ? WHERE name = ?`), pwd, mustChange, name); err != nil {
+		return err
+	}
+	_, err := tx.Exec(e.dialect.rebind(`UPDATE tokens SET invalid = 1 WHERE user_name = ?`), name)
+	return err
+}
+
+// pushHistory appends the current password hash of the user to its
+// history, and deletes the hashes beyond the latest passwordHistory-1.
+func (e *sqlEngine) pushHistory(tx *sql.Tx, name string) error {
+	if e.passwordHistory <= 1 {
+		_, err := tx.Exec(e.dialect.rebind(`DELETE FROM password_history WHERE user_name = ?`), name)
+		return err
+	}
+	var last int
+	if err := tx.QueryRow(e.dialect.rebind(`SELECT COALESCE(MAX(position), 0) FROM password_history WHERE user_name = ?`),
+		name).Scan(&last); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(e.dialect.rebind(`INSERT INTO password_history (user_name, position, pwd_encrypted)
+		SELECT name, ?, pwd_encrypted FROM users WHERE name = ?`), last+1, name); err != nil {
+		return err
+	}
+	_, err := tx.Exec(e.dialect.rebind(`DELETE FROM password_history WHERE user_name = ? AND position <= ?`),
+		name, last+1-(e.passwordHistory-1))
+	return err
+}
+
+// queryPage returns the page p of the names of query, whose %s is replaced
+// by the conditions on column selecting the page, after args.
+func (e *sqlEngine) queryPage(query, column string, p mdl.Page, args ...interface{}) ([]string, string, error) {
+	cond := `SUBSTR(` + column + `, 1, ?) = ? AND ` + column + ` > ?`
+	if mdl.TenantOf(p.Prefix).IsDefault() {
+		cond += ` AND ` + column + ` NOT LIKE '%` + mdl.TenantSep + `%'`
+	}
+	args = append(args, utf8.RuneCountInString(p.Prefix), p.Prefix, p.Cursor, p.Size()+1)
+	names, err := e.queryNames(e.db, strings.Replace(query, "%s", cond, 1)+` LIMIT ?`, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	names, next := p.Cut(names)
+	return names, next, nil
+}
+
+func userNames(names []string) []mdl.User {
+	res := make([]mdl.User, 0, len(names))
+	for _, n := range names {
+		res = append(res, mdl.User{Name: n})
+	}
+	return res
+}
+
+// userHasRole reports whether role is bound to user on res itself.
+func (e *sqlEngine) userHasRole(q querier, user, role string, res mdl.Resource) (bool, error) {
+	var n int
+	var err error
+	if res.IsGlobal() {
+		err = q.QueryRow(e.dialect.rebind(`SELECT COUNT(*) FROM user_roles WHERE user_name = ? AND role_name = ?`), user, role).Scan(&n)
+	} else {
+		err = q.QueryRow(e.dialect.rebind(`SELECT COUNT(*) FROM scoped_user_roles WHERE user_name = ? AND resource = ? AND role_name = ?`),
+			user, res.Path, role).Scan(&n)
+	}
+	return n > 0, err
+}
+
+// evictSessions revokes the oldest sessions of the user to make room for a
+// new one under maxSessions.
+func (e *sqlEngine) evictSessions(tx *sql.Tx, name string, nowInUsec int64) mdl.StatusCode {
+	if e.maxSessions == 0 {
+		return mdl.OK
+	}
+	rows, err := tx.Query(e.dialect.rebind(`SELECT session_id FROM tokens
+		WHERE user_name = ? AND invalid = 0 AND expired_at_in_usec >= ?
+		ORDER BY created_at_in_usec, session_id`), name, nowInUsec)
+	if err != nil {
+		return mdl.Internal
+	}
+	var active []string
+	for rows.Next() {
+		var sid string
+		if err := rows.Scan(&sid); err != nil {
+			rows.Close()
+			return mdl.Internal
+		}
+		active = append(active, sid)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return mdl.Internal
+	}
+	if len(active) < e.maxSessions {
+		return mdl.OK
+	}
+	for _, sid := range active[:len(active)-e.maxSessions+1] {
+		if _, err := tx.Exec(e.dialect.rebind(`UPDATE tokens SET invalid = 1 WHERE user_name = ? AND session_id = ?`), name, sid); err != nil {
+			return mdl.Internal
+		}
+	}
+	return mdl.OK
+}
+
+// getTokenUser returns the user name of a valid token.
+func (e *sqlEngine) getTokenUser(q querier, t string) (string, mdl.StatusCode) {
+	var name string
+	var expiredAt int64
+	var invalid int
+	err := q.QueryRow(e.dialect.rebind(`SELECT user_name, expired_at_in_usec, invalid FROM tokens WHERE token_hash = ?`),
+		hashToken(t)).Scan(&name, &expiredAt, &invalid)
+	if err == sql.ErrNoRows {
+		return "", mdl.TokenNotFound
+	} else if err != nil {
+		return "", mdl.Internal
+	}
+	if expiredAt < e.nowInUsec() {
+		return "", mdl.TokenExpired
+	}
+	if invalid != 0 {
+		return "", mdl.TokenIsInvalid
+	}
+	return name, mdl.OK
+}
+
+func hashToken(t string) string {
+	sum := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(sum[:])
+}
+
+func (e *sqlEngine) nowInUsec() int64 {
+	return e.clock.Now().UnixNano() / 1000
+}
+
+func generateSessionID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
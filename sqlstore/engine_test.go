@@ -0,0 +1,119 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mdl "hsbc-hw/model"
+	"hsbc-hw/model/enginetest"
+
+	"github.com/stretchr/testify/assert"
+	_ "modernc.org/sqlite"
+)
+
+var (
+	u1 = mdl.User{Name: "u1", Password: "xxxx"}
+	r1 = mdl.Role{Name: "r1"}
+)
+
+func statusCodeEqual(t *testing.T, expected, actual mdl.StatusCode) {
+	assert.Equal(t, expected, actual)
+	assert.Equal(t, expected.String(), actual.String())
+}
+
+func openDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	assert.Nil(t, err)
+	// SQLite serializes writers anyway
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newEngineForTesting(t *testing.T) *sqlEngine {
+	e, err := NewSQLEngine(openDB(t), SQLite,
+		mdl.WithPasswordHasher(mdl.NewPBKDF2Hasher(10)),
+		mdl.WithClock(mdl.NewFakeClock(time.Unix(1600000000, 0))))
+	assert.Nil(t, err)
+	t.Cleanup(e.Shutdown)
+	return e.(*sqlEngine)
+}
+
+func TestConformance(t *testing.T) {
+	enginetest.Run(t, func(t *testing.T, c enginetest.Config) mdl.AuthenticateAuthorizationEngine {
+		e, err := NewSQLEngine(openDB(t), SQLite,
+			mdl.WithTokenTTL(c.TokenTTL),
+			mdl.WithPasswordHasher(c.Hasher),
+			mdl.WithClock(c.Clock),
+			mdl.WithMaxSessions(c.MaxSessions),
+			mdl.WithPasswordHistory(c.PasswordHistory))
+		assert.Nil(t, err)
+		return e
+	})
+}
+
+func TestTokenHashed(t *testing.T) {
+	e := newEngineForTesting(t)
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	token, code := e.Authenticate(u1, mdl.SessionInfo{})
+	statusCodeEqual(t, mdl.TokenCreated, code)
+
+	// Only the hash of the token is stored
+	var n int
+	assert.Nil(t, e.db.QueryRow(`SELECT COUNT(*) FROM tokens WHERE token_hash = ?`, token.ID).Scan(&n))
+	assert.Equal(t, 0, n)
+	assert.Nil(t, e.db.QueryRow(`SELECT COUNT(*) FROM tokens WHERE token_hash = ?`, hashToken(token.ID)).Scan(&n))
+	assert.Equal(t, 1, n)
+}
+
+func TestRehashOnLogin(t *testing.T) {
+	e := newEngineForTesting(t)
+	stored := func() string {
+		pwd, _ := e.getPassword(e.db, u1.Name)
+		return pwd
+	}
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	assert.Contains(t, stored(), "$pbkdf2-sha256$i=10$")
+	e.SetPasswordHasher(mdl.NewBcryptHasher(4))
+	_, code := e.Authenticate(u1, mdl.SessionInfo{})
+	statusCodeEqual(t, mdl.TokenCreated, code)
+	assert.Contains(t, stored(), "$2a$04$")
+	_, code = e.Authenticate(u1, mdl.SessionInfo{})
+	statusCodeEqual(t, mdl.TokenCreated, code)
+}
+
+func TestTokenExpired(t *testing.T) {
+	e := newEngineForTesting(t)
+	clock := e.clock.(*mdl.FakeClock)
+	e.SetTokenTTL(time.Minute)
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	token, code := e.Authenticate(u1, mdl.SessionInfo{})
+	statusCodeEqual(t, mdl.TokenCreated, code)
+	clock.Advance(time.Minute + time.Microsecond)
+	statusCodeEqual(t, mdl.TokenExpired, e.Invalidate(token.ID))
+	e.deleteExpiredTokensNow()
+	statusCodeEqual(t, mdl.TokenNotFound, e.Invalidate(token.ID))
+}
+
+// TestSettingsWhileServing changes the settings while authenticating, which
+// is checked by go test -race.
+func TestSettingsWhileServing(t *testing.T) {
+	e := newEngineForTesting(t)
+	statusCodeEqual(t, mdl.UserCreated, e.CreateUser(u1))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			e.SetTokenTTL(time.Duration(i+1) * time.Minute)
+			e.SetPasswordHasher(mdl.NewPBKDF2Hasher(10 + i))
+			e.SetTokenGenerator(mdl.DefaultTokenGenerator())
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		_, code := e.Authenticate(u1, mdl.SessionInfo{})
+		statusCodeEqual(t, mdl.TokenCreated, code)
+	}
+	<-done
+}
@@ -0,0 +1,282 @@
+package sqlstore
+
+import (
+	"database/sql"
+
+	mdl "hsbc-hw/model"
+)
+
+// This file implements groups. group_members keeps the users in each group,
+// group_parents the groups each group is nested in and group_ancestors
+// their closure, which is recomputed for the groups affected by each write
+// like role_ancestors. Roles in group_roles are granted globally to the
+// members of the group and of the groups nested in it.
+
+// groupRolesQuery selects the roles granted to the groups of a user, for
+// UNION with the roles bound to the user.
+const groupRolesQuery = `SELECT gr.role_name FROM group_members gm
+	JOIN group_ancestors ga ON ga.group_name = gm.group_name
+	JOIN group_roles gr ON gr.group_name = ga.ancestor_name
+	WHERE gm.user_name = ?`
+
+func (e *sqlEngine) CreateGroup(g mdl.Group) mdl.StatusCode {
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if exists, err := e.groupExists(tx, g.Name); err != nil {
+			return mdl.Internal
+		} else if exists {
+			return mdl.GroupAlreadyExisting
+		}
+		if status := e.checkTenant(tx, g.Name); status != mdl.OK {
+			return status
+		}
+		if _, err := tx.Exec(e.dialect.rebind(`INSERT INTO user_groups (name) VALUES (?)`), g.Name); err != nil {
+			return mdl.Internal
+		}
+		if err := e.refreshGroupAncestors(tx, []string{g.Name}); err != nil {
+			return mdl.Internal
+		}
+		return mdl.GroupCreated
+	})
+}
+
+func (e *sqlEngine) DeleteGroup(g mdl.Group) mdl.StatusCode {
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		return e.deleteGroup(tx, g.Name)
+	})
+}
+
+func (e *sqlEngine) AddGroupMember(g mdl.Group, u mdl.User) mdl.StatusCode {
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if _, status := e.getPassword(tx, u.Name); status != mdl.OK {
+			return status
+		}
+		if exists, err := e.groupExists(tx, g.Name); err != nil {
+			return mdl.Internal
+		} else if !exists {
+			return mdl.GroupNotFound
+		}
+		var n int
+		if err := tx.QueryRow(e.dialect.rebind(`SELECT COUNT(*) FROM group_members WHERE group_name = ? AND user_name = ?`),
+			g.Name, u.Name).Scan(&n); err != nil {
+			return mdl.Internal
+		} else if n > 0 {
+			return mdl.GroupMemberAlreadyExisting
+		}
+		if _, err := tx.Exec(e.dialect.rebind(`INSERT INTO group_members (group_name, user_name) VALUES (?, ?)`),
+			g.Name, u.Name); err != nil {
+			return mdl.Internal
+		}
+		return mdl.GroupMemberAdded
+	})
+}
+
+func (e *sqlEngine) RemoveGroupMember(g mdl.Group, u mdl.User) mdl.StatusCode {
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if _, status := e.getPassword(tx, u.Name); status != mdl.OK {
+			return status
+		}
+		if exists, err := e.groupExists(tx, g.Name); err != nil {
+			return mdl.Internal
+		} else if !exists {
+			return mdl.GroupNotFound
+		}
+		res, err := tx.Exec(e.dialect.rebind(`DELETE FROM group_members WHERE group_name = ? AND user_name = ?`), g.Name, u.Name)
+		if err != nil {
+			return mdl.Internal
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return mdl.Internal
+		} else if n == 0 {
+			return mdl.GroupMemberNotFound
+		}
+		return mdl.GroupMemberRemoved
+	})
+}
+
+// AddGroupParent nests g in parent.
+func (e *sqlEngine) AddGroupParent(g, parent mdl.Group) mdl.StatusCode {
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if status := e.groupsExist(tx, []string{g.Name, parent.Name}); status != mdl.OK {
+			return status
+		}
+		var n int
+		if err := tx.QueryRow(e.dialect.rebind(`SELECT COUNT(*) FROM group_parents WHERE group_name = ? AND parent_name = ?`),
+			g.Name, parent.Name).Scan(&n); err != nil {
+			return mdl.Internal
+		} else if n > 0 {
+			return mdl.GroupParentAlreadyExisting
+		}
+		// The parent must not be the group or nested in it
+		if ok, err := e.nestedIn(tx, parent.Name, g.Name); err != nil {
+			return mdl.Internal
+		} else if ok {
+			return mdl.GroupCycle
+		}
+		if _, err := tx.Exec(e.dialect.rebind(`INSERT INTO group_parents (group_name, parent_name) VALUES (?, ?)`),
+			g.Name, parent.Name); err != nil {
+			return mdl.Internal
+		}
+		if err := e.refreshGroupAncestorsOf(tx, g.Name); err != nil {
+			return mdl.Internal
+		}
+		return mdl.GroupParentAdded
+	})
+}
+
+func (e *sqlEngine) RemoveGroupParent(g, parent mdl.Group) mdl.StatusCode {
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if status := e.groupsExist(tx, []string{g.Name, parent.Name}); status != mdl.OK {
+			return status
+		}
+		res, err := tx.Exec(e.dialect.rebind(`DELETE FROM group_parents WHERE group_name = ? AND parent_name = ?`),
+			g.Name, parent.Name)
+		if err != nil {
+			return mdl.Internal
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return mdl.Internal
+		} else if n == 0 {
+			return mdl.GroupParentNotFound
+		}
+		if err := e.refreshGroupAncestorsOf(tx, g.Name); err != nil {
+			return mdl.Internal
+		}
+		return mdl.GroupParentRemoved
+	})
+}
+
+func (e *sqlEngine) AddGroupRole(g mdl.Group, r mdl.Role) mdl.StatusCode {
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if exists, err := e.groupExists(tx, g.Name); err != nil {
+			return mdl.Internal
+		} else if !exists {
+			return mdl.GroupNotFound
+		}
+		if exists, err := e.roleExists(tx, r.Name); err != nil {
+			return mdl.Internal
+		} else if !exists {
+			return mdl.RoleNotFound
+		}
+		var n int
+		if err := tx.QueryRow(e.dialect.rebind(`SELECT COUNT(*) FROM group_roles WHERE group_name = ? AND role_name = ?`),
+			g.Name, r.Name).Scan(&n); err != nil {
+			return mdl.Internal
+		} else if n > 0 {
+			return mdl.GroupRoleAlreadyExisting
+		}
+		if _, err := tx.Exec(e.dialect.rebind(`INSERT INTO group_roles (group_name, role_name) VALUES (?, ?)`),
+			g.Name, r.Name); err != nil {
+			return mdl.Internal
+		}
+		return mdl.GroupRoleAdded
+	})
+}
+
+func (e *sqlEngine) RemoveGroupRole(g mdl.Group, r mdl.Role) mdl.StatusCode {
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if exists, err := e.groupExists(tx, g.Name); err != nil {
+			return mdl.Internal
+		} else if !exists {
+			return mdl.GroupNotFound
+		}
+		if exists, err := e.roleExists(tx, r.Name); err != nil {
+			return mdl.Internal
+		} else if !exists {
+			return mdl.RoleNotFound
+		}
+		res, err := tx.Exec(e.dialect.rebind(`DELETE FROM group_roles WHERE group_name = ? AND role_name = ?`), g.Name, r.Name)
+		if err != nil {
+			return mdl.Internal
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return mdl.Internal
+		} else if n == 0 {
+			return mdl.GroupRoleNotFound
+		}
+		return mdl.GroupRoleRemoved
+	})
+}
+
+// deleteGroup deletes the group named name with its members, nesting and
+// roles.
+func (e *sqlEngine) deleteGroup(tx *sql.Tx, name string) mdl.StatusCode {
+	res, err := tx.Exec(e.dialect.rebind(`DELETE FROM user_groups WHERE name = ?`), name)
+	if err != nil {
+		return mdl.Internal
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return mdl.Internal
+	} else if n == 0 {
+		return mdl.GroupNotFound
+	}
+	for _, q := range []string{
+		`DELETE FROM group_members WHERE group_name = ?`,
+		`DELETE FROM group_roles WHERE group_name = ?`,
+	} {
+		if _, err := tx.Exec(e.dialect.rebind(q), name); err != nil {
+			return mdl.Internal
+		}
+	}
+	// Groups nested in it are no longer nested in its parents
+	descendants, err := e.queryNames(tx, `SELECT group_name FROM group_ancestors WHERE ancestor_name = ? AND group_name <> ?`, name, name)
+	if err != nil {
+		return mdl.Internal
+	}
+	for _, q := range []string{
+		`DELETE FROM group_parents WHERE group_name = ? OR parent_name = ?`,
+		`DELETE FROM group_ancestors WHERE group_name = ? OR ancestor_name = ?`,
+	} {
+		if _, err := tx.Exec(e.dialect.rebind(q), name, name); err != nil {
+			return mdl.Internal
+		}
+	}
+	if err := e.refreshGroupAncestors(tx, descendants); err != nil {
+		return mdl.Internal
+	}
+	return mdl.GroupDeleted
+}
+
+func (e *sqlEngine) groupExists(q querier, name string) (bool, error) {
+	var n int
+	err := q.QueryRow(e.dialect.rebind(`SELECT COUNT(*) FROM user_groups WHERE name = ?`), name).Scan(&n)
+	return n > 0, err
+}
+
+// groupsExist returns GroupNotFound unless all names are groups.
+func (e *sqlEngine) groupsExist(q querier, names []string) mdl.StatusCode {
+	for _, name := range names {
+		if exists, err := e.groupExists(q, name); err != nil {
+			return mdl.Internal
+		} else if !exists {
+			return mdl.GroupNotFound
+		}
+	}
+	return mdl.OK
+}
+
+// nestedIn reports whether group is or is nested in ancestor.
+func (e *sqlEngine) nestedIn(q querier, group, ancestor string) (bool, error) {
+	var n int
+	err := q.QueryRow(e.dialect.rebind(`SELECT COUNT(*) FROM group_ancestors WHERE group_name = ? AND ancestor_name = ?`),
+		group, ancestor).Scan(&n)
+	return n > 0, err
+}
+
+// refreshGroupAncestorsOf recomputes the closures of group and the groups
+// nested in it.
+func (e *sqlEngine) refreshGroupAncestorsOf(tx *sql.Tx, group string) error {
+	affected, err := e.queryNames(tx, `SELECT group_name FROM group_ancestors WHERE ancestor_name = ?`, group)
+	if err != nil {
+		return err
+	}
+	affected = append(affected, group)
+	return e.refreshGroupAncestors(tx, affected)
+}
+
+// refreshGroupAncestors recomputes the closures of groups from
+// group_parents.
+func (e *sqlEngine) refreshGroupAncestors(tx *sql.Tx, groups []string) error {
+	return e.refreshClosures(tx, `SELECT group_name, parent_name FROM group_parents`,
+		`DELETE FROM group_ancestors WHERE group_name = ?`,
+		`INSERT INTO group_ancestors (group_name, ancestor_name) VALUES (?, ?)`, groups)
+}
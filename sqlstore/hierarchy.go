@@ -0,0 +1,211 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"sort"
+
+	mdl "hsbc-hw/model"
+)
+
+// This file implements role hierarchy. role_parents keeps the parents
+// declared by each role, and role_ancestors their closure, which is
+// recomputed for the roles affected by each write so that checks are a
+// single join.
+
+func (e *sqlEngine) AddRoleParent(r, parent mdl.Role) mdl.StatusCode {
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if status := e.rolesExist(tx, []string{r.Name, parent.Name}); status != mdl.OK {
+			return status
+		}
+		var n int
+		if err := tx.QueryRow(e.dialect.rebind(`SELECT COUNT(*) FROM role_parents WHERE role_name = ? AND parent_name = ?`),
+			r.Name, parent.Name).Scan(&n); err != nil {
+			return mdl.Internal
+		} else if n > 0 {
+			return mdl.RoleParentAlreadyExisting
+		}
+		// The parent must not be the role or one of its descendants
+		if ok, err := e.inherits(tx, parent.Name, r.Name); err != nil {
+			return mdl.Internal
+		} else if ok {
+			return mdl.RoleCycle
+		}
+		if _, err := tx.Exec(e.dialect.rebind(`INSERT INTO role_parents (role_name, parent_name) VALUES (?, ?)`),
+			r.Name, parent.Name); err != nil {
+			return mdl.Internal
+		}
+		if err := e.refreshAncestorsOf(tx, r.Name); err != nil {
+			return mdl.Internal
+		}
+		return mdl.RoleParentAdded
+	})
+}
+
+func (e *sqlEngine) RemoveRoleParent(r, parent mdl.Role) mdl.StatusCode {
+	return e.inTx(func(tx *sql.Tx) mdl.StatusCode {
+		if status := e.rolesExist(tx, []string{r.Name, parent.Name}); status != mdl.OK {
+			return status
+		}
+		res, err := tx.Exec(e.dialect.rebind(`DELETE FROM role_parents WHERE role_name = ? AND parent_name = ?`),
+			r.Name, parent.Name)
+		if err != nil {
+			return mdl.Internal
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return mdl.Internal
+		} else if n == 0 {
+			return mdl.RoleParentNotFound
+		}
+		if err := e.refreshAncestorsOf(tx, r.Name); err != nil {
+			return mdl.Internal
+		}
+		return mdl.RoleParentRemoved
+	})
+}
+
+// rolesExist returns RoleNotFound unless all names are roles.
+func (e *sqlEngine) rolesExist(q querier, names []string) mdl.StatusCode {
+	for _, name := range names {
+		if exists, err := e.roleExists(q, name); err != nil {
+			return mdl.Internal
+		} else if !exists {
+			return mdl.RoleNotFound
+		}
+	}
+	return mdl.OK
+}
+
+// inherits reports whether role is or descends from ancestor.
+func (e *sqlEngine) inherits(q querier, role, ancestor string) (bool, error) {
+	var n int
+	err := q.QueryRow(e.dialect.rebind(`SELECT COUNT(*) FROM role_ancestors WHERE role_name = ? AND ancestor_name = ?`),
+		role, ancestor).Scan(&n)
+	return n > 0, err
+}
+
+// refreshAncestorsOf recomputes the closures of role and its descendants.
+func (e *sqlEngine) refreshAncestorsOf(tx *sql.Tx, role string) error {
+	affected, err := e.queryNames(tx, `SELECT role_name FROM role_ancestors WHERE ancestor_name = ?`, role)
+	if err != nil {
+		return err
+	}
+	// A new role has no closure yet
+	affected = append(affected, role)
+	return e.refreshAncestors(tx, affected)
+}
+
+// refreshAncestors recomputes the closures of roles from role_parents.
+func (e *sqlEngine) refreshAncestors(tx *sql.Tx, roles []string) error {
+	return e.refreshClosures(tx, `SELECT role_name, parent_name FROM role_parents`,
+		`DELETE FROM role_ancestors WHERE role_name = ?`,
+		`INSERT INTO role_ancestors (role_name, ancestor_name) VALUES (?, ?)`, roles)
+}
+
+// refreshClosures recomputes the closures of names from the (name, parent)
+// pairs of parentsQuery, by deleting the closure of each name with
+// deleteQuery and inserting the (name, ancestor) pairs with insertQuery.
+func (e *sqlEngine) refreshClosures(tx *sql.Tx, parentsQuery, deleteQuery, insertQuery string, names []string) error {
+	rows, err := tx.Query(parentsQuery)
+	if err != nil {
+		return err
+	}
+	parents := make(map[string][]string)
+	for rows.Next() {
+		var r, p string
+		if err := rows.Scan(&r, &p); err != nil {
+			rows.Close()
+			return err
+		}
+		parents[r] = append(parents[r], p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	done := make(map[string]struct{}, len(names))
+	for _, r := range names {
+		if _, ok := done[r]; ok {
+			continue
+		}
+		done[r] = struct{}{}
+		closure := map[string]struct{}{r: {}}
+		stack := []string{r}
+		for len(stack) > 0 {
+			v := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, p := range parents[v] {
+				if _, ok := closure[p]; !ok {
+					closure[p] = struct{}{}
+					stack = append(stack, p)
+				}
+			}
+		}
+		if _, err := tx.Exec(e.dialect.rebind(deleteQuery), r); err != nil {
+			return err
+		}
+		for a := range closure {
+			if _, err := tx.Exec(e.dialect.rebind(insertQuery), r, a); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// effectiveRoles returns the direct roles of the user followed by the
+// inherited ones by name, including the ones granted by groups.
+func (e *sqlEngine) effectiveRoles(name string) ([]mdl.Role, mdl.StatusCode) {
+	res, status := e.directRoles(name)
+	if status != mdl.OK {
+		return nil, status
+	}
+	ancestors, err := e.queryNames(e.db, `SELECT DISTINCT ra.ancestor_name FROM (
+		SELECT role_name FROM user_roles WHERE user_name = ? UNION ALL `+groupRolesQuery+`) b
+		JOIN role_ancestors ra ON ra.role_name = b.role_name`, name, name)
+	if err != nil {
+		return nil, mdl.Internal
+	}
+	seen := make(map[string]struct{}, len(res))
+	for _, r := range res {
+		seen[r.Name] = struct{}{}
+	}
+	sort.Strings(ancestors)
+	for _, a := range ancestors {
+		if _, ok := seen[a]; !ok {
+			res = append(res, mdl.Role{Name: a})
+		}
+	}
+	return res, mdl.OK
+}
+
+func (e *sqlEngine) directRoles(name string) ([]mdl.Role, mdl.StatusCode) {
+	names, err := e.queryNames(e.db, `SELECT role_name FROM user_roles WHERE user_name = ? ORDER BY position`, name)
+	if err != nil {
+		return nil, mdl.Internal
+	}
+	res := make([]mdl.Role, 0, len(names))
+	for _, n := range names {
+		res = append(res, mdl.Role{Name: n})
+	}
+	return res, mdl.OK
+}
+
+// queryNames returns the single string column of query.
+func (e *sqlEngine) queryNames(q querier, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(e.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
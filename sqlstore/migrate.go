@@ -0,0 +1,201 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file lists the schema migrations. Each migration is a list of
+// statements, which are applied in a transaction and recorded by their
+// 1-based index in the schema_migrations table. Only append to migrations,
+// never edit an applied one.
+
+// Dialect is the flavor of SQL spoken by the database.
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	MySQL
+	Postgres
+)
+
+var migrations = [][]string{
+	// 1: users, roles and tokens
+	{
+		`CREATE TABLE users (
+			name          VARCHAR(255) NOT NULL PRIMARY KEY,
+			pwd_encrypted VARCHAR(255) NOT NULL
+		)`,
+		`CREATE TABLE roles (
+			name VARCHAR(255) NOT NULL PRIMARY KEY
+		)`,
+		`CREATE TABLE user_roles (
+			user_name VARCHAR(255) NOT NULL,
+			role_name VARCHAR(255) NOT NULL,
+			position  BIGINT       NOT NULL,
+			PRIMARY KEY (user_name, role_name)
+		)`,
+		`CREATE INDEX user_roles_role ON user_roles (role_name)`,
+		// Tokens are kept by their SHA-256 only, so that a database dump
+		// doesn't leak usable tokens.
+		`CREATE TABLE tokens (
+			token_hash         VARCHAR(64)   NOT NULL PRIMARY KEY,
+			session_id         VARCHAR(64)   NOT NULL,
+			user_name          VARCHAR(255)  NOT NULL,
+			created_at_in_usec BIGINT        NOT NULL,
+			expired_at_in_usec BIGINT        NOT NULL,
+			invalid            SMALLINT      NOT NULL DEFAULT 0,
+			user_agent         VARCHAR(1024) NOT NULL DEFAULT '',
+			ip                 VARCHAR(64)   NOT NULL DEFAULT '',
+			label              VARCHAR(255)  NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX tokens_user ON tokens (user_name)`,
+		`CREATE INDEX tokens_expiration ON tokens (expired_at_in_usec)`,
+	},
+	// 2: role hierarchy, role_ancestors is the closure of role_parents
+	// including every role itself, kept up to date on writes.
+	{
+		`CREATE TABLE role_parents (
+			role_name   VARCHAR(255) NOT NULL,
+			parent_name VARCHAR(255) NOT NULL,
+			PRIMARY KEY (role_name, parent_name)
+		)`,
+		`CREATE INDEX role_parents_parent ON role_parents (parent_name)`,
+		`CREATE TABLE role_ancestors (
+			role_name     VARCHAR(255) NOT NULL,
+			ancestor_name VARCHAR(255) NOT NULL,
+			PRIMARY KEY (role_name, ancestor_name)
+		)`,
+		`CREATE INDEX role_ancestors_ancestor ON role_ancestors (ancestor_name)`,
+		`INSERT INTO role_ancestors (role_name, ancestor_name) SELECT name, name FROM roles`,
+	},
+	// 3: permissions granted to roles
+	{
+		`CREATE TABLE role_permissions (
+			role_name  VARCHAR(255) NOT NULL,
+			permission VARCHAR(255) NOT NULL,
+			PRIMARY KEY (role_name, permission)
+		)`,
+	},
+	// 4: role bindings scoped to resources, the global ones stay in
+	// user_roles
+	{
+		`CREATE TABLE scoped_user_roles (
+			user_name VARCHAR(255) NOT NULL,
+			resource  VARCHAR(255) NOT NULL,
+			role_name VARCHAR(255) NOT NULL,
+			PRIMARY KEY (user_name, resource, role_name)
+		)`,
+		`CREATE INDEX scoped_user_roles_role ON scoped_user_roles (role_name)`,
+	},
+	// 5: tenants other than the default one, their users and roles are
+	// named with their prefix
+	{
+		`CREATE TABLE tenants (
+			name VARCHAR(255) NOT NULL PRIMARY KEY
+		)`,
+	},
+	// 6: groups of users, in user_groups as GROUPS is reserved by MySQL,
+	// nested by group_parents whose closure including every group itself
+	// is group_ancestors, and the roles granted to them
+	{
+		`CREATE TABLE user_groups (
+			name VARCHAR(255) NOT NULL PRIMARY KEY
+		)`,
+		`CREATE TABLE group_members (
+			group_name VARCHAR(255) NOT NULL,
+			user_name  VARCHAR(255) NOT NULL,
+			PRIMARY KEY (group_name, user_name)
+		)`,
+		`CREATE INDEX group_members_user ON group_members (user_name)`,
+		`CREATE TABLE group_parents (
+			group_name  VARCHAR(255) NOT NULL,
+			parent_name VARCHAR(255) NOT NULL,
+			PRIMARY KEY (group_name, parent_name)
+		)`,
+		`CREATE INDEX group_parents_parent ON group_parents (parent_name)`,
+		`CREATE TABLE group_ancestors (
+			group_name    VARCHAR(255) NOT NULL,
+			ancestor_name VARCHAR(255) NOT NULL,
+			PRIMARY KEY (group_name, ancestor_name)
+		)`,
+		`CREATE INDEX group_ancestors_ancestor ON group_ancestors (ancestor_name)`,
+		`CREATE TABLE group_roles (
+			group_name VARCHAR(255) NOT NULL,
+			role_name  VARCHAR(255) NOT NULL,
+			PRIMARY KEY (group_name, role_name)
+		)`,
+		`CREATE INDEX group_roles_role ON group_roles (role_name)`,
+	},
+	// 7: passwords reset by ResetPassword, which must be changed before
+	// authenticating
+	{
+		`ALTER TABLE users ADD COLUMN must_change_password SMALLINT NOT NULL DEFAULT 0`,
+	},
+	// 8: previous password hashes of users, which new passwords must differ
+	// from
+	{
+		`CREATE TABLE password_history (
+			user_name     VARCHAR(255) NOT NULL,
+			position      INTEGER      NOT NULL,
+			pwd_encrypted VARCHAR(255) NOT NULL,
+			PRIMARY KEY (user_name, position)
+		)`,
+	},
+}
+
+// migrate applies the migrations not applied yet, each in a transaction.
+func migrate(db *sql.DB, d Dialect) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER NOT NULL PRIMARY KEY
+	)`); err != nil {
+		return fmt.Errorf("sqlstore: create schema_migrations: %v", err)
+	}
+	var applied int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&applied); err != nil {
+		return fmt.Errorf("sqlstore: read schema version: %v", err)
+	}
+	if applied > len(migrations) {
+		return fmt.Errorf("sqlstore: schema version %d is newer than the supported %d", applied, len(migrations))
+	}
+	for i := applied; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range migrations[i] {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("sqlstore: migration %d: %v", i+1, err)
+			}
+		}
+		if _, err := tx.Exec(d.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), i+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlstore: migration %d: %v", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("sqlstore: migration %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// rebind replaces the ? placeholders of query with the ones of the dialect.
+func (d Dialect) rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
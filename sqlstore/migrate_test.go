@@ -0,0 +1,44 @@
+package sqlstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrate(t *testing.T) {
+	db := openDB(t)
+	assert.Nil(t, migrate(db, SQLite))
+	// Applying again is a no-op
+	assert.Nil(t, migrate(db, SQLite))
+	var version int
+	assert.Nil(t, db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version))
+	assert.Equal(t, len(migrations), version)
+
+	_, err := db.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, len(migrations)+1)
+	assert.Nil(t, err)
+	assert.NotNil(t, migrate(db, SQLite), "newer schema must be refused")
+}
+
+func TestRebind(t *testing.T) {
+	q := `SELECT a FROM t WHERE b = ? AND c = ?`
+	assert.Equal(t, q, SQLite.rebind(q))
+	assert.Equal(t, q, MySQL.rebind(q))
+	assert.Equal(t, `SELECT a FROM t WHERE b = $1 AND c = $2`, Postgres.rebind(q))
+}
+
+func TestMigrateRoleAncestors(t *testing.T) {
+	db := openDB(t)
+	all := migrations
+	migrations = all[:1]
+	assert.Nil(t, migrate(db, SQLite))
+	migrations = all
+	_, err := db.Exec(`INSERT INTO roles (name) VALUES ('r1')`)
+	assert.Nil(t, err)
+
+	// Roles created before the hierarchy are their own ancestors
+	assert.Nil(t, migrate(db, SQLite))
+	var ancestor string
+	assert.Nil(t, db.QueryRow(`SELECT ancestor_name FROM role_ancestors WHERE role_name = 'r1'`).Scan(&ancestor))
+	assert.Equal(t, "r1", ancestor)
+}